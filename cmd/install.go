@@ -26,6 +26,8 @@ import (
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/copyfile"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server/vless"
+	gonanoid "github.com/matoous/go-nanoid"
 	"github.com/spf13/cobra"
 )
 
@@ -51,12 +53,34 @@ func installProtocolOptions() []string {
 	return []string{
 		string(protocol.ProtocolVMessTCP),
 		string(protocol.ProtocolVMessTlsGrpc),
+		string(server.ProtocolVMessWs),
+		string(server.ProtocolVMessTlsWs),
 		string(protocol.ProtocolShadowsocks),
 		string(protocol.ProtocolJuicity),
 		string(server.ProtocolAnyTLS),
+		string(server.ProtocolTrojan),
+		string(server.ProtocolVlessReality),
+		string(server.ProtocolHysteria2),
 	}
 }
 
+// newRealityParams generates the x25519 key pair and a short-id for REALITY.
+func newRealityParams(dest string) (config.Reality, error) {
+	privateKey, _, err := vless.GenerateKeyPair()
+	if err != nil {
+		return config.Reality{}, err
+	}
+	shortId, err := vless.GenerateShortId()
+	if err != nil {
+		return config.Reality{}, err
+	}
+	return config.Reality{
+		Dest:       dest,
+		PrivateKey: privateKey,
+		ShortIds:   shortId,
+	}, nil
+}
+
 func hostsValidator(ans interface{}) error {
 	str := ans.(string)
 	if len(str) == 0 {
@@ -264,13 +288,21 @@ func getParams(targetConfigPath string) (*config.Params, bool, error) {
 		return nil, false, err
 	}
 	randPort := strconv.Itoa(1024 + fastrand.Intn(30000))
-	if proto == string(protocol.ProtocolVMessTlsGrpc) {
+	switch proto {
+	case string(protocol.ProtocolVMessTlsGrpc):
 		randPort = "50051"
+	case string(server.ProtocolVMessWs):
+		// one of the HTTP ports proxied by common CDNs
+		randPort = "8880"
+	case string(server.ProtocolVMessTlsWs):
+		// one of the HTTPS ports proxied by common CDNs
+		randPort = "8443"
 	}
 	if err := survey.AskOne(&survey.Input{
 		Message: "Address to listen on:",
 		Default: "0.0.0.0:" + randPort,
-		Help: "The local address you want to listen. ACME TLS protocols (vmess+tls+grpc and anytls) will occupy one more port 80. " +
+		Help: "The local address you want to listen. ACME TLS protocols (vmess+tls+grpc, vmess+tls+ws, anytls and trojan) will occupy one more port 80, " +
+			"unless acme.challenge is tls-alpn-01 or dns-01, or certificate files are given by tls.certFile or tls.certDir in the config. " +
 			"Make sure the ports are available.",
 	}, &listen, survey.WithValidator(addressValidator)); err != nil {
 		return nil, false, err
@@ -303,6 +335,36 @@ func getParams(targetConfigPath string) (*config.Params, bool, error) {
 	}, &name, survey.WithValidator(minLengthValidatorFactory(5))); err != nil {
 		return nil, false, err
 	}
+	var reality config.Reality
+	if proto == string(server.ProtocolVlessReality) {
+		var dest string
+		if err := survey.AskOne(&survey.Input{
+			Message: "The TLS site for REALITY to borrow (host:port):",
+			Default: "www.microsoft.com:443",
+			Help: "Unauthenticated handshakes are forwarded to this site, so it should support TLS 1.3. " +
+				"The key pair and the short-id are generated automatically.",
+		}, &dest, survey.WithValidator(addressValidator)); err != nil {
+			return nil, false, err
+		}
+		if reality, err = newRealityParams(dest); err != nil {
+			return nil, false, err
+		}
+	}
+	var hysteria2 config.Hysteria2
+	if proto == string(server.ProtocolHysteria2) {
+		var obfs bool
+		if err := survey.AskOne(&survey.Confirm{
+			Message: "Do you want to enable the Salamander obfuscation?",
+			Default: false,
+			Help: "Salamander makes QUIC packets look like random bytes, which helps where QUIC is blocked. " +
+				"The password is generated automatically.",
+		}, &obfs); err != nil {
+			return nil, false, err
+		}
+		if obfs {
+			hysteria2.ObfsPassword, _ = gonanoid.Generate(common.Alphabet, 23)
+		}
+	}
 	var (
 		needRelay bool
 		strDay    string
@@ -373,8 +435,10 @@ func getParams(targetConfigPath string) (*config.Params, bool, error) {
 				DownlinkLimitGiB: downlinkLimitGiB,
 				TotalLimitGiB:    totalLimitGiB,
 			},
-			NoRelay:  noRelay,
-			Protocol: proto,
+			NoRelay:   noRelay,
+			Protocol:  proto,
+			Reality:   reality,
+			Hysteria2: hysteria2,
 		},
 	}, true, nil
 }
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server/vless"
 )
 
 func TestInstallProtocolOptionsIncludeAnyTLS(t *testing.T) {
@@ -14,3 +15,19 @@ func TestInstallProtocolOptionsIncludeAnyTLS(t *testing.T) {
 	}
 	t.Fatalf("install protocol options do not contain %q", server.ProtocolAnyTLS)
 }
+
+func TestNewRealityParams(t *testing.T) {
+	reality, err := newRealityParams("www.example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reality.Dest != "www.example.com:443" {
+		t.Fatalf("dest = %q, want %q", reality.Dest, "www.example.com:443")
+	}
+	if _, err := vless.ParsePrivateKey(reality.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vless.ParseShortId(reality.ShortIds); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -17,14 +17,13 @@ import (
 	"github.com/daeuniverse/outbound/pkg/fastrand"
 	"github.com/daeuniverse/outbound/protocol"
 	"github.com/daeuniverse/outbound/protocol/shadowsocks"
-	"github.com/daeuniverse/outbound/protocol/vmess"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/api"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/common"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/cdn_validator"
-	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/copy_cert"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/disk_bloom"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/replay_filter"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/resolver"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/viper_tool"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
@@ -118,6 +117,18 @@ func Run() (err error) {
 		return err
 	}
 
+	if manager := conf.John.Manager; manager.RotateInterval > 0 && (manager.GracePeriod < 0 || manager.GracePeriod >= manager.RotateInterval) {
+		return fmt.Errorf("gracePeriod of the manager key should be less than rotateInterval: %v, %v", manager.GracePeriod, manager.RotateInterval)
+	}
+
+	hopPorts, err := server.ParseHopPorts(conf.John.HopPorts)
+	if err != nil {
+		return err
+	}
+	if len(hopPorts) > 0 && !protocolSupportsPortHopping(protocol.Protocol(conf.John.Protocol)) {
+		return fmt.Errorf("port hopping is not supported by %v", conf.John.Protocol)
+	}
+
 	// listen
 	s, err := server.NewServer(ctx, dialer,
 		conf.John.Protocol, conf.Lisa, server.Argument{
@@ -125,6 +136,7 @@ func Run() (err error) {
 			ServerName: conf.John.Name,
 			Hostnames:  conf.John.Hostname,
 			Port:       conf.John.Port,
+			HopPorts:   hopPorts,
 			NoRelay:    conf.John.NoRelay,
 		})
 	if err != nil {
@@ -213,59 +225,116 @@ func Run() (err error) {
 }
 
 func protocolRequiresDNSReady(proto protocol.Protocol) bool {
-	if proto == server.ProtocolAnyTLS {
+	if proto == server.ProtocolAnyTLS || proto == server.ProtocolTrojan {
 		return true
 	}
 	return common.StringsHas(strings.Split(string(proto), "+"), "tls")
 }
 
+// protocolSupportsPortHopping reports whether the protocol is over QUIC.
+func protocolSupportsPortHopping(proto protocol.Protocol) bool {
+	return proto == protocol.ProtocolJuicity || proto == server.ProtocolHysteria2
+}
+
 func protocolRuntime(proto protocol.Protocol) (context.Context, netproxy.Dialer, error) {
 	switch proto {
 	case protocol.ProtocolShadowsocks:
-		bloom, err := disk_bloom.NewBloom(filepath.Join(filepath.Dir(v.ConfigFileUsed()), "disk_bloom_*"), []byte(DiskBloomSalt))
+		bloom, err := newBloom()
 		if err != nil {
-			return nil, nil, fmt.Errorf("%v", err)
+			return nil, nil, err
 		}
 		return context.WithValue(context.Background(), "bloom", bloom), fullconeDialer(), nil
-	case protocol.ProtocolVMessTCP, protocol.ProtocolVMessTlsGrpc:
-		doubleCuckoo := vmess.NewReplayFilter(120)
-		return context.WithValue(context.Background(), "doubleCuckoo", doubleCuckoo), fullconeDialer(), nil
-	case protocol.ProtocolJuicity:
-		var errs []error
-		crtPath, err := config.DataFile(server.JuicityDomain + "_443.crt")
-		errs = append(errs, err)
-		keyPath, err := config.DataFile(server.JuicityDomain + "_443.key")
-		errs = append(errs, err)
-		if err = errors.Join(errs...); err != nil {
+	case protocol.ProtocolVMessTCP, protocol.ProtocolVMessTlsGrpc, server.ProtocolVMessWs, server.ProtocolVMessTlsWs:
+		vmessConfig := config.ParamsObj.John.VMess
+		if vmessConfig.EAuthIDWindow <= 0 {
+			return nil, nil, fmt.Errorf("invalid eAuthIDWindow of vmess: %v", vmessConfig.EAuthIDWindow)
+		}
+		path, err := config.DataFile("vmess_replay_filter")
+		if err != nil {
 			return nil, nil, err
 		}
-		errs = errs[:0]
-		crt, err := os.ReadFile(crtPath)
-		errs = append(errs, err)
-		key, err := os.ReadFile(keyPath)
-		errs = append(errs, err)
-		if err = errors.Join(errs...); err != nil {
-			crt, key, err = copy_cert.Copy(server.JuicityDomain + ":443")
-			if err != nil {
-				return nil, nil, err
-			}
-			if err = os.WriteFile(crtPath, crt, 0600); err != nil {
-				return nil, nil, err
-			}
-			if err = os.WriteFile(keyPath, key, 0600); err != nil {
+		doubleCuckoo, err := replay_filter.Open(path, vmessConfig.EAuthIDWindow, time.Duration(vmessConfig.SaveInterval)*time.Second)
+		if err != nil {
+			return nil, nil, err
+		}
+		ctx := context.WithValue(context.Background(), "doubleCuckoo", doubleCuckoo)
+		if proto == protocol.ProtocolVMessTlsGrpc {
+			if ctx, err = withECHKeys(ctx); err != nil {
 				return nil, nil, err
 			}
 		}
-		ctx := context.WithValue(context.Background(), "certificate", crt)
-		ctx = context.WithValue(ctx, "key", key)
 		return ctx, fullconeDialer(), nil
+	case protocol.ProtocolJuicity, server.ProtocolHysteria2:
+		juicity := config.ParamsObj.John.Juicity
+		copied, err := server.NewCopiedCertificate(juicity.ImpersonateDomain, time.Duration(juicity.CertRefreshInterval)*time.Second)
+		if err != nil {
+			return nil, nil, err
+		}
+		return context.WithValue(context.Background(), "copiedCertificate", copied), fullconeDialer(), nil
 	case server.ProtocolAnyTLS:
+		ctx, err := withECHKeys(context.Background())
+		if err != nil {
+			return nil, nil, err
+		}
+		return ctx, fullconeDialer(), nil
+	case server.ProtocolTrojan, server.ProtocolVlessReality:
 		return context.Background(), fullconeDialer(), nil
 	default:
 		return nil, nil, fmt.Errorf("protocol %v is invalid", strconv.Quote(string(proto)))
 	}
 }
 
+// newBloom opens the bloom filter of shadowsocks by the config.
+func newBloom() (*disk_bloom.Bloom, error) {
+	conf := config.ParamsObj.John.Shadowsocks.Bloom
+	fsync, err := disk_bloom.ParseFsyncMode(conf.Fsync)
+	if err != nil {
+		return nil, err
+	}
+	if conf.RotateInterval < 0 {
+		return nil, fmt.Errorf("invalid rotateInterval of the bloom filter: %v", conf.RotateInterval)
+	}
+	opts := disk_bloom.Options{
+		Capacity:       conf.Capacity,
+		FPR:            conf.FPR,
+		Fsync:          fsync,
+		RotateInterval: time.Duration(conf.RotateInterval) * time.Second,
+		// where the former versions put the filters
+		LegacyDir: filepath.Dir(v.ConfigFileUsed()),
+	}
+	if conf.Memory {
+		opts.Capacity = conf.MemoryCapacity
+	} else {
+		opts.Dir = conf.Dir
+		if opts.Dir == "" {
+			if opts.Dir, err = config.DataFile("shadowsocks_bloom"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return disk_bloom.NewBloom(opts, []byte(DiskBloomSalt))
+}
+
+// withECHKeys puts the ECH keys into ctx if ECH is enabled.
+func withECHKeys(ctx context.Context) (context.Context, error) {
+	conf := config.ParamsObj
+	if !conf.John.ECH.Enable {
+		return ctx, nil
+	}
+	publicName := conf.John.ECH.PublicName
+	if publicName == "" {
+		var err error
+		if publicName, err = common.HostsToSNI(conf.John.Hostname, conf.Lisa.Host); err != nil {
+			return nil, err
+		}
+	}
+	keys, err := server.NewECHKeys(publicName, time.Duration(conf.John.ECH.RotateInterval)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return context.WithValue(ctx, "echKeys", keys), nil
+}
+
 func fullconeDialer() netproxy.Dialer {
 	if server.FullconePrivateLimitedDialer != nil {
 		return server.FullconePrivateLimitedDialer
@@ -27,8 +27,13 @@ func TestProtocolRequiresDNSReadyIncludesAnyTLS(t *testing.T) {
 		want  bool
 	}{
 		{name: "anytls", proto: server.ProtocolAnyTLS, want: true},
+		{name: "trojan", proto: server.ProtocolTrojan, want: true},
+		{name: "vless reality", proto: server.ProtocolVlessReality, want: false},
+		{name: "hysteria2", proto: server.ProtocolHysteria2, want: false},
 		{name: "grpc tls", proto: protocol.ProtocolVMessTlsGrpc, want: true},
 		{name: "vmess tcp", proto: protocol.ProtocolVMessTCP, want: false},
+		{name: "vmess ws", proto: server.ProtocolVMessWs, want: false},
+		{name: "vmess tls ws", proto: server.ProtocolVMessTlsWs, want: true},
 		{name: "juicity", proto: protocol.ProtocolJuicity, want: false},
 	}
 	for _, tt := range tests {
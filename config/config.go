@@ -20,8 +20,140 @@ type John struct {
 
 	MaxDrainN int64 `json:"maxDrainN" default:"-1" desc:"Max number of bytes to drain. default value is -1, which means unlimited."`
 
+	HopPorts string `json:"hopPorts,omitempty" desc:"UDP ports for QUIC protocols to also accept on for port hopping, such as 20000-20100 (split by \",\"). They are advertised to SweetLisa."`
+
 	DoNotValidateCDN bool `json:"doNotValidateCDN" desc:"Do not validate the CDN configuration of the peer SweetLisa"`
 	Only4            bool `json:"only4" desc:"Only use IPv4 for outbound traffic"`
+
+	Shadowsocks Shadowsocks `json:"shadowsocks"`
+	VMess       VMess       `json:"vmess"`
+	AnyTLS      AnyTLS      `json:"anytls"`
+	Trojan      Trojan      `json:"trojan"`
+	Reality     Reality     `json:"reality"`
+	Hysteria2   Hysteria2   `json:"hysteria2"`
+	Juicity     Juicity     `json:"juicity"`
+
+	TLS  TLS  `json:"tls"`
+	ACME ACME `json:"acme"`
+	ECH  ECH  `json:"ech"`
+	Ban  Ban  `json:"ban"`
+
+	Manager Manager `json:"manager"`
+}
+
+type Shadowsocks struct {
+	FailurePolicy string `json:"failurePolicy,omitempty" default:"drain" desc:"What to do with shadowsocks connections failing the authentication: drain, close (after a random delay), reset or decoy"`
+	Decoy         string `json:"decoy,omitempty" desc:"The address (host:port) to forward failed shadowsocks connections to with the decoy policy"`
+	Bloom         Bloom  `json:"bloom"`
+}
+
+type Bloom struct {
+	Dir            string  `json:"dir,omitempty" desc:"The directory of the bloom filters rejecting replayed shadowsocks salts. The data directory is used if empty."`
+	Capacity       uint64  `json:"capacity,omitempty" default:"100000000" desc:"The number of salts a bloom filter holds at the false positive rate, and another one is added once it is full. It takes about 3.6 bytes per salt at the default rate."`
+	FPR            float64 `json:"fpr,omitempty" default:"0.000001" desc:"The false positive rate of a bloom filter"`
+	Fsync          string  `json:"fsync,omitempty" default:"everysec" desc:"When to fsync the bloom filter files: always, everysec or no"`
+	RotateInterval int64   `json:"rotateInterval,omitempty" desc:"Start a new generation of bloom filters every the seconds and drop the generation before the previous one, so salts are remembered for one to two intervals. Zero means never."`
+	Memory         bool    `json:"memory,omitempty" desc:"Keep the bloom filters in memory only, which are lost on restarts, for ephemeral containers"`
+	MemoryCapacity uint64  `json:"memoryCapacity,omitempty" default:"1000000" desc:"The capacity of a bloom filter in memory mode instead of capacity, which is allocated at once. It takes about 3.6 MB at the default rate."`
+}
+
+type VMess struct {
+	FailurePolicy string `json:"failurePolicy,omitempty" default:"drain" desc:"What to do with vmess connections failing the authentication: drain, close (after a random delay), reset or decoy"`
+	Decoy         string `json:"decoy,omitempty" desc:"The address (host:port) to forward failed vmess connections to with the decoy policy"`
+	EAuthIDWindow int64  `json:"eAuthIDWindow,omitempty" default:"120" desc:"Accept the vmess EAuthID within the seconds from the time of the server. They are remembered as long to reject replays."`
+	SaveInterval  int64  `json:"saveInterval,omitempty" default:"60" desc:"Save the vmess replay filter to the data directory every the seconds besides on shutdown, to restore it after restarts. Zero means only on shutdown."`
+}
+
+type AnyTLS struct {
+	PaddingScheme     string `json:"paddingScheme,omitempty" desc:"The anytls padding scheme pushed to clients. The default scheme of anytls is used if empty."`
+	IdleTimeout       int64  `json:"idleTimeout,omitempty" default:"300" desc:"Close anytls sessions without any stream or traffic for the seconds. Zero means never."`
+	HeartbeatInterval int64  `json:"heartbeatInterval,omitempty" default:"30" desc:"Send heartbeats to silent anytls clients every the seconds. Zero means never."`
+	HeartbeatMaxMiss  int    `json:"heartbeatMaxMiss,omitempty" default:"3" desc:"Close anytls sessions after the number of unanswered heartbeats"`
+	MaxStreams        int    `json:"maxStreams,omitempty" default:"256" desc:"The max number of concurrent streams per anytls session. Zero means no limit."`
+	Fallback          string `json:"fallback,omitempty" desc:"The URL of the HTTP or HTTPS site to reverse proxy unauthenticated anytls connections to. A built-in static site is served if empty."`
+}
+
+type Trojan struct {
+	Fallback string `json:"fallback,omitempty" desc:"The HTTP backend (host:port) to relay unauthenticated trojan connections to. Drain them if empty."`
+}
+
+type Reality struct {
+	Dest        string `json:"dest,omitempty" default:"www.microsoft.com:443" desc:"The TLS site (host:port) to relay unauthenticated REALITY handshakes to"`
+	ServerNames string `json:"serverNames,omitempty" desc:"Server names allowed in the SNI of REALITY clients (split by \",\"). The host of dest is used if empty."`
+	PrivateKey  string `json:"privateKey,omitempty" desc:"The x25519 private key of REALITY in base64 URL encoding"`
+	ShortIds    string `json:"shortIds,omitempty" desc:"Hex short-ids allowed for REALITY clients (split by \",\")"`
+	MaxTimeDiff int64  `json:"maxTimeDiff,omitempty" desc:"Max time difference in seconds between REALITY clients and the server. Zero means no limit."`
+}
+
+type Hysteria2 struct {
+	UpMbps                int64  `json:"upMbps,omitempty" desc:"The upload bandwidth of the server in Mbps for the Brutal congestion control. Zero means unlimited."`
+	DownMbps              int64  `json:"downMbps,omitempty" desc:"The download bandwidth of the server in Mbps told to clients. Zero means unlimited."`
+	IgnoreClientBandwidth bool   `json:"ignoreClientBandwidth,omitempty" desc:"Always use BBR instead of the Brutal congestion control requested by clients"`
+	ObfsPassword          string `json:"obfsPassword,omitempty" desc:"The password of the Salamander obfuscation. Salamander is disabled if empty."`
+	Masquerade            string `json:"masquerade,omitempty" desc:"The URL of the site to reverse proxy for unauthenticated HTTP/3 requests. Respond 404 if empty."`
+}
+
+type Juicity struct {
+	CongestionControl              string `json:"congestionControl,omitempty" default:"bbr" desc:"The congestion control of juicity connections: bbr, cubic or new_reno"`
+	Cwnd                           int    `json:"cwnd,omitempty" desc:"The initial congestion window in packets for cubic and new_reno. Zero means 32."`
+	MaxIncomingStreams             int64  `json:"maxIncomingStreams,omitempty" default:"100" desc:"The max number of concurrent bidirectional and unidirectional streams per juicity connection"`
+	KeepAlivePeriod                int64  `json:"keepAlivePeriod,omitempty" default:"10" desc:"Send keep-alive packets every the seconds. It should be less than idleTimeout."`
+	IdleTimeout                    int64  `json:"idleTimeout,omitempty" default:"30" desc:"Close juicity connections without any incoming packet for the seconds"`
+	InitialStreamReceiveWindow     uint64 `json:"initialStreamReceiveWindow,omitempty" desc:"The initial stream-level receive window in bytes. Zero means the default of QUIC."`
+	MaxStreamReceiveWindow         uint64 `json:"maxStreamReceiveWindow,omitempty" desc:"The max stream-level receive window in bytes. Zero means the default of QUIC."`
+	InitialConnectionReceiveWindow uint64 `json:"initialConnectionReceiveWindow,omitempty" desc:"The initial connection-level receive window in bytes. Zero means the default of QUIC."`
+	MaxConnectionReceiveWindow     uint64 `json:"maxConnectionReceiveWindow,omitempty" desc:"The max connection-level receive window in bytes. Zero means the default of QUIC."`
+	SendThrough                    string `json:"sendThrough,omitempty" desc:"The local IP address to send outbound traffic of juicity through"`
+	ImpersonateDomain              string `json:"impersonateDomain,omitempty" default:"software.download.prss.microsoft.com" desc:"The HTTPS site whose certificate chain juicity and hysteria2 copy and serve"`
+	CertRefreshInterval            int64  `json:"certRefreshInterval,omitempty" default:"86400" desc:"Check the site of impersonateDomain every the seconds and copy its certificate chain again once it is rotated. Zero means never."`
+}
+
+type TLS struct {
+	CertFile       string `json:"certFile,omitempty" desc:"The certificate chain file in PEM for TLS protocols instead of ACME"`
+	KeyFile        string `json:"keyFile,omitempty" desc:"The private key file in PEM of certFile"`
+	CertDir        string `json:"certDir,omitempty" desc:"The directory of certificates selected by SNI for TLS protocols instead of ACME: <name>.crt with <name>.key, or <name>/fullchain.pem with <name>/privkey.pem like the live directory of certbot"`
+	ReloadInterval int64  `json:"reloadInterval,omitempty" default:"60" desc:"Check the certificate files every the seconds and reload them if changed"`
+	RenewBefore    int64  `json:"renewBefore,omitempty" default:"30" desc:"Renew ACME certificates the days before expiry. Certificate files are expected to be renewed by then too."`
+	CheckInterval  int64  `json:"checkInterval,omitempty" default:"21600" desc:"Check the expiry of certificates every the seconds at most. Failures are retried sooner with backoff."`
+	AlertAfter     int    `json:"alertAfter,omitempty" default:"3" desc:"Alert in the log after the number of consecutive failures to check or renew a certificate"`
+}
+
+type ACME struct {
+	Challenge            string `json:"challenge,omitempty" default:"http-01" desc:"The ACME challenge to issue certificates for TLS protocols: http-01 (listening on port 80), tls-alpn-01 (on the TLS listener of the protocol, which must be reachable at port 443) or dns-01"`
+	DNSProvider          string `json:"dnsProvider,omitempty" desc:"The DNS provider to solve dns-01 challenges: cloudflare or rfc2136"`
+	PropagationTimeout   int64  `json:"propagationTimeout,omitempty" default:"120" desc:"Wait at most the seconds for the TXT records of dns-01 challenges to be visible"`
+	CloudflareAPIToken   string `json:"cloudflareAPIToken,omitempty" desc:"The Cloudflare API token with the permission to edit the DNS of the zone"`
+	RFC2136Nameserver    string `json:"rfc2136Nameserver,omitempty" desc:"The name server (host:port) accepting RFC 2136 dynamic updates"`
+	RFC2136TSIGKey       string `json:"rfc2136TSIGKey,omitempty" desc:"The TSIG key name of RFC 2136 dynamic updates. Updates are not signed if empty."`
+	RFC2136TSIGSecret    string `json:"rfc2136TSIGSecret,omitempty" desc:"The TSIG secret in base64 of RFC 2136 dynamic updates"`
+	RFC2136TSIGAlgorithm string `json:"rfc2136TSIGAlgorithm,omitempty" default:"hmac-sha256" desc:"The TSIG algorithm of RFC 2136 dynamic updates: hmac-sha1, hmac-sha256 or hmac-sha512"`
+	Directory            string `json:"directory,omitempty" default:"letsencrypt" desc:"The ACME CA: letsencrypt, letsencrypt-staging, zerossl, google, buypass, or the https directory URL of any other CA"`
+	FallbackDirectories  string `json:"fallbackDirectories,omitempty" desc:"The CAs tried in order if the directory fails to issue certificates, separated by commas"`
+	Email                string `json:"email,omitempty" desc:"The contact email of the ACME accounts"`
+	EABKeyID             string `json:"eabKeyID,omitempty" desc:"The key id of External Account Binding required by CAs like ZeroSSL and Google. It is used with the directory but not the fallbacks."`
+	EABHMACKey           string `json:"eabHMACKey,omitempty" desc:"The HMAC key in base64url of External Account Binding"`
+	CacheDir             string `json:"cacheDir,omitempty" desc:"The directory of the ACME accounts and certificates. Default: tls in the data directory"`
+}
+
+type ECH struct {
+	Enable         bool   `json:"enable" default:"false" desc:"Accept Encrypted Client Hello on anytls and vmess+tls+grpc, whose configs are published to SweetLisa. Clients need TLS 1.3 to use it."`
+	PublicName     string `json:"publicName,omitempty" desc:"The name in the outer ClientHello, which clients reveal instead of the real SNI. The server must also serve a certificate for it. Default: the TLS SNI"`
+	RotateInterval int64  `json:"rotateInterval,omitempty" default:"604800" desc:"Rotate the ECH key every the seconds and publish the new configs. The previous key is still accepted until the next rotation. Zero means never."`
+}
+
+type Ban struct {
+	Enable      bool   `json:"enable" default:"false" desc:"Ban the sources failing the authentication of shadowsocks or vmess over TCP repeatedly for a while. Their connections are treated by the failure policy without the authentication."`
+	MaxFailures int    `json:"maxFailures,omitempty" default:"10" desc:"Ban a source after the failures within the window. IPv4 sources are counted by /32 and IPv6 ones by /64."`
+	Window      int64  `json:"window,omitempty" default:"600" desc:"The sliding window in seconds to count the failures"`
+	BanTime     int64  `json:"banTime,omitempty" default:"600" desc:"The seconds of the first ban, which double for every ban again up to maxBanTime"`
+	MaxBanTime  int64  `json:"maxBanTime,omitempty" default:"86400" desc:"The max seconds of a ban. The bans are forgiven if a source has not been banned for as long."`
+	MaxEntries  int    `json:"maxEntries,omitempty" default:"65536" desc:"The max number of sources remembered in memory, beyond which the least recently failed ones are forgotten"`
+	Allow       string `json:"allow,omitempty" desc:"IPs or CIDRs never to ban besides SweetLisa (split by \",\")"`
+}
+
+type Manager struct {
+	RotateInterval int64 `json:"rotateInterval,omitempty" desc:"Rotate the manager key every the seconds and register the new one to SweetLisa. Zero means never."`
+	GracePeriod    int64 `json:"gracePeriod,omitempty" default:"300" desc:"Still accept the previous manager key for the seconds after the new one is registered, for the in-flight messages of SweetLisa"`
 }
 
 type BandwidthLimit struct {
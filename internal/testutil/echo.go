@@ -0,0 +1,78 @@
+// Package testutil provides the fixtures shared by the tests of the servers.
+package testutil
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// StartEchoServer starts a TCP server answering "ping" with "pong".
+func StartEchoServer(t testing.TB) (addr string, closeFn func()) {
+	t.Helper()
+
+	lt, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			conn, err := lt.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+				buf := make([]byte, 4)
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					return
+				}
+				if string(buf) == "ping" {
+					_, _ = conn.Write([]byte("pong"))
+				}
+			}(conn)
+		}
+	}()
+
+	return lt.Addr().String(), func() {
+		_ = lt.Close()
+		<-done
+	}
+}
+
+// StartUDPEchoServer starts a UDP server answering "ping" with "pong" and
+// echoing the other packets.
+func StartUDPEchoServer(t testing.TB) (netip.AddrPort, func()) {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:0")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			if string(buf[:n]) == "ping" {
+				_, _ = conn.WriteToUDPAddrPort([]byte("pong"), addr)
+			} else {
+				_, _ = conn.WriteToUDPAddrPort(buf[:n], addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort(), func() {
+		_ = conn.Close()
+		<-done
+	}
+}
@@ -6,9 +6,14 @@ import (
 
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/cmd"
 	_ "github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/cdn_validator/cloudflare"
+	_ "github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/dns_provider/cloudflare"
+	_ "github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/dns_provider/rfc2136"
 	_ "github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server/anytls"
+	_ "github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server/hysteria2"
 	_ "github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server/juicity"
 	_ "github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server/shadowsocks"
+	_ "github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server/trojan"
+	_ "github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server/vless"
 	_ "github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server/vmess"
 )
 
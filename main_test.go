@@ -11,3 +11,29 @@ func TestMainImportsAnyTLSServer(t *testing.T) {
 		t.Fatalf("server mapper does not contain %q", server.ProtocolAnyTLS)
 	}
 }
+
+func TestMainImportsTrojanServer(t *testing.T) {
+	if _, ok := server.Mapper[string(server.ProtocolTrojan)]; !ok {
+		t.Fatalf("server mapper does not contain %q", server.ProtocolTrojan)
+	}
+}
+
+func TestMainImportsVlessRealityServer(t *testing.T) {
+	if _, ok := server.Mapper[string(server.ProtocolVlessReality)]; !ok {
+		t.Fatalf("server mapper does not contain %q", server.ProtocolVlessReality)
+	}
+}
+
+func TestMainImportsHysteria2Server(t *testing.T) {
+	if _, ok := server.Mapper[string(server.ProtocolHysteria2)]; !ok {
+		t.Fatalf("server mapper does not contain %q", server.ProtocolHysteria2)
+	}
+}
+
+func TestMainImportsVMessWsServer(t *testing.T) {
+	for _, proto := range []string{string(server.ProtocolVMessWs), string(server.ProtocolVMessTlsWs)} {
+		if _, ok := server.Mapper[proto]; !ok {
+			t.Fatalf("server mapper does not contain %q", proto)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+// Package acme_test_server runs a local ACME server (pebble) and a DNS server
+// standing in for the authoritative name server of the test domains, which
+// are used by the tests of certificate issuance.
+package acme_test_server
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/pebble/v2/ca"
+	"github.com/letsencrypt/pebble/v2/db"
+	"github.com/letsencrypt/pebble/v2/va"
+	"github.com/letsencrypt/pebble/v2/wfe"
+	"github.com/miekg/dns"
+)
+
+const (
+	// ZoneName is the zone served by the Zone.
+	ZoneName = "example.test."
+	// TSIGKey and TSIGSecret sign the dynamic updates to the Zone.
+	TSIGKey    = "john."
+	TSIGSecret = "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+)
+
+type PebbleOptions struct {
+	// ResolverAddr is the DNS server used to validate challenges.
+	ResolverAddr string
+	// HTTPPort and TLSPort are where the http-01 and tls-alpn-01 challenges
+	// are validated.
+	HTTPPort int
+	TLSPort  int
+	// Validity of the certificates. Pebble decides if zero.
+	Validity time.Duration
+}
+
+type Pebble struct {
+	DirectoryURL string
+	// Client trusts the HTTPS server of the ACME directory.
+	Client *http.Client
+}
+
+// StartPebble starts a pebble stopped on the cleanup of t.
+func StartPebble(t testing.TB, opts PebbleOptions) *Pebble {
+	t.Helper()
+	t.Setenv("PEBBLE_VA_NOSLEEP", "1")
+	t.Setenv("PEBBLE_WFE_NONCEREJECT", "0")
+	t.Setenv("PEBBLE_AUTHZREUSE", "0")
+	logger := log.New(io.Discard, "", 0)
+	store := db.NewMemoryStore()
+	certificateAuthority := ca.New(logger, store, "", "ecdsa", 0, 1, map[string]ca.Profile{
+		"default": {ValidityPeriod: uint64(opts.Validity / time.Second)},
+	})
+	validationAuthority := va.New(logger, opts.HTTPPort, opts.TLSPort, false, opts.ResolverAddr, store)
+	frontEnd := wfe.New(logger, store, validationAuthority, certificateAuthority, []string{"pebble.letsencrypt.org"}, false, false, 0, 0)
+	server := httptest.NewTLSServer(withFinalizeLocation(frontEnd.Handler()))
+	t.Cleanup(server.Close)
+	return &Pebble{
+		DirectoryURL: server.URL + "/dir",
+		Client:       server.Client(),
+	}
+}
+
+// withFinalizeLocation adds the order URL to the finalize responses like Let's
+// Encrypt, which x/crypto/acme depends on to poll the order.
+func withFinalizeLocation(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := strings.CutPrefix(r.URL.Path, "/finalize-order/"); ok {
+			w.Header().Set("Location", "https://"+r.Host+"/my-order/"+id)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Zone is a DNS server of ZoneName on TCP and UDP. It accepts dynamic updates
+// of TXT records signed by TSIGKey.
+type Zone struct {
+	Addr string
+
+	mu   sync.Mutex
+	txts map[string][]string
+	as   map[string]net.IP
+}
+
+// StartZone starts a Zone stopped on the cleanup of t.
+func StartZone(t testing.TB) *Zone {
+	t.Helper()
+	z := &Zone{
+		txts: make(map[string][]string),
+		as:   make(map[string]net.IP),
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.Addr = l.Addr().String()
+	tsig := map[string]string{TSIGKey: TSIGSecret}
+	// the default rejects dynamic updates
+	accept := func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept }
+	for _, s := range []*dns.Server{
+		{Listener: l, Handler: z, TsigSecret: tsig, MsgAcceptFunc: accept},
+		{PacketConn: pc, Handler: z, TsigSecret: tsig, MsgAcceptFunc: accept},
+	} {
+		go func() { _ = s.ActivateAndServe() }()
+		t.Cleanup(func() { _ = s.Shutdown() })
+	}
+	return z
+}
+
+// Resolver resolves names by the Zone.
+func (z *Zone) Resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, z.Addr)
+		},
+	}
+}
+
+// SetA sets the IPv4 address of the domain.
+func (z *Zone) SetA(domain string, ip net.IP) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.as[dns.Fqdn(strings.ToLower(domain))] = ip
+}
+
+// TXTCount returns the number of TXT records.
+func (z *Zone) TXTCount() (n int) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	for _, values := range z.txts {
+		n += len(values)
+	}
+	return n
+}
+
+func (z *Zone) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	defer func() { _ = w.WriteMsg(m) }()
+	if r.Opcode == dns.OpcodeUpdate {
+		if r.IsTsig() == nil || w.TsigStatus() != nil {
+			m.Rcode = dns.RcodeRefused
+			return
+		}
+		if len(r.Question) != 1 || r.Question[0].Name != ZoneName {
+			m.Rcode = dns.RcodeNotZone
+			return
+		}
+		m.SetTsig(TSIGKey, dns.HmacSHA256, 300, time.Now().Unix())
+		z.update(r.Ns)
+		return
+	}
+	if len(r.Question) != 1 {
+		m.Rcode = dns.RcodeFormatError
+		return
+	}
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+	if !dns.IsSubDomain(ZoneName, name) {
+		m.Rcode = dns.RcodeRefused
+		return
+	}
+	soa := &dns.SOA{
+		Hdr:     dns.RR_Header{Name: ZoneName, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+		Ns:      "ns." + ZoneName,
+		Mbox:    "admin." + ZoneName,
+		Serial:  1,
+		Refresh: 60, Retry: 60, Expire: 60, Minttl: 60,
+	}
+	z.mu.Lock()
+	switch {
+	case q.Qtype == dns.TypeSOA && name == ZoneName:
+		m.Answer = append(m.Answer, soa)
+	case q.Qtype == dns.TypeTXT:
+		for _, value := range z.txts[name] {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0},
+				Txt: []string{value},
+			})
+		}
+	case q.Qtype == dns.TypeA && z.as[name] != nil:
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0},
+			A:   z.as[name],
+		})
+	}
+	z.mu.Unlock()
+	if len(m.Answer) == 0 {
+		m.Ns = append(m.Ns, soa)
+	}
+}
+
+func (z *Zone) update(rrs []dns.RR) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	for _, rr := range rrs {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		name := strings.ToLower(txt.Hdr.Name)
+		value := strings.Join(txt.Txt, "")
+		if txt.Hdr.Class == dns.ClassNONE {
+			// removal
+			values := z.txts[name][:0]
+			for _, v := range z.txts[name] {
+				if v != value {
+					values = append(values, v)
+				}
+			}
+			z.txts[name] = values
+			continue
+		}
+		z.txts[name] = append(z.txts[name], value)
+	}
+}
@@ -30,3 +30,8 @@ func (b BufferedConn) Close() error {
 func (b BufferedConn) Read(p []byte) (int, error) {
 	return b.r.Read(p)
 }
+
+// NetConn returns the underlying connection, bypassing the buffer.
+func (b BufferedConn) NetConn() net.Conn {
+	return b.Conn
+}
@@ -0,0 +1,239 @@
+package cert_file
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+)
+
+type Options struct {
+	// CertFile and KeyFile are the default certificate.
+	CertFile string
+	KeyFile  string
+	// Dir contains the certificates selected by SNI, as <name>.crt with
+	// <name>.key, or <name>/fullchain.pem with <name>/privkey.pem like the live
+	// directory of certbot. The names of the files do not matter, and the DNS
+	// names of the certificates are used for selection.
+	Dir string
+	// Interval is how often the files are checked for changes. Zero means
+	// never.
+	Interval time.Duration
+	// OnReload is called after the certificates are reloaded because the files
+	// changed.
+	OnReload func()
+}
+
+type keyPair struct {
+	certFile string
+	keyFile  string
+}
+
+// Store serves the certificates in files and reloads them when the files
+// change, such as after the renewals by certbot.
+type Store struct {
+	opts Options
+
+	mu    sync.RWMutex
+	stamp string
+	def   *tls.Certificate
+	names map[string]*tls.Certificate
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func New(opts Options) (*Store, error) {
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return nil, fmt.Errorf("cert_file: certFile and keyFile must be given together")
+	}
+	if opts.CertFile == "" && opts.Dir == "" {
+		return nil, fmt.Errorf("cert_file: no certificate file is given")
+	}
+	s := &Store{
+		opts:   opts,
+		closed: make(chan struct{}),
+	}
+	pairs, stamp, err := s.keyPairs()
+	if err != nil {
+		return nil, err
+	}
+	if err = s.load(pairs, stamp); err != nil {
+		return nil, err
+	}
+	if opts.Interval > 0 {
+		go s.watch()
+	}
+	return s, nil
+}
+
+// GetCertificate implements the tls.Config.GetCertificate hook.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := s.Lookup(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+	return nil, fmt.Errorf("cert_file: no certificate for %v", strconv.Quote(hello.ServerName))
+}
+
+// Lookup returns the certificate of the name, a wildcard certificate covering
+// it, or the default one.
+func (s *Store) Lookup(name string) *tls.Certificate {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if cert, ok := s.names[name]; ok {
+		return cert
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert, ok := s.names["*."+parent]; ok {
+			return cert
+		}
+	}
+	return s.def
+}
+
+// Covers reports whether a certificate is valid for the name.
+func (s *Store) Covers(name string) bool {
+	cert := s.Lookup(name)
+	return cert != nil && cert.Leaf.VerifyHostname(name) == nil
+}
+
+// Names returns the DNS names of the certificates, which is for logging.
+func (s *Store) Names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.names))
+	for name := range s.names {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (s *Store) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	return nil
+}
+
+func (s *Store) watch() {
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+		pairs, stamp, err := s.keyPairs()
+		if err != nil {
+			log.Warn("cert_file: %v", err)
+			continue
+		}
+		s.mu.RLock()
+		changed := stamp != s.stamp
+		s.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		// certbot may be writing the files, and it is retried on the next tick
+		if err = s.load(pairs, stamp); err != nil {
+			log.Warn("Failed to reload the certificate files: %v", err)
+			continue
+		}
+		log.Warn("The certificate files are reloaded.")
+		if s.opts.OnReload != nil {
+			s.opts.OnReload()
+		}
+	}
+}
+
+// keyPairs lists the certificate files and stamps them with their sizes and
+// modification times.
+func (s *Store) keyPairs() (pairs []keyPair, stamp string, err error) {
+	if s.opts.CertFile != "" {
+		pairs = append(pairs, keyPair{certFile: s.opts.CertFile, keyFile: s.opts.KeyFile})
+	}
+	if s.opts.Dir != "" {
+		entries, err := os.ReadDir(s.opts.Dir)
+		if err != nil {
+			return nil, "", fmt.Errorf("cert_file: %w", err)
+		}
+		for _, entry := range entries {
+			path := filepath.Join(s.opts.Dir, entry.Name())
+			// os.Stat follows the symbolic links of certbot
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if info.IsDir() {
+				pair := keyPair{certFile: filepath.Join(path, "fullchain.pem"), keyFile: filepath.Join(path, "privkey.pem")}
+				if isFile(pair.certFile) && isFile(pair.keyFile) {
+					pairs = append(pairs, pair)
+				}
+				continue
+			}
+			if base, ok := strings.CutSuffix(path, ".crt"); ok && isFile(base+".key") {
+				pairs = append(pairs, keyPair{certFile: path, keyFile: base + ".key"})
+			}
+		}
+	}
+	var b strings.Builder
+	for _, pair := range pairs {
+		for _, file := range []string{pair.certFile, pair.keyFile} {
+			info, err := os.Stat(file)
+			if err != nil {
+				return nil, "", fmt.Errorf("cert_file: %w", err)
+			}
+			fmt.Fprintf(&b, "%v:%v:%v;", file, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return pairs, b.String(), nil
+}
+
+func (s *Store) load(pairs []keyPair, stamp string) error {
+	if len(pairs) == 0 {
+		return fmt.Errorf("cert_file: no certificate is found in %v", s.opts.Dir)
+	}
+	var def *tls.Certificate
+	names := make(map[string]*tls.Certificate)
+	for i, pair := range pairs {
+		cert, err := tls.LoadX509KeyPair(pair.certFile, pair.keyFile)
+		if err != nil {
+			return fmt.Errorf("cert_file: load %v: %w", pair.certFile, err)
+		}
+		if i == 0 {
+			def = &cert
+		}
+		dnsNames := cert.Leaf.DNSNames
+		if len(dnsNames) == 0 && cert.Leaf.Subject.CommonName != "" {
+			dnsNames = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range dnsNames {
+			name = strings.ToLower(name)
+			// the default certificate takes precedence
+			if _, ok := names[name]; !ok {
+				names[name] = &cert
+			}
+		}
+	}
+	s.mu.Lock()
+	s.stamp = stamp
+	s.def = def
+	s.names = names
+	s.mu.Unlock()
+	return nil
+}
+
+func isFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
@@ -0,0 +1,113 @@
+package cert_file
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreReloadsChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeKeyPair(t, certFile, keyFile, "edge.example.com")
+	reloaded := make(chan struct{}, 1)
+	s, err := New(Options{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		Interval: 10 * time.Millisecond,
+		OnReload: func() { reloaded <- struct{}{} },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "edge.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeKeyPair(t, certFile, keyFile, "edge.example.com")
+	select {
+	case <-reloaded:
+	case <-time.After(3 * time.Second):
+		t.Fatal("the changed files were not reloaded")
+	}
+	renewed, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "edge.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) == 0 {
+		t.Fatal("the certificate was not replaced")
+	}
+}
+
+func TestStoreSelectsBySNI(t *testing.T) {
+	dir := t.TempDir()
+	writeKeyPair(t, filepath.Join(dir, "a.crt"), filepath.Join(dir, "a.key"), "a.example.com")
+	// like the live directory of certbot
+	if err := os.Mkdir(filepath.Join(dir, "b.example.com"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeKeyPair(t, filepath.Join(dir, "b.example.com", "fullchain.pem"), filepath.Join(dir, "b.example.com", "privkey.pem"), "*.b.example.com")
+	s, err := New(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, name := range []string{"a.example.com", "edge.b.example.com", "EDGE.B.example.com."} {
+		cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = cert.Leaf.VerifyHostname(name); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+	}
+	if s.Covers("c.example.com") {
+		t.Fatal("c.example.com is covered")
+	}
+	if _, err = New(Options{Dir: t.TempDir()}); err == nil {
+		t.Fatal("expected an error for an empty directory")
+	}
+}
+
+func writeKeyPair(t *testing.T, certFile string, keyFile string, name string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{SerialNumber: serial, Subject: pkix.Name{CommonName: name}}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,462 @@
+package cert_manager
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/dns_provider"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// accountKeyName is where autocert stores the account key, so that both of
+	// them share the same account with the same cache.
+	accountKeyName = "acme_account+key"
+
+	DefaultRenewBefore        = 30 * 24 * time.Hour
+	DefaultPropagationTimeout = 2 * time.Minute
+	propagationInterval       = 2 * time.Second
+	issueTimeout              = 10 * time.Minute
+	// renewInterval limits renewal attempts of a certificate, in case the CA
+	// issues certificates shorter than RenewBefore or keeps failing.
+	renewInterval = time.Hour
+)
+
+type Options struct {
+	// DirectoryURL is the ACME directory. Let's Encrypt is used if empty.
+	DirectoryURL string
+	HTTPClient   *http.Client
+	// Email is the contact of the account, which is optional.
+	Email string
+	// ExternalAccountBinding is required by some CAs to register accounts.
+	ExternalAccountBinding *acme.ExternalAccountBinding
+	// Provider publishes the TXT records of dns-01 challenges.
+	Provider dns_provider.Provider
+	// Cache stores the account key and certificates in the format of autocert.
+	Cache      autocert.Cache
+	HostPolicy autocert.HostPolicy
+	// PropagationTimeout limits the wait for the TXT records to be visible to
+	// Resolver. A zero value means DefaultPropagationTimeout, and a negative
+	// value means not to wait.
+	PropagationTimeout time.Duration
+	Resolver           *net.Resolver
+	// RenewBefore is how early certificates are renewed before expiry.
+	RenewBefore time.Duration
+	// OnRenew is called after a cached certificate is renewed.
+	OnRenew func()
+}
+
+// Manager obtains certificates by ACME dns-01 challenges, and is used like
+// autocert.Manager.
+type Manager struct {
+	opts Options
+
+	mu        sync.Mutex
+	certs     map[string]*tls.Certificate
+	renewedAt map[string]time.Time
+	group     singleflight.Group
+}
+
+func New(opts Options) *Manager {
+	if opts.DirectoryURL == "" {
+		opts.DirectoryURL = acme.LetsEncryptURL
+	}
+	if opts.PropagationTimeout == 0 {
+		opts.PropagationTimeout = DefaultPropagationTimeout
+	}
+	if opts.Resolver == nil {
+		opts.Resolver = net.DefaultResolver
+	}
+	if opts.RenewBefore <= 0 {
+		opts.RenewBefore = DefaultRenewBefore
+	}
+	return &Manager{
+		opts:      opts,
+		certs:     make(map[string]*tls.Certificate),
+		renewedAt: make(map[string]time.Time),
+	}
+}
+
+// GetCertificate implements the tls.Config.GetCertificate hook.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	ctx, name, err := m.serverName(hello)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := m.cached(ctx, name)
+	if err == nil {
+		if time.Until(cert.Leaf.NotAfter) < m.opts.RenewBefore && m.startRenewal(name) {
+			go m.renew(name)
+		}
+		return cert, nil
+	}
+	if !errors.Is(err, autocert.ErrCacheMiss) {
+		log.Warn("cert_manager: %v", err)
+	}
+	v, err, _ := m.group.Do(name, func() (interface{}, error) {
+		return m.obtain(name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*tls.Certificate), nil
+}
+
+// Renew obtains a new certificate for the hello even if the cached one is
+// still valid.
+func (m *Manager) Renew(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	_, name, err := m.serverName(hello)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.renewedAt[name] = time.Now()
+	m.mu.Unlock()
+	v, err, _ := m.group.Do(name, func() (interface{}, error) {
+		return m.obtain(name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*tls.Certificate), nil
+}
+
+// serverName returns the normalized server name of the hello if the host
+// policy allows it.
+func (m *Manager) serverName(hello *tls.ClientHelloInfo) (context.Context, string, error) {
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if name == "" {
+		return nil, "", fmt.Errorf("cert_manager: missing server name")
+	}
+	if strings.ContainsAny(name, `+/\`) {
+		return nil, "", fmt.Errorf("cert_manager: server name contains invalid character")
+	}
+	ctx := hello.Context()
+	if ctx == nil {
+		// not in a handshake
+		ctx = context.Background()
+	}
+	if m.opts.HostPolicy != nil {
+		if err := m.opts.HostPolicy(ctx, name); err != nil {
+			return nil, "", err
+		}
+	}
+	return ctx, name, nil
+}
+
+// cached returns a valid certificate in memory or in the cache.
+func (m *Manager) cached(ctx context.Context, name string) (*tls.Certificate, error) {
+	m.mu.Lock()
+	cert, ok := m.certs[name]
+	m.mu.Unlock()
+	if ok {
+		return cert, nil
+	}
+	if m.opts.Cache == nil {
+		return nil, autocert.ErrCacheMiss
+	}
+	data, err := m.opts.Cache.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if cert, err = parseCertificate(name, data); err != nil {
+		return nil, fmt.Errorf("cached certificate for %v: %w", name, err)
+	}
+	m.mu.Lock()
+	m.certs[name] = cert
+	m.mu.Unlock()
+	return cert, nil
+}
+
+func (m *Manager) startRenewal(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if time.Since(m.renewedAt[name]) < renewInterval {
+		return false
+	}
+	m.renewedAt[name] = time.Now()
+	return true
+}
+
+func (m *Manager) renew(name string) {
+	_, err, shared := m.group.Do(name, func() (interface{}, error) {
+		log.Warn("We are now renewing the certificate for %v.", name)
+		return m.obtain(name)
+	})
+	if shared {
+		return
+	}
+	if err != nil {
+		log.Warn("Failed to renew the certificate for %v: %v", name, err)
+		return
+	}
+	log.Warn("The certificate for %v is renewed successfully.", name)
+	if m.opts.OnRenew != nil {
+		m.opts.OnRenew()
+	}
+}
+
+func (m *Manager) obtain(name string) (*tls.Certificate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), issueTimeout)
+	defer cancel()
+	cert, data, err := m.issue(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("cert_manager: issue the certificate for %v: %w", name, err)
+	}
+	if m.opts.Cache != nil {
+		if err = m.opts.Cache.Put(ctx, name, data); err != nil {
+			log.Warn("cert_manager: failed to cache the certificate for %v: %v", name, err)
+		}
+	}
+	m.mu.Lock()
+	m.certs[name] = cert
+	m.mu.Unlock()
+	return cert, nil
+}
+
+func (m *Manager) issue(ctx context.Context, name string) (*tls.Certificate, []byte, error) {
+	client, err := m.client(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, u := range order.AuthzURLs {
+		if err = m.authorize(ctx, client, u); err != nil {
+			return nil, nil, err
+		}
+	}
+	orderURL := order.URI
+	if order, err = client.WaitOrder(ctx, orderURL); err != nil {
+		return nil, nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: name},
+		DNSNames: []string{name},
+	}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := finalize(ctx, client, orderURL, order.FinalizeURL, csr)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := encodeCertificate(key, der)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := parseCertificate(name, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, data, nil
+}
+
+// finalize submits the CSR and downloads the chain. CreateOrderCert polls the
+// order by the Location of the finalize response, which is not sent by some
+// CAs such as pebble, so the order is polled by its URL in that case.
+func finalize(ctx context.Context, client *acme.Client, orderURL string, finalizeURL string, csr []byte) ([][]byte, error) {
+	der, _, err := client.CreateOrderCert(ctx, finalizeURL, csr, true)
+	if err == nil {
+		return der, nil
+	}
+	order, e := client.WaitOrder(ctx, orderURL)
+	if e != nil || order.Status != acme.StatusValid {
+		return nil, err
+	}
+	return client.FetchCert(ctx, order.CertURL, true)
+}
+
+// client registers the account or reuses the one in the cache.
+func (m *Manager) client(ctx context.Context) (*acme.Client, error) {
+	key, err := m.accountKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client := &acme.Client{
+		Key:          key,
+		DirectoryURL: m.opts.DirectoryURL,
+		HTTPClient:   m.opts.HTTPClient,
+		UserAgent:    "BitterJohn",
+	}
+	if _, err = client.Register(ctx, m.account(), acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("register the ACME account: %w", err)
+	}
+	return client, nil
+}
+
+func (m *Manager) accountKey(ctx context.Context) (crypto.Signer, error) {
+	if m.opts.Cache != nil {
+		data, err := m.opts.Cache.Get(ctx, accountKeyName)
+		if err == nil {
+			block, _ := pem.Decode(data)
+			if block == nil || block.Type != "EC PRIVATE KEY" {
+				return nil, fmt.Errorf("invalid cached ACME account key")
+			}
+			return x509.ParseECPrivateKey(block.Bytes)
+		}
+		if !errors.Is(err, autocert.ErrCacheMiss) {
+			return nil, err
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if m.opts.Cache != nil {
+		b, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
+		if err = m.opts.Cache.Put(ctx, accountKeyName, data); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+func (m *Manager) authorize(ctx context.Context, client *acme.Client, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("no dns-01 challenge is offered for %v", authz.Identifier.Value)
+	}
+	value, err := client.DNS01ChallengeRecord(challenge.Token)
+	if err != nil {
+		return err
+	}
+	fqdn := "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.") + "."
+	if err = m.opts.Provider.Present(ctx, fqdn, value); err != nil {
+		return fmt.Errorf("present the TXT record of %v: %w", fqdn, err)
+	}
+	defer func() {
+		// the context may be done
+		cleanCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := m.opts.Provider.CleanUp(cleanCtx, fqdn, value); err != nil {
+			log.Warn("cert_manager: failed to clean up the TXT record of %v: %v", fqdn, err)
+		}
+	}()
+	m.waitPropagation(ctx, fqdn, value)
+	if _, err = client.Accept(ctx, challenge); err != nil {
+		return err
+	}
+	_, err = client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+// waitPropagation waits for the TXT record to be visible to the resolver. The
+// challenge is accepted anyway after the timeout, since the resolver may see a
+// different view from the CA.
+func (m *Manager) waitPropagation(ctx context.Context, fqdn string, value string) {
+	if m.opts.PropagationTimeout < 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, m.opts.PropagationTimeout)
+	defer cancel()
+	ticker := time.NewTicker(propagationInterval)
+	defer ticker.Stop()
+	for {
+		txts, err := m.opts.Resolver.LookupTXT(ctx, fqdn)
+		if err == nil && slices.Contains(txts, value) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			log.Warn("cert_manager: the TXT record of %v is not visible after %v", fqdn, m.opts.PropagationTimeout)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// encodeCertificate encodes the key and the chain like autocert.
+func encodeCertificate(key *ecdsa.PrivateKey, der [][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err = pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}); err != nil {
+		return nil, err
+	}
+	for _, b := range der {
+		if err = pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: b}); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func parseCertificate(name string, data []byte) (*tls.Certificate, error) {
+	var keyPEM, certPEM []byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if strings.Contains(block.Type, "PRIVATE") {
+			keyPEM = pem.EncodeToMemory(block)
+		} else {
+			certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+		}
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if err = cert.Leaf.VerifyHostname(name); err != nil {
+		return nil, err
+	}
+	if now := time.Now(); now.After(cert.Leaf.NotAfter) || now.Before(cert.Leaf.NotBefore) {
+		return nil, fmt.Errorf("expired certificate")
+	}
+	return &cert, nil
+}
+
+func (m *Manager) account() *acme.Account {
+	account := &acme.Account{ExternalAccountBinding: m.opts.ExternalAccountBinding}
+	if m.opts.Email != "" {
+		account.Contact = []string{"mailto:" + m.opts.Email}
+	}
+	return account
+}
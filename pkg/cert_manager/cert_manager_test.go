@@ -0,0 +1,106 @@
+package cert_manager
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/acme_test_server"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/dns_provider/rfc2136"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const testDomain = "edge.example.test"
+
+func TestManagerIssuesByDNS01(t *testing.T) {
+	zone := acme_test_server.StartZone(t)
+	pebble := acme_test_server.StartPebble(t, acme_test_server.PebbleOptions{ResolverAddr: zone.Addr})
+	cache := autocert.DirCache(t.TempDir())
+	m := New(testOptions(t, zone, pebble, cache, nil))
+
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: testDomain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cert.Leaf.VerifyHostname(testDomain); err != nil {
+		t.Fatal(err)
+	}
+	if n := zone.TXTCount(); n != 0 {
+		t.Fatalf("%v TXT records left after issuing", n)
+	}
+	if _, err = m.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.test"}); err == nil {
+		t.Fatal("issued a certificate for a host out of the policy")
+	}
+
+	// a new manager loads the certificate from the cache
+	m = New(testOptions(t, zone, pebble, cache, nil))
+	cached, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: testDomain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) != 0 {
+		t.Fatal("the certificate was issued again instead of loaded from the cache")
+	}
+}
+
+func TestManagerRenewsInBackground(t *testing.T) {
+	zone := acme_test_server.StartZone(t)
+	pebble := acme_test_server.StartPebble(t, acme_test_server.PebbleOptions{
+		ResolverAddr: zone.Addr,
+		// less than RenewBefore
+		Validity: 10 * 24 * time.Hour,
+	})
+	cache := autocert.DirCache(t.TempDir())
+	renewed := make(chan struct{}, 1)
+	m := New(testOptions(t, zone, pebble, cache, func() {
+		renewed <- struct{}{}
+	}))
+
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: testDomain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the certificate in use is returned while renewing
+	again, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: testDomain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != cert {
+		t.Fatal("the certificate in use was not returned while renewing")
+	}
+	select {
+	case <-renewed:
+	case <-time.After(30 * time.Second):
+		t.Fatal("the certificate was not renewed")
+	}
+	renewedCert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: testDomain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewedCert.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) == 0 {
+		t.Fatal("the certificate was not replaced after renewal")
+	}
+}
+
+func testOptions(t *testing.T, zone *acme_test_server.Zone, pebble *acme_test_server.Pebble, cache autocert.Cache, onRenew func()) Options {
+	t.Helper()
+	provider, err := rfc2136.New(config.ACME{
+		RFC2136Nameserver: zone.Addr,
+		RFC2136TSIGKey:    acme_test_server.TSIGKey,
+		RFC2136TSIGSecret: acme_test_server.TSIGSecret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Options{
+		DirectoryURL:       pebble.DirectoryURL,
+		HTTPClient:         pebble.Client,
+		Provider:           provider,
+		Cache:              cache,
+		HostPolicy:         autocert.HostWhitelist(testDomain),
+		PropagationTimeout: 10 * time.Second,
+		Resolver:           zone.Resolver(),
+		OnRenew:            onRenew,
+	}
+}
@@ -0,0 +1,48 @@
+package congestion
+
+import (
+	"fmt"
+
+	"github.com/daeuniverse/outbound/protocol/tuic/congestion/bbr"
+	"github.com/daeuniverse/quic-go"
+	"github.com/daeuniverse/quic-go/congestion"
+)
+
+// Congestion control algorithms of QUIC connections.
+const (
+	AlgorithmBBR     = "bbr"
+	AlgorithmCubic   = "cubic"
+	AlgorithmNewReno = "new_reno"
+)
+
+// Validate checks the algorithm and the initial congestion window in packets.
+// Zero cwnd means the default one. The initial window of BBR is not
+// configurable.
+func Validate(algorithm string, cwnd int) error {
+	switch algorithm {
+	case AlgorithmBBR:
+		if cwnd != 0 {
+			return fmt.Errorf("the initial congestion window is not configurable for %v", algorithm)
+		}
+	case AlgorithmCubic, AlgorithmNewReno:
+		if cwnd < 0 || cwnd > congestion.MaxCongestionWindowPackets {
+			return fmt.Errorf("the initial congestion window should be between 0 and %v packets: %v", congestion.MaxCongestionWindowPackets, cwnd)
+		}
+	default:
+		return fmt.Errorf("unsupported congestion control: %v", algorithm)
+	}
+	return nil
+}
+
+// Use sets the congestion controller of the connection.
+func Use(conn quic.Connection, algorithm string, cwnd int) {
+	initialPacketSize := bbr.GetInitialPacketSize(conn.RemoteAddr())
+	switch algorithm {
+	case AlgorithmCubic:
+		conn.SetCongestionControl(NewCubicSender(initialPacketSize, cwnd, false))
+	case AlgorithmNewReno:
+		conn.SetCongestionControl(NewCubicSender(initialPacketSize, cwnd, true))
+	default:
+		conn.SetCongestionControl(bbr.NewBbrSender(bbr.DefaultClock{}, initialPacketSize))
+	}
+}
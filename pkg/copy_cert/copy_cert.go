@@ -9,7 +9,9 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"net"
 	"slices"
+	"time"
 )
 
 type certPair struct {
@@ -20,11 +22,13 @@ type certPair struct {
 	privPem    []byte
 }
 
-func getCertsFromNetwork(addr string) ([]*x509.Certificate, error) {
+// Fetch returns the certificate chain of the site at addr, like
+// github.com:443. The leaf comes first.
+func Fetch(addr string) ([]*x509.Certificate, error) {
 	conf := &tls.Config{
 		InsecureSkipVerify: false,
 	}
-	conn, err := tls.Dial("tcp", addr, conf)
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, conf)
 	if err != nil {
 		return nil, err
 	}
@@ -99,10 +103,16 @@ func makeCerts(originCerts []*x509.Certificate) ([]*certPair, error) {
 
 // addr is like github.com:443
 func Copy(addr string) (c []byte, k []byte, err error) {
-	certs, err := getCertsFromNetwork(addr)
+	certs, err := Fetch(addr)
 	if err != nil {
 		return nil, nil, err
 	}
+	return CopyChain(certs)
+}
+
+// CopyChain copies the chain given by Fetch with new keys. The serial numbers
+// and subjects are kept. It modifies the certificates in the chain.
+func CopyChain(certs []*x509.Certificate) (c []byte, k []byte, err error) {
 	newCerts, err := makeCerts(certs)
 	if err != nil {
 		return nil, nil, err
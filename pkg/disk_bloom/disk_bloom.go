@@ -1,8 +1,20 @@
 package disk_bloom
 
 import (
-	"github.com/mzz2017/disk-bloom"
+	"encoding/binary"
+	"fmt"
 	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"github.com/mzz2017/disk-bloom"
 )
 
 func doubleFNVFactory(salt []byte) func(b []byte) (uint64, uint64) {
@@ -20,12 +32,441 @@ func doubleFNVFactory(salt []byte) func(b []byte) (uint64, uint64) {
 }
 
 const (
-	n         = 1e8
-	expectFPR = 1e-6
+	filePrefix = "disk_bloom_"
+	// metadataSize is the same as that of disk_bloom.FilterGroup:
+	// |added entries(8)|expected max entries(8)|slots(1)|bits(8)|reserved(39)|
+	metadataSize = 64
+	// a bloom filter in memory larger than it is warned
+	largeMemoryFilter = 64 << 20
 )
 
-// NewBloom returns a bloom filter in the disk.
-// The filenames are generated by taking pattern and adding a index to the end. the Pattern should includes a "*", and the index replaces the last "*".
-func NewBloom(pattern string, salt []byte) (*disk_bloom.FilterGroup, error) {
-	return disk_bloom.NewGroup(pattern, disk_bloom.FsyncModeEverySec, n, expectFPR, doubleFNVFactory(salt))
+// Options configures the bloom filter.
+type Options struct {
+	// Dir is the directory of the filter files. The filters are in memory
+	// only if Dir is empty.
+	Dir string
+	// Capacity is the expected number of entries of a single filter. Another
+	// filter is added once it is full.
+	Capacity uint64
+	// FPR is the expected false positive rate of a single filter.
+	FPR   float64
+	Fsync disk_bloom.FsyncMode
+	// RotateInterval starts a new generation of filters every interval, and
+	// drops the generation before the previous one. Thus entries are
+	// remembered for one to two intervals. They are never dropped if
+	// RotateInterval is zero.
+	RotateInterval time.Duration
+	// LegacyDir is the directory of the filter files named disk_bloom_<index>
+	// by the former disk_bloom.FilterGroup. They are moved into Dir as the
+	// current generation, or removed if the filters are in memory.
+	LegacyDir string
+}
+
+// ParseFsyncMode parses always, everysec or no.
+func ParseFsyncMode(mode string) (disk_bloom.FsyncMode, error) {
+	switch strings.ToLower(mode) {
+	case "always":
+		return disk_bloom.FsyncModeAlways, nil
+	case "everysec", "":
+		return disk_bloom.FsyncModeEverySec, nil
+	case "no":
+		return disk_bloom.FsyncModeNo, nil
+	default:
+		return 0, fmt.Errorf("unknown fsync mode: %v", mode)
+	}
+}
+
+type filter interface {
+	Exist(b []byte) bool
+	ExistOrAdd(b []byte) bool
+	Close() error
+}
+
+type member struct {
+	filter filter
+	// filename is empty in memory
+	filename string
+	added    atomic.Uint64
+	expected uint64
+}
+
+// generation is the filters started at the same time, named by the unix time.
+type generation struct {
+	id      int64
+	members []*member
+}
+
+// Bloom is a group of bloom filters in the disk or in memory, rotated by
+// generations.
+type Bloom struct {
+	opts  Options
+	hash  func([]byte) (uint64, uint64)
+	slots uint8
+	bits  uint64
+
+	// mu guards generations and their members, and each filter has its own
+	// lock, so checks run concurrently except on rotations and additions.
+	mu sync.RWMutex
+	// generations has the current one last
+	generations []*generation
+}
+
+// NewBloom returns a bloom filter. The filters in opts.Dir are restored, and
+// the expired generations are removed.
+func NewBloom(opts Options, salt []byte) (*Bloom, error) {
+	if opts.Capacity == 0 {
+		return nil, fmt.Errorf("invalid capacity of the bloom filter: %v", opts.Capacity)
+	}
+	if opts.FPR <= 0 || opts.FPR >= 1 {
+		return nil, fmt.Errorf("invalid false positive rate of the bloom filter: %v", opts.FPR)
+	}
+	b := &Bloom{
+		opts: opts,
+		hash: doubleFNVFactory(salt),
+	}
+	b.slots, b.bits = disk_bloom.OptimalParam(opts.Capacity, opts.FPR)
+	if opts.Dir == "" && b.bits/8 > largeMemoryFilter {
+		log.Warn("Each bloom filter in memory takes %v MiB. Lower the capacity if it is too much.", b.bits/8>>20)
+	}
+	if opts.Dir != "" {
+		if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	if opts.LegacyDir != "" {
+		b.migrate(time.Now())
+	}
+	if opts.Dir != "" {
+		if err := b.load(); err != nil {
+			_ = b.Close()
+			return nil, err
+		}
+	}
+	if err := b.rotate(time.Now()); err != nil {
+		_ = b.Close()
+		return nil, err
+	}
+	current := b.generations[len(b.generations)-1]
+	if last := current.members[len(current.members)-1]; last.added.Load() >= last.expected {
+		if err := b.appendMember(current); err != nil {
+			_ = b.Close()
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// ExistOrAdd returns whether the entry was in the filter, and adds it to the
+// filter if it was not in.
+func (b *Bloom) ExistOrAdd(x []byte) bool {
+	now := time.Now()
+	b.mu.RLock()
+	due := b.rotateDue(now)
+	b.mu.RUnlock()
+	if due {
+		b.mu.Lock()
+		if err := b.rotate(now); err != nil {
+			log.Warn("Failed to rotate the bloom filter: %v", err)
+		}
+		b.mu.Unlock()
+	}
+
+	b.mu.RLock()
+	current := b.generations[len(b.generations)-1]
+	last := current.members[len(current.members)-1]
+	for _, g := range b.generations {
+		for _, m := range g.members {
+			if m != last && m.filter.Exist(x) {
+				b.mu.RUnlock()
+				return true
+			}
+		}
+	}
+	// the filter of last adds x only once among the concurrent calls
+	exist := last.filter.ExistOrAdd(x)
+	full := !exist && last.added.Add(1) >= last.expected
+	b.mu.RUnlock()
+	if full {
+		b.mu.Lock()
+		// others may have added one or rotated
+		if n := len(b.generations); n > 0 && b.generations[n-1] == current && current.members[len(current.members)-1] == last {
+			if err := b.appendMember(current); err != nil {
+				log.Warn("Failed to add a bloom filter: %v", err)
+			}
+		}
+		b.mu.Unlock()
+	}
+	return exist
+}
+
+// Close closes the filter files, which are kept for the next run.
+func (b *Bloom) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var err error
+	for _, g := range b.generations {
+		for _, m := range g.members {
+			if e := m.filter.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	b.generations = nil
+	return err
+}
+
+// rotateDue tells if the current generation has lasted for the interval, and
+// must be called with b.mu held.
+func (b *Bloom) rotateDue(now time.Time) bool {
+	n := len(b.generations)
+	if n == 0 {
+		return true
+	}
+	return b.opts.RotateInterval > 0 && now.Sub(time.Unix(b.generations[n-1].id, 0)) >= b.opts.RotateInterval
+}
+
+// rotate starts a new generation if it is due, and must be called with b.mu
+// held for writing unless in NewBloom.
+func (b *Bloom) rotate(now time.Time) error {
+	if !b.rotateDue(now) {
+		return nil
+	}
+	var keep []*generation
+	if n := len(b.generations); n > 0 {
+		start := time.Unix(b.generations[n-1].id, 0)
+		// the entries of the current one were added within an interval since
+		// it started
+		if now.Sub(start) < 2*b.opts.RotateInterval {
+			keep = b.generations[n-1:]
+		}
+	}
+	g := &generation{id: now.Unix()}
+	if err := b.appendMember(g); err != nil {
+		return err
+	}
+	b.drop(b.generations[:len(b.generations)-len(keep)])
+	b.generations = append(append([]*generation(nil), keep...), g)
+	return nil
+}
+
+func (b *Bloom) drop(generations []*generation) {
+	for _, g := range generations {
+		for _, m := range g.members {
+			_ = m.filter.Close()
+			if m.filename != "" {
+				if err := os.Remove(m.filename); err != nil {
+					log.Warn("Failed to remove the expired bloom filter: %v", err)
+				}
+			}
+		}
+	}
+}
+
+func (b *Bloom) filename(id int64, index int) string {
+	return filepath.Join(b.opts.Dir, fmt.Sprintf("%v%v_%v", filePrefix, id, index))
+}
+
+func (b *Bloom) appendMember(g *generation) error {
+	if b.opts.Dir == "" {
+		g.members = append(g.members, &member{
+			filter:   newMemoryFilter(b.slots, b.bits, b.hash),
+			expected: b.opts.Capacity,
+		})
+		return nil
+	}
+	m, err := b.openMember(b.filename(g.id, len(g.members)))
+	if err != nil {
+		return err
+	}
+	g.members = append(g.members, m)
+	return nil
+}
+
+// openMember opens the filter file, which is created if it does not exist.
+func (b *Bloom) openMember(filename string) (*member, error) {
+	m := &member{filename: filename}
+	// saved is only accessed before and in the sync goroutine of the filter
+	var saved uint64
+	f, err := disk_bloom.New(filename, disk_bloom.Controller{
+		Fsync:        b.opts.Fsync,
+		MetadataSize: metadataSize,
+		Control: func(f *os.File, _ bool) {
+			added := m.added.Load()
+			if added == saved {
+				return
+			}
+			var buf [8]byte
+			binary.LittleEndian.PutUint64(buf[:], added)
+			if _, err := f.WriteAt(buf[:], disk_bloom.LenOfMetadataSize); err == nil {
+				saved = added
+			}
+		},
+		GetParam: func(metadata []byte) (disk_bloom.FilterParam, []byte) {
+			if metadata == nil {
+				m.expected = b.opts.Capacity
+				return disk_bloom.FilterParam{Slots: b.slots, Bits: b.bits, Hash: b.hash}, disk_bloom.Metadata{
+					Expected: b.opts.Capacity,
+					Slots:    b.slots,
+					Bits:     b.bits,
+				}.Encode()
+			}
+			saved = binary.LittleEndian.Uint64(metadata[:8])
+			m.added.Store(saved)
+			m.expected = binary.LittleEndian.Uint64(metadata[8:16])
+			return disk_bloom.FilterParam{
+				Slots: metadata[16],
+				Bits:  binary.LittleEndian.Uint64(metadata[17:25]),
+				Hash:  b.hash,
+			}, nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", filename, err)
+	}
+	if p := f.FilterParam(); p.Slots == 0 || p.Bits == 0 {
+		_ = f.Close()
+		return nil, fmt.Errorf("%v: invalid metadata", filename)
+	}
+	m.filter = f
+	return m, nil
+}
+
+// migrate moves the legacy filter files into opts.Dir as the generation
+// started at now, which share the format and the hash with ours. The ones
+// failing to move are removed, lest they take up the disk forever.
+func (b *Bloom) migrate(now time.Time) {
+	var moved, removed int
+	for index := 0; ; index++ {
+		legacy := filepath.Join(b.opts.LegacyDir, filePrefix+strconv.Itoa(index))
+		if _, err := os.Stat(legacy); err != nil {
+			break
+		}
+		if b.opts.Dir != "" {
+			err := os.Rename(legacy, b.filename(now.Unix(), index))
+			if err == nil {
+				moved++
+				continue
+			}
+			log.Warn("Failed to migrate the legacy bloom filter: %v", err)
+		}
+		if err := os.Remove(legacy); err != nil {
+			log.Warn("Failed to remove the legacy bloom filter: %v", err)
+			continue
+		}
+		removed++
+	}
+	if moved > 0 {
+		log.Info("Migrated %v legacy bloom filter file(s) from %v to %v", moved, b.opts.LegacyDir, b.opts.Dir)
+	}
+	if removed > 0 {
+		log.Info("Removed %v legacy bloom filter file(s) in %v", removed, b.opts.LegacyDir)
+	}
+}
+
+// load opens the filter files in the directory. Only the current generation
+// and the previous one are kept, and rotate drops them if they have expired.
+func (b *Bloom) load() error {
+	entries, err := os.ReadDir(b.opts.Dir)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	seen := make(map[int64]struct{})
+	for _, entry := range entries {
+		name, ok := strings.CutPrefix(entry.Name(), filePrefix)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		strID, _, ok := strings.Cut(name, "_")
+		if !ok {
+			continue
+		}
+		id, err := strconv.ParseInt(strID, 10, 64)
+		if err != nil {
+			continue
+		}
+		if _, ok := seen[id]; !ok {
+			seen[id] = struct{}{}
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	for _, id := range ids {
+		g := &generation{id: id}
+		for index := 0; ; index++ {
+			filename := b.filename(id, index)
+			if _, err := os.Stat(filename); os.IsNotExist(err) {
+				break
+			}
+			m, err := b.openMember(filename)
+			if err != nil {
+				for _, m := range g.members {
+					_ = m.filter.Close()
+				}
+				return err
+			}
+			g.members = append(g.members, m)
+		}
+		if len(g.members) > 0 {
+			b.generations = append(b.generations, g)
+		}
+	}
+	if b.opts.RotateInterval > 0 && len(b.generations) > 2 {
+		b.drop(b.generations[:len(b.generations)-2])
+		b.generations = b.generations[len(b.generations)-2:]
+	}
+	return nil
+}
+
+// memoryFilter is a classic bloom filter in memory, hashing the same as
+// disk_bloom.DiskFilter.
+type memoryFilter struct {
+	mu    sync.Mutex
+	slots uint8
+	bits  uint64
+	set   []uint64
+	hash  func([]byte) (uint64, uint64)
+}
+
+func newMemoryFilter(slots uint8, bits uint64, hash func([]byte) (uint64, uint64)) *memoryFilter {
+	return &memoryFilter{
+		slots: slots,
+		bits:  bits,
+		set:   make([]uint64, (bits+63)/64),
+		hash:  hash,
+	}
+}
+
+func (f *memoryFilter) Exist(b []byte) bool {
+	x, y := f.hash(b)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := 0; i < int(f.slots); i++ {
+		offset := (x + uint64(i)*y) % f.bits
+		if f.set[offset/64]&(1<<(offset%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *memoryFilter) ExistOrAdd(b []byte) (exist bool) {
+	x, y := f.hash(b)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	exist = true
+	for i := 0; i < int(f.slots); i++ {
+		offset := (x + uint64(i)*y) % f.bits
+		if f.set[offset/64]&(1<<(offset%64)) == 0 {
+			exist = false
+			f.set[offset/64] |= 1 << (offset % 64)
+		}
+	}
+	return exist
+}
+
+func (f *memoryFilter) Close() error {
+	return nil
 }
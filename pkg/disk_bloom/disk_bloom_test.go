@@ -0,0 +1,153 @@
+package disk_bloom
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mzz2017/disk-bloom"
+)
+
+func TestBloomRestoredAfterRestart(t *testing.T) {
+	opts := Options{
+		Dir:      t.TempDir(),
+		Capacity: 10,
+		FPR:      1e-6,
+		Fsync:    disk_bloom.FsyncModeNo,
+	}
+	b, err := NewBloom(opts, []byte("salt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := byte(0); i < 25; i++ {
+		if b.ExistOrAdd([]byte{i}) {
+			t.Fatalf("%v is a false positive", i)
+		}
+	}
+	if n := len(b.generations[0].members); n != 3 {
+		t.Fatalf("got %v filters, want 3 for 25 entries", n)
+	}
+	if err = b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = NewBloom(opts, []byte("salt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	for i := byte(0); i < 25; i++ {
+		if !b.ExistOrAdd([]byte{i}) {
+			t.Fatalf("%v is forgotten after the restart", i)
+		}
+	}
+}
+
+func TestBloomRotation(t *testing.T) {
+	for _, dir := range []string{t.TempDir(), ""} {
+		opts := Options{
+			Dir:            dir,
+			Capacity:       1000,
+			FPR:            1e-6,
+			Fsync:          disk_bloom.FsyncModeNo,
+			RotateInterval: time.Hour,
+		}
+		b, err := NewBloom(opts, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Unix(b.generations[0].id, 0)
+		b.ExistOrAdd([]byte("old"))
+
+		// the previous generation is still checked
+		if err = b.rotate(start.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if !b.ExistOrAdd([]byte("old")) {
+			t.Fatalf("dir %q: the previous generation is forgotten", dir)
+		}
+		b.ExistOrAdd([]byte("new"))
+
+		// the one before the previous is dropped
+		if err = b.rotate(start.Add(2 * time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if len(b.generations) != 2 {
+			t.Fatalf("dir %q: got %v generations, want 2", dir, len(b.generations))
+		}
+		if !b.ExistOrAdd([]byte("new")) {
+			t.Fatalf("dir %q: the previous generation is forgotten", dir)
+		}
+		if dir != "" {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 2 {
+				t.Fatalf("got %v files, want 2 after dropping the expired one", len(entries))
+			}
+		}
+		_ = b.Close()
+	}
+}
+
+func TestBloomMigratesLegacyFiles(t *testing.T) {
+	legacy := t.TempDir()
+	g, err := disk_bloom.NewGroup(filepath.Join(legacy, "disk_bloom_*"), disk_bloom.FsyncModeNo, 10, 1e-6, doubleFNVFactory([]byte("salt")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := byte(0); i < 15; i++ {
+		g.ExistOrAdd([]byte{i})
+	}
+
+	b, err := NewBloom(Options{
+		Dir:       t.TempDir(),
+		Capacity:  10,
+		FPR:       1e-6,
+		Fsync:     disk_bloom.FsyncModeNo,
+		LegacyDir: legacy,
+	}, []byte("salt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	for i := byte(0); i < 15; i++ {
+		if !b.ExistOrAdd([]byte{i}) {
+			t.Fatalf("%v is forgotten after the migration", i)
+		}
+	}
+	if entries, _ := os.ReadDir(legacy); len(entries) != 0 {
+		t.Fatalf("got %v legacy files left, want 0", len(entries))
+	}
+}
+
+func TestBloomConcurrentExistOrAdd(t *testing.T) {
+	b, err := NewBloom(Options{Capacity: 50, FPR: 1e-6}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	var wg sync.WaitGroup
+	var added atomic.Int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// every goroutine adds the same entries
+			for j := 0; j < 200; j++ {
+				if !b.ExistOrAdd([]byte(strconv.Itoa(j))) {
+					added.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := added.Load(); n != 200 {
+		t.Fatalf("added %v entries, want 200", n)
+	}
+}
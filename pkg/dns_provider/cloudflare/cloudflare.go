@@ -0,0 +1,95 @@
+package cloudflare
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/dns_provider"
+)
+
+const recordTTL = 120
+
+func init() {
+	dns_provider.Register("cloudflare", New)
+}
+
+func New(conf config.ACME) (dns_provider.Provider, error) {
+	if conf.CloudflareAPIToken == "" {
+		return nil, fmt.Errorf("cloudflare: empty API token")
+	}
+	api, err := cloudflare.NewWithAPIToken(conf.CloudflareAPIToken)
+	if err != nil {
+		return nil, err
+	}
+	return NewWithAPI(api), nil
+}
+
+// NewWithAPI returns a provider using the Cloudflare API client.
+func NewWithAPI(api *cloudflare.API) *Cloudflare {
+	return &Cloudflare{
+		api:     api,
+		records: make(map[string]string),
+	}
+}
+
+type Cloudflare struct {
+	api *cloudflare.API
+	// mu protects records
+	mu sync.Mutex
+	// records maps the name and value to the zone and record IDs
+	records map[string]string
+}
+
+// zoneID finds the closest zone enclosing the name.
+func (c *Cloudflare) zoneID(name string) (string, error) {
+	fields := strings.Split(name, ".")
+	var err error
+	for i := 1; i < len(fields)-1; i++ {
+		var zoneID string
+		if zoneID, err = c.api.ZoneIDByName(strings.Join(fields[i:], ".")); err == nil {
+			return zoneID, nil
+		}
+	}
+	return "", fmt.Errorf("cloudflare: no zone found for %v: %w", name, err)
+}
+
+func (c *Cloudflare) Present(ctx context.Context, fqdn string, value string) error {
+	name := strings.TrimSuffix(fqdn, ".")
+	zoneID, err := c.zoneID(name)
+	if err != nil {
+		return err
+	}
+	resp, err := c.api.CreateDNSRecord(ctx, zoneID, cloudflare.DNSRecord{
+		Type:    "TXT",
+		Name:    name,
+		Content: value,
+		TTL:     recordTTL,
+	})
+	if err != nil {
+		return fmt.Errorf("cloudflare: create TXT record for %v: %w", name, err)
+	}
+	c.mu.Lock()
+	c.records[name+" "+value] = zoneID + "/" + resp.Result.ID
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Cloudflare) CleanUp(ctx context.Context, fqdn string, value string) error {
+	name := strings.TrimSuffix(fqdn, ".")
+	c.mu.Lock()
+	ids, ok := c.records[name+" "+value]
+	delete(c.records, name+" "+value)
+	c.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("cloudflare: unknown TXT record for %v", name)
+	}
+	zoneID, recordID, _ := strings.Cut(ids, "/")
+	if err := c.api.DeleteDNSRecord(ctx, zoneID, recordID); err != nil {
+		return fmt.Errorf("cloudflare: delete TXT record for %v: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package dns_provider
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+)
+
+// Provider publishes the TXT records of ACME dns-01 challenges.
+type Provider interface {
+	// Present creates the TXT record with the value at the fully qualified
+	// domain name, such as "_acme-challenge.example.com.".
+	Present(ctx context.Context, fqdn string, value string) error
+	// CleanUp removes the TXT record created by Present.
+	CleanUp(ctx context.Context, fqdn string, value string) error
+}
+
+type Creator func(conf config.ACME) (Provider, error)
+
+var providerMapping = make(map[string]Creator)
+
+func Register(name string, creator Creator) {
+	providerMapping[name] = creator
+}
+
+func New(name string, conf config.ACME) (Provider, error) {
+	creator, ok := providerMapping[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported DNS provider: %v", strconv.Quote(name))
+	}
+	return creator(conf)
+}
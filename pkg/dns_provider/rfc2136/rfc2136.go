@@ -0,0 +1,123 @@
+package rfc2136
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/dns_provider"
+	"github.com/miekg/dns"
+)
+
+const (
+	recordTTL = 120
+	tsigFudge = 300
+)
+
+var tsigAlgorithms = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+func init() {
+	dns_provider.Register("rfc2136", New)
+}
+
+// RFC2136 publishes records by dynamic updates (RFC 2136) to the primary name
+// server of the zone, which are signed by TSIG (RFC 8945) if a key is given.
+type RFC2136 struct {
+	nameserver    string
+	tsigKey       string
+	tsigAlgorithm string
+	client        *dns.Client
+}
+
+func New(conf config.ACME) (dns_provider.Provider, error) {
+	nameserver := conf.RFC2136Nameserver
+	if nameserver == "" {
+		return nil, fmt.Errorf("rfc2136: empty name server")
+	}
+	if _, _, err := net.SplitHostPort(nameserver); err != nil {
+		nameserver = net.JoinHostPort(nameserver, "53")
+	}
+	r := &RFC2136{
+		nameserver: nameserver,
+		client:     &dns.Client{Timeout: 10 * time.Second},
+	}
+	if conf.RFC2136TSIGKey != "" {
+		algorithm := conf.RFC2136TSIGAlgorithm
+		if algorithm == "" {
+			algorithm = "hmac-sha256"
+		}
+		var ok bool
+		if r.tsigAlgorithm, ok = tsigAlgorithms[strings.TrimSuffix(strings.ToLower(algorithm), ".")]; !ok {
+			return nil, fmt.Errorf("rfc2136: unsupported TSIG algorithm: %v", algorithm)
+		}
+		if conf.RFC2136TSIGSecret == "" {
+			return nil, fmt.Errorf("rfc2136: empty TSIG secret")
+		}
+		r.tsigKey = dns.Fqdn(conf.RFC2136TSIGKey)
+		r.client.TsigSecret = map[string]string{r.tsigKey: conf.RFC2136TSIGSecret}
+	}
+	return r, nil
+}
+
+func (r *RFC2136) Present(ctx context.Context, fqdn string, value string) error {
+	return r.update(ctx, fqdn, value, true)
+}
+
+func (r *RFC2136) CleanUp(ctx context.Context, fqdn string, value string) error {
+	return r.update(ctx, fqdn, value, false)
+}
+
+func (r *RFC2136) update(ctx context.Context, fqdn string, value string, insert bool) error {
+	fqdn = dns.Fqdn(fqdn)
+	zone, err := r.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	rr := &dns.TXT{
+		Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: recordTTL},
+		Txt: []string{value},
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(zone)
+	if insert {
+		m.Insert([]dns.RR{rr})
+	} else {
+		m.Remove([]dns.RR{rr})
+	}
+	if r.tsigKey != "" {
+		m.SetTsig(r.tsigKey, r.tsigAlgorithm, tsigFudge, time.Now().Unix())
+	}
+	resp, _, err := r.client.ExchangeContext(ctx, m, r.nameserver)
+	if err != nil {
+		return fmt.Errorf("rfc2136: update %v: %w", fqdn, err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("rfc2136: update %v: %v", fqdn, dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
+
+// zone asks the name server for the SOA enclosing the name.
+func (r *RFC2136) zone(ctx context.Context, fqdn string) (string, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(fqdn, dns.TypeSOA)
+	resp, _, err := r.client.ExchangeContext(ctx, m, r.nameserver)
+	if err != nil {
+		return "", fmt.Errorf("rfc2136: query SOA of %v: %w", fqdn, err)
+	}
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns} {
+		for _, rr := range rrs {
+			if soa, ok := rr.(*dns.SOA); ok {
+				return soa.Hdr.Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("rfc2136: no SOA found for %v", fqdn)
+}
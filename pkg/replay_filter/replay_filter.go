@@ -0,0 +1,244 @@
+package replay_filter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	cuckoo "github.com/seiflotfy/cuckoofilter"
+)
+
+const capacity = 100000
+
+var magic = [4]byte{'B', 'J', 'R', 'F'}
+
+const version = 1
+
+// Filter checks for replays by two cuckoo filters swapped every interval like
+// that of v2ray, and records are remembered for one to two intervals. Unlike
+// that of v2ray, it can be saved to a file and restored after restarts.
+type Filter struct {
+	mu       sync.Mutex
+	poolA    *cuckoo.Filter
+	poolB    *cuckoo.Filter
+	poolSwap bool
+	lastSwap int64
+	interval int64
+	// restored tells if the records are complete since the last run, which
+	// means it was saved on shutdown.
+	restored bool
+	// sealed is set by the final save, after which nothing is recorded, lest
+	// the saved records be incomplete.
+	sealed bool
+
+	path      string
+	closed    chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// New returns a filter in memory, and records expire after the interval in
+// seconds.
+func New(interval int64) *Filter {
+	return &Filter{
+		poolA:    cuckoo.NewFilter(capacity),
+		poolB:    cuckoo.NewFilter(capacity),
+		lastSwap: time.Now().Unix(),
+		interval: interval,
+		closed:   make(chan struct{}),
+	}
+}
+
+// Open restores the filter from path if it exists, and saves it back every
+// saveInterval and on Close. It is never saved periodically if saveInterval
+// is zero.
+func Open(path string, interval int64, saveInterval time.Duration) (*Filter, error) {
+	f, err := load(path, interval)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Warn("Failed to restore the replay filter, and start with an empty one: %v", err)
+		}
+		f = New(interval)
+	}
+	f.path = path
+	// the next run is complete only if it saves on shutdown
+	if err = f.save(false); err != nil {
+		return nil, err
+	}
+	if saveInterval > 0 {
+		f.done = make(chan struct{})
+		go f.run(saveInterval)
+	}
+	return f, nil
+}
+
+// Interval returns the expiration time of records in seconds.
+func (f *Filter) Interval() int64 {
+	return f.interval
+}
+
+// Restored tells if the filter has restored all the records of the last run.
+// Otherwise, the records between the last save and the crash are lost.
+func (f *Filter) Restored() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.restored
+}
+
+// Check returns false if sum is a replay, and records it otherwise. It
+// always returns false after Close.
+func (f *Filter) Check(sum []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.sealed {
+		return false
+	}
+	f.swap(time.Now().Unix())
+	return f.poolA.InsertUnique(sum) && f.poolB.InsertUnique(sum)
+}
+
+// swap must be called with f.mu held.
+func (f *Filter) swap(now int64) {
+	elapsed := now - f.lastSwap
+	if elapsed < f.interval {
+		return
+	}
+	if elapsed >= 2*f.interval {
+		// both have expired
+		f.poolA.Reset()
+		f.poolB.Reset()
+	} else if f.poolSwap {
+		f.poolA.Reset()
+	} else {
+		f.poolB.Reset()
+	}
+	f.poolSwap = !f.poolSwap
+	f.lastSwap = now
+}
+
+// Close stops the periodic saves and saves the filter for the next run.
+func (f *Filter) Close() error {
+	var err error
+	f.closeOnce.Do(func() {
+		close(f.closed)
+		if f.done != nil {
+			<-f.done
+		}
+		if f.path != "" {
+			err = f.save(true)
+		}
+	})
+	return err
+}
+
+func (f *Filter) run(saveInterval time.Duration) {
+	defer close(f.done)
+	ticker := time.NewTicker(saveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.closed:
+			return
+		case <-ticker.C:
+			if err := f.save(false); err != nil {
+				log.Warn("Failed to save the replay filter: %v", err)
+			}
+		}
+	}
+}
+
+// save writes the filter to a temporary file and renames it to the path, lest
+// a crash leave a broken one.
+func (f *Filter) save(complete bool) error {
+	var buf bytes.Buffer
+	f.mu.Lock()
+	buf.Write(magic[:])
+	buf.WriteByte(version)
+	var flags byte
+	if complete {
+		flags |= 1
+		f.sealed = true
+	}
+	if f.poolSwap {
+		flags |= 2
+	}
+	buf.WriteByte(flags)
+	_ = binary.Write(&buf, binary.BigEndian, f.lastSwap)
+	for _, pool := range []*cuckoo.Filter{f.poolA, f.poolB} {
+		b := pool.Encode()
+		_ = binary.Write(&buf, binary.BigEndian, uint32(len(b)))
+		buf.Write(b)
+	}
+	f.mu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(buf.Bytes()); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+func load(path string, interval int64) (*Filter, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(b)
+	var header struct {
+		Magic    [4]byte
+		Version  uint8
+		Flags    uint8
+		LastSwap int64
+	}
+	if err = binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	if header.Magic != magic || header.Version != version {
+		return nil, fmt.Errorf("%v: unknown format", path)
+	}
+	var pools [2]*cuckoo.Filter
+	for i := range pools {
+		var n uint32
+		if err = binary.Read(r, binary.BigEndian, &n); err != nil {
+			return nil, fmt.Errorf("%v: %w", path, err)
+		}
+		p := make([]byte, n)
+		if _, err = io.ReadFull(r, p); err != nil {
+			return nil, fmt.Errorf("%v: %w", path, err)
+		}
+		if pools[i], err = cuckoo.Decode(p); err != nil {
+			return nil, fmt.Errorf("%v: %w", path, err)
+		}
+	}
+	f := &Filter{
+		poolA:    pools[0],
+		poolB:    pools[1],
+		poolSwap: header.Flags&2 != 0,
+		lastSwap: header.LastSwap,
+		interval: interval,
+		restored: header.Flags&1 != 0,
+		closed:   make(chan struct{}),
+	}
+	// drop the expired ones
+	f.swap(time.Now().Unix())
+	return f, nil
+}
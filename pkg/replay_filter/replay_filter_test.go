@@ -0,0 +1,82 @@
+package replay_filter
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFilterRestoredAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replay_filter")
+	f, err := Open(path, 120, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Restored() {
+		t.Fatal("restored without a file")
+	}
+	if !f.Check([]byte("first")) || f.Check([]byte("first")) {
+		t.Fatal("the replay is not rejected")
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if f.Check([]byte("late")) {
+		t.Fatal("recorded after the final save")
+	}
+
+	// shut down gracefully
+	f, err = Open(path, 120, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Restored() {
+		t.Fatal("not restored after a graceful shutdown")
+	}
+	if f.Check([]byte("first")) {
+		t.Fatal("the replay is accepted after the restart")
+	}
+	if !f.Check([]byte("second")) {
+		t.Fatal("a new one is rejected")
+	}
+
+	// crash after the periodic save
+	if err = f.save(false); err != nil {
+		t.Fatal(err)
+	}
+	f, err = Open(path, 120, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Restored() {
+		t.Fatal("restored completely after a crash")
+	}
+	if f.Check([]byte("second")) {
+		t.Fatal("the saved one is accepted after the crash")
+	}
+	_ = f.Close()
+}
+
+func TestFilterExpiresWhileStopped(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replay_filter")
+	f, err := Open(path, 120, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Check([]byte("old"))
+	f.mu.Lock()
+	f.lastSwap = time.Now().Add(-5 * time.Minute).Unix()
+	f.mu.Unlock()
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = Open(path, 120, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if !f.Check([]byte("old")) {
+		t.Fatal("the expired one is still remembered")
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMEDirectories are the directory URLs of well-known CAs by name.
+var ACMEDirectories = map[string]string{
+	"letsencrypt":         acme.LetsEncryptURL,
+	"letsencrypt-staging": "https://acme-staging-v02.api.letsencrypt.org/directory",
+	"zerossl":             "https://acme.zerossl.com/v2/DV90",
+	"google":              "https://dv.acme-v02.api.pki.goog/directory",
+	"buypass":             "https://api.buypass.com/acme/directory",
+}
+
+// acmeCA is a CA to request certificates from.
+type acmeCA struct {
+	directoryURL string
+	// eab is nil if the CA does not require External Account Binding
+	eab *acme.ExternalAccountBinding
+}
+
+// acmeCAs returns the directory in the config and then the fallbacks. The EAB
+// in the config is for the first one.
+func acmeCAs(conf config.ACME) ([]acmeCA, error) {
+	directories := []string{conf.Directory}
+	for _, d := range strings.Split(conf.FallbackDirectories, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			directories = append(directories, d)
+		}
+	}
+	cas := make([]acmeCA, 0, len(directories))
+	for _, d := range directories {
+		directoryURL, err := parseACMEDirectory(d)
+		if err != nil {
+			return nil, err
+		}
+		cas = append(cas, acmeCA{directoryURL: directoryURL})
+	}
+	if (conf.EABKeyID == "") != (conf.EABHMACKey == "") {
+		return nil, fmt.Errorf("eabKeyID and eabHMACKey must be given together")
+	}
+	if conf.EABKeyID != "" {
+		// CAs give the key in base64url, with or without the padding
+		key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(conf.EABHMACKey, "="))
+		if err != nil {
+			return nil, fmt.Errorf("invalid eabHMACKey: %w", err)
+		}
+		cas[0].eab = &acme.ExternalAccountBinding{KID: conf.EABKeyID, Key: key}
+	}
+	return cas, nil
+}
+
+func parseACMEDirectory(d string) (string, error) {
+	d = strings.TrimSpace(d)
+	if d == "" {
+		return acme.LetsEncryptURL, nil
+	}
+	if u, ok := ACMEDirectories[strings.ToLower(d)]; ok {
+		return u, nil
+	}
+	u, err := url.Parse(d)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return "", fmt.Errorf("invalid ACME directory: %v", strconv.Quote(d))
+	}
+	return d, nil
+}
+
+// acmeCache returns the cache of the ACME accounts and certificates, which is
+// the tls directory in the data dir by default.
+func acmeCache(conf config.ACME) (autocert.DirCache, error) {
+	if conf.CacheDir != "" {
+		dir, err := filepath.Abs(conf.CacheDir)
+		if err != nil {
+			return "", err
+		}
+		return autocert.DirCache(dir), nil
+	}
+	dir, err := config.DataFile("tls")
+	if err != nil {
+		return "", err
+	}
+	// Reuse the cache of earlier versions in the working directory, lest the
+	// certificates be issued again and hit the rate limits.
+	if _, err = os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		if info, err := os.Stat("tls"); err == nil && info.IsDir() {
+			legacy, err := filepath.Abs("tls")
+			if err == nil {
+				log.Warn("Using the ACME cache %v in the working directory. Move it to %v or set acme.cacheDir.", legacy, dir)
+				return autocert.DirCache(legacy), nil
+			}
+		}
+	}
+	return autocert.DirCache(dir), nil
+}
+
+// fallbackCertificateGetter tries the getters of the CAs in order.
+func fallbackCertificateGetter(sni string, cas []acmeCA, getters []CertificateGetter) CertificateGetter {
+	if len(getters) == 1 {
+		return getters[0]
+	}
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if !strings.EqualFold(strings.TrimSuffix(hello.ServerName, "."), sni) {
+			// refused by the host policy anyway
+			return getters[0](hello)
+		}
+		var errs []error
+		for i, getCertificate := range getters {
+			cert, err := getCertificate(hello)
+			if err == nil {
+				return cert, nil
+			}
+			errs = append(errs, fmt.Errorf("%v: %w", cas[i].directoryURL, err))
+			if i+1 < len(getters) && !IsACMETLSALPNHello(hello) {
+				log.Warn("Failed to get the certificate for %v from %v: %v. Trying %v.", sni, cas[i].directoryURL, err, cas[i+1].directoryURL)
+			}
+		}
+		return nil, errors.Join(errs...)
+	}
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"golang.org/x/crypto/acme"
+)
+
+func TestACMECAs(t *testing.T) {
+	cas, err := acmeCAs(config.ACME{
+		Directory:           "zerossl",
+		FallbackDirectories: " letsencrypt, https://ca.example.com/directory ,",
+		EABKeyID:            "kid",
+		EABHMACKey:          "c2VjcmV0LWtleQ==",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{ACMEDirectories["zerossl"], acme.LetsEncryptURL, "https://ca.example.com/directory"}
+	if len(cas) != len(want) {
+		t.Fatalf("got %d CAs, want %d", len(cas), len(want))
+	}
+	for i := range want {
+		if cas[i].directoryURL != want[i] {
+			t.Fatalf("CA %d = %v, want %v", i, cas[i].directoryURL, want[i])
+		}
+	}
+	if cas[0].eab == nil || cas[0].eab.KID != "kid" || string(cas[0].eab.Key) != "secret-key" {
+		t.Fatalf("unexpected EAB of the directory: %+v", cas[0].eab)
+	}
+	if cas[1].eab != nil || cas[2].eab != nil {
+		t.Fatal("EAB is used with the fallbacks")
+	}
+
+	cas, err = acmeCAs(config.ACME{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cas) != 1 || cas[0].directoryURL != acme.LetsEncryptURL {
+		t.Fatalf("unexpected default CAs: %+v", cas)
+	}
+
+	for _, conf := range []config.ACME{
+		{Directory: "unknown"},
+		{Directory: "http://ca.example.com/directory"},
+		{FallbackDirectories: "letsencrypt,ftp://ca.example.com"},
+		{EABKeyID: "kid"},
+		{EABHMACKey: "c2VjcmV0LWtleQ"},
+		{EABKeyID: "kid", EABHMACKey: "not base64!"},
+	} {
+		if _, err = acmeCAs(conf); err == nil {
+			t.Fatalf("%+v: expected an error", conf)
+		}
+	}
+}
+
+func TestACMECacheIsAbsolute(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := acmeCache(config.ACME{CacheDir: "tls-cache"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cache) != filepath.Join(wd, "tls-cache") {
+		t.Fatalf("cache = %v, want %v", cache, filepath.Join(wd, "tls-cache"))
+	}
+	if cache, err = acmeCache(config.ACME{}); err != nil {
+		t.Fatal(err)
+	}
+	if !filepath.IsAbs(string(cache)) {
+		t.Fatalf("cache %v is not absolute", cache)
+	}
+}
+
+func TestFallbackCertificateGetterTriesCAsInOrder(t *testing.T) {
+	expected := &tls.Certificate{}
+	var calls []int
+	getters := []CertificateGetter{
+		func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			calls = append(calls, 0)
+			return nil, errors.New("rate limited")
+		},
+		func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			calls = append(calls, 1)
+			return expected, nil
+		},
+		func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			calls = append(calls, 2)
+			return nil, errors.New("unreachable")
+		},
+	}
+	cas := []acmeCA{{directoryURL: "https://a.example"}, {directoryURL: "https://b.example"}, {directoryURL: "https://c.example"}}
+	getCertificate := fallbackCertificateGetter("edge.example.com", cas, getters)
+
+	cert, err := getCertificate(&tls.ClientHelloInfo{ServerName: "edge.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert != expected {
+		t.Fatal("unexpected certificate")
+	}
+	if len(calls) != 2 || calls[0] != 0 || calls[1] != 1 {
+		t.Fatalf("calls = %v, want [0 1]", calls)
+	}
+
+	// other names are refused by the first CA without trying the others
+	calls = nil
+	if _, err = getCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil {
+		t.Fatal("expected an error for another name")
+	}
+	if len(calls) != 1 {
+		t.Fatalf("calls = %v, want [0]", calls)
+	}
+}
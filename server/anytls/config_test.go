@@ -3,6 +3,7 @@ package anytls
 import (
 	"crypto/sha256"
 	"errors"
+	"io"
 	"net"
 	"testing"
 
@@ -128,10 +129,12 @@ func authPassword(t *testing.T, srv *Server, password string) (*Passage, error)
 	writeErr := make(chan error, 1)
 	go func() {
 		defer clientConn.Close()
-		writeErr <- writeClientAuth(clientConn, sha256.Sum256([]byte(password)))
+		writeErr <- writeClientAuth(clientConn, sha256.Sum256([]byte(password)), 0)
 	}()
 
 	passage, err := srv.auth(serverConn)
+	// auth stops reading as soon as the password hash cannot match
+	_, _ = io.Copy(io.Discard, serverConn)
 	_ = serverConn.Close()
 	if err := <-writeErr; err != nil {
 		t.Fatal(err)
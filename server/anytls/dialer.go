@@ -30,7 +30,10 @@ type Dialer struct {
 	proxyAddress string
 	nextDialer   netproxy.Dialer
 	tlsConfig    *tls.Config
+	fingerprint  string
 	passwordHash [sha256.Size]byte
+	// paddings keeps the padding schemes pushed by the servers
+	paddings *paddingSchemeStore
 
 	mu      sync.Mutex
 	session *Session
@@ -53,11 +56,17 @@ func NewDialer(nextDialer netproxy.Dialer, header protocol.Header) (netproxy.Dia
 	if tlsConfig.ServerName == "" && header.SNI != "" {
 		tlsConfig.ServerName = header.SNI
 	}
+	fingerprint, err := bjserver.Fingerprint(header.Cipher)
+	if err != nil {
+		return nil, err
+	}
 	return &Dialer{
 		proxyAddress: header.ProxyAddress,
 		nextDialer:   nextDialer,
 		tlsConfig:    tlsConfig,
+		fingerprint:  fingerprint,
 		passwordHash: sha256.Sum256([]byte(header.Password)),
+		paddings:     pushedPaddingSchemes,
 	}, nil
 }
 
@@ -169,16 +178,23 @@ func (d *Dialer) getSession(ctx context.Context) (*Session, error) {
 	if err != nil {
 		return nil, err
 	}
-	tlsConn := tls.Client(asNetConn(rawConn), d.tlsConfig)
+	tlsConn, err := bjserver.TLSClient(asNetConn(rawConn), d.tlsConfig, d.fingerprint)
+	if err != nil {
+		_ = rawConn.Close()
+		return nil, err
+	}
 	if err := tlsConn.HandshakeContext(ctx); err != nil {
 		_ = tlsConn.Close()
 		return nil, err
 	}
-	if err := writeClientAuth(tlsConn, d.passwordHash); err != nil {
+	padding := d.paddings.load(d.proxyAddress)
+	if err := writeClientAuth(tlsConn, d.passwordHash, padding.authPaddingLen()); err != nil {
 		_ = tlsConn.Close()
 		return nil, err
 	}
-	session := newClientSession(tlsConn)
+	session := newClientSession(tlsConn, padding, func(p *paddingScheme) {
+		d.paddings.store(d.proxyAddress, p)
+	})
 	if err := session.runClient(); err != nil {
 		_ = tlsConn.Close()
 		return nil, err
@@ -187,11 +203,11 @@ func (d *Dialer) getSession(ctx context.Context) (*Session, error) {
 	return session, nil
 }
 
-func writeClientAuth(w io.Writer, passwordHash [sha256.Size]byte) error {
-	var header [sha256.Size + 2]byte
-	copy(header[:sha256.Size], passwordHash[:])
-	binary.BigEndian.PutUint16(header[sha256.Size:], 0)
-	_, err := w.Write(header[:])
+func writeClientAuth(w io.Writer, passwordHash [sha256.Size]byte, paddingLen int) error {
+	b := make([]byte, sha256.Size+2+paddingLen)
+	copy(b[:sha256.Size], passwordHash[:])
+	binary.BigEndian.PutUint16(b[sha256.Size:], uint16(paddingLen))
+	_, err := w.Write(b)
 	return err
 }
 
@@ -0,0 +1,129 @@
+package anytls
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+)
+
+// newFallback reverse proxies the site of rawURL, or serves the decoy page if
+// rawURL is empty.
+func newFallback(rawURL string) (http.Handler, error) {
+	if rawURL == "" {
+		return http.HandlerFunc(server.ServeDecoy), nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse anytls fallback: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("parse anytls fallback: unsupported scheme %v", strconv.Quote(u.Scheme))
+	}
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(u)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Debug("anytls fallback: %v", err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}, nil
+}
+
+// handleFallback serves HTTP over the decrypted connection that failed the
+// authentication, so that the server looks like an ordinary website to active
+// probes.
+func (s *Server) handleFallback(conn net.Conn, authErr error) error {
+	log.Debug("anytls: serve the fallback for %v: %v", conn.RemoteAddr().String(), authErr)
+	ln := newSingleConnListener(conn)
+	srv := &http.Server{
+		Handler:           s.fallback,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       server.DefaultNatTimeout,
+	}
+	_ = srv.Serve(ln)
+	return nil
+}
+
+// rewindConn records what is read during the authentication, which can be
+// read again by the fallback.
+type rewindConn struct {
+	net.Conn
+	recorded  []byte
+	recording bool
+	rewound   bool
+}
+
+func (c *rewindConn) Read(b []byte) (int, error) {
+	if c.rewound && len(c.recorded) > 0 {
+		n := copy(b, c.recorded)
+		c.recorded = c.recorded[n:]
+		return n, nil
+	}
+	n, err := c.Conn.Read(b)
+	if c.recording {
+		c.recorded = append(c.recorded, b[:n]...)
+	}
+	return n, err
+}
+
+func (c *rewindConn) stopRecording() {
+	c.recording = false
+	c.recorded = nil
+}
+
+func (c *rewindConn) rewind() {
+	c.recording = false
+	c.rewound = true
+}
+
+// singleConnListener accepts only conn, and is closed after conn is closed.
+type singleConnListener struct {
+	conn     net.Conn
+	accepted bool
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	return &singleConnListener{conn: conn, closed: make(chan struct{})}
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	if !l.accepted {
+		l.accepted = true
+		return &closeNotifyConn{Conn: l.conn, l: l}, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *singleConnListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+type closeNotifyConn struct {
+	net.Conn
+	l *singleConnListener
+}
+
+func (c *closeNotifyConn) Close() error {
+	err := c.Conn.Close()
+	_ = c.l.Close()
+	return err
+}
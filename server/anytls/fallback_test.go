@@ -0,0 +1,101 @@
+package anytls
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/daeuniverse/outbound/protocol/direct"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
+)
+
+func startFallbackServer(t *testing.T, fallback string) (addr string, closeFn func()) {
+	t.Helper()
+	srv, err := New(testTLSContext(t), direct.SymmetricDirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.(*Server).fallback, err = newFallback(fallback); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.AddPassages([]server.Passage{{
+		Passage: model.Passage{
+			In: model.In{Argument: model.Argument{
+				Protocol: "anytls",
+				Password: "secret-password",
+			}},
+		},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	lt, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = srv.(*Server).serveListener(lt)
+	}()
+	return lt.Addr().String(), func() {
+		_ = srv.Close()
+		_ = lt.Close()
+	}
+}
+
+func fallbackGet(t *testing.T, addr string) (*http.Response, string) {
+	t.Helper()
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get("https://" + addr + "/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestServerFallbackServesDecoy(t *testing.T) {
+	addr, closeFn := startFallbackServer(t, "")
+	defer closeFn()
+
+	resp, body := fallbackGet(t, addr)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %v, want %v", resp.StatusCode, http.StatusOK)
+	}
+	if body != server.DecoyPage {
+		t.Fatalf("body = %q, want the decoy page", body)
+	}
+}
+
+func TestServerFallbackProxiesBackend(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "backend "+r.URL.Path)
+	}))
+	defer backend.Close()
+
+	addr, closeFn := startFallbackServer(t, backend.URL)
+	defer closeFn()
+
+	resp, body := fallbackGet(t, addr)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %v, want %v", resp.StatusCode, http.StatusOK)
+	}
+	if want := "backend /index.html"; body != want {
+		t.Fatalf("body = %q, want %q", body, want)
+	}
+}
+
+func TestNewFallbackRejectsUnsupportedScheme(t *testing.T) {
+	if _, err := newFallback("ftp://example.com"); err == nil {
+		t.Fatal("newFallback accepted an ftp URL")
+	}
+}
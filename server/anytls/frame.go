@@ -50,6 +50,20 @@ func readFrame(r io.Reader) (frame, error) {
 	return f, nil
 }
 
+func appendFrame(b []byte, f frame) []byte {
+	b = append(b, f.cmd)
+	b = binary.BigEndian.AppendUint32(b, f.streamID)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(f.data)))
+	return append(b, f.data...)
+}
+
+// appendWasteFrame appends a cmdWaste frame taking up size bytes with its
+// header, or more if size is too small for a header.
+func appendWasteFrame(b []byte, size int) []byte {
+	dataLen := min(max(size-frameHeaderLen, 0), maxFrameData)
+	return appendFrame(b, frame{cmd: cmdWaste, data: make([]byte, dataLen)})
+}
+
 func writeFrame(w io.Writer, f frame) error {
 	if len(f.data) > maxFrameData {
 		return fmt.Errorf("frame data too large: %d", len(f.data))
@@ -12,12 +12,13 @@ import (
 	"github.com/daeuniverse/outbound/netproxy"
 	"github.com/daeuniverse/outbound/protocol"
 	"github.com/daeuniverse/outbound/protocol/direct"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/internal/testutil"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
 )
 
 func TestDialerRelaysTCPThroughServer(t *testing.T) {
-	echoAddr, closeEcho := startEchoServer(t)
+	echoAddr, closeEcho := testutil.StartEchoServer(t)
 	defer closeEcho()
 
 	srv, err := New(testTLSContext(t), direct.SymmetricDirect)
@@ -74,7 +75,7 @@ func TestDialerRelaysTCPThroughServer(t *testing.T) {
 }
 
 func TestDialerRelaysUDPThroughServer(t *testing.T) {
-	udpAddr, closeUDP := startUDPEchoServer(t)
+	udpAddr, closeUDP := testutil.StartUDPEchoServer(t)
 	defer closeUDP()
 
 	srv, err := New(testTLSContext(t), direct.SymmetricDirect)
@@ -135,6 +136,70 @@ func TestDialerRelaysUDPThroughServer(t *testing.T) {
 	}
 }
 
+func TestServerRelaysUOTPacketMode(t *testing.T) {
+	reflectorA, closeA := startUDPReflector(t)
+	defer closeA()
+	reflectorB, closeB := startUDPReflector(t)
+	defer closeB()
+
+	srv, err := New(testTLSContext(t), direct.FullconeDirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	if err := srv.AddPassages([]server.Passage{anyTLSPassage("secret-password")}); err != nil {
+		t.Fatal(err)
+	}
+	lt, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = srv.(*Server).serveListener(lt)
+	}()
+
+	dialer, err := NewDialer(direct.SymmetricDirect, protocol.Header{
+		ProxyAddress: lt.Addr().String(),
+		Password:     "secret-password",
+		IsClient:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialer.(*Dialer).Close()
+	stream, _, err := dialer.(*Dialer).openStream(context.Background(), net.JoinHostPort(uotMagicAddress, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if err := writeUOTRequest(stream, uotRequest{
+		Destination: socksAddr{Host: reflectorA.Addr().String(), Port: reflectorA.Port()},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	_ = stream.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var mappedAddrs []string
+	for _, reflector := range []netip.AddrPort{reflectorA, reflectorB} {
+		if err := writeUOTPacket(stream, reflector, []byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 64)
+		n, from, err := readUOTPacket(stream, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from.String() != reflector.String() {
+			t.Fatalf("packet source = %v, want %v", from, reflector)
+		}
+		mappedAddrs = append(mappedAddrs, string(buf[:n]))
+	}
+	// a full-cone socket is seen by all peers at the same address
+	if mappedAddrs[0] != mappedAddrs[1] {
+		t.Fatalf("mapped addresses = %v, want a single socket", mappedAddrs)
+	}
+}
+
 func TestDialCmdMsgPing(t *testing.T) {
 	srv, err := New(testTLSContext(t), direct.SymmetricDirect)
 	if err != nil {
@@ -187,76 +252,29 @@ func TestDialCmdMsgPing(t *testing.T) {
 	}
 }
 
-func startUDPEchoServer(t *testing.T) (netip.AddrPort, func()) {
+// startUDPReflector replies the address of the sender like STUN.
+func startUDPReflector(t *testing.T) (netip.AddrPort, func()) {
 	t.Helper()
 
 	conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:0")))
 	if err != nil {
 		t.Fatal(err)
 	}
-	quit := make(chan struct{})
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
 		buf := make([]byte, 1500)
 		for {
-			_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
-			n, addr, err := conn.ReadFromUDPAddrPort(buf)
+			_, addr, err := conn.ReadFromUDPAddrPort(buf)
 			if err != nil {
-				select {
-				case <-quit:
-					return
-				default:
-				}
-				if ne, ok := err.(net.Error); ok && ne.Timeout() {
-					continue
-				}
 				return
 			}
-			if string(buf[:n]) == "ping" {
-				_, _ = conn.WriteToUDPAddrPort([]byte("pong"), addr)
-			}
+			_, _ = conn.WriteToUDPAddrPort([]byte(addr.String()), addr)
 		}
 	}()
 
 	return conn.LocalAddr().(*net.UDPAddr).AddrPort(), func() {
-		close(quit)
 		_ = conn.Close()
 		<-done
 	}
 }
-
-func startEchoServer(t *testing.T) (addr string, closeFn func()) {
-	t.Helper()
-
-	lt, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatal(err)
-	}
-	done := make(chan struct{})
-	go func() {
-		defer close(done)
-		for {
-			conn, err := lt.Accept()
-			if err != nil {
-				return
-			}
-			go func(conn net.Conn) {
-				defer conn.Close()
-				_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
-				buf := make([]byte, 4)
-				if _, err := io.ReadFull(conn, buf); err != nil {
-					return
-				}
-				if string(buf) == "ping" {
-					_, _ = conn.Write([]byte("pong"))
-				}
-			}(conn)
-		}
-	}()
-
-	return lt.Addr().String(), func() {
-		_ = lt.Close()
-		<-done
-	}
-}
@@ -0,0 +1,156 @@
+package anytls
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/daeuniverse/outbound/pkg/fastrand"
+)
+
+// checkMark in the record sizes stops the padding of a packet if there is no
+// payload left.
+const checkMark = -1
+
+// DefaultPaddingScheme is the padding scheme of the reference implementation.
+const DefaultPaddingScheme = `stop=8
+0=30-30
+1=100-400
+2=400-500,c,500-1000,c,500-1000,c,500-1000,c,500-1000
+3=9-9,500-1000
+4=500-1000
+5=500-1000
+6=500-1000
+7=500-1000`
+
+// paddingScheme decides the record sizes of the first packets of a session.
+// The packet 0 is the authentication of the client.
+type paddingScheme struct {
+	raw    []byte
+	md5    string
+	stop   uint32
+	scheme map[string]string
+}
+
+// maxPushedPaddingSchemes bounds the servers whose pushed schemes are kept.
+const maxPushedPaddingSchemes = 1024
+
+// defaultPaddingScheme is used by client sessions until the server pushes its
+// scheme.
+var defaultPaddingScheme = mustParsePaddingScheme(DefaultPaddingScheme)
+
+// paddingSchemeStore keeps the schemes pushed by the servers, keyed by their
+// proxy addresses, so that a server only changes the padding towards itself.
+// It outlives the Dialers, which are created for each connection.
+type paddingSchemeStore struct {
+	mu      sync.Mutex
+	schemes map[string]*paddingScheme
+}
+
+// pushedPaddingSchemes is the store of the Dialers.
+var pushedPaddingSchemes = &paddingSchemeStore{}
+
+// load returns the scheme for new client sessions to the proxy address.
+func (s *paddingSchemeStore) load(proxyAddress string) *paddingScheme {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.schemes[proxyAddress]; ok {
+		return p
+	}
+	return defaultPaddingScheme
+}
+
+// store keeps the scheme pushed by the server at the proxy address. An
+// arbitrary one is forgotten if there are too many.
+func (s *paddingSchemeStore) store(proxyAddress string, p *paddingScheme) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.schemes == nil {
+		s.schemes = make(map[string]*paddingScheme)
+	}
+	if _, ok := s.schemes[proxyAddress]; !ok && len(s.schemes) >= maxPushedPaddingSchemes {
+		for k := range s.schemes {
+			delete(s.schemes, k)
+			break
+		}
+	}
+	s.schemes[proxyAddress] = p
+}
+
+func parsePaddingScheme(raw []byte) (*paddingScheme, error) {
+	scheme := make(map[string]string)
+	for _, line := range strings.Split(string(raw), "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		scheme[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	stop, err := strconv.ParseUint(scheme["stop"], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stop of padding scheme: %w", err)
+	}
+	sum := md5.Sum(raw)
+	return &paddingScheme{
+		raw:    raw,
+		md5:    hex.EncodeToString(sum[:]),
+		stop:   uint32(stop),
+		scheme: scheme,
+	}, nil
+}
+
+func mustParsePaddingScheme(raw string) *paddingScheme {
+	p, err := parsePaddingScheme([]byte(raw))
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// recordSizes generates the record payload sizes of the packet pkt, which may
+// contain checkMark.
+func (p *paddingScheme) recordSizes(pkt uint32) (sizes []int) {
+	s, ok := p.scheme[strconv.FormatUint(uint64(pkt), 10)]
+	if !ok {
+		return nil
+	}
+	for _, r := range strings.Split(s, ",") {
+		if r == "c" {
+			sizes = append(sizes, checkMark)
+			continue
+		}
+		strMin, strMax, ok := strings.Cut(r, "-")
+		if !ok {
+			continue
+		}
+		lo, err := strconv.Atoi(strMin)
+		if err != nil {
+			continue
+		}
+		hi, err := strconv.Atoi(strMax)
+		if err != nil {
+			continue
+		}
+		lo, hi = min(lo, hi), max(lo, hi)
+		if lo <= 0 {
+			continue
+		}
+		if lo == hi {
+			sizes = append(sizes, lo)
+		} else {
+			sizes = append(sizes, lo+fastrand.Intn(hi-lo))
+		}
+	}
+	return sizes
+}
+
+// authPaddingLen is the length of the padding following the password hash.
+func (p *paddingScheme) authPaddingLen() int {
+	if sizes := p.recordSizes(0); len(sizes) > 0 && sizes[0] > 0 {
+		return min(sizes[0], maxFrameData)
+	}
+	return 0
+}
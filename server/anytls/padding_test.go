@@ -0,0 +1,96 @@
+package anytls
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPaddingSchemeRecordSizes(t *testing.T) {
+	p, err := parsePaddingScheme([]byte("stop=3\n0=30-30\n1=10-10,c,20-30"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.stop != 3 {
+		t.Fatalf("stop = %d, want 3", p.stop)
+	}
+	if got := p.authPaddingLen(); got != 30 {
+		t.Fatalf("authPaddingLen() = %d, want 30", got)
+	}
+	sizes := p.recordSizes(1)
+	if len(sizes) != 3 || sizes[0] != 10 || sizes[1] != checkMark || sizes[2] < 20 || sizes[2] >= 30 {
+		t.Fatalf("recordSizes(1) = %v, want [10 %d 20..29]", sizes, checkMark)
+	}
+	if sizes := p.recordSizes(2); sizes != nil {
+		t.Fatalf("recordSizes(2) = %v, want nil", sizes)
+	}
+	if _, err := parsePaddingScheme([]byte("1=10-10")); err == nil {
+		t.Fatal("parsePaddingScheme accepted a scheme without stop")
+	}
+}
+
+func TestSessionPadsFirstPackets(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	session := newServerSession(local, serverSessionOptions{
+		padding: mustParsePaddingScheme("stop=3\n1=100-100\n2=5-5,c,50-50"),
+	}, nil)
+
+	writeErr := make(chan error, 3)
+	go func() {
+		writeErr <- session.writeFrame(frame{cmd: cmdPSH, streamID: 1, data: []byte("hello")})
+		writeErr <- session.writeFrame(frame{cmd: cmdPSH, streamID: 1, data: []byte("world")})
+		writeErr <- session.writeFrame(frame{cmd: cmdPSH, streamID: 1, data: []byte("plain")})
+	}()
+
+	// every Write of the session is a record
+	_ = remote.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	for i, want := range []int{100, 5, 50, frameHeaderLen + len("plain")} {
+		n, err := remote.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Fatalf("record %d size = %d, want %d", i, n, want)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-writeErr; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestServerPushesPaddingSchemeToClient(t *testing.T) {
+	store := &paddingSchemeStore{}
+
+	// net.Pipe deadlocks when both sides write without buffers
+	clientConn, serverConn := tcpPair(t)
+	defer clientConn.Close()
+	defer serverConn.Close()
+	serverPadding := mustParsePaddingScheme("stop=2\n1=200-300")
+	go func() {
+		_ = newServerSession(serverConn, serverSessionOptions{padding: serverPadding}, nil).runServer()
+	}()
+	client := newClientSession(clientConn, store.load("192.0.2.1:443"), func(p *paddingScheme) {
+		store.store("192.0.2.1:443", p)
+	})
+	if err := client.runClient(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if got := client.waitServerSettings(time.Second); got != 2 {
+		t.Fatalf("peer version = %d, want 2", got)
+	}
+	// the scheme is pushed before the server settings
+	if got := store.load("192.0.2.1:443").md5; got != serverPadding.md5 {
+		t.Fatalf("client padding-md5 = %q, want %q", got, serverPadding.md5)
+	}
+	// the other servers are not affected
+	if got := store.load("192.0.2.2:443"); got != defaultPaddingScheme {
+		t.Fatalf("padding-md5 of another server = %q, want the default", got.md5)
+	}
+}
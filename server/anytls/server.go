@@ -34,6 +34,10 @@ func init() {
 type Server struct {
 	dialer    netproxy.Dialer
 	tlsConfig *tls.Config
+	// sessionOptions configures the sessions of clients
+	sessionOptions serverSessionOptions
+	// fallback serves the connections failing the authentication
+	fallback http.Handler
 
 	sweetLisa config.Lisa
 	arg       server.Argument
@@ -57,6 +61,9 @@ type Server struct {
 	autocertServer   *http.Server
 	autocertListener net.Listener
 	autocertStarted  bool
+	tlsResources     *server.TLSResources
+	// echKeys is nil if ECH is disabled
+	echKeys *server.ECHKeys
 }
 
 type Passage struct {
@@ -77,10 +84,26 @@ func newServer(dialer netproxy.Dialer, tlsConfig *tls.Config) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
+	anytlsConfig := config.ParamsObj.John.AnyTLS
+	rawScheme := anytlsConfig.PaddingScheme
+	if rawScheme == "" {
+		rawScheme = DefaultPaddingScheme
+	}
+	padding, err := parsePaddingScheme([]byte(rawScheme))
+	if err != nil {
+		return nil, err
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Server{
-		dialer:      dialer,
-		tlsConfig:   tlsConfig,
+		dialer:    dialer,
+		tlsConfig: tlsConfig,
+		sessionOptions: serverSessionOptions{
+			padding:           padding,
+			idleTimeout:       time.Duration(anytlsConfig.IdleTimeout) * time.Second,
+			heartbeatInterval: time.Duration(anytlsConfig.HeartbeatInterval) * time.Second,
+			heartbeatMaxMiss:  anytlsConfig.HeartbeatMaxMiss,
+			maxStreams:        anytlsConfig.MaxStreams,
+		},
 		users:       make(map[[sha256.Size]byte]Passage),
 		ctx:         ctx,
 		cancel:      cancel,
@@ -94,19 +117,33 @@ func NewJohn(valueCtx context.Context, dialer netproxy.Dialer, sweetLisa config.
 		return nil, err
 	}
 	var john *Server
-	tlsResources, err := newAutocertTLSResources(sni, func() {
-		if john != nil {
-			john.reRegister()
+	var tlsResources *server.TLSResources
+	if tlsConfig, _ := valueCtx.Value(tlsConfigContextKey{}).(*tls.Config); tlsConfig != nil {
+		// given by WithTLSConfig
+		tlsResources = &server.TLSResources{TLSConfig: tlsConfig}
+	} else {
+		tlsResources, err = server.NewTLSResources(sni, func() {
+			if john != nil {
+				john.reRegister()
+			}
+		})
+		if err != nil {
+			return nil, err
 		}
-	})
-	if err != nil {
-		return nil, err
 	}
-	john, err = newServer(dialer, tlsResources.tlsConfig)
+	john, err = newServer(dialer, tlsResources.TLSConfig)
 	if err != nil {
+		_ = tlsResources.Close()
 		return nil, err
 	}
-	john.autocertServer = tlsResources.httpServer
+	john.autocertServer = tlsResources.HTTPServer
+	john.tlsResources = tlsResources
+	if echKeys, _ := valueCtx.Value("echKeys").(*server.ECHKeys); echKeys != nil {
+		john.echKeys = echKeys
+		john.tlsConfig.GetEncryptedClientHelloKeys = echKeys.GetEncryptedClientHelloKeys
+		// publish the new configs
+		echKeys.OnRotate(john.reRegister)
+	}
 	john.sweetLisa = sweetLisa
 	john.arg = arg
 	john.passageContentionCache = server.NewContentionCache()
@@ -117,6 +154,7 @@ func NewJohn(valueCtx context.Context, dialer netproxy.Dialer, sweetLisa config.
 		return nil, err
 	}
 	go john.registerBackground()
+	go server.RotateManager(john, john.register, john.ctx.Done())
 	return john, nil
 }
 
@@ -178,6 +216,9 @@ func (s *Server) Close() error {
 		s.autocertServer = nil
 		autocertListener := s.autocertListener
 		s.autocertListener = nil
+		tlsResources := s.tlsResources
+		s.tlsResources = nil
+		echKeys := s.echKeys
 		activeConns := make([]net.Conn, 0, len(s.activeConns))
 		for conn := range s.activeConns {
 			activeConns = append(activeConns, conn)
@@ -197,6 +238,12 @@ func (s *Server) Close() error {
 				err = closeErr
 			}
 		}
+		if tlsResources != nil {
+			_ = tlsResources.Close()
+		}
+		if echKeys != nil {
+			_ = echKeys.Close()
+		}
 		for _, conn := range activeConns {
 			_ = conn.Close()
 		}
@@ -235,10 +282,10 @@ func (s *Server) AddPassages(passages []server.Passage) error {
 	local, _ := LocalizePassages(passages)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	if server.ReplacesManagers(passages) {
+		s.removePassagesFuncLocked(func(p *Passage) bool { return p.Manager })
+	}
 	for _, passage := range local {
-		if passage.Manager {
-			s.removePassagesFuncLocked(func(p *Passage) bool { return p.Manager })
-		}
 		s.passages = append(s.passages, passage)
 	}
 	s.rebuildUsersLocked()
@@ -279,17 +326,14 @@ func (s *Server) Passages() (passages []server.Passage) {
 }
 
 func LocalizePassages(passages []server.Passage) ([]Passage, *Passage) {
+	passages = server.LocalizeManagers(passages, func(passage *server.Passage) {
+		passage.In.Password, _ = gonanoid.Generate(common.Alphabet, 23)
+	})
 	local := make([]Passage, len(passages))
 	var manager *Passage
 	for i, passage := range passages {
 		if passage.Manager {
-			passage.In.Password, _ = gonanoid.Generate(common.Alphabet, 23)
-			if manager == nil {
-				manager = &local[i]
-			} else {
-				passage.Manager = false
-				log.Warn("found more than one manager")
-			}
+			manager = &local[i]
 		}
 		local[i].Passage = passage
 		local[i].passwordHash = sha256.Sum256([]byte(passage.In.Password))
@@ -318,17 +362,27 @@ func (s *Server) handleConn(conn net.Conn) error {
 	if err := tlsConn.Handshake(); err != nil {
 		return err
 	}
-	passage, err := s.auth(tlsConn)
+	if server.IsACMETLSALPNConn(tlsConn.ConnectionState()) {
+		// a tls-alpn-01 challenge is done with the handshake
+		return nil
+	}
+	rConn := &rewindConn{Conn: tlsConn, recording: true}
+	passage, err := s.auth(rConn)
 	if err != nil {
+		if errors.Is(err, protocol.ErrFailAuth) {
+			rConn.rewind()
+			return s.handleFallback(rConn, err)
+		}
 		return err
 	}
+	rConn.stopRecording()
 	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
 		if err := s.ContentionCheck(tcpAddr.IP, passage); err != nil {
 			return err
 		}
 	}
 
-	session := newServerSession(tlsConn, func(stream *Stream) {
+	session := newServerSession(rConn, s.sessionOptions, func(stream *Stream) {
 		if err := s.handleStream(stream, passage); err != nil {
 			log.Warn("anytls handleStream: %v", err)
 		}
@@ -336,11 +390,25 @@ func (s *Server) handleConn(conn net.Conn) error {
 	return session.runServer()
 }
 
+// auth reads the password hash byte by byte and fails as soon as it is not a
+// prefix of any passage, so that probes do not wait for the fallback.
 func (s *Server) auth(conn net.Conn) (*Passage, error) {
 	var key [sha256.Size]byte
-	if _, err := io.ReadFull(conn, key[:]); err != nil {
-		return nil, err
+	for i := range key {
+		if _, err := io.ReadFull(conn, key[i:i+1]); err != nil {
+			return nil, err
+		}
+		if !s.hasPasswordHashPrefix(key[:i+1]) {
+			return nil, protocol.ErrFailAuth
+		}
+	}
+	s.mutex.Lock()
+	passage, ok := s.users[key]
+	s.mutex.Unlock()
+	if !ok {
+		return nil, protocol.ErrFailAuth
 	}
+
 	var lenBuf [2]byte
 	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
 		return nil, err
@@ -350,14 +418,18 @@ func (s *Server) auth(conn net.Conn) (*Passage, error) {
 			return nil, err
 		}
 	}
+	return &passage, nil
+}
 
+func (s *Server) hasPasswordHashPrefix(prefix []byte) bool {
 	s.mutex.Lock()
-	passage, ok := s.users[key]
-	s.mutex.Unlock()
-	if !ok {
-		return nil, protocol.ErrFailAuth
+	defer s.mutex.Unlock()
+	for key := range s.users {
+		if bytes.HasPrefix(key[:], prefix) {
+			return true
+		}
 	}
-	return &passage, nil
+	return false
 }
 
 func (s *Server) handleStream(stream *Stream, passage *Passage) error {
@@ -430,11 +502,11 @@ func (s *Server) handleMsg(conn netproxy.Conn, passage *Passage) error {
 			log.Warn("the body of received ping message is %v instead of %v", strconv.Quote(string(reqBody)), strconv.Quote("ping"))
 		}
 		s.setLastAlive(time.Now())
-		bandwidthLimit, err := server.GenerateBandwidthLimit()
+		pingResp, err := server.GeneratePingResp()
 		if err != nil {
 			return err
 		}
-		resp, err = jsoniter.Marshal(model.PingResp{BandwidthLimit: bandwidthLimit})
+		resp, err = jsoniter.Marshal(pingResp)
 		if err != nil {
 			return err
 		}
@@ -525,13 +597,7 @@ func (s *Server) registerBackground() {
 }
 
 func (s *Server) register() error {
-	var manager server.Passage
-	for _, passage := range s.Passages() {
-		if passage.Manager {
-			manager = passage
-			break
-		}
-	}
+	manager := server.CurrentManager(s.Passages())
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 	t, _ := net.LookupTXT("cdn-validate." + s.sweetLisa.Host)
@@ -543,15 +609,19 @@ func (s *Server) register() error {
 	if err != nil {
 		return err
 	}
+	argument := model.Argument{
+		Protocol: "anytls",
+		Password: manager.In.Password,
+	}
+	if s.echKeys != nil {
+		argument.Method = s.echKeys.MethodParam()
+	}
 	cdnNames, users, err := api.Register(ctx, s.sweetLisa.Host, validateToken, model.Server{
-		Ticket: s.arg.Ticket,
-		Name:   s.arg.ServerName,
-		Hosts:  s.arg.Hostnames,
-		Port:   s.arg.Port,
-		Argument: model.Argument{
-			Protocol: "anytls",
-			Password: manager.In.Password,
-		},
+		Ticket:         s.arg.Ticket,
+		Name:           s.arg.ServerName,
+		Hosts:          s.arg.Hostnames,
+		Port:           s.arg.Port,
+		Argument:       argument,
 		BandwidthLimit: bandwidthLimit,
 		NoRelay:        s.arg.NoRelay,
 	})
@@ -9,7 +9,10 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
 )
 
 type Session struct {
@@ -22,6 +25,19 @@ type Session struct {
 	writeStateMu sync.Mutex
 	activeWrite  *Stream
 
+	// padding shapes the records of the first packets, which are counted by
+	// pktCounter under writeMu.
+	padding    *paddingScheme
+	pktCounter uint32
+	// onPaddingScheme receives the schemes pushed to client sessions, which
+	// take effect from the next session.
+	onPaddingScheme func(*paddingScheme)
+
+	// liveness of server sessions in unix nanoseconds
+	options    serverSessionOptions
+	lastRecv   atomic.Int64
+	lastActive atomic.Int64
+
 	mu       sync.RWMutex
 	nextID   uint32
 	streams  map[uint32]*Stream
@@ -35,29 +51,47 @@ type Session struct {
 	serverSettingsOnce     sync.Once
 }
 
-func newClientSession(conn net.Conn) *Session {
+func newClientSession(conn net.Conn, padding *paddingScheme, onPaddingScheme func(*paddingScheme)) *Session {
 	return &Session{
 		conn:             conn,
 		isClient:         true,
+		padding:          padding,
+		onPaddingScheme:  onPaddingScheme,
 		streams:          make(map[uint32]*Stream),
 		closed:           make(chan struct{}),
 		serverSettingsCh: make(chan struct{}),
 	}
 }
 
-func newServerSession(conn net.Conn, onStream func(*Stream)) *Session {
-	return &Session{
+// serverSessionOptions configures the padding, liveness and limits of server
+// sessions. Zero durations and numbers disable the corresponding feature.
+type serverSessionOptions struct {
+	padding           *paddingScheme
+	idleTimeout       time.Duration
+	heartbeatInterval time.Duration
+	heartbeatMaxMiss  int
+	maxStreams        int
+}
+
+func newServerSession(conn net.Conn, options serverSessionOptions, onStream func(*Stream)) *Session {
+	s := &Session{
 		conn:     conn,
+		padding:  options.padding,
+		options:  options,
 		onStream: onStream,
 		streams:  make(map[uint32]*Stream),
 		closed:   make(chan struct{}),
 	}
+	now := time.Now().UnixNano()
+	s.lastRecv.Store(now)
+	s.lastActive.Store(now)
+	return s
 }
 
 func (s *Session) runClient() error {
 	if err := s.writeFrame(frame{
 		cmd:  cmdSettings,
-		data: []byte("v=2\nclient=BitterJohn\npadding-md5="),
+		data: fmt.Appendf(nil, "v=2\nclient=BitterJohn\npadding-md5=%s", s.padding.md5),
 	}); err != nil {
 		return err
 	}
@@ -66,9 +100,68 @@ func (s *Session) runClient() error {
 }
 
 func (s *Session) runServer() error {
+	go s.monitor()
 	return s.recvLoop()
 }
 
+// monitor closes the session if it idles out or misses too many heartbeats,
+// which are sent if the client is silent for a heartbeat interval.
+func (s *Session) monitor() {
+	period := s.options.heartbeatInterval
+	if idle := s.options.idleTimeout / 2; idle > 0 && (period <= 0 || idle < period) {
+		period = idle
+	}
+	if period <= 0 {
+		return
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	var missed int
+	var lastHeartbeat time.Time
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			if s.options.idleTimeout > 0 && s.numStreams() == 0 &&
+				now.Sub(time.Unix(0, s.lastActive.Load())) >= s.options.idleTimeout {
+				log.Debug("anytls session from %v idles out", s.conn.RemoteAddr())
+				_ = s.Close()
+				return
+			}
+			// heartbeats are introduced in the protocol version 2
+			if s.options.heartbeatInterval <= 0 || s.getPeerVersion() < 2 {
+				continue
+			}
+			if now.Sub(time.Unix(0, s.lastRecv.Load())) < s.options.heartbeatInterval {
+				missed = 0
+				continue
+			}
+			if now.Sub(lastHeartbeat) < s.options.heartbeatInterval {
+				continue
+			}
+			if missed >= max(s.options.heartbeatMaxMiss, 1) {
+				log.Debug("anytls session from %v misses %v heartbeats", s.conn.RemoteAddr(), missed)
+				_ = s.Close()
+				return
+			}
+			missed++
+			lastHeartbeat = now
+			// the write blocks on a stalled connection, which is closed by the
+			// following ticks
+			go func() {
+				_ = s.writeFrame(frame{cmd: cmdHeartRequest})
+			}()
+		}
+	}
+}
+
+func (s *Session) numStreams() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.streams)
+}
+
 func (s *Session) IsClosed() bool {
 	select {
 	case <-s.closed:
@@ -122,7 +215,7 @@ func (s *Session) OpenStream() (*Stream, error) {
 func (s *Session) writeFrame(f frame) error {
 	s.writeMu.Lock()
 	defer s.writeMu.Unlock()
-	return writeFrame(s.conn, f)
+	return s.writeConn(f)
 }
 
 func (s *Session) writeFrameForStream(stream *Stream, f frame) error {
@@ -138,7 +231,59 @@ func (s *Session) writeFrameForStream(stream *Stream, f frame) error {
 		return err
 	}
 	defer s.endStreamWrite(stream)
-	return writeFrame(s.conn, f)
+	s.lastActive.Store(time.Now().UnixNano())
+	return s.writeConn(f)
+}
+
+// writeConn writes the frame in records of the sizes decided by the padding
+// scheme, padding them with cmdWaste frames. The caller must hold writeMu.
+func (s *Session) writeConn(f frame) error {
+	if s.padding == nil || s.pktCounter >= s.padding.stop {
+		return writeFrame(s.conn, f)
+	}
+	if len(f.data) > maxFrameData {
+		return fmt.Errorf("frame data too large: %d", len(f.data))
+	}
+	s.pktCounter++
+	b := appendFrame(make([]byte, 0, frameHeaderLen+len(f.data)), f)
+	if s.pktCounter >= s.padding.stop {
+		_, err := s.conn.Write(b)
+		return err
+	}
+loop:
+	for _, size := range s.padding.recordSizes(s.pktCounter) {
+		switch {
+		case size == checkMark:
+			if len(b) == 0 {
+				break loop
+			}
+		case len(b) > size:
+			// this record is all payload
+			if _, err := s.conn.Write(b[:size]); err != nil {
+				return err
+			}
+			b = b[size:]
+		case len(b) > 0:
+			// this record is the rest of payload and padding
+			if wasteLen := size - len(b); wasteLen > frameHeaderLen {
+				b = appendWasteFrame(b, wasteLen)
+			}
+			if _, err := s.conn.Write(b); err != nil {
+				return err
+			}
+			b = nil
+		default:
+			// this record is all padding
+			if _, err := s.conn.Write(appendWasteFrame(nil, size)); err != nil {
+				return err
+			}
+		}
+	}
+	if len(b) > 0 {
+		_, err := s.conn.Write(b)
+		return err
+	}
+	return nil
 }
 
 func (s *Session) beginStreamWrite(stream *Stream, deadline time.Time) error {
@@ -191,6 +336,11 @@ func (s *Session) recvLoop() error {
 		if err != nil {
 			return err
 		}
+		now := time.Now().UnixNano()
+		s.lastRecv.Store(now)
+		if f.cmd == cmdSYN || f.cmd == cmdPSH || f.cmd == cmdFIN {
+			s.lastActive.Store(now)
+		}
 		switch f.cmd {
 		case cmdWaste:
 			continue
@@ -207,6 +357,14 @@ func (s *Session) recvLoop() error {
 			if s.isClient {
 				continue
 			}
+			if s.options.maxStreams > 0 && s.getStream(f.streamID) == nil && s.numStreams() >= s.options.maxStreams {
+				if s.peerVersion >= 2 {
+					_ = s.writeFrame(frame{cmd: cmdSYNACK, streamID: f.streamID, data: []byte("too many streams")})
+				} else {
+					_ = s.writeFrame(frame{cmd: cmdFIN, streamID: f.streamID})
+				}
+				continue
+			}
 			stream := s.getOrCreateStream(f.streamID)
 			if s.peerVersion >= 2 {
 				_ = s.writeFrame(frame{cmd: cmdSYNACK, streamID: f.streamID})
@@ -229,7 +387,11 @@ func (s *Session) recvLoop() error {
 		case cmdSettings:
 			if !s.isClient {
 				receivedSettings = true
-				if v, err := strconv.Atoi(parseSettings(f.data)["v"]); err == nil && v >= 2 {
+				settings := parseSettings(f.data)
+				if s.padding != nil && settings["padding-md5"] != s.padding.md5 {
+					_ = s.writeFrame(frame{cmd: cmdUpdatePaddingScheme, data: s.padding.raw})
+				}
+				if v, err := strconv.Atoi(settings["v"]); err == nil && v >= 2 {
 					s.setPeerVersion(byte(v))
 					_ = s.writeFrame(frame{cmd: cmdServerSettings, data: []byte("v=2")})
 				}
@@ -245,7 +407,12 @@ func (s *Session) recvLoop() error {
 		case cmdAlert:
 			return fmt.Errorf("remote alert: %s", string(f.data))
 		case cmdUpdatePaddingScheme:
-			continue
+			if !s.isClient || s.onPaddingScheme == nil {
+				continue
+			}
+			if padding, err := parsePaddingScheme(f.data); err == nil {
+				s.onPaddingScheme(padding)
+			}
 		case cmdHeartRequest:
 			_ = s.writeFrame(frame{cmd: cmdHeartResponse, streamID: f.streamID})
 		case cmdHeartResponse:
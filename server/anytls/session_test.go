@@ -3,6 +3,7 @@ package anytls
 import (
 	"context"
 	"crypto/tls"
+	"io"
 	"net"
 	"testing"
 	"time"
@@ -19,7 +20,7 @@ func TestClientSettingsAdvertiseSupportedProtocolVersion(t *testing.T) {
 
 	errCh := make(chan error, 1)
 	go func() {
-		errCh <- newClientSession(clientConn).runClient()
+		errCh <- newClientSession(clientConn, defaultPaddingScheme, nil).runClient()
 	}()
 
 	if err := serverConn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
@@ -35,6 +36,15 @@ func TestClientSettingsAdvertiseSupportedProtocolVersion(t *testing.T) {
 	if got, want := parseSettings(f.data)["v"], "2"; got != want {
 		t.Fatalf("advertised protocol version = %q, want %q", got, want)
 	}
+	if got, want := parseSettings(f.data)["padding-md5"], defaultPaddingScheme.md5; got != want {
+		t.Fatalf("advertised padding-md5 = %q, want %q", got, want)
+	}
+	// the settings are padded to the record size of the packet 1
+	if f, err := readFrame(serverConn); err != nil {
+		t.Fatal(err)
+	} else if f.cmd != cmdWaste {
+		t.Fatalf("second client frame command = %d, want cmdWaste", f.cmd)
+	}
 
 	if err := <-errCh; err != nil {
 		t.Fatal(err)
@@ -113,7 +123,7 @@ func TestLateServerSettingsCanUpgradeAfterNegotiationTimeout(t *testing.T) {
 	defer clientConn.Close()
 	defer serverConn.Close()
 
-	session := newClientSession(clientConn)
+	session := newClientSession(clientConn, defaultPaddingScheme, nil)
 	errCh := make(chan error, 1)
 	go func() {
 		errCh <- session.runClient()
@@ -122,11 +132,14 @@ func TestLateServerSettingsCanUpgradeAfterNegotiationTimeout(t *testing.T) {
 	if err := serverConn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
 		t.Fatal(err)
 	}
-	if f, err := readFrame(serverConn); err != nil {
+	if f, err := readFrameSkipWaste(serverConn); err != nil {
 		t.Fatal(err)
 	} else if f.cmd != cmdSettings {
 		t.Fatalf("first client frame command = %d, want cmdSettings", f.cmd)
 	}
+	if f, err := readFrame(serverConn); err != nil || f.cmd != cmdWaste {
+		t.Fatalf("settings padding = cmd:%d err:%v, want cmdWaste", f.cmd, err)
+	}
 	if err := serverConn.SetReadDeadline(time.Time{}); err != nil {
 		t.Fatal(err)
 	}
@@ -180,18 +193,18 @@ func startSynackServer(t *testing.T, password string) (addr string, releaseSynac
 		if _, err := authFromConn(t, conn, password); err != nil {
 			return
 		}
-		settings, err := readFrame(conn)
+		settings, err := readFrameSkipWaste(conn)
 		if err != nil || settings.cmd != cmdSettings {
 			return
 		}
 		if err := writeFrame(conn, frame{cmd: cmdServerSettings, data: []byte("v=2")}); err != nil {
 			return
 		}
-		syn, err := readFrame(conn)
+		syn, err := readFrameSkipWaste(conn)
 		if err != nil || syn.cmd != cmdSYN {
 			return
 		}
-		psh, err := readFrame(conn)
+		psh, err := readFrameSkipWaste(conn)
 		if err != nil || psh.cmd != cmdPSH {
 			return
 		}
@@ -227,13 +240,13 @@ func startV1Server(t *testing.T, password string) (addr string, closeFn func())
 		if _, err := authFromConn(t, conn, password); err != nil {
 			return
 		}
-		if _, err := readFrame(conn); err != nil {
+		if _, err := readFrameSkipWaste(conn); err != nil {
 			return
 		}
-		if _, err := readFrame(conn); err != nil {
+		if _, err := readFrameSkipWaste(conn); err != nil {
 			return
 		}
-		if _, err := readFrame(conn); err != nil {
+		if _, err := readFrameSkipWaste(conn); err != nil {
 			return
 		}
 		<-time.After(20 * time.Millisecond)
@@ -244,6 +257,15 @@ func startV1Server(t *testing.T, password string) (addr string, closeFn func())
 	}
 }
 
+func readFrameSkipWaste(r io.Reader) (frame, error) {
+	for {
+		f, err := readFrame(r)
+		if err != nil || f.cmd != cmdWaste {
+			return f, err
+		}
+	}
+}
+
 func authFromConn(t *testing.T, conn net.Conn, password string) (*Passage, error) {
 	t.Helper()
 	srvIface, err := New(testTLSContext(t), direct.SymmetricDirect)
@@ -257,3 +279,135 @@ func authFromConn(t *testing.T, conn net.Conn, password string) (*Passage, error
 	}
 	return srv.auth(conn)
 }
+
+func TestServerSessionIdlesOut(t *testing.T) {
+	clientConn, serverConn := tcpPair(t)
+	defer clientConn.Close()
+	session := newServerSession(serverConn, serverSessionOptions{idleTimeout: 50 * time.Millisecond}, nil)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- session.runServer()
+	}()
+	select {
+	case <-errCh:
+	case <-time.After(time.Second):
+		t.Fatal("idle session was not closed")
+	}
+}
+
+func TestServerSessionClosesAfterMissedHeartbeats(t *testing.T) {
+	clientConn, serverConn := tcpPair(t)
+	defer clientConn.Close()
+	session := newServerSession(serverConn, serverSessionOptions{
+		heartbeatInterval: 20 * time.Millisecond,
+		heartbeatMaxMiss:  2,
+	}, nil)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- session.runServer()
+	}()
+	if err := writeFrame(clientConn, frame{cmd: cmdSettings, data: []byte("v=2")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client never answers
+	var heartbeats int
+	_ = clientConn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		f, err := readFrame(clientConn)
+		if err != nil {
+			break
+		}
+		if f.cmd == cmdHeartRequest {
+			heartbeats++
+		}
+	}
+	if heartbeats != 2 {
+		t.Fatalf("heartbeats = %d, want 2", heartbeats)
+	}
+	select {
+	case <-errCh:
+	case <-time.After(time.Second):
+		t.Fatal("silent session was not closed")
+	}
+}
+
+func TestServerSessionSurvivesAnsweredHeartbeats(t *testing.T) {
+	clientConn, serverConn := tcpPair(t)
+	session := newServerSession(serverConn, serverSessionOptions{
+		heartbeatInterval: 10 * time.Millisecond,
+		heartbeatMaxMiss:  1,
+	}, nil)
+	go func() {
+		_ = session.runServer()
+	}()
+	defer session.Close()
+	client := newClientSession(clientConn, defaultPaddingScheme, nil)
+	if err := client.runClient(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	if session.IsClosed() {
+		t.Fatal("session answering heartbeats was closed")
+	}
+}
+
+func TestServerSessionCapsStreams(t *testing.T) {
+	clientConn, serverConn := tcpPair(t)
+	defer clientConn.Close()
+	session := newServerSession(serverConn, serverSessionOptions{maxStreams: 1}, func(*Stream) {})
+	go func() {
+		_ = session.runServer()
+	}()
+	defer session.Close()
+
+	for _, f := range []frame{
+		{cmd: cmdSettings, data: []byte("v=2")},
+		{cmd: cmdSYN, streamID: 1},
+		{cmd: cmdSYN, streamID: 2},
+	} {
+		if err := writeFrame(clientConn, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = clientConn.SetReadDeadline(time.Now().Add(time.Second))
+	synacks := make(map[uint32]string)
+	for len(synacks) < 2 {
+		f, err := readFrame(clientConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.cmd == cmdSYNACK {
+			synacks[f.streamID] = string(f.data)
+		}
+	}
+	if synacks[1] != "" {
+		t.Fatalf("SYNACK of the first stream carries error %q", synacks[1])
+	}
+	if synacks[2] == "" {
+		t.Fatal("SYNACK of the stream over the cap carries no error")
+	}
+	if got := session.numStreams(); got != 1 {
+		t.Fatalf("streams = %d, want 1", got)
+	}
+}
+
+func tcpPair(t *testing.T) (clientConn, serverConn net.Conn) {
+	t.Helper()
+	lt, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lt.Close()
+	clientConn, err = net.Dial("tcp", lt.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, err = lt.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clientConn, serverConn
+}
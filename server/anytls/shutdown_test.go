@@ -115,7 +115,7 @@ func TestCloseStopsAuthenticatedIdleSession(t *testing.T) {
 	if err := conn.Handshake(); err != nil {
 		t.Fatal(err)
 	}
-	if err := writeClientAuth(conn, sha256.Sum256([]byte(password))); err != nil {
+	if err := writeClientAuth(conn, sha256.Sum256([]byte(password)), 0); err != nil {
 		t.Fatal(err)
 	}
 	time.Sleep(20 * time.Millisecond)
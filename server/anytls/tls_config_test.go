@@ -6,7 +6,6 @@ import (
 	"errors"
 	"net"
 	"net/http"
-	"sync/atomic"
 	"testing"
 	"time"
 
@@ -46,31 +45,6 @@ func TestNewAcceptsExplicitTLSConfig(t *testing.T) {
 	}
 }
 
-func TestAutocertTLSResourcesProvideDynamicCertificates(t *testing.T) {
-	resources, err := newAutocertTLSResources("edge.example.com", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if resources.tlsConfig == nil {
-		t.Fatal("tlsConfig is nil")
-	}
-	if resources.tlsConfig.GetCertificate == nil {
-		t.Fatal("GetCertificate is nil")
-	}
-	if len(resources.tlsConfig.Certificates) != 0 {
-		t.Fatalf("static certificates = %d, want 0", len(resources.tlsConfig.Certificates))
-	}
-	if resources.tlsConfig.MinVersion != tls.VersionTLS12 {
-		t.Fatalf("MinVersion = %v, want TLS 1.2", resources.tlsConfig.MinVersion)
-	}
-	if resources.httpServer == nil {
-		t.Fatal("ACME HTTP server is nil")
-	}
-	if resources.httpServer.Addr != ":80" {
-		t.Fatalf("ACME HTTP server addr = %q, want %q", resources.httpServer.Addr, ":80")
-	}
-}
-
 func TestListenReturnsAutocertBindError(t *testing.T) {
 	blocker, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -126,47 +100,3 @@ func TestStartAutocertServerClosesWithServer(t *testing.T) {
 		t.Fatal("autocert listener still accepts connections after Close")
 	}
 }
-
-func TestRenewingCertificateGetterDoesNotReRegisterAfterSlowFailure(t *testing.T) {
-	expected := errors.New("acme failed")
-	var renews atomic.Int64
-	getCertificate := renewingCertificateGetter("edge.example.com", func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
-		time.Sleep(20 * time.Millisecond)
-		return nil, expected
-	}, time.Millisecond, func() {
-		renews.Add(1)
-	})
-
-	cert, err := getCertificate(&tls.ClientHelloInfo{})
-	if !errors.Is(err, expected) {
-		t.Fatalf("GetCertificate error = %v, want %v", err, expected)
-	}
-	if cert != nil {
-		t.Fatal("certificate is not nil after failure")
-	}
-	if got := renews.Load(); got != 0 {
-		t.Fatalf("renew callback calls = %d, want 0", got)
-	}
-}
-
-func TestRenewingCertificateGetterReRegistersAfterSlowSuccess(t *testing.T) {
-	var renews atomic.Int64
-	expected := &tls.Certificate{}
-	getCertificate := renewingCertificateGetter("edge.example.com", func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
-		time.Sleep(20 * time.Millisecond)
-		return expected, nil
-	}, time.Millisecond, func() {
-		renews.Add(1)
-	})
-
-	cert, err := getCertificate(&tls.ClientHelloInfo{})
-	if err != nil {
-		t.Fatal(err)
-	}
-	if cert != expected {
-		t.Fatal("unexpected certificate")
-	}
-	if got := renews.Load(); got != 1 {
-		t.Fatalf("renew callback calls = %d, want 1", got)
-	}
-}
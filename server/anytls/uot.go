@@ -17,6 +17,14 @@ import (
 
 const uotMagicAddress = "sp.v2.udp-over-tcp.arpa"
 
+// The address families of UDP-over-TCP packets in the packet mode, which are
+// different from the ones of socks addresses.
+const (
+	uotAddrIPv4   byte = 0x00
+	uotAddrIPv6   byte = 0x01
+	uotAddrDomain byte = 0x02
+)
+
 type uotRequest struct {
 	IsConnect   bool
 	Destination socksAddr
@@ -71,6 +79,69 @@ func readUOTPayload(r io.Reader, buf []byte) (int, error) {
 	return io.ReadFull(r, buf[:length])
 }
 
+// writeUOTPacket writes a packet of the packet mode, which carries its address
+// before the length-prefixed payload.
+func writeUOTPacket(w io.Writer, addr netip.AddrPort, payload []byte) error {
+	if len(payload) > maxFrameData {
+		return fmt.Errorf("uot payload too large: %d", len(payload))
+	}
+	buf := make([]byte, 0, 1+16+2+2+len(payload))
+	ip := addr.Addr().Unmap()
+	if ip.Is4() {
+		buf = append(buf, uotAddrIPv4)
+	} else {
+		buf = append(buf, uotAddrIPv6)
+	}
+	buf = append(buf, ip.AsSlice()...)
+	buf = binary.BigEndian.AppendUint16(buf, addr.Port())
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(payload)))
+	buf = append(buf, payload...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readUOTPacket reads a packet of the packet mode into buf.
+func readUOTPacket(r io.Reader, buf []byte) (int, socksAddr, error) {
+	var typ [1]byte
+	if _, err := io.ReadFull(r, typ[:]); err != nil {
+		return 0, socksAddr{}, err
+	}
+	var addr socksAddr
+	switch typ[0] {
+	case uotAddrIPv4:
+		var b [4]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, socksAddr{}, err
+		}
+		addr.Host = netip.AddrFrom4(b).String()
+	case uotAddrIPv6:
+		var b [16]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, socksAddr{}, err
+		}
+		addr.Host = netip.AddrFrom16(b).String()
+	case uotAddrDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return 0, socksAddr{}, err
+		}
+		b := make([]byte, int(l[0]))
+		if _, err := io.ReadFull(r, b); err != nil {
+			return 0, socksAddr{}, err
+		}
+		addr.Host = string(b)
+	default:
+		return 0, socksAddr{}, fmt.Errorf("unsupported uot addr type: %d", typ[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return 0, socksAddr{}, err
+	}
+	addr.Port = binary.BigEndian.Uint16(port[:])
+	n, err := readUOTPayload(r, buf)
+	return n, addr, err
+}
+
 type udpPacketConn struct {
 	stream     *Stream
 	target     socksAddr
@@ -140,9 +211,6 @@ func (s *Server) handleUOT(stream *Stream, passage *Passage) error {
 	if err != nil {
 		return err
 	}
-	if !req.IsConnect {
-		return fmt.Errorf("anytls uot packet mode is not supported")
-	}
 
 	dialer := s.dialer
 	if passage.Out != nil {
@@ -167,12 +235,18 @@ func (s *Server) handleUOT(stream *Stream, passage *Passage) error {
 	}
 	defer packetConn.Close()
 
+	// In the packet mode, every packet carries its address and the socket is
+	// full-cone, so that the client can talk to any peer through it.
 	errCh := make(chan error, 2)
 	go func() {
-		errCh <- relayUOTToPacketConn(packetConn, stream, req.Destination.String())
+		if req.IsConnect {
+			errCh <- relayUOTToPacketConn(packetConn, stream, req.Destination.String())
+		} else {
+			errCh <- relayUOTPacketsToPacketConn(packetConn, stream)
+		}
 	}()
 	go func() {
-		errCh <- relayPacketConnToUOT(stream, packetConn)
+		errCh <- relayPacketConnToUOT(stream, packetConn, !req.IsConnect)
 	}()
 	err = <-errCh
 	if isIgnorableUOTError(err) {
@@ -196,16 +270,40 @@ func relayUOTToPacketConn(dst netproxy.PacketConn, src *Stream, target string) e
 	}
 }
 
-func relayPacketConnToUOT(dst *Stream, src netproxy.PacketConn) error {
+func relayUOTPacketsToPacketConn(dst netproxy.PacketConn, src *Stream) error {
 	buf := make([]byte, maxFrameData)
 	for {
 		_ = src.SetReadDeadline(time.Now().Add(server.DefaultNatTimeout))
-		n, _, err := src.ReadFrom(buf)
+		n, addr, err := readUOTPacket(src, buf)
 		if err != nil {
 			return err
 		}
 		_ = dst.SetWriteDeadline(time.Now().Add(server.DefaultNatTimeout))
-		if err := writeUOTPayload(dst, buf[:n]); err != nil {
+		if _, err := dst.WriteTo(buf[:n], addr.String()); err != nil {
+			if errors.Is(err, server.ErrDialPrivateAddress) {
+				// drop the packet rather than the whole session
+				continue
+			}
+			return err
+		}
+	}
+}
+
+func relayPacketConnToUOT(dst *Stream, src netproxy.PacketConn, withAddr bool) error {
+	buf := make([]byte, maxFrameData)
+	for {
+		_ = src.SetReadDeadline(time.Now().Add(server.DefaultNatTimeout))
+		n, addr, err := src.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		_ = dst.SetWriteDeadline(time.Now().Add(server.DefaultNatTimeout))
+		if withAddr {
+			err = writeUOTPacket(dst, addr, buf[:n])
+		} else {
+			err = writeUOTPayload(dst, buf[:n])
+		}
+		if err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/cert_manager"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/dns_provider"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeStartDelay is how long the certificate supervisor waits for the
+// listeners to answer the challenges before the first issuance.
+var acmeStartDelay = 5 * time.Second
+
+const (
+	ChallengeHTTP01    = "http-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+	ChallengeDNS01     = "dns-01"
+)
+
+type CertificateGetter func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+// NewAutocertTLSResources creates ACME TLS resources for sni by the challenge
+// and the CAs in the config. onRenew is called after a certificate is obtained
+// or renewed, so that the caller can re-register.
+func NewAutocertTLSResources(sni string, onRenew func()) (*TLSResources, error) {
+	sni = strings.TrimSpace(sni)
+	if sni == "" {
+		return nil, fmt.Errorf("empty TLS SNI")
+	}
+	conf := config.ParamsObj.John.ACME
+	cas, err := acmeCAs(conf)
+	if err != nil {
+		return nil, err
+	}
+	dirCache, err := acmeCache(conf)
+	if err != nil {
+		return nil, err
+	}
+	opts := certSupervisorOptions(sni, onRenew)
+	// the issuers put new certificates into the cache, which tells the supervisor
+	cache := &issuedCache{Cache: dirCache, name: sni}
+	var resources *TLSResources
+	switch conf.Challenge {
+	case "", ChallengeHTTP01:
+		resources = newHTTP01TLSResources(sni, cas, newAutocertManagers(sni, cas, cache, conf.Email, opts.RenewBefore))
+	case ChallengeTLSALPN01:
+		resources = newTLSALPN01TLSResources(sni, cas, newAutocertManagers(sni, cas, cache, conf.Email, opts.RenewBefore))
+	case ChallengeDNS01:
+		if resources, opts.Renew, err = newDNS01TLSResources(sni, conf, cas, cache, opts.RenewBefore); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported ACME challenge: %v", strconv.Quote(conf.Challenge))
+	}
+	opts.GetCertificate = resources.TLSConfig.GetCertificate
+	// wait for the listeners to answer the challenges
+	opts.StartDelay = acmeStartDelay
+	supervisor := NewCertSupervisor(opts)
+	cache.supervisor.Store(supervisor)
+	resources.closers = append(resources.closers, supervisor)
+	return resources, nil
+}
+
+// newAutocertManagers returns a manager for every CA. They share the cache, so
+// any of them can serve the certificates and answer the challenges of others.
+func newAutocertManagers(sni string, cas []acmeCA, cache autocert.Cache, email string, renewBefore time.Duration) []*autocert.Manager {
+	managers := make([]*autocert.Manager, 0, len(cas))
+	for _, ca := range cas {
+		managers = append(managers, &autocert.Manager{
+			Cache:                  cache,
+			Prompt:                 autocert.AcceptTOS,
+			HostPolicy:             autocert.HostWhitelist(sni),
+			Email:                  email,
+			RenewBefore:            renewBefore,
+			ExternalAccountBinding: ca.eab,
+			Client:                 &acme.Client{DirectoryURL: ca.directoryURL},
+		})
+	}
+	return managers
+}
+
+func autocertGetters(managers []*autocert.Manager) []CertificateGetter {
+	getters := make([]CertificateGetter, 0, len(managers))
+	for _, manager := range managers {
+		getters = append(getters, manager.GetCertificate)
+	}
+	return getters
+}
+
+func newHTTP01TLSResources(sni string, cas []acmeCA, managers []*autocert.Manager) *TLSResources {
+	// a manager only tries http-01 after its HTTPHandler is called
+	var handler http.Handler
+	for i := len(managers) - 1; i >= 0; i-- {
+		handler = managers[i].HTTPHandler(handler)
+	}
+	getCertificate := fallbackCertificateGetter(sni, cas, autocertGetters(managers))
+	return &TLSResources{
+		TLSConfig: &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: getCertificate,
+		},
+		HTTPServer: &http.Server{Addr: ":80", Handler: handler},
+	}
+}
+
+// newTLSALPN01TLSResources answers the challenges on the TLS listener of the
+// protocol, which must be reachable at port 443 of the host.
+// The managers only try tls-alpn-01 if their HTTPHandler is never called.
+func newTLSALPN01TLSResources(sni string, cas []acmeCA, managers []*autocert.Manager) *TLSResources {
+	getCertificate := fallbackCertificateGetter(sni, cas, autocertGetters(managers))
+	return &TLSResources{
+		TLSConfig: &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: getCertificate,
+			// The protocols set NextProtos by themselves, and a client offering no
+			// protocol of the server would fail the handshake if acme-tls/1 were
+			// in it, so it is only used for the challenges.
+			GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				if !IsACMETLSALPNHello(hello) {
+					return nil, nil
+				}
+				return &tls.Config{
+					MinVersion:     tls.VersionTLS12,
+					NextProtos:     []string{acme.ALPNProto},
+					GetCertificate: getCertificate,
+				}, nil
+			},
+		},
+	}
+}
+
+// IsACMETLSALPNHello reports whether the hello comes from an ACME server
+// validating tls-alpn-01 challenges.
+func IsACMETLSALPNHello(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+// IsACMETLSALPNConn reports whether the handshake of the connection is for a
+// tls-alpn-01 challenge. Such a connection carries no data and should be
+// closed.
+func IsACMETLSALPNConn(state tls.ConnectionState) bool {
+	return state.NegotiatedProtocol == acme.ALPNProto
+}
+
+// newDNS01TLSResources also returns the getter to renew the certificates
+// explicitly.
+func newDNS01TLSResources(sni string, conf config.ACME, cas []acmeCA, cache autocert.Cache, renewBefore time.Duration) (*TLSResources, CertificateGetter, error) {
+	if conf.DNSProvider == "" {
+		return nil, nil, fmt.Errorf("dns-01 challenge: empty DNS provider")
+	}
+	provider, err := dns_provider.New(conf.DNSProvider, conf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("dns-01 challenge: %w", err)
+	}
+	getters := make([]CertificateGetter, 0, len(cas))
+	renewers := make([]CertificateGetter, 0, len(cas))
+	for _, ca := range cas {
+		manager := cert_manager.New(cert_manager.Options{
+			DirectoryURL:           ca.directoryURL,
+			Email:                  conf.Email,
+			ExternalAccountBinding: ca.eab,
+			Provider:               provider,
+			Cache:                  cache,
+			HostPolicy:             autocert.HostWhitelist(sni),
+			PropagationTimeout:     time.Duration(conf.PropagationTimeout) * time.Second,
+			RenewBefore:            renewBefore,
+		})
+		getters = append(getters, manager.GetCertificate)
+		renewers = append(renewers, manager.Renew)
+	}
+	return &TLSResources{
+		TLSConfig: &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: fallbackCertificateGetter(sni, cas, getters),
+		},
+	}, fallbackCertificateGetter(sni, cas, renewers), nil
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/acme_test_server"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/dns_provider"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestAutocertTLSResourcesProvideDynamicCertificates(t *testing.T) {
+	resources, err := NewAutocertTLSResources("edge.example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resources.Close()
+	if resources.TLSConfig == nil {
+		t.Fatal("tlsConfig is nil")
+	}
+	if resources.TLSConfig.GetCertificate == nil {
+		t.Fatal("GetCertificate is nil")
+	}
+	if len(resources.TLSConfig.Certificates) != 0 {
+		t.Fatalf("static certificates = %d, want 0", len(resources.TLSConfig.Certificates))
+	}
+	if resources.TLSConfig.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("MinVersion = %v, want TLS 1.2", resources.TLSConfig.MinVersion)
+	}
+	if resources.HTTPServer == nil {
+		t.Fatal("ACME HTTP server is nil")
+	}
+	if resources.HTTPServer.Addr != ":80" {
+		t.Fatalf("ACME HTTP server addr = %q, want %q", resources.HTTPServer.Addr, ":80")
+	}
+}
+
+func TestTLSALPN01ChallengeOnProtocolListener(t *testing.T) {
+	const domain = "edge.example.test"
+	lt, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lt.Close()
+	zone := acme_test_server.StartZone(t)
+	zone.SetA(domain, net.IPv4(127, 0, 0, 1))
+	pebble := acme_test_server.StartPebble(t, acme_test_server.PebbleOptions{
+		ResolverAddr: zone.Addr,
+		TLSPort:      lt.Addr().(*net.TCPAddr).Port,
+	})
+	manager := &autocert.Manager{
+		Cache:      autocert.DirCache(t.TempDir()),
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domain),
+		Client:     &acme.Client{DirectoryURL: pebble.DirectoryURL, HTTPClient: pebble.Client},
+	}
+	resources := newTLSALPN01TLSResources(domain, []acmeCA{{directoryURL: pebble.DirectoryURL}}, []*autocert.Manager{manager})
+	if resources.HTTPServer != nil {
+		t.Fatal("ACME HTTP server is not nil with tls-alpn-01 challenges")
+	}
+	// like the gRPC server
+	tlsConfig := resources.TLSConfig.Clone()
+	tlsConfig.NextProtos = []string{"h2"}
+	go func() {
+		for {
+			conn, err := lt.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tlsConn := tls.Server(conn, tlsConfig)
+				if err := tlsConn.Handshake(); err != nil || IsACMETLSALPNConn(tlsConn.ConnectionState()) {
+					return
+				}
+				_, _ = tlsConn.Write([]byte("hello"))
+			}()
+		}
+	}()
+
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: 30 * time.Second},
+		Config: &tls.Config{
+			ServerName: domain,
+			// not acme-tls/1 nor a protocol of the server
+			NextProtos:         []string{"http/1.1"},
+			InsecureSkipVerify: true,
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, "tcp", lt.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	state := conn.(*tls.Conn).ConnectionState()
+	if err = state.PeerCertificates[0].VerifyHostname(domain); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(conn); err != nil || string(b) != "hello" {
+		t.Fatalf("got %q (%v), want %q", b, err, "hello")
+	}
+}
+
+type nopDNSProvider struct{}
+
+func (nopDNSProvider) Present(context.Context, string, string) error { return nil }
+func (nopDNSProvider) CleanUp(context.Context, string, string) error { return nil }
+
+func TestAutocertTLSResourcesWithDNS01DoNotNeedHTTPServer(t *testing.T) {
+	dns_provider.Register("nop", func(config.ACME) (dns_provider.Provider, error) {
+		return nopDNSProvider{}, nil
+	})
+	acme := config.ParamsObj.John.ACME
+	defer func() { config.ParamsObj.John.ACME = acme }()
+
+	config.ParamsObj.John.ACME = config.ACME{Challenge: ChallengeDNS01, DNSProvider: "nop"}
+	resources, err := NewAutocertTLSResources("edge.example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resources.Close()
+	if resources.HTTPServer != nil {
+		t.Fatal("ACME HTTP server is not nil with dns-01 challenges")
+	}
+	if resources.TLSConfig == nil || resources.TLSConfig.GetCertificate == nil {
+		t.Fatal("GetCertificate is nil")
+	}
+
+	for _, conf := range []config.ACME{
+		{Challenge: ChallengeDNS01},
+		{Challenge: ChallengeDNS01, DNSProvider: "unknown"},
+		{Challenge: "unknown"},
+	} {
+		config.ParamsObj.John.ACME = conf
+		if _, err = NewAutocertTLSResources("edge.example.com", nil); err == nil {
+			t.Fatalf("%+v: expected an error", conf)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+)
+
+const lisaResolveInterval = 10 * time.Minute
+
+// Banner bans the sources failing the authentication repeatedly for a while,
+// like fail2ban. IPv4 sources are counted by /32 and IPv6 ones by /64. The
+// state is in memory only and bounded by maxEntries, beyond which the least
+// recently failed sources are forgotten.
+type Banner struct {
+	maxFailures int
+	window      time.Duration
+	banTime     time.Duration
+	maxBanTime  time.Duration
+	maxEntries  int
+
+	allow []netip.Prefix
+	// the IPs of SweetLisa are never banned
+	lisaHost string
+	lisaIPs  atomic.Pointer[[]netip.Addr]
+
+	mu      sync.Mutex
+	entries map[netip.Prefix]*list.Element
+	// lru has the most recently failed one at the front
+	lru *list.List
+}
+
+type banEntry struct {
+	prefix netip.Prefix
+	// failures are the times within the window, the oldest first
+	failures    []time.Time
+	bans        int
+	bannedUntil time.Time
+}
+
+// NewBanner validates the config. The IPs which lisaHost resolves to are
+// allowed besides the ones in conf.Allow, which are resolved in the background
+// until done is closed.
+func NewBanner(conf config.Ban, lisaHost string, done <-chan struct{}) (*Banner, error) {
+	if conf.MaxFailures <= 0 {
+		return nil, fmt.Errorf("invalid maxFailures of ban: %v", conf.MaxFailures)
+	}
+	if conf.Window <= 0 || conf.BanTime <= 0 || conf.MaxBanTime < conf.BanTime {
+		return nil, fmt.Errorf("invalid window, banTime or maxBanTime of ban: %v, %v, %v", conf.Window, conf.BanTime, conf.MaxBanTime)
+	}
+	if conf.MaxEntries <= 0 {
+		return nil, fmt.Errorf("invalid maxEntries of ban: %v", conf.MaxEntries)
+	}
+	b := &Banner{
+		maxFailures: conf.MaxFailures,
+		window:      time.Duration(conf.Window) * time.Second,
+		banTime:     time.Duration(conf.BanTime) * time.Second,
+		maxBanTime:  time.Duration(conf.MaxBanTime) * time.Second,
+		maxEntries:  conf.MaxEntries,
+		lisaHost:    lisaHost,
+		entries:     make(map[netip.Prefix]*list.Element),
+		lru:         list.New(),
+	}
+	for _, s := range strings.Split(conf.Allow, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, e := netip.ParseAddr(s)
+			if e != nil {
+				return nil, fmt.Errorf("invalid allow of ban: %w", err)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		b.allow = append(b.allow, prefix.Masked())
+	}
+	if addr, err := netip.ParseAddr(lisaHost); err == nil {
+		b.lisaIPs.Store(&[]netip.Addr{addr.Unmap()})
+	} else if lisaHost != "" {
+		go b.resolveLisaBackground(done)
+	}
+	return b, nil
+}
+
+// banPrefix returns the prefix of addr by which the failures are counted.
+func banPrefix(addr netip.Addr) netip.Prefix {
+	addr = addr.Unmap()
+	if addr.Is4() {
+		return netip.PrefixFrom(addr, 32)
+	}
+	prefix, _ := addr.Prefix(64)
+	return prefix
+}
+
+// Banned tells if addr is banned now.
+func (b *Banner) Banned(addr netip.Addr) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	elem, ok := b.entries[banPrefix(addr)]
+	return ok && time.Now().Before(elem.Value.(*banEntry).bannedUntil)
+}
+
+// Fail counts a failure of addr. It returns the prefix and the duration if
+// the prefix is banned by this failure.
+func (b *Banner) Fail(addr netip.Addr) (netip.Prefix, time.Duration) {
+	if b.allowed(addr) {
+		return netip.Prefix{}, 0
+	}
+	prefix := banPrefix(addr)
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var e *banEntry
+	if elem, ok := b.entries[prefix]; ok {
+		b.lru.MoveToFront(elem)
+		e = elem.Value.(*banEntry)
+	} else {
+		e = &banEntry{prefix: prefix}
+		b.entries[prefix] = b.lru.PushFront(e)
+		for b.lru.Len() > b.maxEntries {
+			delete(b.entries, b.lru.Remove(b.lru.Back()).(*banEntry).prefix)
+		}
+	}
+	if now.Before(e.bannedUntil) {
+		return prefix, 0
+	}
+	// forgive the bans long ago
+	if !e.bannedUntil.IsZero() && now.Sub(e.bannedUntil) > b.maxBanTime {
+		e.bans = 0
+	}
+	i := 0
+	for i < len(e.failures) && now.Sub(e.failures[i]) >= b.window {
+		i++
+	}
+	e.failures = append(e.failures[i:], now)
+	if len(e.failures) < b.maxFailures {
+		return prefix, 0
+	}
+	e.failures = nil
+	e.bans++
+	d := b.banTime
+	for j := 1; j < e.bans && d < b.maxBanTime; j++ {
+		d *= 2
+	}
+	d = min(d, b.maxBanTime)
+	e.bannedUntil = now.Add(d)
+	return prefix, d
+}
+
+func (b *Banner) allowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range b.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	if ips := b.lisaIPs.Load(); ips != nil {
+		for _, ip := range *ips {
+			if ip == addr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolveLisaBackground resolves the host of SweetLisa every
+// lisaResolveInterval, and keeps the last IPs if it fails.
+func (b *Banner) resolveLisaBackground(done <-chan struct{}) {
+	ticker := time.NewTicker(lisaResolveInterval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", b.lisaHost)
+		cancel()
+		if err != nil {
+			log.Warn("Failed to resolve SweetLisa to allow it from the ban: %v", err)
+		} else {
+			ips := make([]netip.Addr, 0, len(addrs))
+			for _, addr := range addrs {
+				ips = append(ips, addr.Unmap())
+			}
+			b.lisaIPs.Store(&ips)
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+)
+
+func TestBannerBansWithBackoff(t *testing.T) {
+	b, err := NewBanner(config.Ban{
+		MaxFailures: 3,
+		Window:      600,
+		BanTime:     600,
+		MaxBanTime:  1800,
+		MaxEntries:  1,
+		Allow:       "192.0.2.0/24, 2001:db8::1",
+	}, "198.51.100.1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fail := func(addr string, n int) time.Duration {
+		var d time.Duration
+		for i := 0; i < n; i++ {
+			_, d = b.Fail(netip.MustParseAddr(addr))
+		}
+		return d
+	}
+
+	if d := fail("203.0.113.1", 2); d != 0 || b.Banned(netip.MustParseAddr("203.0.113.1")) {
+		t.Fatal("banned before the max failures")
+	}
+	if d := fail("203.0.113.1", 1); d != 10*time.Minute {
+		t.Fatalf("banned for %v, want 10m", d)
+	}
+	if !b.Banned(netip.MustParseAddr("::ffff:203.0.113.1")) {
+		t.Fatal("the IPv4-mapped address is not banned")
+	}
+	if b.Banned(netip.MustParseAddr("203.0.113.2")) {
+		t.Fatal("the neighbor of an IPv4 address is banned")
+	}
+
+	// the ban doubles up to the max
+	for _, want := range []time.Duration{20 * time.Minute, 30 * time.Minute} {
+		b.mu.Lock()
+		b.entries[banPrefix(netip.MustParseAddr("203.0.113.1"))].Value.(*banEntry).bannedUntil = time.Now()
+		b.mu.Unlock()
+		if d := fail("203.0.113.1", 3); d != want {
+			t.Fatalf("banned for %v, want %v", d, want)
+		}
+	}
+
+	// IPv6 is counted by /64
+	fail("2001:db8:1::1", 2)
+	if d := fail("2001:db8:1::2", 1); d == 0 || !b.Banned(netip.MustParseAddr("2001:db8:1::ffff")) {
+		t.Fatal("the /64 is not banned")
+	}
+
+	// the least recently failed one is forgotten
+	if b.Banned(netip.MustParseAddr("203.0.113.1")) {
+		t.Fatal("more entries are kept than the max")
+	}
+
+	for _, addr := range []string{"192.0.2.1", "2001:db8::1", "198.51.100.1"} {
+		if d := fail(addr, 3); d != 0 || b.Banned(netip.MustParseAddr(addr)) {
+			t.Fatalf("%v is banned though allowed", addr)
+		}
+	}
+}
+
+func TestBannerResolvesLisaInBackground(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	b, err := NewBanner(config.Ban{
+		MaxFailures: 1,
+		Window:      600,
+		BanTime:     600,
+		MaxBanTime:  600,
+		MaxEntries:  16,
+	}, "localhost", done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(DialTimeout)
+	for b.lisaIPs.Load() == nil {
+		if time.Now().After(deadline) {
+			t.Skip("localhost cannot be resolved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, addr := range *b.lisaIPs.Load() {
+		if _, d := b.Fail(addr); d != 0 || b.Banned(addr) {
+			t.Fatalf("%v of SweetLisa is banned", addr)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	DefaultCertRenewBefore   = 30 * 24 * time.Hour
+	DefaultCertCheckInterval = 6 * time.Hour
+	DefaultCertAlertAfter    = 3
+	DefaultCertMinBackoff    = time.Minute
+)
+
+// CertificateStatus is the state of a certificate reported in the ping
+// responses.
+type CertificateStatus struct {
+	Name      string
+	NotAfter  time.Time
+	RenewedAt time.Time
+	// Failures is the number of consecutive failed checks or renewals.
+	Failures  int
+	LastError string `json:",omitempty"`
+	NextCheck time.Time
+}
+
+type CertSupervisorOptions struct {
+	Name string
+	// GetCertificate returns the certificate being served.
+	GetCertificate CertificateGetter
+	// Renew obtains a new certificate. It is nil if the issuer renews by itself,
+	// such as autocert and certbot, and the supervisor only watches.
+	Renew CertificateGetter
+	// RenewBefore is how early the certificate should be renewed before
+	// expiry.
+	RenewBefore   time.Duration
+	CheckInterval time.Duration
+	// MinBackoff is the first delay to retry after a failure, which doubles
+	// up to CheckInterval.
+	MinBackoff time.Duration
+	// AlertAfter is the number of consecutive failures to alert after.
+	AlertAfter int
+	// StartDelay delays the first check, which may need the listeners for the
+	// ACME challenges.
+	StartDelay time.Duration
+	// OnRenew is called after a new certificate is issued or loaded.
+	OnRenew func()
+}
+
+// CertSupervisor checks the certificate of a name in the background, renews it
+// ahead of expiry, and retries with backoff. The issuers tell it about new
+// certificates by Issued instead of it guessing by the time of handshakes.
+type CertSupervisor struct {
+	opts CertSupervisorOptions
+
+	mu     sync.Mutex
+	status CertificateStatus
+	serial string
+
+	issued    chan *x509.Certificate
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var certSupervisors sync.Map // *CertSupervisor -> struct{}
+
+func NewCertSupervisor(opts CertSupervisorOptions) *CertSupervisor {
+	if opts.RenewBefore <= 0 {
+		opts.RenewBefore = DefaultCertRenewBefore
+	}
+	if opts.CheckInterval <= 0 {
+		opts.CheckInterval = DefaultCertCheckInterval
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = DefaultCertMinBackoff
+	}
+	if opts.AlertAfter <= 0 {
+		opts.AlertAfter = DefaultCertAlertAfter
+	}
+	s := &CertSupervisor{
+		opts:   opts,
+		status: CertificateStatus{Name: opts.Name},
+		issued: make(chan *x509.Certificate, 1),
+		closed: make(chan struct{}),
+	}
+	certSupervisors.Store(s, struct{}{})
+	go s.run()
+	return s
+}
+
+// CertificateStatuses returns the statuses of the supervised certificates.
+func CertificateStatuses() []CertificateStatus {
+	var statuses []CertificateStatus
+	certSupervisors.Range(func(key, _ any) bool {
+		statuses = append(statuses, key.(*CertSupervisor).Status())
+		return true
+	})
+	slices.SortFunc(statuses, func(a, b CertificateStatus) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return statuses
+}
+
+func (s *CertSupervisor) Status() CertificateStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// Issued tells the supervisor that a new certificate of the name is issued or
+// loaded. It does not block.
+func (s *CertSupervisor) Issued(leaf *x509.Certificate) {
+	// the latest one replaces the pending one
+	for {
+		select {
+		case s.issued <- leaf:
+			return
+		default:
+		}
+		select {
+		case <-s.issued:
+		default:
+		}
+	}
+}
+
+func (s *CertSupervisor) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		certSupervisors.Delete(s)
+	})
+	return nil
+}
+
+func (s *CertSupervisor) run() {
+	timer := time.NewTimer(s.opts.StartDelay)
+	defer timer.Stop()
+	for {
+		var next time.Duration
+		select {
+		case <-s.closed:
+			return
+		case leaf := <-s.issued:
+			next = s.onIssued(leaf)
+		case <-timer.C:
+			next = s.check()
+		}
+		timer.Stop()
+		select {
+		case <-timer.C:
+		default:
+		}
+		timer.Reset(next)
+		s.mu.Lock()
+		s.status.NextCheck = time.Now().Add(next)
+		s.mu.Unlock()
+	}
+}
+
+func (s *CertSupervisor) onIssued(leaf *x509.Certificate) time.Duration {
+	s.mu.Lock()
+	renewed := leaf.SerialNumber.String() != s.serial
+	s.observe(leaf)
+	if renewed {
+		s.status.RenewedAt = time.Now()
+		s.status.Failures = 0
+		s.status.LastError = ""
+	}
+	s.mu.Unlock()
+	if !renewed {
+		return s.nextCheck(leaf)
+	}
+	log.Warn("The certificate for %v is renewed, which expires at %v.", s.opts.Name, leaf.NotAfter.Format(time.RFC3339))
+	if s.opts.OnRenew != nil {
+		s.opts.OnRenew()
+	}
+	return s.nextCheck(leaf)
+}
+
+// check loads the certificate being served, which also makes the issuers
+// obtain it or start their own renewals without waiting for clients, and
+// renews it if it is going to expire.
+func (s *CertSupervisor) check() time.Duration {
+	cert, err := s.opts.GetCertificate(s.hello())
+	if err != nil {
+		return s.fail(fmt.Errorf("get the certificate: %w", err))
+	}
+	leaf, err := certificateLeaf(cert)
+	if err != nil {
+		return s.fail(err)
+	}
+	s.mu.Lock()
+	if s.serial == "" || leaf.NotAfter.After(s.status.NotAfter) {
+		s.observe(leaf)
+	}
+	s.mu.Unlock()
+	if time.Until(leaf.NotAfter) > s.due() {
+		s.succeed()
+		return s.nextCheck(leaf)
+	}
+	if s.opts.Renew == nil {
+		return s.fail(fmt.Errorf("not renewed yet, and it expires at %v", leaf.NotAfter.Format(time.RFC3339)))
+	}
+	log.Warn("We are now renewing the certificate for %v.", s.opts.Name)
+	if _, err = s.opts.Renew(s.hello()); err != nil {
+		return s.fail(fmt.Errorf("renew: %w", err))
+	}
+	// the issuer tells by Issued
+	s.succeed()
+	return s.opts.MinBackoff
+}
+
+// hello is like that of a modern client, lest autocert choose RSA
+// certificates.
+func (s *CertSupervisor) hello() *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{
+		ServerName:        s.opts.Name,
+		CipherSuites:      []uint16{tls.TLS_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SupportedCurves:   []tls.CurveID{tls.X25519, tls.CurveP256},
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PSSWithSHA256},
+		SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+	}
+}
+
+// observe must be called with s.mu held.
+func (s *CertSupervisor) observe(leaf *x509.Certificate) {
+	s.serial = leaf.SerialNumber.String()
+	s.status.NotAfter = leaf.NotAfter
+}
+
+func (s *CertSupervisor) succeed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Failures = 0
+	s.status.LastError = ""
+}
+
+func (s *CertSupervisor) fail(err error) time.Duration {
+	s.mu.Lock()
+	s.status.Failures++
+	s.status.LastError = err.Error()
+	failures := s.status.Failures
+	notAfter := s.status.NotAfter
+	s.mu.Unlock()
+	if failures >= s.opts.AlertAfter {
+		if notAfter.IsZero() {
+			log.Alert("The certificate for %v has failed %v times: %v", s.opts.Name, failures, err)
+		} else {
+			log.Alert("The certificate for %v has failed %v times and expires in %v: %v", s.opts.Name, failures, time.Until(notAfter).Truncate(time.Minute), err)
+		}
+	} else {
+		log.Warn("The certificate for %v: %v", s.opts.Name, err)
+	}
+	backoff := s.opts.MinBackoff << min(failures-1, 16)
+	return min(backoff, s.opts.CheckInterval)
+}
+
+// due returns the time before expiry when the certificate is due for renewal.
+// The issuers renewing by themselves are given a grace of a sixth of
+// RenewBefore, since they schedule with jitters or only once or twice a day.
+func (s *CertSupervisor) due() time.Duration {
+	if s.opts.Renew == nil {
+		return s.opts.RenewBefore - s.opts.RenewBefore/6
+	}
+	return s.opts.RenewBefore
+}
+
+// nextCheck returns the time until the next regular check, which is no later
+// than the renewal is due.
+func (s *CertSupervisor) nextCheck(leaf *x509.Certificate) time.Duration {
+	return max(min(time.Until(leaf.NotAfter.Add(-s.due())), s.opts.CheckInterval), s.opts.MinBackoff)
+}
+
+func certificateLeaf(cert *tls.Certificate) (*x509.Certificate, error) {
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("empty certificate")
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
+
+// issuedCache tells the supervisor about the certificates of the name that the
+// ACME managers put into the cache.
+type issuedCache struct {
+	autocert.Cache
+	name string
+	// supervisor is set after the managers using the cache are created
+	supervisor atomic.Pointer[CertSupervisor]
+}
+
+func (c *issuedCache) Put(ctx context.Context, key string, data []byte) error {
+	if err := c.Cache.Put(ctx, key, data); err != nil {
+		return err
+	}
+	// autocert keeps RSA certificates with the suffix
+	supervisor := c.supervisor.Load()
+	if supervisor == nil || key != c.name && key != c.name+"+rsa" {
+		return nil
+	}
+	for rest := data; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if leaf, err := x509.ParseCertificate(block.Bytes); err == nil {
+			supervisor.Issued(leaf)
+		}
+		break
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestCertSupervisorRenewsAheadOfExpiry(t *testing.T) {
+	const name = "edge.example.com"
+	var mu sync.Mutex
+	served, _ := newTestCertificate(t, name, time.Now().Add(time.Hour))
+	cache := &issuedCache{Cache: autocert.DirCache(t.TempDir()), name: name}
+	renewed := make(chan struct{}, 1)
+	supervisor := NewCertSupervisor(CertSupervisorOptions{
+		Name: name,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return served, nil
+		},
+		Renew: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, data := newTestCertificate(t, hello.ServerName, time.Now().Add(90*24*time.Hour))
+			// like the ACME managers
+			if err := cache.Put(context.Background(), hello.ServerName, data); err != nil {
+				return nil, err
+			}
+			mu.Lock()
+			served = cert
+			mu.Unlock()
+			return cert, nil
+		},
+		MinBackoff: 10 * time.Millisecond,
+		OnRenew:    func() { renewed <- struct{}{} },
+	})
+	cache.supervisor.Store(supervisor)
+	defer supervisor.Close()
+
+	select {
+	case <-renewed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("the certificate was not renewed")
+	}
+	status := supervisor.Status()
+	if time.Until(status.NotAfter) < 30*24*time.Hour {
+		t.Fatalf("NotAfter = %v, want the renewed one", status.NotAfter)
+	}
+	if status.RenewedAt.IsZero() || status.Failures != 0 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	// the renewed certificate is observed but not renewed again
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-renewed:
+		t.Fatal("renewed twice")
+	default:
+	}
+}
+
+func TestCertSupervisorBacksOffAndReports(t *testing.T) {
+	const name = "backoff.example.com"
+	expected := errors.New("rate limited")
+	var (
+		mu    sync.Mutex
+		calls []time.Time
+	)
+	supervisor := NewCertSupervisor(CertSupervisorOptions{
+		Name: name,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls = append(calls, time.Now())
+			return nil, expected
+		},
+		MinBackoff:    20 * time.Millisecond,
+		CheckInterval: time.Second,
+		AlertAfter:    2,
+	})
+	defer supervisor.Close()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for supervisor.Status().Failures < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("failures = %v, want 4", supervisor.Status().Failures)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	// 20ms, 40ms and then 80ms
+	if gap, prev := calls[3].Sub(calls[2]), calls[2].Sub(calls[1]); gap <= prev {
+		t.Fatalf("the retries do not back off: %v after %v", gap, prev)
+	}
+	mu.Unlock()
+	if status := supervisor.Status(); !strings.Contains(status.LastError, expected.Error()) {
+		t.Fatalf("LastError = %q, want %q", status.LastError, expected)
+	}
+
+	// reported to SweetLisa along with the bandwidth
+	resp, err := GeneratePingResp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := jsoniter.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields struct {
+		BandwidthLimit *struct{}
+		Certificates   []CertificateStatus
+	}
+	if err = jsoniter.Unmarshal(b, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields.BandwidthLimit == nil {
+		t.Fatalf("BandwidthLimit is missing in %s", b)
+	}
+	var found bool
+	for _, status := range fields.Certificates {
+		found = found || status.Name == name && status.Failures >= 4
+	}
+	if !found {
+		t.Fatalf("the certificate status is missing in %s", b)
+	}
+
+	supervisor.Close()
+	for _, status := range CertificateStatuses() {
+		if status.Name == name {
+			t.Fatal("the status is reported after Close")
+		}
+	}
+}
+
+// newTestCertificate returns a self-signed certificate and its cache data in
+// the format of autocert.
+func newTestCertificate(t *testing.T, name string, notAfter time.Time) (*tls.Certificate, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, data
+}
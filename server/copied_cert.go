@@ -0,0 +1,263 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/common"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/copy_cert"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+)
+
+const minCopiedCertBackoff = time.Minute
+
+// CopiedCertificate is the certificate chain of a real site copied with new
+// keys, which the QUIC protocols serve to look like the site. It is copied
+// again after the site rotates its certificates, lest the stale chain stand
+// out.
+type CopiedCertificate struct {
+	domain   string
+	interval time.Duration
+	// fetch and dataFile are replaced in tests
+	fetch    func(addr string) ([]*x509.Certificate, error)
+	dataFile func(filename string) (string, error)
+
+	pinned PinnedCertificate
+
+	mu  sync.RWMutex
+	crt []byte
+	key []byte
+	// serial is of the leaf of the site, which the copy keeps
+	serial   *big.Int
+	onChange []func()
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewCopiedCertificate loads the copied chain of the domain from the data dir,
+// or copies it if there is none. It is checked every interval for rotations,
+// and never if interval is zero.
+func NewCopiedCertificate(domain string, interval time.Duration) (*CopiedCertificate, error) {
+	return newCopiedCertificate(&CopiedCertificate{
+		domain:   domain,
+		interval: interval,
+		fetch:    copy_cert.Fetch,
+		dataFile: config.DataFile,
+	})
+}
+
+func newCopiedCertificate(c *CopiedCertificate) (*CopiedCertificate, error) {
+	if c.domain = strings.TrimSpace(c.domain); c.domain == "" {
+		c.domain = JuicityDomain
+	}
+	c.closed = make(chan struct{})
+	domain := c.domain
+	crtPath, keyPath, err := c.paths()
+	if err != nil {
+		return nil, err
+	}
+	crt, err := os.ReadFile(crtPath)
+	if err == nil {
+		var key []byte
+		if key, err = os.ReadFile(keyPath); err == nil {
+			err = c.set(crt, key)
+		}
+	}
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Warn("Failed to load the copied certificate chain of %v, and copy it again: %v", domain, err)
+		}
+		origin, err := c.fetch(c.addr())
+		if err != nil {
+			return nil, err
+		}
+		if err = c.copy(origin); err != nil {
+			return nil, err
+		}
+	}
+	if c.interval > 0 {
+		go c.run()
+	}
+	return c, nil
+}
+
+// Domain returns the site impersonated, which clients use as the SNI.
+func (c *CopiedCertificate) Domain() string {
+	return c.domain
+}
+
+// KeyPair returns the chain and the keys in PEM.
+func (c *CopiedCertificate) KeyPair() (crt []byte, key []byte) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.crt, c.key
+}
+
+// PinnedCertchainSha256 returns the hash of the chain for clients to pin.
+func (c *CopiedCertificate) PinnedCertchainSha256() string {
+	return c.pinned.PinnedCertchainSha256()
+}
+
+// OnChange registers f to be called after the chain is copied again.
+func (c *CopiedCertificate) OnChange(f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onChange = append(c.onChange, f)
+}
+
+func (c *CopiedCertificate) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *CopiedCertificate) addr() string {
+	return net.JoinHostPort(c.domain, "443")
+}
+
+func (c *CopiedCertificate) paths() (crtPath string, keyPath string, err error) {
+	if crtPath, err = c.dataFile(c.domain + "_443.crt"); err != nil {
+		return "", "", err
+	}
+	if keyPath, err = c.dataFile(c.domain + "_443.key"); err != nil {
+		return "", "", err
+	}
+	return crtPath, keyPath, nil
+}
+
+func (c *CopiedCertificate) set(crt []byte, key []byte) error {
+	if err := c.pinned.Set(crt, key); err != nil {
+		return err
+	}
+	cert, _ := c.pinned.GetCertificate(nil)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.crt, c.key = crt, key
+	c.serial = cert.Leaf.SerialNumber
+	return nil
+}
+
+// copy copies the chain of the site and saves it to the data dir.
+func (c *CopiedCertificate) copy(origin []*x509.Certificate) error {
+	crt, key, err := copy_cert.CopyChain(origin)
+	if err != nil {
+		return err
+	}
+	crtPath, keyPath, err := c.paths()
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(crtPath, crt, 0600); err != nil {
+		return err
+	}
+	if err = os.WriteFile(keyPath, key, 0600); err != nil {
+		return err
+	}
+	return c.set(crt, key)
+}
+
+func (c *CopiedCertificate) run() {
+	// check soon in case the site rotated while we were offline
+	next := min(c.interval, minCopiedCertBackoff)
+	backoff := minCopiedCertBackoff
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-time.After(next):
+		}
+		var err error
+		if next, err = c.refresh(); err != nil {
+			log.Warn("Failed to refresh the copied certificate chain of %v: %v. Retry in %v.", c.domain, err, backoff)
+			next = backoff
+			backoff = min(backoff*2, c.interval)
+			continue
+		}
+		backoff = minCopiedCertBackoff
+	}
+}
+
+// refresh copies the chain again if the site has rotated its certificates,
+// and returns the time until the next check, which is no later than the
+// certificate of the site expires.
+func (c *CopiedCertificate) refresh() (time.Duration, error) {
+	origin, err := c.fetch(c.addr())
+	if err != nil {
+		return 0, err
+	}
+	if len(origin) == 0 {
+		return 0, fmt.Errorf("no certificate from %v", c.addr())
+	}
+	// CopyChain modifies the chain
+	leaf := origin[0]
+	serial, notAfter := leaf.SerialNumber, leaf.NotAfter
+	c.mu.RLock()
+	same := c.serial != nil && c.serial.Cmp(serial) == 0
+	c.mu.RUnlock()
+	if !same {
+		if err = c.copy(origin); err != nil {
+			return 0, err
+		}
+		log.Warn("The certificate chain of %v is copied again after its rotation.", c.domain)
+		c.mu.RLock()
+		onChange := c.onChange
+		c.mu.RUnlock()
+		for _, f := range onChange {
+			f()
+		}
+	}
+	return max(min(c.interval, time.Until(notAfter)), minCopiedCertBackoff), nil
+}
+
+// PinnedCertificate is served to clients pinning the hash of its chain, and
+// can be replaced while serving.
+type PinnedCertificate struct {
+	v atomic.Pointer[pinnedCertificate]
+}
+
+type pinnedCertificate struct {
+	cert tls.Certificate
+	hash string
+}
+
+func (p *PinnedCertificate) Set(crt []byte, key []byte) error {
+	cert, err := tls.X509KeyPair(crt, key)
+	if err != nil {
+		return err
+	}
+	hash, err := common.GenerateCertChainHashFromBytes(crt)
+	if err != nil {
+		return err
+	}
+	p.v.Store(&pinnedCertificate{cert: cert, hash: hash})
+	return nil
+}
+
+// GetCertificate implements the tls.Config.GetCertificate hook.
+func (p *PinnedCertificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	v := p.v.Load()
+	if v == nil {
+		return nil, errors.New("no certificate")
+	}
+	return &v.cert, nil
+}
+
+// PinnedCertchainSha256 returns the hash of the chain for clients to pin.
+func (p *PinnedCertificate) PinnedCertchainSha256() string {
+	if v := p.v.Load(); v != nil {
+		return v.hash
+	}
+	return ""
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSite issues the certificate chain of a site, whose leaf can be rotated.
+type testSite struct {
+	t      *testing.T
+	caKey  *ecdsa.PrivateKey
+	ca     *x509.Certificate
+	caDER  []byte
+	mu     sync.Mutex
+	serial int64
+}
+
+func newTestSite(t *testing.T) *testSite {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(100),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSite{t: t, caKey: key, ca: ca, caDER: der, serial: 1}
+}
+
+func (s *testSite) rotate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.serial++
+}
+
+// fetch returns a fresh chain like copy_cert.Fetch, since the copy modifies it.
+func (s *testSite) fetch(string) ([]*x509.Certificate, error) {
+	s.mu.Lock()
+	serial := s.serial
+	s.mu.Unlock()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "site.example.com"},
+		DNSNames:     []string{"site.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(12 * time.Hour),
+	}, s.ca, &key.PublicKey, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(s.caDER)
+	if err != nil {
+		return nil, err
+	}
+	return []*x509.Certificate{leaf, ca}, nil
+}
+
+func TestCopiedCertificateRefreshesAfterRotation(t *testing.T) {
+	dir := t.TempDir()
+	dataFile := func(filename string) (string, error) {
+		return filepath.Join(dir, filename), nil
+	}
+	site := newTestSite(t)
+	copied, err := newCopiedCertificate(&CopiedCertificate{
+		domain:   "site.example.com",
+		interval: 24 * time.Hour,
+		fetch:    site.fetch,
+		dataFile: dataFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copied.Close()
+	var changes int
+	copied.OnChange(func() { changes++ })
+	hash := copied.PinnedCertchainSha256()
+	if hash == "" {
+		t.Fatal("empty pinned hash")
+	}
+
+	next, err := copied.refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes != 0 || copied.PinnedCertchainSha256() != hash {
+		t.Fatal("copied again without a rotation")
+	}
+	// no later than the expiry of the site
+	if next > 12*time.Hour {
+		t.Fatalf("next check in %v, want no later than the expiry", next)
+	}
+
+	site.rotate()
+	if _, err = copied.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if changes != 1 {
+		t.Fatalf("OnChange called %v times, want 1", changes)
+	}
+	if copied.PinnedCertchainSha256() == hash {
+		t.Fatal("the pinned hash is not updated")
+	}
+	crt, key := copied.KeyPair()
+	cert, err := tls.X509KeyPair(crt, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf.SerialNumber.Int64() != 2 {
+		t.Fatalf("the copied serial = %v, want 2", cert.Leaf.SerialNumber)
+	}
+
+	// the refreshed chain is saved and loaded without the site
+	loaded, err := newCopiedCertificate(&CopiedCertificate{
+		domain: "site.example.com",
+		fetch: func(string) ([]*x509.Certificate, error) {
+			return nil, errors.New("offline")
+		},
+		dataFile: dataFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.PinnedCertchainSha256() != copied.PinnedCertchainSha256() {
+		t.Fatal("the saved chain is not loaded")
+	}
+}
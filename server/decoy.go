@@ -0,0 +1,43 @@
+package server
+
+import (
+	"io"
+	"net/http"
+)
+
+// DecoyPage is served to the requests of active probes, so that the server
+// looks like an ordinary web server.
+const DecoyPage = `<!DOCTYPE html>
+<html>
+<head>
+<title>Welcome to nginx!</title>
+<style>
+html { color-scheme: light dark; }
+body { width: 35em; margin: 0 auto;
+font-family: Tahoma, Verdana, Arial, sans-serif; }
+</style>
+</head>
+<body>
+<h1>Welcome to nginx!</h1>
+<p>If you see this page, the nginx web server is successfully installed and
+working. Further configuration is required.</p>
+
+<p>For online documentation and support please refer to
+<a href="http://nginx.org/">nginx.org</a>.<br/>
+Commercial support is available at
+<a href="http://nginx.com/">nginx.com</a>.</p>
+
+<p><em>Thank you for using nginx.</em></p>
+</body>
+</html>
+`
+
+// ServeDecoy responds the decoy page like a freshly installed nginx.
+func ServeDecoy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Server", "nginx")
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = io.WriteString(w, DecoyPage)
+}
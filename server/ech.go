@@ -0,0 +1,263 @@
+package server
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	jsoniter "github.com/json-iterator/go"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	echKeysFile = "ech_keys.json"
+	// echVersion is the version of ECHConfig, which is also the code point of
+	// the extension.
+	echVersion = 0xfe0d
+	// DHKEM(X25519, HKDF-SHA256)
+	echKEMX25519  = 0x0020
+	echKDFSHA256  = 0x0001
+	echAEADAES    = 0x0001
+	echAEADChaCha = 0x0003
+
+	minECHRotateBackoff = time.Minute
+)
+
+// ECHKeys are the keys of Encrypted Client Hello, whose configs are published
+// to SweetLisa for clients to hide the real SNI behind the public name. They
+// are rotated every interval, and the previous key is still accepted until the
+// next rotation for clients with the stale configs.
+type ECHKeys struct {
+	publicName string
+	interval   time.Duration
+	// dataFile is replaced in tests
+	dataFile func(filename string) (string, error)
+
+	mu sync.RWMutex
+	// keys has the current key first
+	keys     []echKey
+	onRotate []func()
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type echKey struct {
+	PublicName string
+	Config     []byte
+	PrivateKey []byte
+	CreatedAt  time.Time
+}
+
+// NewECHKeys loads the ECH keys from the data dir, or generates one if there
+// is none. They are rotated every interval, and never if interval is zero.
+func NewECHKeys(publicName string, interval time.Duration) (*ECHKeys, error) {
+	return newECHKeys(&ECHKeys{
+		publicName: publicName,
+		interval:   interval,
+		dataFile:   config.DataFile,
+	})
+}
+
+func newECHKeys(k *ECHKeys) (*ECHKeys, error) {
+	if k.publicName == "" || len(k.publicName) > 255 {
+		return nil, fmt.Errorf("invalid public name of ECH: %q", k.publicName)
+	}
+	k.closed = make(chan struct{})
+	if err := k.load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Warn("Failed to load the ECH keys, and generate new ones: %v", err)
+	}
+	if len(k.keys) == 0 || k.keys[0].PublicName != k.publicName {
+		k.keys = nil
+		if err := k.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	if k.interval > 0 {
+		go k.run()
+	}
+	return k, nil
+}
+
+// ConfigList returns the ECHConfigList of the current key for clients.
+func (k *ECHKeys) ConfigList() []byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(k.keys[0].Config)
+	})
+	return b.BytesOrPanic()
+}
+
+// MethodParam returns the ECHConfigList in the method published to SweetLisa.
+func (k *ECHKeys) MethodParam() string {
+	return "ech=" + base64.StdEncoding.EncodeToString(k.ConfigList())
+}
+
+// GetEncryptedClientHelloKeys implements the tls.Config hook. The configs of
+// the current key are sent to the clients to retry if their ECH is rejected.
+func (k *ECHKeys) GetEncryptedClientHelloKeys(*tls.ClientHelloInfo) ([]tls.EncryptedClientHelloKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	keys := make([]tls.EncryptedClientHelloKey, 0, len(k.keys))
+	for i, key := range k.keys {
+		keys = append(keys, tls.EncryptedClientHelloKey{
+			Config:      key.Config,
+			PrivateKey:  key.PrivateKey,
+			SendAsRetry: i == 0,
+		})
+	}
+	return keys, nil
+}
+
+// OnRotate registers f to be called after the keys are rotated.
+func (k *ECHKeys) OnRotate(f func()) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.onRotate = append(k.onRotate, f)
+}
+
+func (k *ECHKeys) Close() error {
+	k.closeOnce.Do(func() {
+		close(k.closed)
+	})
+	return nil
+}
+
+func (k *ECHKeys) load() error {
+	path, err := k.dataFile(echKeysFile)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var keys []echKey
+	if err = jsoniter.Unmarshal(b, &keys); err != nil {
+		return fmt.Errorf("%v: %w", path, err)
+	}
+	for _, key := range keys {
+		if len(key.Config) < 5 {
+			return fmt.Errorf("%v: invalid ECHConfig", path)
+		}
+	}
+	k.keys = keys
+	return nil
+}
+
+func (k *ECHKeys) save(keys []echKey) error {
+	path, err := k.dataFile(echKeysFile)
+	if err != nil {
+		return err
+	}
+	b, err := jsoniter.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0600)
+}
+
+// rotate generates a new key, which replaces the current one. The current one
+// becomes the previous one, and the previous one is dropped.
+func (k *ECHKeys) rotate() error {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	k.mu.RLock()
+	keys := k.keys
+	k.mu.RUnlock()
+	var id [1]byte
+	for {
+		if _, err = rand.Read(id[:]); err != nil {
+			return err
+		}
+		// the config ids tell the keys apart
+		if len(keys) == 0 || keys[0].Config[4] != id[0] {
+			break
+		}
+	}
+	key := echKey{
+		PublicName: k.publicName,
+		Config:     marshalECHConfig(id[0], privateKey.PublicKey().Bytes(), k.publicName),
+		PrivateKey: privateKey.Bytes(),
+		CreatedAt:  time.Now(),
+	}
+	keys = append([]echKey{key}, keys[:min(len(keys), 1)]...)
+	if err = k.save(keys); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+	return nil
+}
+
+func (k *ECHKeys) run() {
+	backoff := minECHRotateBackoff
+	for {
+		k.mu.RLock()
+		next := time.Until(k.keys[0].CreatedAt.Add(k.interval))
+		k.mu.RUnlock()
+		select {
+		case <-k.closed:
+			return
+		case <-time.After(next):
+		}
+		if err := k.rotate(); err != nil {
+			log.Warn("Failed to rotate the ECH keys: %v. Retry in %v.", err, backoff)
+			select {
+			case <-k.closed:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, k.interval)
+			continue
+		}
+		backoff = minECHRotateBackoff
+		log.Info("The ECH keys are rotated.")
+		k.mu.RLock()
+		onRotate := k.onRotate
+		k.mu.RUnlock()
+		for _, f := range onRotate {
+			f()
+		}
+	}
+}
+
+// marshalECHConfig returns the ECHConfig of draft-ietf-tls-esni.
+func marshalECHConfig(id uint8, publicKey []byte, publicName string) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16(echVersion)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(id)
+		b.AddUint16(echKEMX25519)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(publicKey)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, aead := range []uint16{echAEADAES, echAEADChaCha} {
+				b.AddUint16(echKDFSHA256)
+				b.AddUint16(aead)
+			}
+		})
+		// maximum_name_length, for the clients to pad by themselves
+		b.AddUint8(0)
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte(publicName))
+		})
+		// no extensions
+		b.AddUint16(0)
+	})
+	return b.BytesOrPanic()
+}
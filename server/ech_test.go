@@ -0,0 +1,89 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestECHKeysRotation(t *testing.T) {
+	dir := t.TempDir()
+	dataFile := func(filename string) (string, error) {
+		return filepath.Join(dir, filename), nil
+	}
+	keys, err := newECHKeys(&ECHKeys{publicName: "public.example.com", dataFile: dataFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keys.Close()
+
+	cert, _ := newTestCertificate(t, "inner.example.com", time.Now().Add(time.Hour))
+	handshake := func(configList []byte) (bool, error) {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		go func() {
+			conn := tls.Server(server, &tls.Config{
+				Certificates:                []tls.Certificate{*cert},
+				GetEncryptedClientHelloKeys: keys.GetEncryptedClientHelloKeys,
+			})
+			// read the alerts of the client
+			_, _ = io.Copy(io.Discard, conn)
+		}()
+		conn := tls.Client(client, &tls.Config{
+			ServerName:                     "inner.example.com",
+			InsecureSkipVerify:             true,
+			EncryptedClientHelloConfigList: configList,
+			// the certificate is not of the public name
+			EncryptedClientHelloRejectionVerify: func(tls.ConnectionState) error {
+				return nil
+			},
+		})
+		err := conn.Handshake()
+		return conn.ConnectionState().ECHAccepted, err
+	}
+
+	first := keys.ConfigList()
+	if accepted, err := handshake(first); err != nil || !accepted {
+		t.Fatalf("ECH accepted = %v: %v", accepted, err)
+	}
+
+	// the previous key is accepted until the next rotation
+	if err = keys.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	second := keys.ConfigList()
+	for _, configList := range [][]byte{first, second} {
+		if accepted, err := handshake(configList); err != nil || !accepted {
+			t.Fatalf("ECH accepted = %v: %v", accepted, err)
+		}
+	}
+	if err = keys.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	var rejection *tls.ECHRejectionError
+	if _, err := handshake(first); !errors.As(err, &rejection) {
+		t.Fatalf("the config of two rotations ago: %v, want the rejection", err)
+	}
+
+	// the keys are loaded after restarts
+	loaded, err := newECHKeys(&ECHKeys{publicName: "public.example.com", dataFile: dataFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(loaded.ConfigList()) != string(keys.ConfigList()) {
+		t.Fatal("the saved keys are not loaded")
+	}
+	// but not if the public name is changed
+	renamed, err := newECHKeys(&ECHKeys{publicName: "cover.example.com", dataFile: dataFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(renamed.ConfigList()) == string(keys.ConfigList()) {
+		t.Fatal("the keys are not generated again for the new public name")
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/outbound/pkg/fastrand"
+	"github.com/daeuniverse/outbound/protocol"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+)
+
+// FailurePolicy decides what to do with connections failing the authentication
+// or the contention check.
+type FailurePolicy string
+
+const (
+	// FailurePolicyDrain reads the connection until EOF or MaxDrainN bytes.
+	FailurePolicyDrain FailurePolicy = "drain"
+	// FailurePolicyClose closes the connection after a random delay.
+	FailurePolicyClose FailurePolicy = "close"
+	// FailurePolicyReset resets the connection immediately.
+	FailurePolicyReset FailurePolicy = "reset"
+	// FailurePolicyDecoy forwards the connection to the decoy address.
+	FailurePolicyDecoy FailurePolicy = "decoy"
+)
+
+// MaxFailureCloseDelay is the upper bound of the delay of FailurePolicyClose.
+const MaxFailureCloseDelay = 10 * time.Second
+
+type FailureHandler struct {
+	Policy FailurePolicy
+	// Decoy is the address (host:port) for FailurePolicyDecoy
+	Decoy string
+	// Banner bans the sources failing repeatedly if not nil
+	Banner *Banner
+	// Dialer dials the decoy, which is the dialer of the server
+	Dialer netproxy.Dialer
+}
+
+// NewFailureHandler validates the policy. An empty policy means
+// FailurePolicyDrain.
+func NewFailureHandler(policy string, decoy string, dialer netproxy.Dialer) (*FailureHandler, error) {
+	h := &FailureHandler{Policy: FailurePolicy(policy), Decoy: decoy, Dialer: dialer}
+	switch h.Policy {
+	case "":
+		h.Policy = FailurePolicyDrain
+	case FailurePolicyDrain, FailurePolicyClose, FailurePolicyReset:
+	case FailurePolicyDecoy:
+		if _, _, err := net.SplitHostPort(decoy); err != nil {
+			return nil, fmt.Errorf("invalid decoy address of the failure policy: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown failure policy: %v", strconv.Quote(policy))
+	}
+	return h, nil
+}
+
+// Handle treats the failed connection by the policy. The peeked bytes have been
+// read from conn, which are forwarded ahead of the rest by FailurePolicyDecoy.
+// The caller should close conn after Handle returns.
+func (h *FailureHandler) Handle(conn net.Conn, peeked []byte) error {
+	switch h.Policy {
+	case FailurePolicyClose:
+		delay := time.Duration(fastrand.Int63n(int64(MaxFailureCloseDelay)))
+		_ = conn.SetReadDeadline(time.Now().Add(delay))
+		_, _ = io.Copy(io.Discard, conn)
+		return nil
+	case FailurePolicyReset:
+		if tcpConn, ok := netConn(conn).(*net.TCPConn); ok {
+			// a zero linger makes Close send RST
+			return tcpConn.SetLinger(0)
+		}
+		return nil
+	case FailurePolicyDecoy:
+		ctx, cancel := context.WithTimeout(context.TODO(), DialTimeout)
+		rConn, err := h.Dialer.DialContext(ctx, "tcp", h.Decoy)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to dial decoy: %w", err)
+		}
+		defer rConn.Close()
+		if _, err = rConn.Write(peeked); err != nil {
+			return err
+		}
+		if err = RelayTCP(conn, rConn); err != nil {
+			var netErr net.Error
+			if errors.Is(err, io.EOF) || (errors.As(err, &netErr) && netErr.Timeout()) {
+				return nil
+			}
+			return fmt.Errorf("relay decoy error: %w", err)
+		}
+		return nil
+	default:
+		if config.ParamsObj.John.MaxDrainN == -1 {
+			io.Copy(io.Discard, conn)
+		} else {
+			io.CopyN(io.Discard, conn, config.ParamsObj.John.MaxDrainN)
+		}
+		return nil
+	}
+}
+
+// Banned tells if the source addr is banned. The connections from it should
+// be treated by Handle without the authentication.
+func (h *FailureHandler) Banned(addr net.Addr) bool {
+	if h.Banner == nil {
+		return false
+	}
+	ip, ok := addrIP(addr)
+	return ok && h.Banner.Banned(ip)
+}
+
+// Fail counts the failure of the source addr if err fails the authentication
+// or is a replay.
+func (h *FailureHandler) Fail(addr net.Addr, err error) {
+	if h.Banner == nil || !(errors.Is(err, protocol.ErrFailAuth) || errors.Is(err, protocol.ErrReplayAttack)) {
+		return
+	}
+	ip, ok := addrIP(addr)
+	if !ok {
+		return
+	}
+	if prefix, d := h.Banner.Fail(ip); d > 0 {
+		log.Warn("Banned %v for %v after repeated authentication failures", prefix, d)
+	}
+}
+
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return netip.AddrFromSlice(addr.IP)
+	case *net.UDPAddr:
+		return netip.AddrFromSlice(addr.IP)
+	default:
+		return netip.Addr{}, false
+	}
+}
+
+// netConn unwraps conn to the connection accepted from the listener.
+func netConn(conn net.Conn) net.Conn {
+	for {
+		u, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return conn
+		}
+		conn = u.NetConn()
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/outbound/protocol/direct"
+)
+
+func TestNewFailureHandlerValidatesPolicy(t *testing.T) {
+	h, err := NewFailureHandler("", "", direct.SymmetricDirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Policy != FailurePolicyDrain {
+		t.Fatalf("Policy = %q, want %q", h.Policy, FailurePolicyDrain)
+	}
+	for _, policy := range []string{"drain", "close", "reset"} {
+		if _, err := NewFailureHandler(policy, "", direct.SymmetricDirect); err != nil {
+			t.Fatalf("%v: %v", policy, err)
+		}
+	}
+	if _, err := NewFailureHandler("decoy", "127.0.0.1:80", direct.SymmetricDirect); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFailureHandler("decoy", "", direct.SymmetricDirect); err == nil {
+		t.Fatal("decoy without address: expected an error")
+	}
+	if _, err := NewFailureHandler("bogus", "", direct.SymmetricDirect); err == nil {
+		t.Fatal("unknown policy: expected an error")
+	}
+}
+
+func TestFailureHandlerDecoyForwardsPeekedBytes(t *testing.T) {
+	decoy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoy.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := decoy.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b, _ := io.ReadAll(conn)
+		received <- b
+	}()
+
+	dialer := &countingDialer{Dialer: direct.SymmetricDirect}
+	h, err := NewFailureHandler("decoy", decoy.Addr().String(), dialer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, conn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Handle(conn, []byte("peeked"))
+		conn.Close()
+	}()
+	if _, err = client.Write([]byte("-rest")); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handle did not return")
+	}
+	select {
+	case b := <-received:
+		if !bytes.Equal(b, []byte("peeked-rest")) {
+			t.Fatalf("decoy received %q, want %q", b, "peeked-rest")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("decoy received nothing")
+	}
+	if dialer.n.Load() != 1 {
+		t.Fatal("the decoy is not dialed through the dialer of the server")
+	}
+}
+
+// countingDialer counts the dials.
+type countingDialer struct {
+	netproxy.Dialer
+	n atomic.Int32
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, addr string) (netproxy.Conn, error) {
+	d.n.Add(1)
+	return d.Dialer.DialContext(ctx, network, addr)
+}
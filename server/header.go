@@ -26,15 +26,30 @@ func GetHeader(out model.Out, lisa *config.Lisa) (header *protocol.Header, err e
 		feature1 = common.SimplyGetParam(out.Method, "serviceName")
 		sni, _ = common.HostToSNI(out.Host, lisa.Host)
 		flags = protocol.Flags_VMess_UsePacketAddr
+		// the dialers read the fingerprint from the method
+		if _, err = Fingerprint(out.Method); err != nil {
+			return nil, err
+		}
 	case string(protocol.ProtocolVMessTCP):
 		flags = protocol.Flags_VMess_UsePacketAddr
-	case string(protocol.ProtocolJuicity):
-		feature1 = "bbr"
+	case string(ProtocolVMessWs), string(ProtocolVMessTlsWs):
+		feature1 = common.SimplyGetParam(out.Method, "path")
+		if string(out.Protocol) == string(ProtocolVMessTlsWs) {
+			sni, _ = common.HostToSNI(out.Host, lisa.Host)
+		}
+		flags = protocol.Flags_VMess_UsePacketAddr
+	case string(protocol.ProtocolJuicity), string(ProtocolHysteria2):
+		if string(out.Protocol) == string(protocol.ProtocolJuicity) {
+			feature1 = "bbr"
+		}
 		pinnedHash, err := base64.URLEncoding.DecodeString(common.SimplyGetParam(out.Method, "pinned_certchain_sha256"))
 		if err != nil {
 			return nil, fmt.Errorf("decode pinned_certchain_sha256: %w", err)
 		}
-		sni = JuicityDomain
+		// the site impersonated by the next hop
+		if sni = common.SimplyGetParam(out.Method, "sni"); sni == "" {
+			sni = JuicityDomain
+		}
 		tlsConfig = &tls.Config{
 			NextProtos:         []string{"h3"},
 			MinVersion:         tls.VersionTLS13,
@@ -47,7 +62,10 @@ func GetHeader(out model.Out, lisa *config.Lisa) (header *protocol.Header, err e
 				return nil
 			},
 		}
-	case string(ProtocolAnyTLS):
+	case string(ProtocolAnyTLS), string(ProtocolTrojan):
+		if _, err = Fingerprint(out.Method); err != nil {
+			return nil, err
+		}
 		sni = common.SimplyGetParam(out.Method, "sni")
 		if sni == "" {
 			if sni, err = common.HostToSNI(out.Host, lisa.Host); err != nil {
@@ -55,10 +73,14 @@ func GetHeader(out model.Out, lisa *config.Lisa) (header *protocol.Header, err e
 			}
 		}
 		tlsConfig = &tls.Config{
-			MinVersion:         tls.VersionTLS12,
-			ServerName:         sni,
-			InsecureSkipVerify: true,
+			MinVersion: tls.VersionTLS12,
+			ServerName: sni,
+			// trojan next hops have certificates issued by ACME, and the
+			// password would be sent to whoever answers the handshake
+			InsecureSkipVerify: string(out.Protocol) == string(ProtocolAnyTLS),
 		}
+	case string(ProtocolVlessReality):
+		sni = common.SimplyGetParam(out.Method, "sni")
 	}
 	return &protocol.Header{
 		ProxyAddress: net.JoinHostPort(out.Host, out.Port),
@@ -0,0 +1,310 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daeuniverse/outbound/pool"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/infra/lru"
+)
+
+// Port hopping lets QUIC clients send to any port of a range, since UDP to a
+// single port is often throttled. The listener holds a socket for every port
+// and feeds one QUIC transport with the packets of all of them.
+
+const (
+	// MaxHopPorts limits the number of sockets of a hop listener.
+	MaxHopPorts = 1024
+	// hopRouteTimeout is how long the port of a client is remembered for the
+	// replies.
+	hopRouteTimeout = 5 * time.Minute
+	hopQueueSize    = 1024
+)
+
+// ParseHopPorts parses port ranges split by ",", such as "20000-20100,30000".
+// The duplicate ports are counted once against MaxHopPorts.
+func ParseHopPorts(s string) (ports []int, err error) {
+	seen := make(map[int]struct{})
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(r, "-")
+		from, err := parsePort(first)
+		if err != nil {
+			return nil, err
+		}
+		to := from
+		if isRange {
+			if to, err = parsePort(last); err != nil {
+				return nil, err
+			}
+		}
+		if from > to {
+			return nil, fmt.Errorf("invalid port range: %v", r)
+		}
+		// stop at the first port beyond the limit rather than expanding the
+		// whole range
+		for port := from; port <= to; port++ {
+			if _, ok := seen[port]; ok {
+				continue
+			}
+			if len(ports) == MaxHopPorts {
+				return nil, fmt.Errorf("too many hop ports: more than %v", MaxHopPorts)
+			}
+			seen[port] = struct{}{}
+			ports = append(ports, port)
+		}
+	}
+	slices.Sort(ports)
+	return ports, nil
+}
+
+// FormatHopPorts formats sorted ports into ranges, which is the reverse of
+// ParseHopPorts.
+func FormatHopPorts(ports []int) string {
+	var ranges []string
+	for i := 0; i < len(ports); {
+		j := i
+		for j+1 < len(ports) && ports[j+1] == ports[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, strconv.Itoa(ports[i]))
+		} else {
+			ranges = append(ranges, strconv.Itoa(ports[i])+"-"+strconv.Itoa(ports[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ",")
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || port <= 0 || port > 0xffff {
+		return 0, fmt.Errorf("invalid port: %v", strconv.Quote(s))
+	}
+	return port, nil
+}
+
+// ListenPacket listens on the UDP address, and also on the hop ports of the
+// same host if any.
+func ListenPacket(addr string, hopPorts []int) (net.PacketConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conns := []*net.UDPConn{conn}
+	for _, p := range hopPorts {
+		if p == port {
+			continue
+		}
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: udpAddr.IP, Port: p, Zone: udpAddr.Zone})
+		if err != nil {
+			for _, c := range conns {
+				_ = c.Close()
+			}
+			return nil, fmt.Errorf("listen on hop port %v: %w", p, err)
+		}
+		conns = append(conns, c)
+	}
+	if len(conns) == 1 {
+		return conn, nil
+	}
+	return newHopPacketConn(conns), nil
+}
+
+type hopPacket struct {
+	b    []byte
+	addr *net.UDPAddr
+	conn *net.UDPConn
+}
+
+// hopPacketConn reads from all sockets and replies to a client through the
+// socket it sent to last.
+type hopPacketConn struct {
+	conns []*net.UDPConn
+	ch    chan hopPacket
+	// routes maps the client address to the socket to reply through
+	routes *lru.LRU
+
+	mu               sync.Mutex
+	readDeadline     time.Time
+	deadlineModified chan struct{}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newHopPacketConn(conns []*net.UDPConn) *hopPacketConn {
+	c := &hopPacketConn{
+		conns:            conns,
+		ch:               make(chan hopPacket, hopQueueSize),
+		routes:           lru.New(lru.FixedTimeout, int64(hopRouteTimeout)),
+		deadlineModified: make(chan struct{}),
+		closed:           make(chan struct{}),
+	}
+	for _, conn := range conns {
+		go c.readLoop(conn)
+	}
+	return c
+}
+
+func (c *hopPacketConn) readLoop(conn *net.UDPConn) {
+	buf := pool.GetFullCap(0xffff)
+	defer pool.Put(buf)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			// closed, and the other sockets keep working otherwise
+			return
+		}
+		b := pool.Get(n)
+		copy(b, buf[:n])
+		select {
+		case c.ch <- hopPacket{b: b, addr: addr, conn: conn}:
+		case <-c.closed:
+			pool.Put(b)
+			return
+		default:
+			// drop it like a full socket buffer
+			pool.Put(b)
+		}
+	}
+}
+
+func (c *hopPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		c.mu.Lock()
+		deadline := c.readDeadline
+		modified := c.deadlineModified
+		c.mu.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		var pkt hopPacket
+		var received bool
+		select {
+		case pkt = <-c.ch:
+			received = true
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-modified:
+		case <-c.closed:
+			err = net.ErrClosed
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		if !received {
+			// the deadline was modified
+			continue
+		}
+		n = copy(p, pkt.b)
+		pool.Put(pkt.b)
+		c.setRoute(pkt.addr, pkt.conn)
+		return n, pkt.addr, nil
+	}
+}
+
+func (c *hopPacketConn) setRoute(addr *net.UDPAddr, conn *net.UDPConn) {
+	key := addr.AddrPort()
+	if route, ok := c.routes.Get(key).(*hopRoute); ok {
+		route.set(conn)
+		return
+	}
+	route := &hopRoute{conn: conn}
+	c.routes.Insert(key, route)
+}
+
+func (c *hopPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	conn := c.conns[0]
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		if route, ok := c.routes.Get(udpAddr.AddrPort()).(*hopRoute); ok {
+			conn = route.get()
+		}
+	}
+	return conn.WriteTo(p, addr)
+}
+
+func (c *hopPacketConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		for _, conn := range c.conns {
+			if e := conn.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
+// LocalAddr returns the address of the main port.
+func (c *hopPacketConn) LocalAddr() net.Addr {
+	return c.conns[0].LocalAddr()
+}
+
+func (c *hopPacketConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *hopPacketConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	close(c.deadlineModified)
+	c.deadlineModified = make(chan struct{})
+	return nil
+}
+
+func (c *hopPacketConn) SetWriteDeadline(t time.Time) error {
+	for _, conn := range c.conns {
+		if err := conn.SetWriteDeadline(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type hopRoute struct {
+	mu   sync.Mutex
+	conn *net.UDPConn
+}
+
+func (r *hopRoute) get() *net.UDPConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conn
+}
+
+func (r *hopRoute) set(conn *net.UDPConn) {
+	r.mu.Lock()
+	r.conn = conn
+	r.mu.Unlock()
+}
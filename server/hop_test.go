@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseHopPorts(t *testing.T) {
+	ports, err := ParseHopPorts(" 20003, 20000-20002,20001 ,30000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{20000, 20001, 20002, 20003, 30000}; !slices.Equal(ports, want) {
+		t.Fatalf("ports = %v, want %v", ports, want)
+	}
+	if got, want := FormatHopPorts(ports), "20000-20003,30000"; got != want {
+		t.Fatalf("FormatHopPorts() = %q, want %q", got, want)
+	}
+	if ports, err = ParseHopPorts(""); err != nil || len(ports) != 0 {
+		t.Fatalf("empty: got %v (%v)", ports, err)
+	}
+	// the duplicates are counted once
+	if ports, err = ParseHopPorts("20000-21023,20000-21023,20500"); err != nil || len(ports) != MaxHopPorts {
+		t.Fatalf("duplicates: got %v ports (%v), want %v", len(ports), err, MaxHopPorts)
+	}
+	for _, s := range []string{"0", "65536", "20010-20000", "a-b", "1-65535", "20000-21023,30000"} {
+		if _, err := ParseHopPorts(s); err == nil {
+			t.Fatalf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestHopPacketConnRepliesThroughReceivedPort(t *testing.T) {
+	hopPort := freeUDPPort(t)
+	conn, err := ListenPacket("127.0.0.1:0", []int{hopPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(3 * time.Second))
+	hopAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: hopPort}
+	if _, err = client.WriteTo([]byte("ping"), hopAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 16)
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Fatalf("got %q, want %q", buf[:n], "ping")
+	}
+	if _, err = conn.WriteTo([]byte("pong"), addr); err != nil {
+		t.Fatal(err)
+	}
+	n, from, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "pong" || from.(*net.UDPAddr).Port != hopPort {
+		t.Fatalf("got %q from %v, want %q from the hop port %v", buf[:n], from, "pong", hopPort)
+	}
+}
+
+func TestHopPacketConnReadDeadline(t *testing.T) {
+	conn, err := ListenPacket("127.0.0.1:0", []int{freeUDPPort(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadFrom(make([]byte, 16))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// quic-go unblocks the reader like this on closing
+	_ = conn.SetReadDeadline(time.Now())
+	select {
+	case err := <-done:
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			t.Fatalf("ReadFrom() error = %v, want a timeout", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("ReadFrom was not unblocked by the deadline")
+	}
+}
+
+func freeUDPPort(t *testing.T) int {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
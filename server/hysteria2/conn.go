@@ -0,0 +1,230 @@
+package hysteria2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/outbound/protocol"
+	"github.com/daeuniverse/outbound/protocol/tuic/congestion"
+	"github.com/daeuniverse/quic-go"
+	"github.com/daeuniverse/quic-go/http3"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+)
+
+const (
+	closeErrCodeOK            = 0x100 // HTTP3 ErrCodeNoError
+	closeErrCodeProtocolError = 0x101 // HTTP3 ErrCodeGeneralProtocolError
+)
+
+// connHandler serves a QUIC connection of a Hysteria2 client. Streams and
+// datagrams are refused until the client authenticates by HTTP/3.
+type connHandler struct {
+	s    *Server
+	conn quic.Connection
+
+	mu      sync.Mutex
+	passage *Passage
+	udp     *udpSessionManager
+}
+
+func (s *Server) handleConn(conn quic.Connection) error {
+	h := &connHandler{s: s, conn: conn}
+	defer h.close()
+	h3s := &http3.Server{
+		Handler:        h,
+		StreamHijacker: h.hijackStream,
+	}
+	err := h3s.ServeQUICConn(conn)
+	_ = conn.CloseWithError(closeErrCodeOK, "")
+	var appErr *quic.ApplicationError
+	var idleErr *quic.IdleTimeoutError
+	if errors.As(err, &appErr) || errors.As(err, &idleErr) || errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (h *connHandler) authenticated() *Passage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.passage
+}
+
+func (h *connHandler) close() {
+	h.mu.Lock()
+	udp := h.udp
+	h.mu.Unlock()
+	if udp != nil {
+		udp.close()
+	}
+}
+
+func (h *connHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.Host != authHost || r.URL.Path != authPath {
+		h.s.masquerade.ServeHTTP(w, r)
+		return
+	}
+	req := authRequestFromHeader(r.Header)
+	passage, err := h.authenticate(req)
+	if err != nil {
+		log.Warn("hysteria2 auth from %v: %v", h.conn.RemoteAddr().String(), err)
+		h.s.masquerade.ServeHTTP(w, r)
+		return
+	}
+	authResponseToHeader(w.Header(), authResponse{
+		// the manager only sends messages
+		udpEnabled: !passage.Manager,
+		rx:         h.s.maxRx,
+		rxAuto:     h.s.ignoreClientBandwidth,
+	})
+	w.WriteHeader(statusAuthOK)
+}
+
+func (h *connHandler) authenticate(req authRequest) (*Passage, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.passage != nil {
+		// the client may authenticate more than once
+		if h.passage.auth != req.auth {
+			return nil, fmt.Errorf("%w: inconsistent auth", protocol.ErrFailAuth)
+		}
+		return h.passage, nil
+	}
+	passage, ok := h.s.getPassage(req.auth)
+	if !ok {
+		return nil, protocol.ErrFailAuth
+	}
+	if udpAddr, ok := h.conn.RemoteAddr().(*net.UDPAddr); ok {
+		if err := h.s.ContentionCheck(udpAddr.IP, &passage); err != nil {
+			return nil, err
+		}
+	}
+	h.setCongestionControl(req.rx)
+	h.passage = &passage
+	if !passage.Manager {
+		dialer, err := h.s.passageDialer(&passage)
+		if err != nil {
+			return nil, err
+		}
+		h.udp = newUDPSessionManager(h.conn, dialer)
+		go h.udp.run()
+	}
+	return h.passage, nil
+}
+
+// setCongestionControl uses Brutal at the min of the download bandwidth of the
+// client and the upload bandwidth of the server, or BBR if any of them is
+// unknown or the server ignores the bandwidth of clients.
+func (h *connHandler) setCongestionControl(clientRx uint64) {
+	if h.s.ignoreClientBandwidth || clientRx == 0 {
+		congestion.UseBBR(h.conn)
+		return
+	}
+	tx := clientRx
+	if h.s.maxTx > 0 && tx > h.s.maxTx {
+		tx = h.s.maxTx
+	}
+	congestion.UseBrutal(h.conn, tx)
+}
+
+func (h *connHandler) hijackStream(ft http3.FrameType, _ quic.ConnectionTracingID, stream quic.Stream, err error) (bool, error) {
+	if err != nil || ft != frameTypeTCPRequest {
+		return false, nil
+	}
+	passage := h.authenticated()
+	if passage == nil {
+		// let HTTP/3 reject it
+		return false, nil
+	}
+	go func() {
+		if err := h.handleStream(&streamConn{Stream: stream}, passage); err != nil {
+			if errors.Is(err, server.ErrPassageAbuse) || errors.Is(err, protocol.ErrFailAuth) {
+				log.Warn("hysteria2 handleStream: %v", err)
+			} else {
+				log.Info("hysteria2 handleStream: %v", err)
+			}
+		}
+	}()
+	return true, nil
+}
+
+func (h *connHandler) handleStream(conn *streamConn, passage *Passage) error {
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	target, err := readTCPRequest(conn)
+	if err != nil {
+		return err
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	if cmd, ok := parseMsgAddr(target); ok {
+		return h.s.handleMsg(conn, cmd, passage)
+	}
+	if passage.Manager {
+		return fmt.Errorf("%w: manager key is abused for a non-cmd connection", server.ErrPassageAbuse)
+	}
+	dialer, err := h.s.passageDialer(passage)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), server.DialTimeout)
+	defer cancel()
+	rConn, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		_ = writeTCPResponse(conn, false, err.Error())
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			log.Debug("%v", err)
+			return nil
+		}
+		return err
+	}
+	defer rConn.Close()
+	if err = writeTCPResponse(conn, true, ""); err != nil {
+		return err
+	}
+	if err = server.RelayTCP(conn, rConn); err != nil {
+		var netErr net.Error
+		var streamErr *quic.StreamError
+		if errors.Is(err, io.EOF) || (errors.As(err, &netErr) && netErr.Timeout()) || errors.As(err, &streamErr) {
+			return nil
+		}
+		return fmt.Errorf("relay tcp error: %w", err)
+	}
+	return nil
+}
+
+// passageDialer returns the dialer for the outbound of the passage, which is
+// a relay if the passage has Out.
+func (s *Server) passageDialer(passage *Passage) (netproxy.Dialer, error) {
+	if passage.Out == nil {
+		return s.dialer, nil
+	}
+	header, err := server.GetHeader(*passage.Out, &s.sweetLisa)
+	if err != nil {
+		return nil, err
+	}
+	return server.NewDialer(string(passage.Out.Protocol), s.dialer, header)
+}
+
+// streamConn makes Close release both directions of the stream, and CloseWrite
+// only the sending direction like TCP.
+type streamConn struct {
+	quic.Stream
+}
+
+func (c *streamConn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
+func (c *streamConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
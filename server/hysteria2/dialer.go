@@ -0,0 +1,112 @@
+package hysteria2
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/outbound/protocol"
+	"github.com/daeuniverse/outbound/protocol/hysteria2/client"
+	"github.com/daeuniverse/outbound/protocol/tuic/common"
+	bjcommon "github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/common"
+)
+
+func init() {
+	protocol.Register("hysteria2", NewDialer)
+}
+
+// Dialer is a Hysteria2 client with Salamander support, which is used to relay
+// passages to hysteria2 servers.
+type Dialer struct {
+	client client.Client
+}
+
+// NewDialer reads the obfuscation from the cipher of the header, which is the
+// method of the argument registered to SweetLisa.
+func NewDialer(nextDialer netproxy.Dialer, header protocol.Header) (netproxy.Dialer, error) {
+	if nextDialer == nil {
+		return nil, fmt.Errorf("nil next dialer")
+	}
+	serverAddr, err := net.ResolveUDPAddr("udp", header.ProxyAddress)
+	if err != nil {
+		return nil, err
+	}
+	var obfs *salamander
+	switch o := bjcommon.SimplyGetParam(header.Cipher, "obfs"); o {
+	case "":
+	case "salamander":
+		if obfs, err = newSalamander(bjcommon.SimplyGetParam(header.Cipher, "obfs-password")); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported obfs: %v", o)
+	}
+	tlsConfig := header.TlsConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{
+			ServerName:         header.SNI,
+			InsecureSkipVerify: true,
+		}
+	}
+	c, err := client.NewClient(&client.Config{
+		ConnFactory: &client.UdpConnFactory{
+			NewFunc: func(ctx context.Context) (net.PacketConn, error) {
+				conn, err := nextDialer.DialContext(ctx, "udp", serverAddr.String())
+				if err != nil {
+					return nil, err
+				}
+				var packetConn net.PacketConn = netproxy.NewFakeNetPacketConn(
+					conn.(netproxy.PacketConn),
+					net.UDPAddrFromAddrPort(common.GetUniqueFakeAddrPort()),
+					serverAddr,
+				)
+				if obfs != nil {
+					packetConn = newObfsPacketConn(packetConn, obfs)
+				}
+				return packetConn, nil
+			},
+		},
+		ServerAddr: serverAddr,
+		Auth:       AuthString(header.User, header.Password),
+		TLSConfig: client.TLSConfig{
+			ServerName:            tlsConfig.ServerName,
+			InsecureSkipVerify:    tlsConfig.InsecureSkipVerify,
+			VerifyPeerCertificate: tlsConfig.VerifyPeerCertificate,
+			RootCAs:               tlsConfig.RootCAs,
+		},
+		FastOpen: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Dialer{client: c}, nil
+}
+
+func (d *Dialer) Dial(network string, addr string) (netproxy.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network string, addr string) (netproxy.Conn, error) {
+	magicNetwork, err := netproxy.ParseMagicNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	switch magicNetwork.Network {
+	case "tcp":
+		return d.client.TCP(addr, ctx)
+	case "udp":
+		return d.client.UDP(addr, ctx)
+	default:
+		return nil, fmt.Errorf("unsupported network: %v", network)
+	}
+}
+
+func (d *Dialer) DialCmdMsg(cmd protocol.MetadataCmd) (netproxy.Conn, error) {
+	return d.DialCmdMsgContext(context.Background(), cmd)
+}
+
+func (d *Dialer) DialCmdMsgContext(ctx context.Context, cmd protocol.MetadataCmd) (netproxy.Conn, error) {
+	return d.client.TCP(msgAddr(cmd), ctx)
+}
@@ -0,0 +1,110 @@
+package hysteria2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/daeuniverse/outbound/protocol"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	handshakeTimeout = 10 * time.Second
+	// msgHost is the host of the TCP requests carrying manager messages, whose
+	// port is the cmd. It never resolves because .invalid is reserved.
+	msgHost = "bitterjohn.invalid"
+)
+
+func msgAddr(cmd protocol.MetadataCmd) string {
+	return net.JoinHostPort(msgHost, strconv.Itoa(int(cmd)))
+}
+
+func parseMsgAddr(addr string) (cmd protocol.MetadataCmd, ok bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != msgHost {
+		return 0, false
+	}
+	c, err := strconv.ParseUint(port, 10, 8)
+	if err != nil {
+		return 0, false
+	}
+	return protocol.MetadataCmd(c), true
+}
+
+func (s *Server) handleMsg(conn io.ReadWriter, cmd protocol.MetadataCmd, passage *Passage) error {
+	if !passage.Manager {
+		_ = writeTCPResponse(conn, false, "")
+		return fmt.Errorf("handleMsg: illegal message received from a non-manager passage")
+	}
+	log.Trace("handleMsg(hysteria2): cmd: %v", cmd)
+	reqBody, err := readManagerBody(conn)
+	if err != nil {
+		return err
+	}
+
+	var resp []byte
+	switch cmd {
+	case protocol.MetadataCmdPing:
+		if !bytes.Equal(reqBody, []byte("ping")) {
+			log.Warn("the body of received ping message is %v instead of %v", strconv.Quote(string(reqBody)), strconv.Quote("ping"))
+		}
+		s.setLastAlive(time.Now())
+		pingResp, err := server.GeneratePingResp()
+		if err != nil {
+			return err
+		}
+		resp, err = jsoniter.Marshal(pingResp)
+		if err != nil {
+			return err
+		}
+	case protocol.MetadataCmdSyncPassages:
+		var passages []model.Passage
+		if err := jsoniter.Unmarshal(reqBody, &passages); err != nil {
+			return err
+		}
+		serverPassages := make([]server.Passage, 0, len(passages))
+		for _, passage := range passages {
+			serverPassages = append(serverPassages, server.Passage{Passage: passage})
+		}
+		log.Info("Server asked to SyncPassages")
+		if err := s.SyncPassages(serverPassages); err != nil {
+			return err
+		}
+		resp = []byte("OK")
+	default:
+		_ = writeTCPResponse(conn, false, "")
+		return fmt.Errorf("%w: unexpected metadata cmd type: %v", protocol.ErrFailAuth, cmd)
+	}
+	if err := writeTCPResponse(conn, true, ""); err != nil {
+		return err
+	}
+	return writeManagerBody(conn, resp)
+}
+
+func readManagerBody(r io.Reader) ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	body := make([]byte, int(binary.BigEndian.Uint32(lenBuf[:])))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func writeManagerBody(w io.Writer, body []byte) error {
+	buf := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(len(body)))
+	copy(buf[4:], body)
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,110 @@
+package hysteria2
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/daeuniverse/outbound/pool"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	salamanderSaltLen = 8
+	salamanderKeyLen  = blake2b.Size256
+	// salamanderMinPSKLen is the min length of the Salamander password.
+	salamanderMinPSKLen = 4
+)
+
+var ErrSalamanderPSKTooShort = fmt.Errorf("the password of salamander must be at least %v bytes", salamanderMinPSKLen)
+
+// salamander obfuscates every packet by prepending 8 random bytes of salt and
+// XORing the payload with BLAKE2b-256(password || salt).
+type salamander struct {
+	psk []byte
+}
+
+func newSalamander(psk string) (*salamander, error) {
+	if len(psk) < salamanderMinPSKLen {
+		return nil, ErrSalamanderPSKTooShort
+	}
+	return &salamander{psk: []byte(psk)}, nil
+}
+
+func (o *salamander) key(salt []byte) [salamanderKeyLen]byte {
+	buf := make([]byte, 0, len(o.psk)+len(salt))
+	buf = append(buf, o.psk...)
+	buf = append(buf, salt...)
+	return blake2b.Sum256(buf)
+}
+
+// obfuscate writes the obfuscated p into out and returns the length written.
+// out must be at least salamanderSaltLen bytes longer than p.
+func (o *salamander) obfuscate(p, out []byte) int {
+	if len(out) < len(p)+salamanderSaltLen {
+		return 0
+	}
+	_, _ = rand.Read(out[:salamanderSaltLen])
+	key := o.key(out[:salamanderSaltLen])
+	for i, c := range p {
+		out[salamanderSaltLen+i] = c ^ key[i%salamanderKeyLen]
+	}
+	return len(p) + salamanderSaltLen
+}
+
+// deobfuscate writes the plain text of the obfuscated in into out and returns
+// the length written. Zero is returned for invalid packets.
+func (o *salamander) deobfuscate(in, out []byte) int {
+	if len(in) <= salamanderSaltLen || len(out) < len(in)-salamanderSaltLen {
+		return 0
+	}
+	key := o.key(in[:salamanderSaltLen])
+	for i, c := range in[salamanderSaltLen:] {
+		out[i] = c ^ key[i%salamanderKeyLen]
+	}
+	return len(in) - salamanderSaltLen
+}
+
+// obfsPacketConn is a net.PacketConn that obfuscates all packets it sends and
+// receives by salamander.
+type obfsPacketConn struct {
+	net.PacketConn
+	obfs *salamander
+
+	readMu  sync.Mutex
+	readBuf []byte
+}
+
+func newObfsPacketConn(conn net.PacketConn, obfs *salamander) *obfsPacketConn {
+	return &obfsPacketConn{
+		PacketConn: conn,
+		obfs:       obfs,
+		readBuf:    make([]byte, 2048),
+	}
+}
+
+func (c *obfsPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for {
+		n, addr, err = c.PacketConn.ReadFrom(c.readBuf)
+		if err != nil {
+			return 0, addr, err
+		}
+		// drop invalid packets silently
+		if n = c.obfs.deobfuscate(c.readBuf[:n], p); n > 0 {
+			return n, addr, nil
+		}
+	}
+}
+
+func (c *obfsPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	buf := pool.Get(len(p) + salamanderSaltLen)
+	defer pool.Put(buf)
+	n = c.obfs.obfuscate(p, buf)
+	if _, err = c.PacketConn.WriteTo(buf[:n], addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,267 @@
+package hysteria2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/daeuniverse/outbound/pkg/fastrand"
+	"github.com/daeuniverse/quic-go/quicvarint"
+)
+
+const (
+	frameTypeTCPRequest = 0x401
+
+	maxAddressLength = 2048
+	maxMessageLength = 2048
+	maxPaddingLength = 4096
+	maxUDPSize       = 4096
+
+	authHost = "hysteria"
+	authPath = "/auth"
+
+	headerAuth        = "Hysteria-Auth"
+	headerUDPEnabled  = "Hysteria-UDP"
+	headerCCRX        = "Hysteria-CC-RX"
+	headerPadding     = "Hysteria-Padding"
+	statusAuthOK      = 233
+	paddingCharacters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+var (
+	ErrInvalidAddressLength = fmt.Errorf("invalid address length")
+	ErrInvalidPaddingLength = fmt.Errorf("invalid padding length")
+	ErrInvalidMessageLength = fmt.Errorf("invalid message length")
+)
+
+// padding is a half-open range [min, max) of the length of random padding.
+type padding struct {
+	min int
+	max int
+}
+
+func (p padding) String() string {
+	b := make([]byte, p.min+fastrand.Intn(p.max-p.min))
+	for i := range b {
+		b[i] = paddingCharacters[fastrand.Intn(len(paddingCharacters))]
+	}
+	return string(b)
+}
+
+var (
+	authResponsePadding = padding{min: 256, max: 2048}
+	tcpResponsePadding  = padding{min: 128, max: 1024}
+)
+
+// authRequest is what clients send in the headers of the HTTP/3 auth request.
+type authRequest struct {
+	auth string
+	// rx is the download bandwidth of the client in bytes per second.
+	// Zero means unknown.
+	rx uint64
+}
+
+func authRequestFromHeader(h http.Header) authRequest {
+	rx, _ := strconv.ParseUint(h.Get(headerCCRX), 10, 64)
+	return authRequest{
+		auth: h.Get(headerAuth),
+		rx:   rx,
+	}
+}
+
+// authResponse is what the server replies to authenticated clients.
+type authResponse struct {
+	udpEnabled bool
+	// rx is the download bandwidth of the server in bytes per second.
+	// Zero means unlimited.
+	rx uint64
+	// rxAuto asks the client to detect the bandwidth itself.
+	rxAuto bool
+}
+
+func authResponseToHeader(h http.Header, resp authResponse) {
+	h.Set(headerUDPEnabled, strconv.FormatBool(resp.udpEnabled))
+	if resp.rxAuto {
+		h.Set(headerCCRX, "auto")
+	} else {
+		h.Set(headerCCRX, strconv.FormatUint(resp.rx, 10))
+	}
+	h.Set(headerPadding, authResponsePadding.String())
+}
+
+// readTCPRequest reads the address of a TCP request whose frame type has been
+// consumed by HTTP/3:
+//
+//	[Address length (varint)][Address][Padding length (varint)][Padding]
+func readTCPRequest(r io.Reader) (addr string, err error) {
+	br := quicvarint.NewReader(r)
+	addrLen, err := quicvarint.Read(br)
+	if err != nil {
+		return "", err
+	}
+	if addrLen == 0 || addrLen > maxAddressLength {
+		return "", ErrInvalidAddressLength
+	}
+	buf := make([]byte, addrLen)
+	if _, err = io.ReadFull(br, buf); err != nil {
+		return "", err
+	}
+	paddingLen, err := quicvarint.Read(br)
+	if err != nil {
+		return "", err
+	}
+	if paddingLen > maxPaddingLength {
+		return "", ErrInvalidPaddingLength
+	}
+	if _, err = io.CopyN(io.Discard, br, int64(paddingLen)); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// writeTCPResponse writes the response of a TCP request:
+//
+//	[Status][Message length (varint)][Message][Padding length (varint)][Padding]
+func writeTCPResponse(w io.Writer, ok bool, msg string) error {
+	if len(msg) > maxMessageLength {
+		msg = msg[:maxMessageLength]
+	}
+	pad := tcpResponsePadding.String()
+	buf := make([]byte, 1, 1+8+len(msg)+8+len(pad))
+	if !ok {
+		buf[0] = 1
+	}
+	buf = quicvarint.Append(buf, uint64(len(msg)))
+	buf = append(buf, msg...)
+	buf = quicvarint.Append(buf, uint64(len(pad)))
+	buf = append(buf, pad...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// udpMessage is carried by a QUIC datagram:
+//
+//	[Session ID (uint32)][Packet ID (uint16)][Fragment ID][Fragment count][Address length (varint)][Address][Data]
+type udpMessage struct {
+	sessionID uint32
+	packetID  uint16
+	fragID    uint8
+	fragCount uint8
+	addr      string
+	data      []byte
+}
+
+func (m *udpMessage) headerSize() int {
+	return 4 + 2 + 1 + 1 + quicvarint.Len(uint64(len(m.addr))) + len(m.addr)
+}
+
+func (m *udpMessage) size() int {
+	return m.headerSize() + len(m.data)
+}
+
+func (m *udpMessage) appendTo(b []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, m.sessionID)
+	b = binary.BigEndian.AppendUint16(b, m.packetID)
+	b = append(b, m.fragID, m.fragCount)
+	b = quicvarint.Append(b, uint64(len(m.addr)))
+	b = append(b, m.addr...)
+	return append(b, m.data...)
+}
+
+func parseUDPMessage(b []byte) (*udpMessage, error) {
+	if len(b) < 8 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	m := &udpMessage{
+		sessionID: binary.BigEndian.Uint32(b),
+		packetID:  binary.BigEndian.Uint16(b[4:]),
+		fragID:    b[6],
+		fragCount: b[7],
+	}
+	r := bytes.NewReader(b[8:])
+	addrLen, err := quicvarint.Read(r)
+	if err != nil {
+		return nil, err
+	}
+	if addrLen == 0 || addrLen > maxMessageLength {
+		return nil, ErrInvalidAddressLength
+	}
+	rest := b[len(b)-r.Len():]
+	// at least one byte of data is expected after the address
+	if len(rest) <= int(addrLen) {
+		return nil, ErrInvalidMessageLength
+	}
+	m.addr = string(rest[:addrLen])
+	m.data = rest[addrLen:]
+	return m, nil
+}
+
+// fragUDPMessage splits the message into fragments no larger than maxSize.
+func fragUDPMessage(m *udpMessage, maxSize int) []udpMessage {
+	if m.size() <= maxSize {
+		return []udpMessage{*m}
+	}
+	maxPayloadSize := maxSize - m.headerSize()
+	if maxPayloadSize <= 0 {
+		return nil
+	}
+	fragCount := (len(m.data) + maxPayloadSize - 1) / maxPayloadSize
+	if fragCount > 255 {
+		return nil
+	}
+	frags := make([]udpMessage, 0, fragCount)
+	for off := 0; off < len(m.data); off += maxPayloadSize {
+		frag := *m
+		frag.fragID = uint8(len(frags))
+		frag.fragCount = uint8(fragCount)
+		frag.data = m.data[off:min(off+maxPayloadSize, len(m.data))]
+		frags = append(frags, frag)
+	}
+	return frags
+}
+
+// defragger reassembles fragmented messages. It only keeps the fragments of
+// the latest packet, which is what Hysteria2 clients expect.
+type defragger struct {
+	packetID uint16
+	frags    []*udpMessage
+	count    int
+	size     int
+}
+
+func (d *defragger) feed(m *udpMessage) *udpMessage {
+	if m.fragCount <= 1 {
+		return m
+	}
+	if m.fragID >= m.fragCount {
+		return nil
+	}
+	if m.packetID != d.packetID || int(m.fragCount) != len(d.frags) {
+		d.packetID = m.packetID
+		d.frags = make([]*udpMessage, m.fragCount)
+		d.count = 0
+		d.size = 0
+	}
+	if d.frags[m.fragID] != nil {
+		return nil
+	}
+	d.frags[m.fragID] = m
+	d.count++
+	d.size += len(m.data)
+	if d.count < len(d.frags) {
+		return nil
+	}
+	data := make([]byte, 0, d.size)
+	for _, frag := range d.frags {
+		data = append(data, frag.data...)
+	}
+	assembled := *m
+	assembled.fragID = 0
+	assembled.fragCount = 1
+	assembled.data = data
+	d.frags = nil
+	return &assembled
+}
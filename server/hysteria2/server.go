@@ -0,0 +1,472 @@
+package hysteria2
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/quic-go"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/api"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/common"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
+	gonanoid "github.com/matoous/go-nanoid"
+)
+
+func init() {
+	server.Register(string(server.ProtocolHysteria2), NewJohn)
+}
+
+type Server struct {
+	dialer     netproxy.Dialer
+	tlsConfig  *tls.Config
+	obfs       *salamander
+	masquerade http.Handler
+	// maxTx and maxRx are the bandwidth of the server in bytes per second.
+	maxTx                 uint64
+	maxRx                 uint64
+	ignoreClientBandwidth bool
+
+	sweetLisa config.Lisa
+	arg       server.Argument
+	// certificate is replaced after the copied chain is refreshed
+	certificate  server.PinnedCertificate
+	copied       *server.CopiedCertificate
+	obfsPassword string
+
+	mutex    sync.Mutex
+	passages []Passage
+	users    map[string]Passage
+
+	passageContentionCache *server.ContentionCache
+	lastAliveMu            sync.RWMutex
+	lastAlive              time.Time
+
+	lifecycleMu sync.Mutex
+	closeOnce   sync.Once
+	closed      bool
+	ctx         context.Context
+	cancel      context.CancelFunc
+	listener    *quic.Listener
+}
+
+type Passage struct {
+	server.Passage
+	auth string
+}
+
+// Options is the server side configuration of Hysteria2.
+type Options struct {
+	Certificate []byte
+	PrivateKey  []byte
+	config.Hysteria2
+}
+
+func New(dialer netproxy.Dialer, opts *Options) (*Server, error) {
+	var (
+		obfs *salamander
+		err  error
+	)
+	if opts.ObfsPassword != "" {
+		if obfs, err = newSalamander(opts.ObfsPassword); err != nil {
+			return nil, err
+		}
+	}
+	masquerade, err := newMasquerade(opts.Masquerade)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		dialer:                dialer,
+		obfs:                  obfs,
+		obfsPassword:          opts.ObfsPassword,
+		masquerade:            masquerade,
+		maxTx:                 mbpsToBps(opts.UpMbps),
+		maxRx:                 mbpsToBps(opts.DownMbps),
+		ignoreClientBandwidth: opts.IgnoreClientBandwidth,
+		users:                 make(map[string]Passage),
+		ctx:                   ctx,
+		cancel:                cancel,
+	}
+	if err = s.certificate.Set(opts.Certificate, opts.PrivateKey); err != nil {
+		cancel()
+		return nil, err
+	}
+	s.tlsConfig = &tls.Config{
+		NextProtos:     []string{"h3"},
+		MinVersion:     tls.VersionTLS13,
+		GetCertificate: s.certificate.GetCertificate,
+	}
+	return s, nil
+}
+
+func NewJohn(valueCtx context.Context, dialer netproxy.Dialer, sweetLisa config.Lisa, arg server.Argument) (server.Server, error) {
+	copied := valueCtx.Value("copiedCertificate").(*server.CopiedCertificate)
+	cert, key := copied.KeyPair()
+	john, err := New(dialer, &Options{
+		Certificate: cert,
+		PrivateKey:  key,
+		Hysteria2:   config.ParamsObj.John.Hysteria2,
+	})
+	if err != nil {
+		return nil, err
+	}
+	john.sweetLisa = sweetLisa
+	john.arg = arg
+	john.copied = copied
+	copied.OnChange(func() {
+		// clients get the new pin by the re-registration
+		if err := john.certificate.Set(copied.KeyPair()); err != nil {
+			log.Warn("hysteria2: %v", err)
+			return
+		}
+		john.setLastAlive(time.Time{})
+	})
+	john.passageContentionCache = server.NewContentionCache()
+	if err := john.AddPassages([]server.Passage{{Manager: true}}); err != nil {
+		return nil, err
+	}
+	if err := john.register(); err != nil {
+		return nil, err
+	}
+	go john.registerBackground()
+	go server.RotateManager(john, john.register, john.ctx.Done())
+	return john, nil
+}
+
+func mbpsToBps(mbps int64) uint64 {
+	if mbps <= 0 {
+		return 0
+	}
+	return uint64(mbps) * 1000000 / 8
+}
+
+// newMasquerade returns the handler for requests that fail to authenticate,
+// so that the server looks like an ordinary HTTP/3 site to active probes.
+func newMasquerade(rawURL string) (http.Handler, error) {
+	if rawURL == "" {
+		return http.NotFoundHandler(), nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse masquerade: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("parse masquerade: unsupported scheme %v", strconv.Quote(u.Scheme))
+	}
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(u)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Debug("hysteria2 masquerade: %v", err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}, nil
+}
+
+func (s *Server) Listen(addr string) error {
+	conn, err := server.ListenPacket(addr, s.arg.HopPorts)
+	if err != nil {
+		return err
+	}
+	return s.serve(conn)
+}
+
+func (s *Server) serve(conn net.PacketConn) error {
+	var packetConn = conn
+	if s.obfs != nil {
+		packetConn = newObfsPacketConn(conn, s.obfs)
+	}
+	listener, err := quic.Listen(packetConn, s.tlsConfig, &quic.Config{
+		MaxIncomingStreams: 1024,
+		MaxIdleTimeout:     30 * time.Second,
+		KeepAlivePeriod:    10 * time.Second,
+		EnableDatagrams:    true,
+	})
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	if !s.setListener(listener) {
+		_ = listener.Close()
+		_ = conn.Close()
+		return nil
+	}
+	defer func() {
+		s.clearListener(listener)
+		_ = listener.Close()
+		_ = conn.Close()
+	}()
+	for {
+		qConn, err := listener.Accept(s.ctx)
+		if err != nil {
+			if errors.Is(err, context.Canceled) || errors.Is(err, quic.ErrServerClosed) {
+				return nil
+			}
+			return err
+		}
+		go func(qConn quic.Connection) {
+			if err := s.handleConn(qConn); err != nil {
+				log.Info("hysteria2 handleConn: %v", err)
+			}
+		}(qConn)
+	}
+}
+
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		if s.copied != nil {
+			_ = s.copied.Close()
+		}
+		s.lifecycleMu.Lock()
+		s.closed = true
+		if s.cancel != nil {
+			s.cancel()
+		}
+		listener := s.listener
+		s.listener = nil
+		s.lifecycleMu.Unlock()
+		if listener != nil {
+			err = listener.Close()
+		}
+	})
+	return err
+}
+
+func (s *Server) AddPassages(passages []server.Passage) error {
+	local, _ := LocalizePassages(passages)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if server.ReplacesManagers(passages) {
+		s.removePassagesFuncLocked(func(p *Passage) bool { return p.Manager })
+	}
+	for _, passage := range local {
+		s.passages = append(s.passages, passage)
+	}
+	s.rebuildUsersLocked()
+	return nil
+}
+
+func (s *Server) RemovePassages(passages []server.Passage, alsoManager bool) error {
+	local, _ := LocalizePassages(passages)
+	keySet := make(map[string]struct{}, len(local))
+	for _, passage := range local {
+		if passage.Manager && !alsoManager {
+			continue
+		}
+		keySet[passage.In.Argument.Hash()] = struct{}{}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.removePassagesFuncLocked(func(p *Passage) bool {
+		_, ok := keySet[p.In.Argument.Hash()]
+		return ok
+	})
+	s.rebuildUsersLocked()
+	return nil
+}
+
+func (s *Server) SyncPassages(passages []server.Passage) error {
+	return server.SyncPassages(s, passages)
+}
+
+func (s *Server) Passages() (passages []server.Passage) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, passage := range s.passages {
+		passages = append(passages, passage.Passage)
+	}
+	return passages
+}
+
+// AuthString returns the auth string that Hysteria2 clients send for the
+// argument.
+func AuthString(username, password string) string {
+	if password == "" {
+		return username
+	}
+	return username + ":" + password
+}
+
+func LocalizePassages(passages []server.Passage) ([]Passage, *Passage) {
+	passages = server.LocalizeManagers(passages, func(passage *server.Passage) {
+		passage.In.Password, _ = gonanoid.Generate(common.Alphabet, 23)
+	})
+	local := make([]Passage, len(passages))
+	var manager *Passage
+	for i, passage := range passages {
+		if passage.Manager {
+			manager = &local[i]
+		}
+		local[i] = Passage{
+			Passage: passage,
+			auth:    AuthString(passage.In.Username, passage.In.Password),
+		}
+	}
+	return local, manager
+}
+
+func (s *Server) removePassagesFuncLocked(f func(*Passage) bool) {
+	for i := len(s.passages) - 1; i >= 0; i-- {
+		if f(&s.passages[i]) {
+			s.passages = append(s.passages[:i], s.passages[i+1:]...)
+		}
+	}
+}
+
+func (s *Server) rebuildUsersLocked() {
+	s.users = make(map[string]Passage, len(s.passages))
+	for i := range s.passages {
+		s.users[s.passages[i].auth] = s.passages[i]
+	}
+}
+
+func (s *Server) getPassage(auth string) (Passage, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	passage, ok := s.users[auth]
+	return passage, ok
+}
+
+func (s *Server) ContentionCheck(thisIP net.IP, passage *Passage) error {
+	if s.passageContentionCache == nil {
+		return nil
+	}
+	contentionDuration := server.ProtectTime[passage.Use()]
+	if contentionDuration > 0 {
+		passageKey := passage.In.Argument.Hash()
+		accept, conflictIP := s.passageContentionCache.Check(passageKey, contentionDuration, thisIP)
+		if !accept {
+			return fmt.Errorf("%w: from %v and %v: contention detected", server.ErrPassageAbuse, thisIP.String(), conflictIP.String())
+		}
+	}
+	return nil
+}
+
+func (s *Server) registerBackground() {
+	interval := 2 * time.Second
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-s.ctx.Done():
+			ticker.Stop()
+			return
+		case <-ticker.C:
+			if time.Since(s.getLastAlive()) < server.LostThreshold {
+				continue
+			}
+			if err := s.register(); err != nil {
+				interval *= 2
+				if interval > 600*time.Second {
+					interval = 600 * time.Second
+				}
+				log.Warn("hysteria2 registerBackground: %v. retry in %v", err, interval.String())
+			} else {
+				interval = 2 * time.Second
+			}
+			ticker.Reset(interval)
+		}
+	}
+}
+
+// method is the argument method registered to SweetLisa, which carries what
+// clients need besides the auth string.
+func (s *Server) method() string {
+	method := "pinned_certchain_sha256=" + s.certificate.PinnedCertchainSha256()
+	if s.copied != nil && s.copied.Domain() != server.JuicityDomain {
+		method += ";sni=" + s.copied.Domain()
+	}
+	if s.obfsPassword != "" {
+		method += ";obfs=salamander;obfs-password=" + s.obfsPassword
+	}
+	if len(s.arg.HopPorts) > 0 {
+		method += ";mport=" + server.FormatHopPorts(s.arg.HopPorts)
+	}
+	return method
+}
+
+func (s *Server) register() error {
+	manager := server.CurrentManager(s.Passages())
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	t, _ := net.LookupTXT("cdn-validate." + s.sweetLisa.Host)
+	var validateToken string
+	if len(t) > 0 {
+		validateToken = t[0]
+	}
+	bandwidthLimit, err := server.GenerateBandwidthLimit()
+	if err != nil {
+		return err
+	}
+	cdnNames, users, err := api.Register(ctx, s.sweetLisa.Host, validateToken, model.Server{
+		Ticket: s.arg.Ticket,
+		Name:   s.arg.ServerName,
+		Hosts:  s.arg.Hostnames,
+		Port:   s.arg.Port,
+		Argument: model.Argument{
+			Protocol: "hysteria2",
+			Username: manager.In.Username,
+			Password: manager.In.Password,
+			Method:   s.method(),
+		},
+		BandwidthLimit: bandwidthLimit,
+		NoRelay:        s.arg.NoRelay,
+	})
+	if err != nil {
+		return err
+	}
+	log.Alert("Succeed to register at %v (%v)", strconv.Quote(s.sweetLisa.Host), cdnNames)
+	s.setLastAlive(time.Now())
+	return s.SyncPassages(users)
+}
+
+func (s *Server) setListener(listener *quic.Listener) bool {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.listener = listener
+	return true
+}
+
+func (s *Server) clearListener(listener *quic.Listener) {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+	if s.listener == listener {
+		s.listener = nil
+	}
+}
+
+func (s *Server) getListener() *quic.Listener {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+	return s.listener
+}
+
+func (s *Server) setLastAlive(t time.Time) {
+	s.lastAliveMu.Lock()
+	defer s.lastAliveMu.Unlock()
+	s.lastAlive = t
+}
+
+func (s *Server) getLastAlive() time.Time {
+	s.lastAliveMu.RLock()
+	defer s.lastAliveMu.RUnlock()
+	return s.lastAlive
+}
@@ -0,0 +1,363 @@
+package hysteria2
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/outbound/protocol"
+	"github.com/daeuniverse/outbound/protocol/direct"
+	coreErrs "github.com/daeuniverse/outbound/protocol/hysteria2/errors"
+	"github.com/daeuniverse/quic-go/http3"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/common"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/internal/testutil"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
+)
+
+const (
+	testUser     = "hysteria2-user"
+	testPassword = "hysteria2-password"
+)
+
+func TestDialerRelaysTCPThroughServer(t *testing.T) {
+	echoAddr, closeEcho := testutil.StartEchoServer(t)
+	defer closeEcho()
+
+	srv, addr := startHysteria2Server(t, config.Hysteria2{}, hysteria2Passage(testUser, testPassword))
+	dialer := newTestDialer(t, srv, addr, testUser, testPassword)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, "tcp", echoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf), "pong"; got != want {
+		t.Fatalf("echo response = %q, want %q", got, want)
+	}
+}
+
+func TestDialerRelaysUDPThroughServer(t *testing.T) {
+	udpAddr, closeUDP := testutil.StartUDPEchoServer(t)
+	defer closeUDP()
+
+	srv, addr := startHysteria2Server(t, config.Hysteria2{}, hysteria2Passage(testUser, testPassword))
+	dialer := newTestDialer(t, srv, addr, testUser, testPassword)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, "udp", udpAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// larger than a datagram, so that both directions are fragmented
+	packet := bytes.Repeat([]byte("0123456789"), 300)
+	packetConn := conn.(netproxy.PacketConn)
+	_ = packetConn.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, want := range [][]byte{[]byte("hello"), packet} {
+		if _, err := packetConn.WriteTo(want, udpAddr.String()); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(want))
+		n, addrPort, err := packetConn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], want) {
+			t.Fatalf("udp response has %v bytes, want %v bytes", n, len(want))
+		}
+		if addrPort != udpAddr {
+			t.Fatalf("udp response addr = %v, want %v", addrPort, udpAddr)
+		}
+	}
+}
+
+func TestSalamanderObfuscatedServer(t *testing.T) {
+	echoAddr, closeEcho := testutil.StartEchoServer(t)
+	defer closeEcho()
+
+	srv, addr := startHysteria2Server(t, config.Hysteria2{ObfsPassword: "salamander-password"}, hysteria2Passage(testUser, testPassword))
+	dialer := newTestDialer(t, srv, addr, testUser, testPassword)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, "tcp", echoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// clients without the obfuscation cannot handshake
+	plain, err := NewDialer(direct.SymmetricDirect, protocol.Header{
+		ProxyAddress: addr,
+		User:         testUser,
+		Password:     testPassword,
+		IsClient:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if conn, err := plain.DialContext(ctx, "tcp", echoAddr); err == nil {
+		_ = conn.Close()
+		t.Fatal("a client without salamander connected to the obfuscated server")
+	}
+}
+
+func TestSalamanderRoundTrip(t *testing.T) {
+	obfs, err := newSalamander("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := []byte("hello, hysteria2")
+	obfuscated := make([]byte, len(plain)+salamanderSaltLen)
+	if n := obfs.obfuscate(plain, obfuscated); n != len(obfuscated) {
+		t.Fatalf("obfuscate() = %v, want %v", n, len(obfuscated))
+	}
+	if bytes.Contains(obfuscated, plain) {
+		t.Fatal("obfuscated packet contains the plain text")
+	}
+	out := make([]byte, len(plain))
+	if n := obfs.deobfuscate(obfuscated, out); n != len(plain) || !bytes.Equal(out, plain) {
+		t.Fatalf("deobfuscate() = %q, want %q", out[:n], plain)
+	}
+	if _, err := newSalamander("abc"); !errors.Is(err, ErrSalamanderPSKTooShort) {
+		t.Fatalf("newSalamander() error = %v, want %v", err, ErrSalamanderPSKTooShort)
+	}
+}
+
+func TestWrongPasswordIsMasqueraded(t *testing.T) {
+	echoAddr, closeEcho := testutil.StartEchoServer(t)
+	defer closeEcho()
+
+	srv, addr := startHysteria2Server(t, config.Hysteria2{}, hysteria2Passage(testUser, testPassword))
+	dialer := newTestDialer(t, srv, addr, testUser, "wrong-password")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := dialer.DialContext(ctx, "tcp", echoAddr)
+	var authErr coreErrs.AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("DialContext() error = %v, want an auth error", err)
+	}
+	if authErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("auth status = %v, want %v", authErr.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestMasqueradeProxiesHTTP3Requests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "masquerade:"+r.URL.Path)
+	}))
+	defer backend.Close()
+
+	_, addr := startHysteria2Server(t, config.Hysteria2{Masquerade: backend.URL})
+	rt := &http3.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer rt.Close()
+	resp, err := (&http.Client{Transport: rt, Timeout: 5 * time.Second}).Get("https://" + addr + "/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(body), "masquerade:/index.html"; got != want {
+		t.Fatalf("masquerade response = %q, want %q", got, want)
+	}
+}
+
+func TestDialCmdMsgPing(t *testing.T) {
+	srv, addr := startHysteria2Server(t, config.Hysteria2{}, server.Passage{Manager: true})
+	manager := srv.Passages()[0]
+	dialer := newTestDialer(t, srv, addr, manager.In.Username, manager.In.Password)
+
+	conn, err := dialer.DialCmdMsg(protocol.MetadataCmdPing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := make([]byte, 8)
+	binary.BigEndian.PutUint32(req[:4], 4)
+	copy(req[4:], "ping")
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, req[:4]); err != nil {
+		t.Fatal(err)
+	}
+	if n := binary.BigEndian.Uint32(req[:4]); n == 0 {
+		t.Fatal("empty ping response")
+	} else if n > 4096 {
+		t.Fatalf("ping response too large: %d", n)
+	}
+	if srv.getLastAlive().IsZero() {
+		t.Fatal("lastAlive is not updated by ping")
+	}
+}
+
+func TestUserCannotSendManagerMessage(t *testing.T) {
+	srv, addr := startHysteria2Server(t, config.Hysteria2{}, hysteria2Passage(testUser, testPassword))
+	dialer := newTestDialer(t, srv, addr, testUser, testPassword)
+
+	conn, err := dialer.DialCmdMsg(protocol.MetadataCmdPing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := make([]byte, 8)
+	binary.BigEndian.PutUint32(req[:4], 4)
+	copy(req[4:], "ping")
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, req[:4]); err == nil {
+		t.Fatal("non-manager passage received a ping response")
+	}
+	if !srv.getLastAlive().IsZero() {
+		t.Fatal("lastAlive is updated by a non-manager passage")
+	}
+}
+
+func TestMethod(t *testing.T) {
+	cert, key := testCertificate(t)
+	hash, err := common.GenerateCertChainHashFromBytes(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{}
+	if err = srv.certificate.Set(cert, key); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := srv.method(), "pinned_certchain_sha256="+hash; got != want {
+		t.Fatalf("method() = %q, want %q", got, want)
+	}
+	srv.obfsPassword = "secret"
+	if got, want := srv.method(), "pinned_certchain_sha256="+hash+";obfs=salamander;obfs-password=secret"; got != want {
+		t.Fatalf("method() = %q, want %q", got, want)
+	}
+}
+
+func hysteria2Passage(user, password string) server.Passage {
+	return server.Passage{
+		Passage: model.Passage{
+			In: model.In{Argument: model.Argument{
+				Protocol: "hysteria2",
+				Username: user,
+				Password: password,
+			}},
+		},
+	}
+}
+
+func startHysteria2Server(t *testing.T, conf config.Hysteria2, passages ...server.Passage) (*Server, string) {
+	t.Helper()
+
+	cert, key := testCertificate(t)
+	srv, err := New(direct.SymmetricDirect, &Options{
+		Certificate: cert,
+		PrivateKey:  key,
+		Hysteria2:   conf,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.AddPassages(passages); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:0")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = srv.serve(conn)
+	}()
+	t.Cleanup(func() {
+		_ = srv.Close()
+		<-done
+	})
+	return srv, conn.LocalAddr().String()
+}
+
+func newTestDialer(t *testing.T, srv *Server, addr string, user, password string) *Dialer {
+	t.Helper()
+
+	dialer, err := NewDialer(direct.SymmetricDirect, protocol.Header{
+		ProxyAddress: addr,
+		Cipher:       srv.method(),
+		User:         user,
+		Password:     password,
+		IsClient:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialer.(*Dialer)
+}
+
+func testCertificate(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
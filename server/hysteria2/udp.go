@@ -0,0 +1,186 @@
+package hysteria2
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/outbound/pkg/fastrand"
+	"github.com/daeuniverse/outbound/pool"
+	"github.com/daeuniverse/quic-go"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+)
+
+// udpSessionManager relays the UDP sessions of a QUIC connection. Every
+// session is a full-cone UDP socket dialed at its first message.
+type udpSessionManager struct {
+	conn   quic.Connection
+	dialer netproxy.Dialer
+
+	mu       sync.Mutex
+	sessions map[uint32]*udpSession
+	closed   bool
+}
+
+type udpSession struct {
+	id        uint32
+	defragger defragger
+	dialing   bool
+	rConn     netproxy.PacketConn
+}
+
+func newUDPSessionManager(conn quic.Connection, dialer netproxy.Dialer) *udpSessionManager {
+	return &udpSessionManager{
+		conn:     conn,
+		dialer:   dialer,
+		sessions: make(map[uint32]*udpSession),
+	}
+}
+
+func (m *udpSessionManager) run() {
+	defer m.close()
+	for {
+		b, err := m.conn.ReceiveDatagram(context.Background())
+		if err != nil {
+			return
+		}
+		msg, err := parseUDPMessage(b)
+		if err != nil {
+			log.Debug("hysteria2 parseUDPMessage: %v", err)
+			continue
+		}
+		m.feed(msg)
+	}
+}
+
+func (m *udpSessionManager) feed(msg *udpMessage) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	session, ok := m.sessions[msg.sessionID]
+	if !ok {
+		session = &udpSession{id: msg.sessionID}
+		m.sessions[msg.sessionID] = session
+	}
+	if msg = session.defragger.feed(msg); msg == nil {
+		m.mu.Unlock()
+		return
+	}
+	rConn := session.rConn
+	if rConn == nil {
+		if session.dialing {
+			// drop the packet like a congested link
+			m.mu.Unlock()
+			return
+		}
+		session.dialing = true
+		m.mu.Unlock()
+		// dialing is slow; do not block the datagrams of other sessions
+		go m.dial(session, msg)
+		return
+	}
+	m.mu.Unlock()
+	_ = rConn.SetWriteDeadline(time.Now().Add(server.DefaultNatTimeout))
+	if _, err := rConn.WriteTo(msg.data, msg.addr); err != nil {
+		log.Debug("hysteria2 udp WriteTo: %v", err)
+	}
+}
+
+func (m *udpSessionManager) dial(session *udpSession, msg *udpMessage) {
+	ctx, cancel := context.WithTimeout(context.Background(), server.DialTimeout)
+	defer cancel()
+	c, err := m.dialer.DialContext(ctx, "udp", msg.addr)
+	if err != nil {
+		log.Debug("hysteria2 udp dial: %v", err)
+		m.removeSession(session)
+		return
+	}
+	rConn := c.(netproxy.PacketConn)
+	m.mu.Lock()
+	if m.closed || m.sessions[session.id] != session {
+		// the session has been closed while dialing
+		m.mu.Unlock()
+		_ = rConn.Close()
+		return
+	}
+	session.rConn = rConn
+	m.mu.Unlock()
+	_ = rConn.SetWriteDeadline(time.Now().Add(server.DefaultNatTimeout))
+	if _, err = rConn.WriteTo(msg.data, msg.addr); err != nil {
+		log.Debug("hysteria2 udp WriteTo: %v", err)
+	}
+	go m.relayBack(session)
+}
+
+// relayBack sends what the remote replies back to the client until the session
+// idles out.
+func (m *udpSessionManager) relayBack(session *udpSession) {
+	defer m.removeSession(session)
+	buf := pool.Get(maxUDPSize)
+	defer pool.Put(buf)
+	sendBuf := make([]byte, 0, maxUDPSize+maxAddressLength+16)
+	for {
+		_ = session.rConn.SetReadDeadline(time.Now().Add(server.DefaultNatTimeout))
+		n, addr, err := session.rConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		msg := &udpMessage{
+			sessionID: session.id,
+			fragCount: 1,
+			addr:      addr.String(),
+			data:      buf[:n],
+		}
+		if err = m.send(sendBuf, msg); err != nil {
+			return
+		}
+	}
+}
+
+func (m *udpSessionManager) send(buf []byte, msg *udpMessage) error {
+	err := m.conn.SendDatagram(msg.appendTo(buf[:0]))
+	var errTooLarge *quic.DatagramTooLargeError
+	if !errors.As(err, &errTooLarge) {
+		return err
+	}
+	msg.packetID = uint16(fastrand.Intn(0xFFFF)) + 1
+	for _, frag := range fragUDPMessage(msg, int(errTooLarge.MaxDataLen)) {
+		if err := m.conn.SendDatagram(frag.appendTo(buf[:0])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *udpSessionManager) removeSession(session *udpSession) {
+	m.mu.Lock()
+	if m.sessions[session.id] == session {
+		delete(m.sessions, session.id)
+	}
+	m.mu.Unlock()
+	if session.rConn != nil {
+		_ = session.rConn.Close()
+	}
+}
+
+func (m *udpSessionManager) close() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	sessions := m.sessions
+	m.sessions = nil
+	m.mu.Unlock()
+	for _, session := range sessions {
+		if session.rConn != nil {
+			_ = session.rConn.Close()
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package juicity
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/outbound/pool"
+	"github.com/daeuniverse/outbound/protocol/juicity"
+	"github.com/daeuniverse/outbound/protocol/tuic"
+	"github.com/daeuniverse/quic-go"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+)
+
+// The datagram mode relays UDP packets in QUIC datagrams, which are encoded as
+// the native Packet commands of TUIC v5 with the version of juicity. Clients
+// not negotiating datagrams keep using the stream mode.
+
+const (
+	// MaxPendingFragmentedPackets limits the incomplete fragmented packets of
+	// a connection.
+	MaxPendingFragmentedPackets = 64
+	// associationQueueSize is the number of packets queued for an association
+	// before dialing. Packets are dropped once the queue is full.
+	associationQueueSize = 64
+)
+
+type datagramPacket struct {
+	b    []byte
+	addr string
+}
+
+// association is a UDP session identified by ASSOC_ID.
+type association struct {
+	id uint16
+	ch chan datagramPacket
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+	rConn     netproxy.PacketConn
+}
+
+func (a *association) close() {
+	a.closeOnce.Do(func() {
+		close(a.closed)
+		a.mu.Lock()
+		if a.rConn != nil {
+			_ = a.rConn.Close()
+		}
+		a.mu.Unlock()
+	})
+}
+
+// setRConn returns false if the association has been closed before dialed.
+func (a *association) setRConn(rConn netproxy.PacketConn) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	select {
+	case <-a.closed:
+		return false
+	default:
+	}
+	a.rConn = rConn
+	return true
+}
+
+type fragmentedPacket struct {
+	frags [][]byte
+	addr  *tuic.Address
+	count int
+}
+
+// datagramSession holds the association table of a QUIC connection.
+type datagramSession struct {
+	conn   quic.Connection
+	dialer netproxy.Dialer
+
+	mu           sync.Mutex
+	associations map[uint16]*association
+	// pending is only accessed by the receiving loop
+	pending map[uint32]*fragmentedPacket
+	pktID   atomic.Uint32
+	wg      sync.WaitGroup
+}
+
+func newDatagramSession(conn quic.Connection, dialer netproxy.Dialer) *datagramSession {
+	return &datagramSession{
+		conn:         conn,
+		dialer:       dialer,
+		associations: make(map[uint16]*association),
+		pending:      make(map[uint32]*fragmentedPacket),
+	}
+}
+
+// Serve receives datagrams until ctx is done or the connection is closed.
+func (d *datagramSession) Serve(ctx context.Context) error {
+	defer func() {
+		d.mu.Lock()
+		for _, a := range d.associations {
+			a.close()
+		}
+		d.mu.Unlock()
+		d.wg.Wait()
+	}()
+	for {
+		message, err := d.conn.ReceiveDatagram(ctx)
+		if err != nil {
+			return err
+		}
+		if err = d.handleDatagram(message); err != nil {
+			log.Debug("juicity: handleDatagram: %v", err)
+		}
+	}
+}
+
+func (d *datagramSession) handleDatagram(message []byte) error {
+	r := bytes.NewReader(message)
+	head, err := tuic.ReadCommandHead(r)
+	if err != nil {
+		return err
+	}
+	if head.VER != juicity.Version0 {
+		return fmt.Errorf("%w: %v", ErrUnexpectedVersion, head.VER)
+	}
+	switch head.TYPE {
+	case tuic.PacketType:
+		packet, err := tuic.ReadPacketWithHead(head, r)
+		if err != nil {
+			return err
+		}
+		data, addr, ok := d.reassemble(packet)
+		if !ok {
+			return nil
+		}
+		if addr == nil {
+			return fmt.Errorf("no address in the packet of association %v", packet.ASSOC_ID)
+		}
+		d.deliver(packet.ASSOC_ID, datagramPacket{b: data, addr: addr.String()})
+	case tuic.DissociateType:
+		dissociate, err := tuic.ReadDissociateWithHead(head, r)
+		if err != nil {
+			return err
+		}
+		d.mu.Lock()
+		a, ok := d.associations[dissociate.ASSOC_ID]
+		delete(d.associations, dissociate.ASSOC_ID)
+		d.mu.Unlock()
+		if ok {
+			a.close()
+		}
+	case tuic.HeartbeatType:
+	default:
+		return fmt.Errorf("%w: %v", ErrUnexpectedCmdType, head.TYPE)
+	}
+	return nil
+}
+
+// reassemble returns the whole packet once all fragments are received.
+func (d *datagramSession) reassemble(packet *tuic.Packet) (data []byte, addr *tuic.Address, ok bool) {
+	if packet.FRAG_TOTAL <= 1 {
+		return packet.DATA, packet.ADDR, true
+	}
+	if packet.FRAG_ID >= packet.FRAG_TOTAL {
+		return nil, nil, false
+	}
+	key := uint32(packet.ASSOC_ID)<<16 | uint32(packet.PKT_ID)
+	f, exists := d.pending[key]
+	if !exists {
+		if len(d.pending) >= MaxPendingFragmentedPackets {
+			// the lost fragments never come
+			clear(d.pending)
+		}
+		f = &fragmentedPacket{frags: make([][]byte, packet.FRAG_TOTAL)}
+		d.pending[key] = f
+	}
+	if len(f.frags) != int(packet.FRAG_TOTAL) || f.frags[packet.FRAG_ID] != nil {
+		return nil, nil, false
+	}
+	f.frags[packet.FRAG_ID] = packet.DATA
+	f.count++
+	if packet.FRAG_ID == 0 {
+		f.addr = packet.ADDR
+	}
+	if f.count < len(f.frags) {
+		return nil, nil, false
+	}
+	delete(d.pending, key)
+	return bytes.Join(f.frags, nil), f.addr, true
+}
+
+func (d *datagramSession) deliver(assocID uint16, p datagramPacket) {
+	d.mu.Lock()
+	a, ok := d.associations[assocID]
+	if !ok {
+		a = &association{
+			id:     assocID,
+			ch:     make(chan datagramPacket, associationQueueSize),
+			closed: make(chan struct{}),
+		}
+		d.associations[assocID] = a
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			if err := d.serveAssociation(a, p.addr); err != nil {
+				log.Debug("juicity: association %v: %v", a.id, err)
+			}
+		}()
+	}
+	d.mu.Unlock()
+	select {
+	case a.ch <- p:
+	default:
+		// never block other associations
+	}
+}
+
+func (d *datagramSession) removeAssociation(a *association) {
+	a.close()
+	d.mu.Lock()
+	if d.associations[a.id] == a {
+		delete(d.associations, a.id)
+	}
+	d.mu.Unlock()
+}
+
+func (d *datagramSession) serveAssociation(a *association, target string) error {
+	defer d.removeAssociation(a)
+	ctx, cancel := context.WithTimeout(context.TODO(), server.DialTimeout)
+	c, err := d.dialer.DialContext(ctx, "udp", target)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("Dial: %w", err)
+	}
+	rConn := c.(netproxy.PacketConn)
+	if !a.setRConn(rConn) {
+		return rConn.Close()
+	}
+	go func() {
+		for {
+			select {
+			case p := <-a.ch:
+				_ = rConn.SetWriteDeadline(time.Now().Add(server.DefaultNatTimeout)) // should keep consistent
+				if _, err := rConn.WriteTo(p.b, p.addr); err != nil {
+					if errors.Is(err, net.ErrWriteToConnected) {
+						log.Error("juicity: association %v: %v", a.id, err)
+					}
+					a.close()
+					return
+				}
+			case <-a.closed:
+				return
+			}
+		}
+	}()
+	buf := pool.GetFullCap(0xffff)
+	defer pool.Put(buf)
+	for {
+		_ = rConn.SetReadDeadline(time.Now().Add(server.DefaultNatTimeout))
+		n, addr, err := rConn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.Is(err, net.ErrClosed) || (errors.As(err, &netErr) && netErr.Timeout()) {
+				return nil
+			}
+			return err
+		}
+		if err = d.send(a.id, addr, buf[:n]); err != nil {
+			return err
+		}
+	}
+}
+
+// send writes the packet in datagrams, which is fragmented if it exceeds the
+// datagram MTU.
+func (d *datagramSession) send(assocID uint16, addr netip.AddrPort, b []byte) error {
+	packet := tuic.NewPacket(assocID, uint16(d.pktID.Add(1)), 1, 0, uint16(len(b)), tuic.NewAddressAddrPort(addr), b, juicity.Version0)
+	buf := pool.GetBuffer()
+	defer pool.PutBuffer(buf)
+	if err := packet.WriteTo(buf); err != nil {
+		return err
+	}
+	err := d.conn.SendDatagram(buf.Bytes())
+	var tooLarge *quic.DatagramTooLargeError
+	if errors.As(err, &tooLarge) {
+		return d.sendFragments(packet, int(tooLarge.MaxDataLen)-tuic.PacketOverHead)
+	}
+	return err
+}
+
+func (d *datagramSession) sendFragments(packet *tuic.Packet, fragSize int) error {
+	if fragSize <= 0 {
+		return fmt.Errorf("datagram MTU is too small to relay packets")
+	}
+	data := packet.DATA
+	fragTotal := (len(data) + fragSize - 1) / fragSize
+	if fragTotal > 0xff {
+		return fmt.Errorf("too many fragments: %v", fragTotal)
+	}
+	buf := pool.GetBuffer()
+	defer pool.PutBuffer(buf)
+	addr := packet.ADDR
+	for i := 0; i < fragTotal; i++ {
+		frag := data[i*fragSize : min((i+1)*fragSize, len(data))]
+		if i > 0 {
+			// only the first fragment carries the address
+			addr = &tuic.Address{TYPE: tuic.AtypNone}
+		}
+		buf.Reset()
+		if err := tuic.NewPacket(packet.ASSOC_ID, packet.PKT_ID, uint8(fragTotal), uint8(i), uint16(len(frag)), addr, frag, juicity.Version0).WriteTo(buf); err != nil {
+			return err
+		}
+		if err := d.conn.SendDatagram(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package juicity
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/daeuniverse/outbound/protocol/juicity"
+	"github.com/daeuniverse/outbound/protocol/tuic"
+	"github.com/daeuniverse/quic-go"
+	"github.com/google/uuid"
+)
+
+func TestDatagramRelaysUDPThroughServer(t *testing.T) {
+	udpAddr, closeUDP := startJuicityUDPEchoServer(t)
+	defer closeUDP()
+
+	_, addr, closeServer := startJuicityServerWithPassage(t)
+	defer closeServer()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, &tls.Config{
+		NextProtos:         []string{"h3"},
+		MinVersion:         tls.VersionTLS13,
+		InsecureSkipVerify: true,
+	}, &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, "")
+	if !conn.ConnectionState().SupportsDatagrams {
+		t.Fatal("the server does not support datagrams")
+	}
+
+	id := uuid.MustParse(testJuicityUser)
+	token, err := tuic.GenToken(conn.ConnectionState(), id, testJuicityPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authStream, err := conn.OpenUniStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = tuic.NewAuthenticate(id, token, juicity.Version0).WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = authStream.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	_ = authStream.Close()
+
+	target := netip.MustParseAddrPort(udpAddr.String())
+	buf.Reset()
+	if err = tuic.NewPacket(1, 1, 1, 0, 4, tuic.NewAddressAddrPort(target), []byte("ping"), juicity.Version0).WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.SendDatagram(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	message, err := conn.ReceiveDatagram(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := tuic.ReadPacket(bytes.NewReader(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet.ASSOC_ID != 1 || string(packet.DATA) != "pong" {
+		t.Fatalf("got association %v data %q, want 1 %q", packet.ASSOC_ID, packet.DATA, "pong")
+	}
+	if got := packet.ADDR.String(); got != target.String() {
+		t.Fatalf("udp response addr = %v, want %v", got, target)
+	}
+}
+
+func TestDatagramReassembleFragments(t *testing.T) {
+	d := newDatagramSession(nil, nil)
+	addr := tuic.NewAddressAddrPort(netip.MustParseAddrPort("127.0.0.1:53"))
+	none := &tuic.Address{TYPE: tuic.AtypNone}
+	frags := []*tuic.Packet{
+		tuic.NewPacket(1, 7, 3, 2, 1, none, []byte("c"), juicity.Version0),
+		tuic.NewPacket(1, 7, 3, 0, 1, addr, []byte("a"), juicity.Version0),
+		tuic.NewPacket(1, 7, 3, 1, 1, none, []byte("b"), juicity.Version0),
+	}
+	for i, frag := range frags {
+		data, gotAddr, ok := d.reassemble(frag)
+		if i < len(frags)-1 {
+			if ok {
+				t.Fatalf("assembled after %v fragments", i+1)
+			}
+			continue
+		}
+		if !ok {
+			t.Fatal("not assembled after all fragments")
+		}
+		if string(data) != "abc" || gotAddr.String() != "127.0.0.1:53" {
+			t.Fatalf("got %q from %v, want %q from 127.0.0.1:53", data, gotAddr, "abc")
+		}
+	}
+	if len(d.pending) != 0 {
+		t.Fatalf("%v pending packets left", len(d.pending))
+	}
+}
+
+func TestDatagramSendFragments(t *testing.T) {
+	conn := &recordingDatagramConn{}
+	d := newDatagramSession(conn, nil)
+	addr := tuic.NewAddressAddrPort(netip.MustParseAddrPort("127.0.0.1:53"))
+	packet := tuic.NewPacket(1, 7, 1, 0, 5, addr, []byte("hello"), juicity.Version0)
+	if err := d.sendFragments(packet, 2); err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.datagrams) != 3 {
+		t.Fatalf("sent %v datagrams, want 3", len(conn.datagrams))
+	}
+	r := newDatagramSession(nil, nil)
+	for _, message := range conn.datagrams {
+		frag, err := tuic.ReadPacket(bytes.NewReader(message))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, gotAddr, ok := r.reassemble(frag); ok {
+			if string(data) != "hello" || gotAddr.String() != "127.0.0.1:53" {
+				t.Fatalf("got %q from %v", data, gotAddr)
+			}
+			return
+		}
+	}
+	t.Fatal("fragments were not assembled")
+}
+
+type recordingDatagramConn struct {
+	quic.Connection
+	datagrams [][]byte
+}
+
+func (c *recordingDatagramConn) SendDatagram(b []byte) error {
+	c.datagrams = append(c.datagrams, bytes.Clone(b))
+	return nil
+}
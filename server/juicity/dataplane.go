@@ -15,6 +15,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/congestion"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
@@ -27,7 +29,6 @@ import (
 	"github.com/daeuniverse/outbound/protocol/juicity"
 	"github.com/daeuniverse/outbound/protocol/trojanc"
 	"github.com/daeuniverse/outbound/protocol/tuic"
-	"github.com/daeuniverse/outbound/protocol/tuic/common"
 	"github.com/daeuniverse/quic-go"
 	"github.com/google/uuid"
 )
@@ -43,15 +44,27 @@ var (
 	ErrAuthenticationFailed = fmt.Errorf("authentication failed")
 )
 
+const (
+	DefaultMaxIncomingStreams = 100
+	DefaultKeepAlivePeriod    = 10 * time.Second
+	DefaultIdleTimeout        = 30 * time.Second
+)
+
 type Options struct {
-	Certificate       []byte
-	PrivateKey        []byte
-	CongestionControl string
-	SendThrough       string
+	Certificate []byte
+	PrivateKey  []byte
+	config.Juicity
 }
 
 func New(opts *Options) (*Server, error) {
-	cert, err := tls.X509KeyPair(opts.Certificate, opts.PrivateKey)
+	congestionControl := opts.CongestionControl
+	if congestionControl == "" {
+		congestionControl = congestion.AlgorithmBBR
+	}
+	if err := congestion.Validate(congestionControl, opts.Cwnd); err != nil {
+		return nil, err
+	}
+	quicConfig, err := newQuicConfig(&opts.Juicity)
 	if err != nil {
 		return nil, err
 	}
@@ -64,38 +77,91 @@ func New(opts *Options) (*Server, error) {
 		dialer = direct.NewDirectDialerLaddr(lAddr, direct.Option{FullCone: true})
 	}
 	ctx, close := context.WithCancel(context.Background())
-	return &Server{
-		dialer: dialer,
-		tlsConfig: &tls.Config{
-			NextProtos:   []string{"h3"}, // h3 only.
-			MinVersion:   tls.VersionTLS13,
-			Certificates: []tls.Certificate{cert},
-		},
-		maxOpenIncomingStreams: 100,
-		congestionControl:      opts.CongestionControl,
-		cwnd:                   10,
-		ctx:                    ctx,
-		close:                  close,
+	s := &Server{
+		dialer:            dialer,
+		quicConfig:        quicConfig,
+		congestionControl: congestionControl,
+		cwnd:              opts.Cwnd,
+		ctx:               ctx,
+		close:             close,
+	}
+	if err = s.certificate.Set(opts.Certificate, opts.PrivateKey); err != nil {
+		close()
+		return nil, err
+	}
+	s.tlsConfig = &tls.Config{
+		NextProtos:     []string{"h3"}, // h3 only.
+		MinVersion:     tls.VersionTLS13,
+		GetCertificate: s.certificate.GetCertificate,
+	}
+	return s, nil
+}
+
+// newQuicConfig validates the transport parameters. Zero values are replaced
+// with the defaults.
+func newQuicConfig(opts *config.Juicity) (*quic.Config, error) {
+	maxIncomingStreams := opts.MaxIncomingStreams
+	if maxIncomingStreams == 0 {
+		maxIncomingStreams = DefaultMaxIncomingStreams
+	}
+	if maxIncomingStreams < 0 {
+		return nil, fmt.Errorf("invalid max incoming streams: %v", maxIncomingStreams)
+	}
+	keepAlivePeriod := time.Duration(opts.KeepAlivePeriod) * time.Second
+	if keepAlivePeriod == 0 {
+		keepAlivePeriod = DefaultKeepAlivePeriod
+	}
+	idleTimeout := time.Duration(opts.IdleTimeout) * time.Second
+	if idleTimeout == 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+	if keepAlivePeriod < 0 || idleTimeout < 0 {
+		return nil, fmt.Errorf("invalid keep-alive period %v or idle timeout %v", keepAlivePeriod, idleTimeout)
+	}
+	if keepAlivePeriod >= idleTimeout {
+		return nil, fmt.Errorf("the keep-alive period %v should be less than the idle timeout %v", keepAlivePeriod, idleTimeout)
+	}
+	if opts.InitialStreamReceiveWindow != 0 && opts.MaxStreamReceiveWindow != 0 &&
+		opts.InitialStreamReceiveWindow > opts.MaxStreamReceiveWindow {
+		return nil, fmt.Errorf("the initial stream receive window %v is larger than the max one %v", opts.InitialStreamReceiveWindow, opts.MaxStreamReceiveWindow)
+	}
+	if opts.InitialConnectionReceiveWindow != 0 && opts.MaxConnectionReceiveWindow != 0 &&
+		opts.InitialConnectionReceiveWindow > opts.MaxConnectionReceiveWindow {
+		return nil, fmt.Errorf("the initial connection receive window %v is larger than the max one %v", opts.InitialConnectionReceiveWindow, opts.MaxConnectionReceiveWindow)
+	}
+	if opts.MaxStreamReceiveWindow != 0 && opts.MaxConnectionReceiveWindow != 0 &&
+		opts.MaxStreamReceiveWindow > opts.MaxConnectionReceiveWindow {
+		return nil, fmt.Errorf("the max stream receive window %v is larger than the max connection receive window %v", opts.MaxStreamReceiveWindow, opts.MaxConnectionReceiveWindow)
+	}
+	return &quic.Config{
+		MaxIncomingStreams:             maxIncomingStreams,
+		MaxIncomingUniStreams:          maxIncomingStreams,
+		KeepAlivePeriod:                keepAlivePeriod,
+		MaxIdleTimeout:                 idleTimeout,
+		InitialStreamReceiveWindow:     opts.InitialStreamReceiveWindow,
+		MaxStreamReceiveWindow:         opts.MaxStreamReceiveWindow,
+		InitialConnectionReceiveWindow: opts.InitialConnectionReceiveWindow,
+		MaxConnectionReceiveWindow:     opts.MaxConnectionReceiveWindow,
+		DisablePathMTUDiscovery:        false,
+		EnableDatagrams:                true,
+		CapabilityCallback:             nil,
 	}, nil
 }
 
 func (s *Server) Serve(addr string) (err error) {
-	quicMaxOpenIncomingStreams := int64(s.maxOpenIncomingStreams)
-
-	listener, err := quic.ListenAddr(addr, s.tlsConfig, &quic.Config{
-		MaxIncomingStreams:      quicMaxOpenIncomingStreams,
-		MaxIncomingUniStreams:   quicMaxOpenIncomingStreams,
-		KeepAlivePeriod:         10 * time.Second,
-		DisablePathMTUDiscovery: false,
-		EnableDatagrams:         false,
-		CapabilityCallback:      nil,
-	})
+	conn, err := server.ListenPacket(addr, s.arg.HopPorts)
 	if err != nil {
 		return err
 	}
+	listener, err := quic.Listen(conn, s.tlsConfig, s.quicConfig.Clone())
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
 	s.setListener(listener)
 	defer func() {
 		_ = listener.Close()
+		_ = conn.Close()
 		s.setListener(nil)
 	}()
 	ctx := s.serverContext()
@@ -120,7 +186,7 @@ func (s *Server) Serve(addr string) (err error) {
 }
 
 func (s *Server) handleConn(conn quic.Connection) (err error) {
-	common.SetCongestionController(conn, s.congestionControl, s.cwnd)
+	congestion.Use(conn, s.congestionControl, s.cwnd)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	authCtx, authDone := context.WithCancel(ctx)
@@ -136,6 +202,13 @@ func (s *Server) handleConn(conn quic.Connection) (err error) {
 			authDone()
 		}
 	}()
+	if conn.ConnectionState().SupportsDatagrams {
+		go func() {
+			if err := s.handleDatagrams(ctx, authCtx, &id, conn); err != nil {
+				log.Warn("handleDatagrams: %v", err)
+			}
+		}()
+	}
 	for {
 		stream, err := conn.AcceptStream(ctx)
 		if err != nil {
@@ -180,16 +253,9 @@ func (s *Server) handleStream(ctx context.Context, authCtx context.Context, id *
 	if passage.Manager {
 		return fmt.Errorf("%w: manager key is ubused for a non-cmd connection", server.ErrPassageAbuse)
 	}
-	dialer := s.dialer
-	if passage.Out != nil {
-		header, err := server.GetHeader(*passage.Out, &s.sweetLisa)
-		if err != nil {
-			return err
-		}
-		dialer, err = server.NewDialer(string(passage.Out.Protocol), dialer, header)
-		if err != nil {
-			return err
-		}
+	dialer, err := s.passageDialer(passage)
+	if err != nil {
+		return err
 	}
 	target := net.JoinHostPort(mdata.Hostname, strconv.Itoa(int(mdata.Port)))
 	ctx, cancel := context.WithTimeout(ctx, server.DialTimeout)
@@ -258,6 +324,53 @@ func (s *Server) handleStream(ctx context.Context, authCtx context.Context, id *
 	return nil
 }
 
+// handleDatagrams relays the UDP packets in the datagrams of the
+// authenticated connection.
+func (s *Server) handleDatagrams(ctx context.Context, authCtx context.Context, id *uuid.UUID, conn quic.Connection) error {
+	<-authCtx.Done()
+	select {
+	case <-ctx.Done():
+		return nil
+	default:
+	}
+	_passage, ok := s.users.Load(*id)
+	if !ok {
+		return fmt.Errorf("no such user: %v", *id)
+	}
+	passage := _passage.(*Passage)
+	if err := s.ContentionCheck(conn.RemoteAddr().(*net.UDPAddr).IP, passage); err != nil {
+		return err
+	}
+	if passage.Manager {
+		// the manager only sends messages in streams
+		return nil
+	}
+	dialer, err := s.passageDialer(passage)
+	if err != nil {
+		return err
+	}
+	err = newDatagramSession(conn, dialer).Serve(ctx)
+	if errors.Is(err, context.Canceled) || strings.HasSuffix(err.Error(), "with error code 0") {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) passageDialer(passage *Passage) (netproxy.Dialer, error) {
+	dialer := s.dialer
+	if passage.Out != nil {
+		header, err := server.GetHeader(*passage.Out, &s.sweetLisa)
+		if err != nil {
+			return nil, err
+		}
+		dialer, err = server.NewDialer(string(passage.Out.Protocol), dialer, header)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dialer, nil
+}
+
 func (s *Server) handleAuth(ctx context.Context, conn quic.Connection) (uuid *uuid.UUID, err error) {
 	ctx, cancel := context.WithTimeout(ctx, AuthenticateTimeout)
 	defer cancel()
@@ -334,12 +447,12 @@ func (s *Server) handleMsg(conn *juicity.Conn, reqMetadata *trojanc.Metadata, pa
 		}
 		log.Trace("Received a ping message")
 		s.setLastAlive(time.Now())
-		bandwidthLimit, err := server.GenerateBandwidthLimit()
+		pingResp, err := server.GeneratePingResp()
 		if err != nil {
 			log.Warn("generatePingResp: %v", err)
 			return err
 		}
-		bPingResp, err := jsoniter.Marshal(model.PingResp{BandwidthLimit: bandwidthLimit})
+		bPingResp, err := jsoniter.Marshal(pingResp)
 		if err != nil {
 			log.Warn("%v", err)
 			return err
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/quic-go"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/api"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/common"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
@@ -24,21 +25,19 @@ func init() {
 	server.Register("juicity", NewJohn)
 }
 
-const (
-	ManagerUuid = "00000000-0000-0000-0000-000000000000"
-)
-
 type Server struct {
-	dialer                 netproxy.Dialer
-	tlsConfig              *tls.Config
-	maxOpenIncomingStreams int64
-	congestionControl      string
-	cwnd                   int
-	users                  sync.Map
+	dialer            netproxy.Dialer
+	tlsConfig         *tls.Config
+	quicConfig        *quic.Config
+	congestionControl string
+	cwnd              int
+	users             sync.Map
 
-	sweetLisa             config.Lisa
-	arg                   server.Argument
-	pinnedCertchainSha256 string
+	sweetLisa config.Lisa
+	arg       server.Argument
+	// certificate is replaced after the copied chain is refreshed
+	certificate server.PinnedCertificate
+	copied      *server.CopiedCertificate
 	// mutex protects passages
 	mutex    sync.Mutex
 	passages []Passage
@@ -63,13 +62,12 @@ type Passage struct {
 }
 
 func NewJohn(valueCtx context.Context, dialer netproxy.Dialer, sweetLisa config.Lisa, arg server.Argument) (server.Server, error) {
-	cert := valueCtx.Value("certificate").([]byte)
-	key := valueCtx.Value("key").([]byte)
+	copied := valueCtx.Value("copiedCertificate").(*server.CopiedCertificate)
+	cert, key := copied.KeyPair()
 	s, err := New(&Options{
-		Certificate:       cert,
-		PrivateKey:        key,
-		CongestionControl: "bbr",
-		SendThrough:       "",
+		Certificate: cert,
+		PrivateKey:  key,
+		Juicity:     config.ParamsObj.John.Juicity,
 	})
 	if err != nil {
 		return nil, err
@@ -77,10 +75,15 @@ func NewJohn(valueCtx context.Context, dialer netproxy.Dialer, sweetLisa config.
 	john := s
 	john.sweetLisa = sweetLisa
 	john.arg = arg
-	john.pinnedCertchainSha256, err = common.GenerateCertChainHashFromBytes(cert)
-	if err != nil {
-		return nil, err
-	}
+	john.copied = copied
+	copied.OnChange(func() {
+		// clients get the new pin by the re-registration
+		if err := john.certificate.Set(copied.KeyPair()); err != nil {
+			log.Warn("juicity: %v", err)
+			return
+		}
+		john.reRegister()
+	})
 	john.passageContentionCache = server.NewContentionCache()
 	if err := s.AddPassages([]server.Passage{{Manager: true}}); err != nil {
 		return nil, err
@@ -92,6 +95,7 @@ func NewJohn(valueCtx context.Context, dialer netproxy.Dialer, sweetLisa config.
 		return nil, err
 	}
 	go john.registerBackground()
+	go server.RotateManager(john, john.register, john.ctx.Done())
 	return john, nil
 }
 
@@ -127,15 +131,24 @@ func (s *Server) registerBackground() {
 	}
 }
 
-func (s *Server) register() error {
-	var manager server.Passage
-	users := s.Passages()
-	for _, u := range users {
-		if u.Manager {
-			manager = u
-			break
-		}
+func (s *Server) reRegister() {
+	s.setLastAlive(time.Time{})
+}
+
+// method is the argument method registered to SweetLisa.
+func (s *Server) method() string {
+	method := "pinned_certchain_sha256=" + s.certificate.PinnedCertchainSha256()
+	if s.copied != nil && s.copied.Domain() != server.JuicityDomain {
+		method += ";sni=" + s.copied.Domain()
+	}
+	if len(s.arg.HopPorts) > 0 {
+		method += ";mport=" + server.FormatHopPorts(s.arg.HopPorts)
 	}
+	return method
+}
+
+func (s *Server) register() error {
+	manager := server.CurrentManager(s.Passages())
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 	t, _ := net.LookupTXT("cdn-validate." + s.sweetLisa.Host)
@@ -156,7 +169,7 @@ func (s *Server) register() error {
 			Protocol: "juicity",
 			Username: manager.In.Username,
 			Password: manager.In.Password,
-			Method:   "pinned_certchain_sha256=" + s.pinnedCertchainSha256,
+			Method:   s.method(),
 		},
 		BandwidthLimit: bandwidthLimit,
 		NoRelay:        s.arg.NoRelay,
@@ -182,6 +195,9 @@ func (s *Server) Listen(addr string) (err error) {
 }
 
 func (s *Server) Close() error {
+	if s.copied != nil {
+		_ = s.copied.Close()
+	}
 	s.lifecycleMu.Lock()
 	if s.close != nil {
 		s.close()
@@ -229,18 +245,16 @@ func (s *Server) getLastAlive() time.Time {
 }
 
 func LocalizePassages(passages []server.Passage) (psgs []Passage, manager *Passage) {
+	passages = server.LocalizeManagers(passages, func(passage *server.Passage) {
+		// users are looked up by the uuid, which tells the previous manager
+		// and the new one apart during the rotation
+		passage.In.Username = uuid.New().String()
+		passage.In.Password, _ = gonanoid.Generate(common.Alphabet, 23)
+	})
 	psgs = make([]Passage, len(passages))
 	for i, psg := range passages {
 		if psg.Manager {
-			psg.In.Username = ManagerUuid
-			psg.In.Password, _ = gonanoid.Generate(common.Alphabet, 23)
-			// allow only one manager
-			if manager == nil {
-				manager = &psgs[i]
-			} else {
-				psg.Manager = false
-				log.Warn("found more than one manager")
-			}
+			manager = &psgs[i]
 		}
 		psgs[i].Passage = psg
 		psgs[i].uuid, _ = uuid.Parse(psg.In.Username)
@@ -250,11 +264,11 @@ func LocalizePassages(passages []server.Passage) (psgs []Passage, manager *Passa
 
 func (s *Server) AddPassages(passages []server.Passage) (err error) {
 	log.Trace("AddPassages: %v", len(passages))
-	us, managerKey := LocalizePassages(passages)
+	us, _ := LocalizePassages(passages)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	// update manager key
-	if managerKey != nil {
+	if server.ReplacesManagers(passages) {
 		// remove manager key in UserContext
 		s.removePassagesFunc(func(passage *Passage) (remove bool) {
 			return passage.Manager == true
@@ -7,18 +7,24 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/binary"
 	"encoding/pem"
 	"io"
 	"math/big"
 	"net"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/daeuniverse/outbound/netproxy"
 	outprotocol "github.com/daeuniverse/outbound/protocol"
 	"github.com/daeuniverse/outbound/protocol/direct"
+	"github.com/daeuniverse/outbound/protocol/juicity"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
 	bjserver "github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
+	"github.com/google/uuid"
 )
 
 func TestCloseStopsServe(t *testing.T) {
@@ -107,6 +113,60 @@ func TestOutboundJuicityDialerRelaysTCPThroughServer(t *testing.T) {
 	}
 }
 
+func TestRotatedManagerCanPing(t *testing.T) {
+	s, addr, closeServer := startJuicityServerWithPassage(t)
+	defer closeServer()
+
+	if err := s.AddPassages([]bjserver.Passage{{Manager: true}}); err != nil {
+		t.Fatal(err)
+	}
+	previous := bjserver.CurrentManager(s.Passages())
+	if err := s.AddPassages([]bjserver.Passage{{Manager: true, Rotating: true}}); err != nil {
+		t.Fatal(err)
+	}
+	current := bjserver.CurrentManager(s.Passages())
+	if current.In.Username == previous.In.Username {
+		t.Fatal("the rotated manager has the same uuid as the previous one")
+	}
+
+	// both are accepted during the grace period
+	for _, manager := range []bjserver.Passage{previous, current} {
+		pingJuicityManager(t, addr, manager)
+	}
+	if err := s.RemovePassages([]bjserver.Passage{previous}, true); err != nil {
+		t.Fatal(err)
+	}
+	pingJuicityManager(t, addr, current)
+	if _, ok := s.users.Load(uuid.MustParse(previous.In.Username)); ok {
+		t.Fatal("the previous manager is still accepted after removal")
+	}
+}
+
+func pingJuicityManager(t *testing.T, addr string, manager bjserver.Passage) {
+	t.Helper()
+	dialer := newOutboundJuicityDialer(t, addr, manager.In.Username, manager.In.Password).(*juicity.Dialer)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	conn, err := dialer.DialCmdMsg(ctx, outprotocol.MetadataCmdPing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req := make([]byte, 8)
+	binary.BigEndian.PutUint32(req[:4], 4)
+	copy(req[4:], "ping")
+	if _, err = conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err = io.ReadFull(conn, req[:4]); err != nil {
+		t.Fatalf("manager %v: %v", manager.In.Username, err)
+	}
+	if binary.BigEndian.Uint32(req[:4]) == 0 {
+		t.Fatal("empty ping response")
+	}
+}
+
 func TestOutboundJuicityDialerRelaysUDPThroughServer(t *testing.T) {
 	udpAddr, closeUDP := startJuicityUDPEchoServer(t)
 	defer closeUDP()
@@ -141,13 +201,109 @@ func TestOutboundJuicityDialerRelaysUDPThroughServer(t *testing.T) {
 	}
 }
 
+func TestNewValidatesTransportParameters(t *testing.T) {
+	cert, key := testCertificate(t)
+	for _, tc := range []struct {
+		name    string
+		c       config.Juicity
+		wantErr bool
+	}{
+		{name: "default"},
+		{name: "cubic with cwnd", c: config.Juicity{CongestionControl: "cubic", Cwnd: 10}},
+		{name: "new_reno", c: config.Juicity{CongestionControl: "new_reno"}},
+		{name: "unknown algorithm", c: config.Juicity{CongestionControl: "vegas"}, wantErr: true},
+		{name: "bbr with cwnd", c: config.Juicity{CongestionControl: "bbr", Cwnd: 10}, wantErr: true},
+		{name: "negative cwnd", c: config.Juicity{CongestionControl: "cubic", Cwnd: -1}, wantErr: true},
+		{name: "huge cwnd", c: config.Juicity{CongestionControl: "cubic", Cwnd: 1 << 20}, wantErr: true},
+		{name: "negative streams", c: config.Juicity{MaxIncomingStreams: -1}, wantErr: true},
+		{name: "keepalive longer than idle timeout", c: config.Juicity{KeepAlivePeriod: 30, IdleTimeout: 20}, wantErr: true},
+		{name: "default keepalive beyond idle timeout", c: config.Juicity{IdleTimeout: 5}, wantErr: true},
+		{name: "windows", c: config.Juicity{InitialStreamReceiveWindow: 1 << 20, MaxStreamReceiveWindow: 4 << 20, MaxConnectionReceiveWindow: 8 << 20}},
+		{name: "initial stream window beyond max", c: config.Juicity{InitialStreamReceiveWindow: 4 << 20, MaxStreamReceiveWindow: 1 << 20}, wantErr: true},
+		{name: "initial connection window beyond max", c: config.Juicity{InitialConnectionReceiveWindow: 4 << 20, MaxConnectionReceiveWindow: 1 << 20}, wantErr: true},
+		{name: "stream window beyond connection window", c: config.Juicity{MaxStreamReceiveWindow: 4 << 20, MaxConnectionReceiveWindow: 1 << 20}, wantErr: true},
+	} {
+		_, err := New(&Options{Certificate: cert, PrivateKey: key, Juicity: tc.c})
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%v: New() error = %v, wantErr %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestCongestionControlRelaysTCPThroughServer(t *testing.T) {
+	for _, cc := range []string{"cubic", "new_reno"} {
+		echoAddr, closeEcho := startJuicityTCPEchoServer(t)
+		_, addr, closeServer := startJuicityServerWithConfig(t, config.Juicity{CongestionControl: cc, Cwnd: 4})
+		dialer := newOutboundJuicityDialer(t, addr, testJuicityUser, testJuicityPassword)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		conn, err := dialer.DialContext(ctx, "tcp", echoAddr)
+		if err != nil {
+			t.Fatalf("%v: %v", cc, err)
+		}
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("%v: %v", cc, err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("%v: %v", cc, err)
+		}
+		if got, want := string(buf), "pong"; got != want {
+			t.Fatalf("%v: tcp relay response = %q, want %q", cc, got, want)
+		}
+		conn.Close()
+		cancel()
+		closeServer()
+		closeEcho()
+	}
+}
+
+func TestPortHoppingRelaysTCPThroughServer(t *testing.T) {
+	echoAddr, closeEcho := startJuicityTCPEchoServer(t)
+	defer closeEcho()
+
+	_, hopPort, _ := net.SplitHostPort(freeUDPAddr(t))
+	port, _ := strconv.Atoi(hopPort)
+	s := newTestServer(t)
+	s.arg.HopPorts = []int{port}
+	_, _, closeServer := startJuicityServer(t, s)
+	defer closeServer()
+	if got, want := s.method(), ";mport="+hopPort; !strings.HasSuffix(got, want) {
+		t.Fatalf("method() = %q, want the suffix %q", got, want)
+	}
+
+	dialer := newOutboundJuicityDialer(t, net.JoinHostPort("127.0.0.1", hopPort), testJuicityUser, testJuicityPassword)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, "tcp", echoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf), "pong"; got != want {
+		t.Fatalf("tcp relay response = %q, want %q", got, want)
+	}
+}
+
 func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	return newTestServerWithConfig(t, config.Juicity{})
+}
+
+func newTestServerWithConfig(t *testing.T, c config.Juicity) *Server {
 	t.Helper()
 	cert, key := testCertificate(t)
 	s, err := New(&Options{
-		Certificate:       cert,
-		PrivateKey:        key,
-		CongestionControl: "bbr",
+		Certificate: cert,
+		PrivateKey:  key,
+		Juicity:     c,
 	})
 	if err != nil {
 		t.Fatalf("New() error = %v", err)
@@ -162,7 +318,16 @@ const (
 
 func startJuicityServerWithPassage(t *testing.T) (*Server, string, func()) {
 	t.Helper()
-	s := newTestServer(t)
+	return startJuicityServerWithConfig(t, config.Juicity{})
+}
+
+func startJuicityServerWithConfig(t *testing.T, c config.Juicity) (*Server, string, func()) {
+	t.Helper()
+	return startJuicityServer(t, newTestServerWithConfig(t, c))
+}
+
+func startJuicityServer(t *testing.T, s *Server) (*Server, string, func()) {
+	t.Helper()
 	if err := s.AddPassages([]bjserver.Passage{{
 		Passage: model.Passage{In: model.In{Argument: model.Argument{
 			Protocol: "juicity",
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+)
+
+const minManagerRotateBackoff = time.Minute
+
+// CurrentManager returns the manager passage added last, which is the one to
+// register. The previous ones are still accepted until they are removed.
+func CurrentManager(passages []Passage) (manager Passage) {
+	for _, passage := range passages {
+		if passage.Manager {
+			manager = passage
+		}
+	}
+	return manager
+}
+
+// ReplacesManagers tells if adding passages removes the managers added before,
+// which is the case for any manager but the one added by a rotation.
+func ReplacesManagers(passages []Passage) bool {
+	for _, passage := range passages {
+		if passage.Manager && !passage.Rotating {
+			return true
+		}
+	}
+	return false
+}
+
+// LocalizeManagers returns a copy of passages with the credentials of the
+// managers filled in by newCredential, and only the first manager is kept as
+// one.
+//
+// A new manager has no password yet. A manager with one was added before and
+// is passed back to be removed, such as the previous one after a rotation, so
+// its credential is kept to match.
+func LocalizeManagers(passages []Passage, newCredential func(passage *Passage)) []Passage {
+	passages = append([]Passage(nil), passages...)
+	found := false
+	for i := range passages {
+		if !passages[i].Manager {
+			continue
+		}
+		passages[i].Rotating = false
+		if passages[i].In.Password == "" {
+			newCredential(&passages[i])
+		}
+		if found {
+			passages[i].Manager = false
+			log.Warn("found more than one manager")
+		}
+		found = true
+	}
+	return passages
+}
+
+// RotateManager adds a new manager passage to s every rotateInterval of the
+// config and registers it to SweetLisa by register. The previous one is still
+// accepted for the grace period, lest the in-flight messages of SweetLisa
+// fail. It returns when done is closed, or at once if it never rotates.
+func RotateManager(s Server, register func() error, done <-chan struct{}) {
+	conf := config.ParamsObj.John.Manager
+	if conf.RotateInterval <= 0 {
+		return
+	}
+	interval := time.Duration(conf.RotateInterval) * time.Second
+	grace := time.Duration(conf.GracePeriod) * time.Second
+	backoff := minManagerRotateBackoff
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+		previous, err := rotateManager(s, register)
+		if err != nil {
+			log.Warn("Failed to rotate the manager key: %v. Retry in %v.", err, backoff)
+			timer.Reset(backoff)
+			backoff = min(backoff*2, interval)
+			continue
+		}
+		backoff = minManagerRotateBackoff
+		log.Info("The manager key is rotated.")
+		select {
+		case <-done:
+			return
+		case <-time.After(grace):
+		}
+		if err = s.RemovePassages(previous, true); err != nil {
+			log.Warn("Failed to remove the previous manager key: %v", err)
+		}
+		timer.Reset(max(interval-grace, 0))
+	}
+}
+
+// rotateManager adds a new manager passage and registers it. It returns the
+// previous ones to remove after the grace period.
+func rotateManager(s Server, register func() error) (previous []Passage, err error) {
+	known := make(map[string]struct{})
+	for _, passage := range s.Passages() {
+		if passage.Manager {
+			previous = append(previous, passage)
+			known[passage.In.Argument.Hash()] = struct{}{}
+		}
+	}
+	if err = s.AddPassages([]Passage{{Manager: true, Rotating: true}}); err != nil {
+		return nil, err
+	}
+	if err = register(); err != nil {
+		// SweetLisa still uses the previous one
+		var added []Passage
+		for _, passage := range s.Passages() {
+			if _, ok := known[passage.In.Argument.Hash()]; passage.Manager && !ok {
+				added = append(added, passage)
+			}
+		}
+		if e := s.RemovePassages(added, true); e != nil {
+			log.Warn("Failed to remove the unregistered manager key: %v", e)
+		}
+		return nil, err
+	}
+	return previous, nil
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// managerTestServer keeps the passages like the servers do.
+type managerTestServer struct {
+	Server
+	mu       sync.Mutex
+	passages []Passage
+	n        int
+}
+
+func (s *managerTestServer) AddPassages(passages []Passage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ReplacesManagers(passages) {
+		var kept []Passage
+		for _, passage := range s.passages {
+			if !passage.Manager {
+				kept = append(kept, passage)
+			}
+		}
+		s.passages = kept
+	}
+	for _, passage := range passages {
+		passage.Rotating = false
+		if passage.Manager && passage.In.Password == "" {
+			s.n++
+			passage.In.Password = strconv.Itoa(s.n)
+		}
+		s.passages = append(s.passages, passage)
+	}
+	return nil
+}
+
+func (s *managerTestServer) RemovePassages(passages []Passage, alsoManager bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, passage := range passages {
+		for i := len(s.passages) - 1; i >= 0; i-- {
+			if s.passages[i].In.Argument.Hash() == passage.In.Argument.Hash() && (alsoManager || !passage.Manager) {
+				s.passages = append(s.passages[:i], s.passages[i+1:]...)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *managerTestServer) Passages() []Passage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Passage(nil), s.passages...)
+}
+
+func TestRotateManager(t *testing.T) {
+	s := &managerTestServer{}
+	if err := s.AddPassages([]Passage{{Manager: true}}); err != nil {
+		t.Fatal(err)
+	}
+	var registered string
+	register := func() error {
+		registered = CurrentManager(s.Passages()).In.Password
+		return nil
+	}
+
+	previous, err := rotateManager(s, register)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registered != "2" {
+		t.Fatalf("registered %q, want the new manager key", registered)
+	}
+	if len(previous) != 1 || previous[0].In.Password != "1" || len(s.Passages()) != 2 {
+		t.Fatal("the previous manager key is not kept for the grace period")
+	}
+	if err = s.RemovePassages(previous, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// the new one is dropped if it fails to register
+	if _, err = rotateManager(s, func() error {
+		return errors.New("unreachable")
+	}); err == nil {
+		t.Fatal("rotateManager succeeded, want the error of register")
+	}
+	if passages := s.Passages(); len(passages) != 1 || passages[0].In.Password != "2" {
+		t.Fatalf("got %v, want only the registered manager key", passages)
+	}
+}
+
+func TestLocalizeManagers(t *testing.T) {
+	previous := Passage{Manager: true}
+	previous.In.Password = "previous"
+	n := 0
+	passages := LocalizeManagers([]Passage{previous, {Manager: true}}, func(passage *Passage) {
+		n++
+		passage.In.Password = "new"
+	})
+	if n != 1 || passages[0].In.Password != "previous" || passages[1].In.Password != "new" {
+		t.Fatalf("got %v, want the password of the previous manager kept", passages)
+	}
+	if !passages[0].Manager || passages[1].Manager {
+		t.Fatal("more than one manager is kept")
+	}
+}
@@ -16,7 +16,14 @@ const (
 	evictLifeWindow = 10 * time.Minute
 )
 
-const ProtocolAnyTLS protocol.Protocol = "anytls"
+const (
+	ProtocolAnyTLS       protocol.Protocol = "anytls"
+	ProtocolTrojan       protocol.Protocol = "trojan"
+	ProtocolVlessReality protocol.Protocol = "vless+reality"
+	ProtocolHysteria2    protocol.Protocol = "hysteria2"
+	ProtocolVMessWs      protocol.Protocol = "vmess+ws"
+	ProtocolVMessTlsWs   protocol.Protocol = "vmess+tls+ws"
+)
 
 func init() {
 	direct.InitDirectDialers("")
@@ -33,13 +40,14 @@ var (
 )
 
 func ProtocolValid(p protocol.Protocol) bool {
-	return p.Valid() || p == ProtocolAnyTLS
+	return p.Valid() || p == ProtocolAnyTLS || p == ProtocolTrojan || p == ProtocolVlessReality ||
+		p == ProtocolHysteria2 || p == ProtocolVMessWs || p == ProtocolVMessTlsWs
 }
 
 func NewDialer(name string, nextDialer netproxy.Dialer, header *protocol.Header) (netproxy.Dialer, error) {
 	switch name {
-	case "juicity":
-		// Cache dialer.
+	case "juicity", string(ProtocolHysteria2):
+		// Cache dialer, which holds a QUIC connection.
 		key := strings.Join([]string{
 			header.ProxyAddress,
 			header.User,
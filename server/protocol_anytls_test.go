@@ -14,6 +14,18 @@ func TestProtocolValidAcceptsAnyTLS(t *testing.T) {
 	if !ProtocolValid(ProtocolAnyTLS) {
 		t.Fatalf("ProtocolValid(%q) = false, want true", ProtocolAnyTLS)
 	}
+	if !ProtocolValid(ProtocolTrojan) {
+		t.Fatalf("ProtocolValid(%q) = false, want true", ProtocolTrojan)
+	}
+	if !ProtocolValid(ProtocolVlessReality) {
+		t.Fatalf("ProtocolValid(%q) = false, want true", ProtocolVlessReality)
+	}
+	if !ProtocolValid(ProtocolHysteria2) {
+		t.Fatalf("ProtocolValid(%q) = false, want true", ProtocolHysteria2)
+	}
+	if !ProtocolValid(ProtocolVMessTlsWs) {
+		t.Fatalf("ProtocolValid(%q) = false, want true", ProtocolVMessTlsWs)
+	}
 	if !ProtocolValid(protocol.ProtocolVMessTCP) {
 		t.Fatalf("ProtocolValid(%q) = false, want true", protocol.ProtocolVMessTCP)
 	}
@@ -84,6 +96,33 @@ func TestGetHeaderAnyTLSConfigVariants(t *testing.T) {
 			wantSNI:    "edge.example.com",
 			wantServer: "edge.example.com",
 		},
+		{
+			name: "uTLS fingerprint",
+			out: model.Out{
+				Host: "relay.example.com",
+				Port: "443",
+				Argument: model.Argument{
+					Protocol: "anytls",
+					Password: "secret-password",
+					Method:   "fp=chrome",
+				},
+			},
+			wantSNI:    "relay.example.com",
+			wantServer: "relay.example.com",
+		},
+		{
+			name: "unknown uTLS fingerprint is rejected",
+			out: model.Out{
+				Host: "relay.example.com",
+				Port: "443",
+				Argument: model.Argument{
+					Protocol: "anytls",
+					Password: "secret-password",
+					Method:   "fp=netscape",
+				},
+			},
+			wantErr: true,
+		},
 		{
 			name: "ipv6 host without explicit sni is rejected",
 			out: model.Out{
@@ -135,3 +174,23 @@ func TestGetHeaderAnyTLSConfigVariants(t *testing.T) {
 		})
 	}
 }
+
+func TestGetHeaderTrojanVerifiesCertificate(t *testing.T) {
+	header, err := GetHeader(model.Out{
+		Host: "relay.example.com",
+		Port: "443",
+		Argument: model.Argument{
+			Protocol: "trojan",
+			Password: "secret-password",
+		},
+	}, &config.Lisa{Host: "sweet.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.TlsConfig == nil || header.TlsConfig.InsecureSkipVerify {
+		t.Fatal("trojan client config should verify the certificate chain")
+	}
+	if got, want := header.TlsConfig.ServerName, "relay.example.com"; got != want {
+		t.Fatalf("TlsConfig.ServerName = %q, want %q", got, want)
+	}
+}
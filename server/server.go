@@ -26,6 +26,8 @@ type Argument struct {
 	ServerName string
 	Hostnames  string
 	Port       int
+	// HopPorts are the extra ports of QUIC protocols for port hopping
+	HopPorts []int
 
 	NoRelay bool
 }
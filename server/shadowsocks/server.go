@@ -20,11 +20,11 @@ import (
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/infra/ip_mtu_trie"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/infra/lru"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/disk_bloom"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
 	gonanoid "github.com/matoous/go-nanoid"
-	disk_bloom "github.com/mzz2017/disk-bloom"
 )
 
 func init() {
@@ -50,8 +50,11 @@ type Server struct {
 	// passageContentionCache log the last client IP of passages
 	passageContentionCache *server.ContentionCache
 
-	bloom  *disk_bloom.FilterGroup
+	bloom  *disk_bloom.Bloom
 	dialer netproxy.Dialer
+
+	// failure treats the connections failing the authentication
+	failure *server.FailureHandler
 }
 
 type Passage struct {
@@ -60,8 +63,13 @@ type Passage struct {
 }
 
 func New(valueCtx context.Context, dialer netproxy.Dialer) (server.Server, error) {
-	bloom := valueCtx.Value("bloom").(*disk_bloom.FilterGroup)
+	bloom := valueCtx.Value("bloom").(*disk_bloom.Bloom)
+	failure, err := server.NewFailureHandler(config.ParamsObj.John.Shadowsocks.FailurePolicy, config.ParamsObj.John.Shadowsocks.Decoy, dialer)
+	if err != nil {
+		return nil, err
+	}
 	s := &Server{
+		failure:         failure,
 		userContextPool: (*UserContextPool)(lru.New(lru.FixedTimeout, int64(1*time.Hour))),
 		nm:              NewUDPConnMapping(),
 		closed:          make(chan struct{}),
@@ -80,6 +88,11 @@ func NewJohn(valueCtx context.Context, dialer netproxy.Dialer, sweetLisa config.
 	john.sweetLisa = sweetLisa
 	john.arg = arg
 	john.passageContentionCache = server.NewContentionCache()
+	if config.ParamsObj.John.Ban.Enable {
+		if john.failure.Banner, err = server.NewBanner(config.ParamsObj.John.Ban, sweetLisa.Host, john.closed); err != nil {
+			return nil, err
+		}
+	}
 	if err := s.AddPassages([]server.Passage{{Manager: true}}); err != nil {
 		return nil, err
 	}
@@ -89,6 +102,7 @@ func NewJohn(valueCtx context.Context, dialer netproxy.Dialer, sweetLisa config.
 		return nil, err
 	}
 	go john.registerBackground()
+	go server.RotateManager(john, john.register, john.closed)
 	return john, nil
 }
 
@@ -126,14 +140,7 @@ func (s *Server) registerBackground() {
 }
 
 func (s *Server) register() error {
-	var manager server.Passage
-	users := s.Passages()
-	for _, u := range users {
-		if u.Manager {
-			manager = u
-			break
-		}
-	}
+	manager := server.CurrentManager(s.Passages())
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 	t, _ := net.LookupTXT("cdn-validate." + s.sweetLisa.Host)
@@ -278,6 +285,11 @@ func (s *Server) Close() error {
 		close(s.closed)
 		s.mutex.Lock()
 		defer s.mutex.Unlock()
+		if s.bloom != nil {
+			if e := s.bloom.Close(); e != nil {
+				log.Warn("Failed to close the bloom filter: %v", e)
+			}
+		}
 		if s.listener != nil {
 			err = s.listener.Close()
 		}
@@ -304,18 +316,14 @@ func (s *Server) setLastAlive(t time.Time) {
 }
 
 func LocalizePassages(passages []server.Passage) (psgs []Passage, manager *Passage) {
+	passages = server.LocalizeManagers(passages, func(passage *server.Passage) {
+		passage.In.Password, _ = gonanoid.Generate(common.Alphabet, 21)
+	})
 	psgs = make([]Passage, len(passages))
 	for i, psg := range passages {
 		if psg.Manager {
-			psg.In.Password, _ = gonanoid.Generate(common.Alphabet, 21)
 			psg.In.Method = "aes-256-gcm"
-			// allow only one manager
-			if manager == nil {
-				manager = &psgs[i]
-			} else {
-				psg.Manager = false
-				log.Warn("found more than one manager")
-			}
+			manager = &psgs[i]
 		}
 		psgs[i].Passage = psg
 		if psgs[i].In.Method == "" {
@@ -328,11 +336,11 @@ func LocalizePassages(passages []server.Passage) (psgs []Passage, manager *Passa
 
 func (s *Server) AddPassages(passages []server.Passage) (err error) {
 	log.Trace("AddPassages: %v", len(passages))
-	us, managerKey := LocalizePassages(passages)
+	us, _ := LocalizePassages(passages)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	// update manager key
-	if managerKey != nil {
+	if server.ReplacesManagers(passages) {
 		// remove manager key in UserContext
 		s.removePassagesFunc(func(passage *Passage) (remove bool) {
 			return passage.Manager == true
@@ -2,7 +2,6 @@ package shadowsocks
 
 import (
 	"context"
-	"hash/fnv"
 	"sort"
 	"strconv"
 	"testing"
@@ -10,9 +9,9 @@ import (
 
 	"github.com/daeuniverse/outbound/protocol/direct"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/infra/lru"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/disk_bloom"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
-	disk_bloom "github.com/mzz2017/disk-bloom"
 )
 
 func getState(s *Server, key string) (list []string) {
@@ -122,6 +121,57 @@ func TestServer_AddPassages(t *testing.T) {
 	}
 }
 
+func TestServer_ManagerRotation(t *testing.T) {
+	s := Server{
+		userContextPool: (*UserContextPool)(lru.New(lru.FixedTimeout, int64(1*time.Hour))),
+	}
+	if err := s.AddPassages([]server.Passage{{Manager: true}}); err != nil {
+		t.Fatal(err)
+	}
+	previous := server.CurrentManager(s.Passages())
+	if err := s.AddPassages([]server.Passage{{Manager: true, Rotating: true}}); err != nil {
+		t.Fatal(err)
+	}
+	current := server.CurrentManager(s.Passages())
+	if current.In.Password == previous.In.Password {
+		t.Fatal("the manager key is not generated again")
+	}
+	// both are accepted during the grace period
+	if st := getState(&s, "test"); len(st) != 2 {
+		t.Fatalf("got %v passages, want both managers", len(st))
+	}
+	if err := s.RemovePassages([]server.Passage{previous}, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.passages) != 1 || s.passages[0].In.Password != current.In.Password {
+		t.Fatal("the previous manager is not removed alone")
+	}
+}
+
+func TestServer_SyncPassagesReplacesManager(t *testing.T) {
+	s := Server{
+		userContextPool: (*UserContextPool)(lru.New(lru.FixedTimeout, int64(1*time.Hour))),
+	}
+	if err := s.AddPassages([]server.Passage{{Manager: true}}); err != nil {
+		t.Fatal(err)
+	}
+	local := server.CurrentManager(s.Passages())
+	manager := shadowsocksTestPassage("", "lisa-password")
+	manager.Manager = true
+	if err := s.SyncPassages([]server.Passage{manager, shadowsocksTestPassage("alpha", "alpha-password")}); err != nil {
+		t.Fatal(err)
+	}
+	var managers []server.Passage
+	for _, passage := range s.Passages() {
+		if passage.Manager {
+			managers = append(managers, passage)
+		}
+	}
+	if len(managers) != 1 || managers[0].In.Password == local.In.Password {
+		t.Fatalf("got managers %v, want only the synced one", managers)
+	}
+}
+
 func TestAuthenticatedPassageSurvivesHotSync(t *testing.T) {
 	s := Server{
 		userContextPool: (*UserContextPool)(lru.New(lru.FixedTimeout, int64(1*time.Hour))),
@@ -150,15 +200,7 @@ func TestAuthenticatedPassageSurvivesHotSync(t *testing.T) {
 }
 
 func TestServer(t *testing.T) {
-	bloom, err := disk_bloom.NewGroup("/tmp/bloom_*", disk_bloom.FsyncModeNo, 1e3, 1e-6, func(b []byte) (uint64, uint64) {
-		hx := fnv.New64()
-		hx.Write(b)
-		x := hx.Sum64()
-		hy := fnv.New64a()
-		hy.Write(b)
-		y := hy.Sum64()
-		return x, y
-	})
+	bloom, err := disk_bloom.NewBloom(disk_bloom.Options{Capacity: 1e3, FPR: 1e-6}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -11,11 +11,12 @@ import (
 	"time"
 
 	"github.com/daeuniverse/outbound/ciphers"
+	"github.com/daeuniverse/outbound/netproxy"
 	"github.com/daeuniverse/outbound/pool"
 	"github.com/daeuniverse/outbound/protocol"
 	"github.com/daeuniverse/outbound/protocol/shadowsocks"
-	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/bufferred_conn"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/disk_bloom"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
@@ -52,12 +53,12 @@ func (s *Server) handleMsg(crw *shadowsocks.TCPConn, reqMetadata *shadowsocks.Me
 		}
 		log.Trace("Received a ping message")
 		s.setLastAlive(time.Now())
-		bandwidthLimit, err := server.GenerateBandwidthLimit()
+		pingResp, err := server.GeneratePingResp()
 		if err != nil {
 			log.Warn("generatePingResp: %v", err)
 			return err
 		}
-		bPingResp, err := jsoniter.Marshal(model.PingResp{BandwidthLimit: bandwidthLimit})
+		bPingResp, err := jsoniter.Marshal(pingResp)
 		if err != nil {
 			log.Warn("Marshal: %v", err)
 			return err
@@ -93,25 +94,29 @@ func (s *Server) handleMsg(crw *shadowsocks.TCPConn, reqMetadata *shadowsocks.Me
 }
 
 func (s *Server) handleTCP(conn net.Conn) error {
+	if s.failure.Banned(conn.RemoteAddr()) {
+		if e := s.failure.Handle(conn, nil); e != nil {
+			log.Debug("handleTCP: %v", e)
+		}
+		conn.Close()
+		return fmt.Errorf("%v is banned. Treated the conn by the %v policy", conn.RemoteAddr().String(), s.failure.Policy)
+	}
 	bConn := bufferred_conn.NewBufferedConnSize(conn.(*net.TCPConn), TCPBufferSize)
 	passage, err := s.authTCP(bConn)
 	if err != nil {
-		// Auth fail. Drain the conn
-		if config.ParamsObj.John.MaxDrainN == -1 {
-			io.Copy(io.Discard, bConn)
-		} else {
-			io.CopyN(io.Discard, bConn, config.ParamsObj.John.MaxDrainN)
+		s.failure.Fail(conn.RemoteAddr(), err)
+		// the peeked bytes are still in the buffer of bConn
+		if e := s.failure.Handle(bConn, nil); e != nil {
+			log.Debug("handleTCP: %v", e)
 		}
 		bConn.Close()
-		return fmt.Errorf("auth fail: %w. Drained the conn from: %v", err, conn.RemoteAddr().String())
+		return fmt.Errorf("auth fail: %w. Treated the conn from %v by the %v policy", err, conn.RemoteAddr().String(), s.failure.Policy)
 	}
 
 	// detect passage contention
 	if err := s.ContentionCheck(conn.RemoteAddr().(*net.TCPAddr).IP, passage); err != nil {
-		if config.ParamsObj.John.MaxDrainN == -1 {
-			io.Copy(io.Discard, bConn)
-		} else {
-			io.CopyN(io.Discard, bConn, config.ParamsObj.John.MaxDrainN)
+		if e := s.failure.Handle(bConn, nil); e != nil {
+			log.Debug("handleTCP: %v", e)
 		}
 		bConn.Close()
 		return err
@@ -119,10 +124,15 @@ func (s *Server) handleTCP(conn net.Conn) error {
 
 	// handle connection
 	var target string
-	lConn, err := shadowsocks.NewTCPConn(bConn, protocol.Metadata{
+	// the salts are checked and added to the bloom filter by ourselves
+	lConn, err := shadowsocks.NewTCPConn(&saltConn{
+		Conn:  bConn,
+		bloom: s.bloom,
+		salt:  make([]byte, ciphers.AeadCiphersConf[passage.In.Method].SaltLen),
+	}, protocol.Metadata{
 		Cipher:   passage.In.Method,
 		IsClient: false,
-	}, passage.inMasterKey, s.bloom)
+	}, passage.inMasterKey, nil)
 	if err != nil {
 		bConn.Close()
 		return err
@@ -193,7 +203,7 @@ func (s *Server) authTCP(conn bufferred_conn.BufferedConn) (passage *Passage, er
 		return nil, protocol.ErrFailAuth
 	}
 	// check bloom
-	if exist := s.bloom.Exist(data[:ciphers.AeadCiphersConf[passage.In.Method].SaltLen]); exist {
+	if exist := s.bloom.ExistOrAdd(data[:ciphers.AeadCiphersConf[passage.In.Method].SaltLen]); exist {
 		return nil, protocol.ErrReplayAttack
 	}
 	return passage, nil
@@ -208,3 +218,22 @@ func (s *Server) probeTCP(buf []byte, data []byte, passage *Passage) ([]byte, bo
 
 	return conf.Verify(buf, passage.inMasterKey, salt, cipherText, nil)
 }
+
+// saltConn adds the salt written first to the bloom filter, lest it be
+// replayed to the server.
+type saltConn struct {
+	netproxy.Conn
+	bloom *disk_bloom.Bloom
+	salt  []byte
+	n     int
+}
+
+func (c *saltConn) Write(b []byte) (int, error) {
+	if c.n < len(c.salt) {
+		c.n += copy(c.salt[c.n:], b)
+		if c.n == len(c.salt) {
+			c.bloom.ExistOrAdd(c.salt)
+		}
+	}
+	return c.Conn.Write(b)
+}
@@ -18,6 +18,10 @@ import (
 )
 
 func (s *Server) handleUDP(lAddr net.Addr, data []byte) (err error) {
+	// the sources of UDP can be spoofed, so they are banned but never counted
+	if s.failure.Banned(lAddr) {
+		return nil
+	}
 	// get conn or dial and relay
 	rc, passage, plainText, target, err := s.GetOrBuildUDPConn(lAddr, data)
 	if err != nil {
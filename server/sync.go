@@ -59,3 +59,18 @@ func GenerateBandwidthLimit() (l model.BandwidthLimit, err error) {
 	}
 	return l, nil
 }
+
+// PingResp is the response of ping messages. Certificates are extra fields to
+// model.PingResp, which older SweetLisa ignores.
+type PingResp struct {
+	model.PingResp
+	Certificates []CertificateStatus `json:",omitempty"`
+}
+
+func GeneratePingResp() (resp PingResp, err error) {
+	if resp.BandwidthLimit, err = GenerateBandwidthLimit(); err != nil {
+		return PingResp{}, err
+	}
+	resp.Certificates = CertificateStatuses()
+	return resp, nil
+}
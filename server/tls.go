@@ -0,0 +1,106 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/cert_file"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+)
+
+// TLSResources holds a TLS config of the TLS protocols and the HTTP server
+// that answers its ACME HTTP-01 challenges. HTTPServer is nil unless the
+// certificates are issued by http-01 challenges.
+type TLSResources struct {
+	TLSConfig  *tls.Config
+	HTTPServer *http.Server
+
+	closers []io.Closer
+}
+
+// Close stops the background work of the certificates. HTTPServer is left to
+// the caller.
+func (r *TLSResources) Close() error {
+	var errs []error
+	for _, closer := range r.closers {
+		if err := closer.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// certSupervisorOptions returns the options of the certificate supervisor of
+// sni in the config.
+func certSupervisorOptions(sni string, onRenew func()) CertSupervisorOptions {
+	conf := config.ParamsObj.John.TLS
+	return CertSupervisorOptions{
+		Name:          sni,
+		RenewBefore:   time.Duration(conf.RenewBefore) * 24 * time.Hour,
+		CheckInterval: time.Duration(conf.CheckInterval) * time.Second,
+		AlertAfter:    conf.AlertAfter,
+		OnRenew:       onRenew,
+	}
+}
+
+// NewTLSResources creates TLS resources for sni with the certificate files in
+// the config, or with ACME if there is none. onRenew is called after the
+// certificate is renewed or reloaded, so that the caller can re-register.
+func NewTLSResources(sni string, onRenew func()) (*TLSResources, error) {
+	conf := config.ParamsObj.John.TLS
+	if conf.CertFile == "" && conf.KeyFile == "" && conf.CertDir == "" {
+		return NewAutocertTLSResources(sni, onRenew)
+	}
+	var (
+		store      *cert_file.Store
+		supervisor atomic.Pointer[CertSupervisor]
+		err        error
+	)
+	sni = strings.TrimSpace(sni)
+	store, err = cert_file.New(cert_file.Options{
+		CertFile: conf.CertFile,
+		KeyFile:  conf.KeyFile,
+		Dir:      conf.CertDir,
+		Interval: time.Duration(conf.ReloadInterval) * time.Second,
+		OnReload: func() {
+			s := supervisor.Load()
+			if s == nil {
+				if onRenew != nil {
+					onRenew()
+				}
+				return
+			}
+			if cert := store.Lookup(sni); cert != nil && cert.Leaf != nil {
+				s.Issued(cert.Leaf)
+			}
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sni != "" && !store.Covers(sni) {
+		log.Warn("The certificate files are not valid for %v but for %v", sni, store.Names())
+	}
+	resources := &TLSResources{
+		TLSConfig: &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: store.GetCertificate,
+		},
+		closers: []io.Closer{store},
+	}
+	if sni == "" {
+		return resources, nil
+	}
+	// certbot and the like renew the files, which are only watched
+	opts := certSupervisorOptions(sni, onRenew)
+	opts.GetCertificate = store.GetCertificate
+	supervisor.Store(NewCertSupervisor(opts))
+	resources.closers = append(resources.closers, supervisor.Load())
+	return resources, nil
+}
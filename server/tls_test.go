@@ -0,0 +1,77 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+)
+
+func TestTLSResourcesWithCertificateFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestKeyPair(t, certFile, keyFile, "edge.example.com")
+	tlsConf := config.ParamsObj.John.TLS
+	defer func() { config.ParamsObj.John.TLS = tlsConf }()
+
+	config.ParamsObj.John.TLS = config.TLS{CertFile: certFile, KeyFile: keyFile}
+	resources, err := NewTLSResources("edge.example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resources.Close()
+	if resources.HTTPServer != nil {
+		t.Fatal("ACME HTTP server is not nil with certificate files")
+	}
+	cert, err := resources.TLSConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "edge.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cert.Leaf.VerifyHostname("edge.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	config.ParamsObj.John.TLS = config.TLS{CertFile: certFile}
+	if _, err = NewTLSResources("edge.example.com", nil); err == nil {
+		t.Fatal("expected an error without the key file")
+	}
+}
+
+func writeTestKeyPair(t *testing.T, certFile string, keyFile string, name string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
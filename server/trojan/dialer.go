@@ -0,0 +1,157 @@
+package trojan
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/outbound/protocol"
+	"github.com/daeuniverse/outbound/protocol/trojanc"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+)
+
+func init() {
+	protocol.Register("trojan", NewDialer)
+}
+
+// Dialer is a trojan client, which is used to relay passages to trojan servers.
+type Dialer struct {
+	proxyAddress string
+	nextDialer   netproxy.Dialer
+	tlsConfig    *tls.Config
+	fingerprint  string
+	password     string
+}
+
+func NewDialer(nextDialer netproxy.Dialer, header protocol.Header) (netproxy.Dialer, error) {
+	if nextDialer == nil {
+		return nil, fmt.Errorf("nil next dialer")
+	}
+	tlsConfig := header.TlsConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			ServerName: header.SNI,
+		}
+	} else {
+		tlsConfig = tlsConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" && header.SNI != "" {
+		tlsConfig.ServerName = header.SNI
+	}
+	fingerprint, err := server.Fingerprint(header.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	return &Dialer{
+		proxyAddress: header.ProxyAddress,
+		nextDialer:   nextDialer,
+		tlsConfig:    tlsConfig,
+		fingerprint:  fingerprint,
+		password:     header.Password,
+	}, nil
+}
+
+func (d *Dialer) Dial(network string, addr string) (netproxy.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network string, addr string) (netproxy.Conn, error) {
+	magicNetwork, err := netproxy.ParseMagicNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	switch magicNetwork.Network {
+	case "tcp", "udp":
+		mdata, err := protocol.ParseMetadata(addr)
+		if err != nil {
+			return nil, err
+		}
+		mdata.IsClient = true
+		conn, err := d.dialTLS(ctx, magicNetwork)
+		if err != nil {
+			return nil, err
+		}
+		tConn, err := trojanc.NewConn(conn, trojanc.Metadata{
+			Metadata: mdata,
+			Network:  magicNetwork.Network,
+		}, d.password)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		if magicNetwork.Network == "tcp" {
+			return tConn, nil
+		}
+		return &trojanc.PacketConn{Conn: tConn}, nil
+	default:
+		return nil, fmt.Errorf("%w: %v", netproxy.UnsupportedTunnelTypeError, magicNetwork.Network)
+	}
+}
+
+func (d *Dialer) DialCmdMsg(cmd protocol.MetadataCmd) (netproxy.Conn, error) {
+	return d.DialCmdMsgContext(context.Background(), cmd)
+}
+
+func (d *Dialer) DialCmdMsgContext(ctx context.Context, cmd protocol.MetadataCmd) (netproxy.Conn, error) {
+	conn, err := d.dialTLS(ctx, &netproxy.MagicNetwork{Network: "tcp"})
+	if err != nil {
+		return nil, err
+	}
+	tConn, err := trojanc.NewConn(conn, trojanc.Metadata{
+		Metadata: protocol.Metadata{
+			Type:     protocol.MetadataTypeMsg,
+			Cmd:      cmd,
+			IsClient: true,
+		},
+		Network: "tcp",
+	}, d.password)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tConn, nil
+}
+
+func (d *Dialer) dialTLS(ctx context.Context, magicNetwork *netproxy.MagicNetwork) (server.TLSConn, error) {
+	tcpNetwork := netproxy.MagicNetwork{
+		Network: "tcp",
+		Mark:    magicNetwork.Mark,
+		Mptcp:   magicNetwork.Mptcp,
+	}.Encode()
+	rawConn, err := d.nextDialer.DialContext(ctx, tcpNetwork, d.proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn, err := server.TLSClient(asNetConn(rawConn), d.tlsConfig, d.fingerprint)
+	if err != nil {
+		_ = rawConn.Close()
+		return nil, err
+	}
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = tlsConn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+type netConnAddr string
+
+func (a netConnAddr) Network() string { return "trojan" }
+func (a netConnAddr) String() string  { return string(a) }
+
+type netConnAdapter struct {
+	netproxy.Conn
+}
+
+func asNetConn(conn netproxy.Conn) net.Conn {
+	if c, ok := conn.(net.Conn); ok {
+		return c
+	}
+	return netConnAdapter{Conn: conn}
+}
+
+func (c netConnAdapter) LocalAddr() net.Addr  { return netConnAddr("local") }
+func (c netConnAdapter) RemoteAddr() net.Addr { return netConnAddr("remote") }
@@ -0,0 +1,53 @@
+package trojan
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+)
+
+// bufferedConn reads through r so that the bytes peeked during the
+// authentication are not lost.
+type bufferedConn struct {
+	*tls.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// handleFallback relays a connection that failed the authentication to the
+// fallback HTTP backend, so that the server looks like an ordinary website to
+// active probes. The connection is drained if no fallback is configured.
+func (s *Server) handleFallback(conn *bufferedConn, authErr error) error {
+	if s.fallback == "" {
+		if config.ParamsObj.John.MaxDrainN == -1 {
+			io.Copy(io.Discard, conn)
+		} else {
+			io.CopyN(io.Discard, conn, config.ParamsObj.John.MaxDrainN)
+		}
+		return fmt.Errorf("auth fail: %w. Drained the conn from: %v", authErr, conn.RemoteAddr().String())
+	}
+	log.Debug("trojan: relay the conn from %v to fallback %v: %v", conn.RemoteAddr().String(), s.fallback, authErr)
+	rConn, err := net.DialTimeout("tcp", s.fallback, server.DialTimeout)
+	if err != nil {
+		return fmt.Errorf("auth fail: %w. Failed to dial fallback: %v", authErr, err)
+	}
+	defer rConn.Close()
+	if err = server.RelayTCP(conn, rConn); err != nil {
+		var netErr net.Error
+		if errors.Is(err, io.EOF) || (errors.As(err, &netErr) && netErr.Timeout()) {
+			return nil
+		}
+		return fmt.Errorf("relay fallback error: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,601 @@
+package trojan
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/outbound/protocol"
+	"github.com/daeuniverse/outbound/protocol/trojanc"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/api"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/common"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
+	gonanoid "github.com/matoous/go-nanoid"
+)
+
+const passwordHashLen = sha256.Size224 * 2
+
+func init() {
+	server.Register(string(server.ProtocolTrojan), NewJohn)
+}
+
+type Server struct {
+	dialer    netproxy.Dialer
+	tlsConfig *tls.Config
+	fallback  string
+
+	sweetLisa config.Lisa
+	arg       server.Argument
+
+	mutex    sync.Mutex
+	passages []Passage
+	users    map[[passwordHashLen]byte]Passage
+
+	passageContentionCache *server.ContentionCache
+	lastAliveMu            sync.RWMutex
+	lastAlive              time.Time
+
+	lifecycleMu sync.Mutex
+	closeOnce   sync.Once
+	closed      bool
+	ctx         context.Context
+	cancel      context.CancelFunc
+	listener    net.Listener
+	activeConns map[net.Conn]struct{}
+
+	autocertServer   *http.Server
+	autocertListener net.Listener
+	autocertStarted  bool
+	tlsResources     *server.TLSResources
+}
+
+type Passage struct {
+	server.Passage
+	passwordHash [passwordHashLen]byte
+}
+
+func New(valueCtx context.Context, dialer netproxy.Dialer) (server.Server, error) {
+	tlsConfig, err := tlsConfigFromContext(valueCtx)
+	if err != nil {
+		return nil, err
+	}
+	return newServer(dialer, tlsConfig)
+}
+
+func newServer(dialer netproxy.Dialer, tlsConfig *tls.Config) (*Server, error) {
+	tlsConfig, err := normalizeTLSConfig(tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		dialer:      dialer,
+		tlsConfig:   tlsConfig,
+		users:       make(map[[passwordHashLen]byte]Passage),
+		ctx:         ctx,
+		cancel:      cancel,
+		activeConns: make(map[net.Conn]struct{}),
+	}, nil
+}
+
+func NewJohn(valueCtx context.Context, dialer netproxy.Dialer, sweetLisa config.Lisa, arg server.Argument) (server.Server, error) {
+	fallback := config.ParamsObj.John.Trojan.Fallback
+	if fallback != "" {
+		if _, _, err := net.SplitHostPort(fallback); err != nil {
+			return nil, fmt.Errorf("invalid trojan fallback %v: %w", strconv.Quote(fallback), err)
+		}
+	}
+	sni, err := common.HostsToSNI(arg.Hostnames, sweetLisa.Host)
+	if err != nil {
+		return nil, err
+	}
+	var john *Server
+	tlsResources, err := server.NewTLSResources(sni, func() {
+		if john != nil {
+			john.reRegister()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	john, err = newServer(dialer, tlsResources.TLSConfig)
+	if err != nil {
+		_ = tlsResources.Close()
+		return nil, err
+	}
+	john.autocertServer = tlsResources.HTTPServer
+	john.tlsResources = tlsResources
+	john.fallback = fallback
+	john.sweetLisa = sweetLisa
+	john.arg = arg
+	john.passageContentionCache = server.NewContentionCache()
+	if err := john.AddPassages([]server.Passage{{Manager: true}}); err != nil {
+		return nil, err
+	}
+	if err := john.register(); err != nil {
+		return nil, err
+	}
+	go john.registerBackground()
+	go server.RotateManager(john, john.register, john.ctx.Done())
+	return john, nil
+}
+
+func (s *Server) Listen(addr string) error {
+	lt, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if err := s.startAutocertServer(); err != nil {
+		_ = lt.Close()
+		return err
+	}
+	return s.serveListener(lt)
+}
+
+func (s *Server) serveListener(lt net.Listener) error {
+	if !s.setListener(lt) {
+		_ = lt.Close()
+		return nil
+	}
+	defer s.clearListener(lt)
+	for {
+		conn, err := lt.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if !s.trackConn(conn) {
+			_ = conn.Close()
+			continue
+		}
+		go func(conn net.Conn) {
+			defer s.untrackConn(conn)
+			if err := s.handleConn(conn); err != nil {
+				if errors.Is(err, server.ErrPassageAbuse) ||
+					errors.Is(err, protocol.ErrFailAuth) {
+					log.Warn("trojan handleConn: %v", err)
+				} else {
+					log.Info("trojan handleConn: %v", err)
+				}
+			}
+		}(conn)
+	}
+}
+
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		s.lifecycleMu.Lock()
+		s.closed = true
+		if s.cancel != nil {
+			s.cancel()
+		}
+		listener := s.listener
+		s.listener = nil
+		autocertServer := s.autocertServer
+		s.autocertServer = nil
+		autocertListener := s.autocertListener
+		s.autocertListener = nil
+		tlsResources := s.tlsResources
+		s.tlsResources = nil
+		activeConns := make([]net.Conn, 0, len(s.activeConns))
+		for conn := range s.activeConns {
+			activeConns = append(activeConns, conn)
+		}
+		s.activeConns = make(map[net.Conn]struct{})
+		s.lifecycleMu.Unlock()
+		if listener != nil {
+			err = listener.Close()
+		}
+		if autocertServer != nil {
+			if closeErr := autocertServer.Close(); err == nil && closeErr != nil && !errors.Is(closeErr, http.ErrServerClosed) && !errors.Is(closeErr, net.ErrClosed) {
+				err = closeErr
+			}
+		}
+		if autocertListener != nil {
+			if closeErr := autocertListener.Close(); err == nil && closeErr != nil && !errors.Is(closeErr, net.ErrClosed) {
+				err = closeErr
+			}
+		}
+		if tlsResources != nil {
+			_ = tlsResources.Close()
+		}
+		for _, conn := range activeConns {
+			_ = conn.Close()
+		}
+	})
+	return err
+}
+
+func (s *Server) startAutocertServer() error {
+	s.lifecycleMu.Lock()
+	if s.closed || s.autocertServer == nil || s.autocertStarted {
+		s.lifecycleMu.Unlock()
+		return nil
+	}
+	autocertServer := s.autocertServer
+	autocertListener, err := net.Listen("tcp", autocertServer.Addr)
+	if err != nil {
+		s.lifecycleMu.Unlock()
+		return fmt.Errorf("listen for ACME challenges on %v: %w", strconv.Quote(autocertServer.Addr), err)
+	}
+	s.autocertListener = autocertListener
+	s.autocertStarted = true
+	s.lifecycleMu.Unlock()
+
+	go func() {
+		log.Alert("BitterJohn is listening at %v for ACME Challenges", autocertListener.Addr())
+		if err := autocertServer.Serve(autocertListener); err != nil &&
+			!errors.Is(err, http.ErrServerClosed) &&
+			!errors.Is(err, net.ErrClosed) {
+			log.Warn("autocertServer: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (s *Server) AddPassages(passages []server.Passage) error {
+	local, _ := LocalizePassages(passages)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if server.ReplacesManagers(passages) {
+		s.removePassagesFuncLocked(func(p *Passage) bool { return p.Manager })
+	}
+	for _, passage := range local {
+		s.passages = append(s.passages, passage)
+	}
+	s.rebuildUsersLocked()
+	return nil
+}
+
+func (s *Server) RemovePassages(passages []server.Passage, alsoManager bool) error {
+	local, _ := LocalizePassages(passages)
+	keySet := make(map[string]struct{}, len(local))
+	for _, passage := range local {
+		if passage.Manager && !alsoManager {
+			continue
+		}
+		keySet[passage.In.Argument.Hash()] = struct{}{}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.removePassagesFuncLocked(func(p *Passage) bool {
+		_, ok := keySet[p.In.Argument.Hash()]
+		return ok
+	})
+	s.rebuildUsersLocked()
+	return nil
+}
+
+func (s *Server) SyncPassages(passages []server.Passage) error {
+	return server.SyncPassages(s, passages)
+}
+
+func (s *Server) Passages() (passages []server.Passage) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, passage := range s.passages {
+		passages = append(passages, passage.Passage)
+	}
+	return passages
+}
+
+func LocalizePassages(passages []server.Passage) ([]Passage, *Passage) {
+	passages = server.LocalizeManagers(passages, func(passage *server.Passage) {
+		passage.In.Password, _ = gonanoid.Generate(common.Alphabet, 23)
+	})
+	local := make([]Passage, len(passages))
+	var manager *Passage
+	for i, passage := range passages {
+		if passage.Manager {
+			manager = &local[i]
+		}
+		local[i].Passage = passage
+		local[i].passwordHash = passwordHash(passage.In.Password)
+	}
+	return local, manager
+}
+
+func passwordHash(password string) (hash [passwordHashLen]byte) {
+	sum := sha256.Sum224([]byte(password))
+	hex.Encode(hash[:], sum[:])
+	return hash
+}
+
+func (s *Server) removePassagesFuncLocked(f func(*Passage) bool) {
+	for i := len(s.passages) - 1; i >= 0; i-- {
+		if f(&s.passages[i]) {
+			s.passages = append(s.passages[:i], s.passages[i+1:]...)
+		}
+	}
+}
+
+func (s *Server) rebuildUsersLocked() {
+	s.users = make(map[[passwordHashLen]byte]Passage, len(s.passages))
+	for i := range s.passages {
+		s.users[s.passages[i].passwordHash] = s.passages[i]
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) error {
+	defer conn.Close()
+	tlsConn := tls.Server(conn, s.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	if server.IsACMETLSALPNConn(tlsConn.ConnectionState()) {
+		// a tls-alpn-01 challenge is done with the handshake
+		return nil
+	}
+	lConn := &bufferedConn{Conn: tlsConn, r: bufio.NewReader(tlsConn)}
+	passage, err := s.auth(lConn.r)
+	if err != nil {
+		if errors.Is(err, protocol.ErrFailAuth) {
+			return s.handleFallback(lConn, err)
+		}
+		return err
+	}
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		if err := s.ContentionCheck(tcpAddr.IP, passage); err != nil {
+			return err
+		}
+	}
+
+	mdata, err := readRequest(lConn)
+	if err != nil {
+		return err
+	}
+	if mdata.Type == protocol.MetadataTypeMsg {
+		return s.handleMsg(lConn, mdata, passage)
+	}
+	if passage.Manager {
+		return fmt.Errorf("%w: manager key is abused for a non-cmd connection", server.ErrPassageAbuse)
+	}
+
+	dialer := s.dialer
+	if passage.Out != nil {
+		header, err := server.GetHeader(*passage.Out, &s.sweetLisa)
+		if err != nil {
+			return err
+		}
+		dialer, err = server.NewDialer(string(passage.Out.Protocol), dialer, header)
+		if err != nil {
+			return err
+		}
+	}
+	switch mdata.Network {
+	case "tcp":
+		return s.handleTCP(lConn, dialer, net.JoinHostPort(mdata.Hostname, strconv.Itoa(int(mdata.Port))))
+	case "udp":
+		return s.handleUDP(lConn, dialer)
+	default:
+		return fmt.Errorf("unexpected network: %v", mdata.Network)
+	}
+}
+
+// auth peeks the password hash and the following CRLF so that the bytes are
+// still available to the fallback if the authentication fails.
+func (s *Server) auth(r *bufio.Reader) (*Passage, error) {
+	var key [passwordHashLen]byte
+	for i := 0; i < passwordHashLen+len(trojanc.CRLF); i++ {
+		b, err := r.Peek(i + 1)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("%w: unexpected EOF in trojan header", protocol.ErrFailAuth)
+			}
+			return nil, err
+		}
+		if i < passwordHashLen {
+			if !isLowerHex(b[i]) {
+				return nil, fmt.Errorf("%w: not a trojan request", protocol.ErrFailAuth)
+			}
+			key[i] = b[i]
+		} else if b[i] != trojanc.CRLF[i-passwordHashLen] {
+			return nil, fmt.Errorf("%w: not a trojan request", protocol.ErrFailAuth)
+		}
+	}
+
+	s.mutex.Lock()
+	passage, ok := s.users[key]
+	s.mutex.Unlock()
+	if !ok {
+		return nil, protocol.ErrFailAuth
+	}
+	if _, err := r.Discard(passwordHashLen + len(trojanc.CRLF)); err != nil {
+		return nil, err
+	}
+	return &passage, nil
+}
+
+func isLowerHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f')
+}
+
+func readRequest(r io.Reader) (*trojanc.Metadata, error) {
+	var cmd [1]byte
+	if _, err := io.ReadFull(r, cmd[:]); err != nil {
+		return nil, err
+	}
+	mdata := &trojanc.Metadata{Network: trojanc.ParseNetwork(cmd[0])}
+	if mdata.Network == "invalid" {
+		return nil, fmt.Errorf("unexpected trojan command: %v", cmd[0])
+	}
+	if _, err := mdata.Unpack(r); err != nil {
+		return nil, err
+	}
+	var crlf [2]byte
+	if _, err := io.ReadFull(r, crlf[:]); err != nil {
+		return nil, err
+	}
+	if crlf != [2]byte(trojanc.CRLF) {
+		return nil, fmt.Errorf("invalid trojan request: missing CRLF")
+	}
+	return mdata, nil
+}
+
+func (s *Server) handleTCP(lConn *bufferedConn, dialer netproxy.Dialer, target string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), server.DialTimeout)
+	defer cancel()
+	rConn, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			log.Debug("%v", err)
+			return nil
+		}
+		return err
+	}
+	defer rConn.Close()
+	if err = server.RelayTCP(lConn, rConn); err != nil {
+		var netErr net.Error
+		if errors.Is(err, io.EOF) || (errors.As(err, &netErr) && netErr.Timeout()) {
+			return nil
+		}
+		return fmt.Errorf("relay tcp error: %w", err)
+	}
+	return nil
+}
+
+func (s *Server) reRegister() {
+	s.setLastAlive(time.Time{})
+}
+
+func (s *Server) ContentionCheck(thisIP net.IP, passage *Passage) error {
+	if s.passageContentionCache == nil {
+		return nil
+	}
+	contentionDuration := server.ProtectTime[passage.Use()]
+	if contentionDuration > 0 {
+		passageKey := passage.In.Argument.Hash()
+		accept, conflictIP := s.passageContentionCache.Check(passageKey, contentionDuration, thisIP)
+		if !accept {
+			return fmt.Errorf("%w: from %v and %v: contention detected", server.ErrPassageAbuse, thisIP.String(), conflictIP.String())
+		}
+	}
+	return nil
+}
+
+func (s *Server) registerBackground() {
+	interval := 2 * time.Second
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-s.ctx.Done():
+			ticker.Stop()
+			return
+		case <-ticker.C:
+			if time.Since(s.getLastAlive()) < server.LostThreshold {
+				continue
+			}
+			if err := s.register(); err != nil {
+				interval *= 2
+				if interval > 600*time.Second {
+					interval = 600 * time.Second
+				}
+				log.Warn("trojan registerBackground: %v. retry in %v", err, interval.String())
+			} else {
+				interval = 2 * time.Second
+			}
+			ticker.Reset(interval)
+		}
+	}
+}
+
+func (s *Server) register() error {
+	manager := server.CurrentManager(s.Passages())
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	t, _ := net.LookupTXT("cdn-validate." + s.sweetLisa.Host)
+	var validateToken string
+	if len(t) > 0 {
+		validateToken = t[0]
+	}
+	bandwidthLimit, err := server.GenerateBandwidthLimit()
+	if err != nil {
+		return err
+	}
+	cdnNames, users, err := api.Register(ctx, s.sweetLisa.Host, validateToken, model.Server{
+		Ticket: s.arg.Ticket,
+		Name:   s.arg.ServerName,
+		Hosts:  s.arg.Hostnames,
+		Port:   s.arg.Port,
+		Argument: model.Argument{
+			Protocol: "trojan",
+			Password: manager.In.Password,
+		},
+		BandwidthLimit: bandwidthLimit,
+		NoRelay:        s.arg.NoRelay,
+	})
+	if err != nil {
+		return err
+	}
+	log.Alert("Succeed to register at %v (%v)", strconv.Quote(s.sweetLisa.Host), cdnNames)
+	s.setLastAlive(time.Now())
+	return s.SyncPassages(users)
+}
+
+func (s *Server) setListener(lt net.Listener) bool {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.listener = lt
+	return true
+}
+
+func (s *Server) clearListener(lt net.Listener) {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+	if s.listener == lt {
+		s.listener = nil
+	}
+}
+
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.activeConns == nil {
+		s.activeConns = make(map[net.Conn]struct{})
+	}
+	s.activeConns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+	delete(s.activeConns, conn)
+}
+
+func (s *Server) setLastAlive(t time.Time) {
+	s.lastAliveMu.Lock()
+	defer s.lastAliveMu.Unlock()
+	s.lastAlive = t
+}
+
+func (s *Server) getLastAlive() time.Time {
+	s.lastAliveMu.RLock()
+	defer s.lastAliveMu.RUnlock()
+	return s.lastAlive
+}
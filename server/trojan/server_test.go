@@ -0,0 +1,282 @@
+package trojan
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/outbound/protocol"
+	"github.com/daeuniverse/outbound/protocol/direct"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/internal/testutil"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
+)
+
+func TestDialerRelaysTCPThroughServer(t *testing.T) {
+	echoAddr, closeEcho := testutil.StartEchoServer(t)
+	defer closeEcho()
+
+	srv, addr := startTrojanServer(t, trojanPassage("secret-password"))
+	dialer := newTestDialer(t, srv, addr, "secret-password")
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", echoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf), "pong"; got != want {
+		t.Fatalf("echo response = %q, want %q", got, want)
+	}
+}
+
+func TestDialerRelaysUDPThroughServer(t *testing.T) {
+	udpAddr, closeUDP := testutil.StartUDPEchoServer(t)
+	defer closeUDP()
+
+	srv, addr := startTrojanServer(t, trojanPassage("secret-password"))
+	dialer := newTestDialer(t, srv, addr, "secret-password")
+
+	conn, err := dialer.DialContext(context.Background(), "udp", udpAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	packetConn := conn.(netproxy.PacketConn)
+	if _, err := packetConn.WriteTo([]byte("ping"), udpAddr.String()); err != nil {
+		t.Fatal(err)
+	}
+	_ = packetConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	n, from, err := packetConn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "pong" {
+		t.Fatalf("udp response = %q, want %q", string(buf[:n]), "pong")
+	}
+	if from != udpAddr {
+		t.Fatalf("udp response addr = %v, want %v", from, udpAddr)
+	}
+}
+
+func TestDialCmdMsgPing(t *testing.T) {
+	srv, addr := startTrojanServer(t, server.Passage{Manager: true})
+	dialer := newTestDialer(t, srv, addr, srv.Passages()[0].In.Password)
+
+	conn, err := dialer.DialCmdMsg(protocol.MetadataCmdPing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := make([]byte, 8)
+	binary.BigEndian.PutUint32(req[:4], 4)
+	copy(req[4:], "ping")
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, req[:4]); err != nil {
+		t.Fatal(err)
+	}
+	if n := binary.BigEndian.Uint32(req[:4]); n == 0 {
+		t.Fatal("empty ping response")
+	} else if n > 4096 {
+		t.Fatalf("ping response too large: %d", n)
+	}
+	if srv.getLastAlive().IsZero() {
+		t.Fatal("lastAlive is not updated by ping")
+	}
+}
+
+func TestDialerRejectsUntrustedServer(t *testing.T) {
+	_, addr := startTrojanServer(t, trojanPassage("secret-password"))
+	dialer, err := NewDialer(direct.SymmetricDirect, protocol.Header{
+		ProxyAddress: addr,
+		SNI:          "localhost",
+		Password:     "secret-password",
+		IsClient:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.(*Dialer).DialCmdMsg(protocol.MetadataCmdPing)
+	if err == nil {
+		_ = conn.Close()
+		t.Fatal("the password is sent to a server with an untrusted certificate")
+	}
+}
+
+func TestUserCannotSendManagerMessage(t *testing.T) {
+	srv, addr := startTrojanServer(t, trojanPassage("secret-password"))
+	dialer := newTestDialer(t, srv, addr, "secret-password")
+
+	conn, err := dialer.DialCmdMsg(protocol.MetadataCmdPing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := make([]byte, 8)
+	binary.BigEndian.PutUint32(req[:4], 4)
+	copy(req[4:], "ping")
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, req[:4]); err == nil {
+		t.Fatal("non-manager passage received a ping response")
+	}
+}
+
+func TestUnauthenticatedConnectionFallsBack(t *testing.T) {
+	wrongHash := passwordHash("wrong-password")
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{
+			name:    "http request",
+			payload: "GET / HTTP/1.1\r\nHost: edge.example.com\r\n\r\n",
+		},
+		{
+			name:    "short request",
+			payload: "GET /",
+		},
+		{
+			name:    "wrong password",
+			payload: string(wrongHash[:]) + "\r\n\x01\x01\x7f\x00\x00\x01\x00\x50\r\nhello",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backendAddr, received := startFallbackBackend(t, len(tt.payload))
+			srv, addr := startTrojanServer(t, trojanPassage("secret-password"))
+			srv.fallback = backendAddr
+
+			conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err := conn.Write([]byte(tt.payload)); err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			resp := make([]byte, len(tt.payload))
+			if _, err := io.ReadFull(conn, resp); err != nil {
+				t.Fatal(err)
+			}
+			if got := <-received; got != tt.payload {
+				t.Fatalf("fallback received %q, want %q", got, tt.payload)
+			}
+			if got := string(resp); got != tt.payload {
+				t.Fatalf("fallback response = %q, want %q", got, tt.payload)
+			}
+		})
+	}
+}
+
+func TestPasswordHashIsHexSHA224(t *testing.T) {
+	hash := passwordHash("password")
+	if got, want := string(hash[:]), "d63dc919e201d7bc4c825630d2cf25fdc93d4b2f0d46706d29038d01"; got != want {
+		t.Fatalf("passwordHash = %q, want %q", got, want)
+	}
+}
+
+func trojanPassage(password string) server.Passage {
+	return server.Passage{
+		Passage: model.Passage{
+			In: model.In{Argument: model.Argument{
+				Protocol: "trojan",
+				Password: password,
+			}},
+		},
+	}
+}
+
+func startTrojanServer(t *testing.T, passages ...server.Passage) (*Server, string) {
+	t.Helper()
+
+	srvIface, err := New(WithTLSConfig(context.Background(), testTLSConfig(t)), direct.SymmetricDirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := srvIface.(*Server)
+	t.Cleanup(func() { _ = srv.Close() })
+	if err := srv.AddPassages(passages); err != nil {
+		t.Fatal(err)
+	}
+	lt, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = srv.serveListener(lt)
+	}()
+	return srv, lt.Addr().String()
+}
+
+// newTestDialer trusts the certificate of srv.
+func newTestDialer(t *testing.T, srv *Server, addr string, password string) *Dialer {
+	t.Helper()
+
+	cert, err := x509.ParseCertificate(srv.tlsConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	dialer, err := NewDialer(direct.SymmetricDirect, protocol.Header{
+		ProxyAddress: addr,
+		SNI:          "localhost",
+		Password:     password,
+		IsClient:     true,
+		TlsConfig:    &tls.Config{RootCAs: roots},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialer.(*Dialer)
+}
+
+// startFallbackBackend echoes the first n bytes it receives.
+func startFallbackBackend(t *testing.T, n int) (addr string, received <-chan string) {
+	t.Helper()
+
+	lt, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lt.Close() })
+	ch := make(chan string, 1)
+	go func() {
+		conn, err := lt.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, n)
+		read, err := io.ReadFull(conn, buf)
+		ch <- string(buf[:read])
+		if err == nil {
+			_, _ = conn.Write(buf)
+		}
+	}()
+	return lt.Addr().String(), ch
+}
@@ -0,0 +1,34 @@
+package trojan
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+)
+
+var ErrTLSConfigRequired = errors.New("trojan tls config with certificate provider is required")
+
+type tlsConfigContextKey struct{}
+
+func WithTLSConfig(ctx context.Context, tlsConfig *tls.Config) context.Context {
+	return context.WithValue(ctx, tlsConfigContextKey{}, tlsConfig)
+}
+
+func tlsConfigFromContext(ctx context.Context) (*tls.Config, error) {
+	tlsConfig, _ := ctx.Value(tlsConfigContextKey{}).(*tls.Config)
+	return normalizeTLSConfig(tlsConfig)
+}
+
+func normalizeTLSConfig(tlsConfig *tls.Config) (*tls.Config, error) {
+	if tlsConfig == nil {
+		return nil, ErrTLSConfigRequired
+	}
+	tlsConfig = tlsConfig.Clone()
+	if len(tlsConfig.Certificates) == 0 && tlsConfig.GetCertificate == nil && tlsConfig.GetConfigForClient == nil {
+		return nil, ErrTLSConfigRequired
+	}
+	if tlsConfig.MinVersion == 0 {
+		tlsConfig.MinVersion = tls.VersionTLS12
+	}
+	return tlsConfig, nil
+}
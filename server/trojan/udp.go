@@ -0,0 +1,144 @@
+package trojan
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/outbound/pool"
+	"github.com/daeuniverse/outbound/protocol"
+	"github.com/daeuniverse/outbound/protocol/trojanc"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+)
+
+const maxPacketSize = 65535
+
+// readUDPFrame reads a trojan UDP frame:
+// ATYP | DST.ADDR | DST.PORT | Length | CRLF | Payload
+func readUDPFrame(r io.Reader, buf []byte) (target string, n int, err error) {
+	var mdata trojanc.Metadata
+	if _, err = mdata.Unpack(r); err != nil {
+		return "", 0, err
+	}
+	if mdata.Type == protocol.MetadataTypeMsg {
+		return "", 0, fmt.Errorf("unexpected message in trojan UDP frame")
+	}
+	var header [4]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return "", 0, err
+	}
+	if [2]byte(header[2:]) != [2]byte(trojanc.CRLF) {
+		return "", 0, fmt.Errorf("invalid trojan UDP frame: missing CRLF")
+	}
+	length := int(binary.BigEndian.Uint16(header[:2]))
+	if length > len(buf) {
+		return "", 0, io.ErrShortBuffer
+	}
+	if _, err = io.ReadFull(r, buf[:length]); err != nil {
+		return "", 0, err
+	}
+	return net.JoinHostPort(mdata.Hostname, strconv.Itoa(int(mdata.Port))), length, nil
+}
+
+func writeUDPFrame(w io.Writer, from netip.AddrPort, payload []byte) error {
+	from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+	mdata, err := protocol.ParseMetadata(from.String())
+	if err != nil {
+		return err
+	}
+	metadata := trojanc.Metadata{Metadata: mdata, Network: "udp"}
+	buf := pool.Get(metadata.Len() + 4 + len(payload))
+	defer pool.Put(buf)
+	_, err = w.Write(trojanc.SealUDP(metadata, buf, payload))
+	return err
+}
+
+func (s *Server) handleUDP(lConn *bufferedConn, dialer netproxy.Dialer) error {
+	buf := pool.Get(maxPacketSize)
+	defer pool.Put(buf)
+	_ = lConn.SetReadDeadline(time.Now().Add(server.DefaultNatTimeout))
+	target, n, err := readUDPFrame(lConn, buf)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), server.DialTimeout)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, "udp", target)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil // ignore i/o timeout
+		}
+		return err
+	}
+	rConn, ok := conn.(netproxy.PacketConn)
+	if !ok {
+		_ = conn.Close()
+		return fmt.Errorf("dialer returned %T for udp", conn)
+	}
+	defer rConn.Close()
+	_ = rConn.SetWriteDeadline(time.Now().Add(server.DefaultNatTimeout))
+	if _, err = rConn.WriteTo(buf[:n], target); err != nil {
+		return err
+	}
+
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- relayFramesToPacketConn(rConn, lConn)
+	}()
+	go func() {
+		errCh <- relayPacketConnToFrames(lConn, rConn)
+	}()
+	if err = <-errCh; isIgnorableUDPError(err) {
+		return nil
+	}
+	return fmt.Errorf("relay udp error: %w", err)
+}
+
+func relayFramesToPacketConn(dst netproxy.PacketConn, src *bufferedConn) error {
+	buf := pool.Get(maxPacketSize)
+	defer pool.Put(buf)
+	for {
+		_ = src.SetReadDeadline(time.Now().Add(server.DefaultNatTimeout))
+		target, n, err := readUDPFrame(src, buf)
+		if err != nil {
+			return err
+		}
+		_ = dst.SetWriteDeadline(time.Now().Add(server.DefaultNatTimeout)) // should keep consistent
+		if _, err = dst.WriteTo(buf[:n], target); err != nil {
+			return err
+		}
+	}
+}
+
+func relayPacketConnToFrames(dst *bufferedConn, src netproxy.PacketConn) error {
+	buf := pool.Get(maxPacketSize)
+	defer pool.Put(buf)
+	for {
+		_ = src.SetReadDeadline(time.Now().Add(server.DefaultNatTimeout))
+		n, from, err := src.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		_ = dst.SetWriteDeadline(time.Now().Add(server.DefaultNatTimeout))
+		if err = writeUDPFrame(dst, from, buf[:n]); err != nil {
+			return err
+		}
+	}
+}
+
+func isIgnorableUDPError(err error) bool {
+	if err == nil || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
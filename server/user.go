@@ -26,6 +26,9 @@ var (
 type Passage struct {
 	model.Passage
 	Manager bool
+	// Rotating is set on the manager added by a rotation, which keeps the
+	// previous managers for the grace period. Any other manager replaces them.
+	Rotating bool `json:"-"`
 }
 
 func (p *Passage) Use() (use PassageUse) {
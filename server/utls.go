@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/common"
+	utls "github.com/refraction-networking/utls"
+)
+
+// clientHelloIDs are the ClientHellos that the relay dialers can mimic, which
+// are selected by the fp parameter of the method of an Out.
+var clientHelloIDs = map[string]utls.ClientHelloID{
+	"chrome":  utls.HelloChrome_Auto,
+	"firefox": utls.HelloFirefox_Auto,
+	"safari":  utls.HelloSafari_Auto,
+	"random":  utls.HelloRandomized,
+}
+
+// Fingerprint returns the fingerprint in the method of an Out, which is empty
+// for the ClientHello of crypto/tls.
+func Fingerprint(method string) (string, error) {
+	fingerprint := strings.ToLower(common.SimplyGetParam(method, "fp"))
+	if fingerprint == "" {
+		return "", nil
+	}
+	if _, ok := clientHelloIDs[fingerprint]; !ok {
+		return "", fmt.Errorf("unknown TLS fingerprint: %v", fingerprint)
+	}
+	return fingerprint, nil
+}
+
+// TLSConn is a TLS client conn of crypto/tls or uTLS.
+type TLSConn interface {
+	net.Conn
+	HandshakeContext(ctx context.Context) error
+}
+
+// TLSClient returns a TLS client conn over conn, whose ClientHello mimics the
+// fingerprint given by Fingerprint.
+func TLSClient(conn net.Conn, config *tls.Config, fingerprint string) (TLSConn, error) {
+	if fingerprint == "" {
+		return tls.Client(conn, config), nil
+	}
+	id, ok := clientHelloIDs[fingerprint]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS fingerprint: %v", fingerprint)
+	}
+	if id == utls.HelloRandomized && len(config.NextProtos) > 0 {
+		// the protocols are required, such as h2 of gRPC
+		id = utls.HelloRandomizedALPN
+	}
+	return utls.UClient(conn, &utls.Config{
+		ServerName:            config.ServerName,
+		RootCAs:               config.RootCAs,
+		InsecureSkipVerify:    config.InsecureSkipVerify,
+		VerifyPeerCertificate: config.VerifyPeerCertificate,
+		NextProtos:            config.NextProtos,
+		MinVersion:            config.MinVersion,
+		MaxVersion:            config.MaxVersion,
+	}, id), nil
+}
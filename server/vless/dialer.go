@@ -0,0 +1,108 @@
+package vless
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/outbound/protocol"
+	"github.com/daeuniverse/outbound/protocol/vless"
+	"github.com/daeuniverse/outbound/protocol/vmess"
+	"github.com/daeuniverse/outbound/transport/tls"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/common"
+)
+
+func init() {
+	protocol.Register("vless+reality", NewDialer)
+}
+
+// Dialer is a VLESS client over REALITY, which is used to relay passages to
+// vless+reality servers.
+type Dialer struct {
+	proxyAddress  string
+	realityDialer netproxy.Dialer
+	vlessDialer   netproxy.Dialer
+	key           []byte
+}
+
+// NewDialer reads the REALITY parameters from the cipher of the header, which
+// is the method of the argument registered to SweetLisa.
+func NewDialer(nextDialer netproxy.Dialer, header protocol.Header) (netproxy.Dialer, error) {
+	if nextDialer == nil {
+		return nil, fmt.Errorf("nil next dialer")
+	}
+	sni := header.SNI
+	if sni == "" {
+		sni = common.SimplyGetParam(header.Cipher, "sni")
+	}
+	sid, _, _ := strings.Cut(common.SimplyGetParam(header.Cipher, "sid"), ",")
+	link := url.URL{
+		Scheme: "reality",
+		Host:   header.ProxyAddress,
+		RawQuery: url.Values{
+			"sni": []string{sni},
+			"sid": []string{sid},
+			"pbk": []string{common.SimplyGetParam(header.Cipher, "pbk")},
+			"fp":  []string{"chrome"},
+		}.Encode(),
+	}
+	realityDialer, err := tls.NewReality(link.String(), nextDialer)
+	if err != nil {
+		return nil, err
+	}
+	key, err := vless.Password2Key(header.Password)
+	if err != nil {
+		return nil, err
+	}
+	vlessDialer, err := vless.NewDialer(realityDialer, protocol.Header{
+		ProxyAddress: header.ProxyAddress,
+		Feature1:     "",
+		Password:     header.Password,
+		IsClient:     true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Dialer{
+		proxyAddress:  header.ProxyAddress,
+		realityDialer: realityDialer,
+		vlessDialer:   vlessDialer,
+		key:           key,
+	}, nil
+}
+
+func (d *Dialer) Dial(network string, addr string) (netproxy.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network string, addr string) (netproxy.Conn, error) {
+	return d.vlessDialer.DialContext(ctx, network, addr)
+}
+
+func (d *Dialer) DialCmdMsg(cmd protocol.MetadataCmd) (netproxy.Conn, error) {
+	return d.DialCmdMsgContext(context.Background(), cmd)
+}
+
+func (d *Dialer) DialCmdMsgContext(ctx context.Context, cmd protocol.MetadataCmd) (netproxy.Conn, error) {
+	conn, err := d.realityDialer.DialContext(ctx, "tcp", d.proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+	vConn, err := vless.NewConn(conn, vless.Metadata{
+		Metadata: vmess.Metadata{
+			Metadata: protocol.Metadata{
+				Type:     protocol.MetadataTypeMsg,
+				Cmd:      cmd,
+				IsClient: true,
+			},
+			Network: "tcp",
+		},
+	}, d.key)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return vConn, nil
+}
@@ -0,0 +1,260 @@
+package vless
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+)
+
+// The handshake of authenticated clients mirrors the one dest answers the
+// same ClientHello with: the ServerHello is that of dest with our random and
+// key share, the encrypted flight is padded to the record sizes of dest, and
+// the ALPN is the one dest negotiates. Otherwise, they could be told apart
+// from the site REALITY borrows.
+
+const (
+	// maxFlightRecords bounds the encrypted records of dest to mirror.
+	maxFlightRecords = 16
+	// alpnCacheTimeout is how long the ALPN negotiated by dest is cached.
+	alpnCacheTimeout = time.Hour
+)
+
+// helloRetryRequestRandom is the random of a HelloRetryRequest.
+var helloRetryRequestRandom = []byte{
+	0xCF, 0x21, 0xAD, 0x74, 0xE5, 0x9A, 0x61, 0x11,
+	0xBE, 0x1D, 0x8C, 0x02, 0x1E, 0x65, 0xB8, 0x91,
+	0xC2, 0xA2, 0x11, 0x16, 0x7A, 0xBB, 0x8C, 0x5E,
+	0x07, 0x9E, 0x09, 0xE2, 0xC8, 0xA8, 0x33, 0x9C,
+}
+
+// destFlight is the first flight of dest.
+type destFlight struct {
+	// serverHello is nil if it cannot be mirrored, such as a key share of a
+	// group other than x25519, and so is the rest.
+	serverHello []byte
+	suite       uint16
+	// keyShareOffset is the offset of the x25519 key share in serverHello.
+	keyShareOffset int
+	ccs            bool
+	// records are the lengths of the encrypted handshake records.
+	records []int
+}
+
+// marshalServerHello returns the ServerHello of dest with the random and the
+// key share replaced.
+func (f *destFlight) marshalServerHello(random []byte, publicKey []byte) []byte {
+	serverHello := bytes.Clone(f.serverHello)
+	copy(serverHello[6:38], random)
+	copy(serverHello[f.keyShareOffset:], publicKey)
+	return serverHello
+}
+
+// fetchDestFlight sends the ClientHello to dest and reads its first flight.
+func fetchDestFlight(dest string, clientHello []byte, sessionId []byte) (*destFlight, error) {
+	conn, err := net.DialTimeout("tcp", dest, server.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	start := time.Now()
+	_ = conn.SetDeadline(start.Add(handshakeTimeout))
+	if _, err = conn.Write(clientHello); err != nil {
+		return nil, err
+	}
+
+	var msg []byte
+	for len(msg) < 4 || len(msg) < 4+(int(msg[1])<<16|int(msg[2])<<8|int(msg[3])) {
+		header, body, err := readRecord(conn)
+		if err != nil {
+			return nil, err
+		}
+		if header[0] != recordTypeHandshake {
+			return nil, fmt.Errorf("unexpected record type %v from dest", header[0])
+		}
+		msg = append(msg, body...)
+	}
+	if msg[0] != 2 {
+		return nil, fmt.Errorf("unexpected handshake type %v from dest", msg[0])
+	}
+	msgLen := 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+	flight := parseDestServerHello(msg[:msgLen], sessionId)
+	if flight.serverHello == nil {
+		// the rest is up to the ServerHello we do not mirror
+		return flight, nil
+	}
+
+	// The flight of dest arrives in a burst, and it ends once dest is quiet
+	// for a while.
+	quiet := min(max(time.Since(start)/2, 10*time.Millisecond), time.Second)
+	for len(flight.records) < maxFlightRecords {
+		header, body, err := readRecord(conn)
+		if err != nil {
+			var netErr net.Error
+			if len(flight.records) > 0 && errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			return nil, err
+		}
+		switch header[0] {
+		case recordTypeChangeCipherSpec:
+			flight.ccs = true
+		case recordTypeApplicationData:
+			flight.records = append(flight.records, len(body))
+			_ = conn.SetReadDeadline(time.Now().Add(quiet))
+		default:
+			return nil, fmt.Errorf("unexpected record type %v from dest", header[0])
+		}
+	}
+	return flight, nil
+}
+
+// parseDestServerHello returns the flight with the ServerHello if it can be
+// mirrored.
+func parseDestServerHello(msg []byte, sessionId []byte) *destFlight {
+	flight := &destFlight{}
+	s := cryptoString(msg[4:])
+	var random []byte
+	var echoedSessionId, extensions cryptoString
+	var suite uint16
+	if !s.skip(2) ||
+		!s.read(32, &random) ||
+		!s.readU8LengthPrefixed(&echoedSessionId) ||
+		!s.readU16(&suite) ||
+		!s.skip(1) ||
+		!s.readU16LengthPrefixed(&extensions) {
+		return flight
+	}
+	if bytes.Equal(random, helloRetryRequestRandom) || !bytes.Equal(echoedSessionId, sessionId) || selectTLS13Suite([]uint16{suite}) == nil {
+		return flight
+	}
+	keyShareOffset := 0
+	for len(extensions) > 0 {
+		var typ, group uint16
+		var data, key cryptoString
+		if !extensions.readU16(&typ) || !extensions.readU16LengthPrefixed(&data) {
+			return flight
+		}
+		switch typ {
+		case extensionKeyShare:
+			if !data.readU16(&group) || !data.readU16LengthPrefixed(&key) || group != groupX25519 || len(key) != 32 || len(data) != 0 {
+				return flight
+			}
+			keyShareOffset = len(msg) - len(extensions) - len(key)
+		case extensionPreSharedKey:
+			return flight
+		}
+	}
+	if keyShareOffset == 0 {
+		return flight
+	}
+	flight.serverHello = msg
+	flight.suite = suite
+	flight.keyShareOffset = keyShareOffset
+	return flight
+}
+
+type alpnEntry struct {
+	protocol  string
+	expiresAt time.Time
+}
+
+// alpnCache caches the ALPN dest negotiates for each server name and the
+// protocols offered.
+type alpnCache struct {
+	mu      sync.Mutex
+	entries map[string]alpnEntry
+}
+
+// negotiate returns the ALPN dest negotiates with the protocols, which is
+// probed by a TLS connection to dest if it is not cached.
+func (c *alpnCache) negotiate(dest string, serverName string, protocols []string) (string, error) {
+	if len(protocols) == 0 {
+		return "", nil
+	}
+	key := serverName + "\x00" + strings.Join(protocols, "\x00")
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.protocol, nil
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: server.DialTimeout}, "tcp", dest, &tls.Config{
+		ServerName: serverName,
+		NextProtos: protocols,
+		// only the ALPN is wanted, and nothing is sent over it
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return "", err
+	}
+	protocol := conn.ConnectionState().NegotiatedProtocol
+	_ = conn.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]alpnEntry)
+	}
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expiresAt) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = alpnEntry{protocol: protocol, expiresAt: now.Add(alpnCacheTimeout)}
+	return protocol, nil
+}
+
+// mirror fetches the flight and the ALPN of dest for the ClientHello. The
+// handshake falls back to the default layout without them if dest fails.
+func (c *realityConfig) mirror(hello *clientHello, consumed []byte) (flight *destFlight, alpn string) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var err error
+		if alpn, err = c.alpn.negotiate(c.dest, hello.serverName, hello.alpnProtocols); err != nil {
+			log.Debug("vless: failed to probe the ALPN of dest %v: %v", c.dest, err)
+		}
+	}()
+	flight, err := fetchDestFlight(c.dest, consumed, hello.sessionId)
+	if err != nil {
+		log.Debug("vless: failed to fetch the flight of dest %v: %v", c.dest, err)
+	} else if flight.serverHello == nil {
+		log.Debug("vless: the flight of dest %v cannot be mirrored", c.dest)
+		flight = nil
+	}
+	wg.Wait()
+	return flight, alpn
+}
+
+// sealFlight seals the handshake messages into records of the sizes, padded
+// with zeros. The messages beyond the sizes go into more records.
+func (h *halfConn) sealFlight(msgs []byte, sizes []int) []byte {
+	var flight []byte
+	for i, size := range sizes {
+		capacity := size - 1 - h.aead.Overhead()
+		if capacity <= 0 || capacity > maxPlaintext || len(msgs) == 0 {
+			break
+		}
+		// leave a byte for each record left, as handshake records must not
+		// be empty
+		n := max(min(capacity, len(msgs)-(len(sizes)-1-i)), 1)
+		flight = append(flight, h.sealPadded(recordTypeHandshake, msgs[:n], capacity-n)...)
+		msgs = msgs[n:]
+	}
+	for len(msgs) > 0 {
+		n := min(len(msgs), maxPlaintext)
+		flight = append(flight, h.seal(recordTypeHandshake, msgs[:n])...)
+		msgs = msgs[n:]
+	}
+	return flight
+}
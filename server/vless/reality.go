@@ -0,0 +1,455 @@
+package vless
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	recordTypeChangeCipherSpec = 20
+	recordTypeAlert            = 21
+	recordTypeHandshake        = 22
+	recordTypeApplicationData  = 23
+
+	handshakeTypeClientHello = 1
+
+	extensionServerName        = 0
+	extensionALPN              = 16
+	extensionPreSharedKey      = 41
+	extensionSupportedVersions = 43
+	extensionKeyShare          = 51
+
+	groupX25519 = 0x001d
+
+	maxClientHelloLen = 1 << 16
+)
+
+var (
+	ErrNotReality            = errors.New("not a REALITY client")
+	ErrRealityConfigRequired = errors.New("vless reality config is required")
+)
+
+type realityConfigContextKey struct{}
+
+func WithRealityConfig(ctx context.Context, conf config.Reality) context.Context {
+	return context.WithValue(ctx, realityConfigContextKey{}, conf)
+}
+
+func realityConfigFromContext(ctx context.Context) (*realityConfig, error) {
+	conf, ok := ctx.Value(realityConfigContextKey{}).(config.Reality)
+	if !ok {
+		return nil, ErrRealityConfigRequired
+	}
+	return newRealityConfig(conf)
+}
+
+type realityConfig struct {
+	conf        config.Reality
+	dest        string
+	serverNames map[string]struct{}
+	privateKey  *ecdh.PrivateKey
+	shortIds    map[[8]byte]struct{}
+	maxTimeDiff time.Duration
+	cert        *realityCertificate
+	alpn        alpnCache
+}
+
+func newRealityConfig(conf config.Reality) (*realityConfig, error) {
+	if _, _, err := net.SplitHostPort(conf.Dest); err != nil {
+		return nil, fmt.Errorf("invalid REALITY dest %q: %w", conf.Dest, err)
+	}
+	privateKey, err := ParsePrivateKey(conf.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	c := &realityConfig{
+		conf:        conf,
+		dest:        conf.Dest,
+		serverNames: make(map[string]struct{}),
+		privateKey:  privateKey,
+		shortIds:    make(map[[8]byte]struct{}),
+		maxTimeDiff: time.Duration(conf.MaxTimeDiff) * time.Second,
+	}
+	for _, name := range realityServerNames(conf) {
+		c.serverNames[strings.ToLower(name)] = struct{}{}
+	}
+	for _, sid := range strings.Split(conf.ShortIds, ",") {
+		shortId, err := ParseShortId(strings.TrimSpace(sid))
+		if err != nil {
+			return nil, err
+		}
+		c.shortIds[shortId] = struct{}{}
+	}
+	if c.cert, err = newRealityCertificate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// method describes the parameters clients need, which is exposed to SweetLisa
+// as the method of the argument.
+func (c *realityConfig) method() string {
+	var shortIds []string
+	for _, sid := range strings.Split(c.conf.ShortIds, ",") {
+		shortIds = append(shortIds, strings.TrimSpace(sid))
+	}
+	return strings.Join([]string{
+		"pbk=" + base64.RawURLEncoding.EncodeToString(c.privateKey.PublicKey().Bytes()),
+		"sid=" + strings.Join(shortIds, ","),
+		"sni=" + realityServerNames(c.conf)[0],
+		// xtls-rprx-vision is not supported
+		"flow=",
+	}, ";")
+}
+
+// realityServerNames returns the server names that clients may put in the SNI.
+// It defaults to the host of dest.
+func realityServerNames(conf config.Reality) []string {
+	var names []string
+	for _, name := range strings.Split(conf.ServerNames, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		host, _, _ := net.SplitHostPort(conf.Dest)
+		names = append(names, host)
+	}
+	return names
+}
+
+// GenerateKeyPair generates a x25519 key pair for REALITY. Keys are encoded in
+// unpadded base64 URL encoding, which is the format used by clients.
+func GenerateKeyPair() (privateKey string, publicKey string, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(key.Bytes()),
+		base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+func ParsePrivateKey(s string) (*ecdh.PrivateKey, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REALITY private key: %w", err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REALITY private key: %w", err)
+	}
+	return key, nil
+}
+
+// GenerateShortId generates a random short-id of 8 bytes in hex.
+func GenerateShortId() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// ParseShortId parses a hex short-id of up to 16 characters. Shorter ids are
+// padded with zeros like clients do.
+func ParseShortId(s string) (shortId [8]byte, err error) {
+	if len(s) > 16 || len(s)%2 != 0 {
+		return shortId, fmt.Errorf("invalid REALITY short-id %q: length should be an even number no more than 16", s)
+	}
+	if _, err = hex.Decode(shortId[:], []byte(s)); err != nil {
+		return shortId, fmt.Errorf("invalid REALITY short-id %q: %w", s, err)
+	}
+	return shortId, nil
+}
+
+type clientHello struct {
+	raw           []byte
+	random        []byte
+	sessionId     []byte
+	cipherSuites  []uint16
+	serverName    string
+	alpnProtocols []string
+	supportsTLS13 bool
+	x25519Share   []byte
+}
+
+// readClientHello reads the ClientHello from r. The bytes read are always
+// returned so that they can be replayed to the dest.
+func readClientHello(r io.Reader) (consumed []byte, hello *clientHello, err error) {
+	var msg []byte
+	for {
+		var header [5]byte
+		if _, err = io.ReadFull(r, header[:]); err != nil {
+			return consumed, nil, err
+		}
+		consumed = append(consumed, header[:]...)
+		if header[0] != recordTypeHandshake {
+			return consumed, nil, ErrNotReality
+		}
+		length := int(binary.BigEndian.Uint16(header[3:]))
+		start := len(consumed)
+		consumed = append(consumed, make([]byte, length)...)
+		if _, err = io.ReadFull(r, consumed[start:]); err != nil {
+			return consumed, nil, err
+		}
+		msg = append(msg, consumed[start:]...)
+		if len(msg) < 4 {
+			continue
+		}
+		if msg[0] != handshakeTypeClientHello {
+			return consumed, nil, ErrNotReality
+		}
+		msgLen := 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+		if msgLen > maxClientHelloLen {
+			return consumed, nil, ErrNotReality
+		}
+		if len(msg) >= msgLen {
+			hello, err = parseClientHello(msg[:msgLen])
+			return consumed, hello, err
+		}
+	}
+}
+
+func parseClientHello(raw []byte) (*clientHello, error) {
+	hello := &clientHello{raw: raw}
+	s := cryptoString(raw[4:])
+	var sessionId, cipherSuites, compression, extensions cryptoString
+	if !s.skip(2) ||
+		!s.read(32, &hello.random) ||
+		!s.readU8LengthPrefixed(&sessionId) ||
+		!s.readU16LengthPrefixed(&cipherSuites) ||
+		!s.readU8LengthPrefixed(&compression) {
+		return nil, ErrNotReality
+	}
+	hello.sessionId = sessionId
+	for len(cipherSuites) >= 2 {
+		hello.cipherSuites = append(hello.cipherSuites, binary.BigEndian.Uint16(cipherSuites))
+		cipherSuites = cipherSuites[2:]
+	}
+	if len(s) == 0 {
+		return hello, nil
+	}
+	if !s.readU16LengthPrefixed(&extensions) {
+		return nil, ErrNotReality
+	}
+	for len(extensions) > 0 {
+		var typ uint16
+		var data cryptoString
+		if !extensions.readU16(&typ) || !extensions.readU16LengthPrefixed(&data) {
+			return nil, ErrNotReality
+		}
+		switch typ {
+		case extensionServerName:
+			var list, name cryptoString
+			var nameType uint8
+			if !data.readU16LengthPrefixed(&list) {
+				return nil, ErrNotReality
+			}
+			for len(list) > 0 {
+				if !list.readU8(&nameType) || !list.readU16LengthPrefixed(&name) {
+					return nil, ErrNotReality
+				}
+				if nameType == 0 {
+					hello.serverName = string(name)
+				}
+			}
+		case extensionALPN:
+			var list, proto cryptoString
+			if !data.readU16LengthPrefixed(&list) {
+				return nil, ErrNotReality
+			}
+			for len(list) > 0 {
+				if !list.readU8LengthPrefixed(&proto) {
+					return nil, ErrNotReality
+				}
+				hello.alpnProtocols = append(hello.alpnProtocols, string(proto))
+			}
+		case extensionSupportedVersions:
+			var versions cryptoString
+			if !data.readU8LengthPrefixed(&versions) {
+				return nil, ErrNotReality
+			}
+			for len(versions) >= 2 {
+				if binary.BigEndian.Uint16(versions) == tls.VersionTLS13 {
+					hello.supportsTLS13 = true
+				}
+				versions = versions[2:]
+			}
+		case extensionKeyShare:
+			var shares cryptoString
+			if !data.readU16LengthPrefixed(&shares) {
+				return nil, ErrNotReality
+			}
+			for len(shares) > 0 {
+				var group uint16
+				var key cryptoString
+				if !shares.readU16(&group) || !shares.readU16LengthPrefixed(&key) {
+					return nil, ErrNotReality
+				}
+				if group == groupX25519 && len(key) == 32 {
+					hello.x25519Share = key
+				}
+			}
+		}
+	}
+	return hello, nil
+}
+
+// authenticate verifies the session id of a REALITY ClientHello and returns
+// the auth key shared with the client.
+func (c *realityConfig) authenticate(hello *clientHello) ([]byte, error) {
+	if !hello.supportsTLS13 || len(hello.sessionId) != 32 || hello.x25519Share == nil {
+		return nil, ErrNotReality
+	}
+	if _, ok := c.serverNames[strings.ToLower(hello.serverName)]; !ok {
+		return nil, fmt.Errorf("%w: unexpected server name %q", ErrNotReality, hello.serverName)
+	}
+	peerKey, err := ecdh.X25519().NewPublicKey(hello.x25519Share)
+	if err != nil {
+		return nil, ErrNotReality
+	}
+	authKey, err := c.privateKey.ECDH(peerKey)
+	if err != nil {
+		return nil, ErrNotReality
+	}
+	if _, err = io.ReadFull(hkdf.New(sha256.New, authKey, hello.random[:20], []byte("REALITY")), authKey); err != nil {
+		return nil, err
+	}
+	var aead cipher.AEAD
+	if aesgcmPreferred(hello.cipherSuites) {
+		block, _ := aes.NewCipher(authKey)
+		aead, _ = cipher.NewGCM(block)
+	} else {
+		aead, _ = chacha20poly1305.New(authKey)
+	}
+	// The session id is zeroed in the additional data.
+	aad := make([]byte, len(hello.raw))
+	copy(aad, hello.raw)
+	copy(aad[39:], make([]byte, 32))
+	plain, err := aead.Open(nil, hello.random[20:], hello.sessionId, aad)
+	if err != nil {
+		return nil, ErrNotReality
+	}
+	if c.maxTimeDiff > 0 {
+		t := time.Unix(int64(binary.BigEndian.Uint32(plain[4:8])), 0)
+		if d := time.Since(t); d > c.maxTimeDiff || d < -c.maxTimeDiff {
+			return nil, fmt.Errorf("%w: time difference %v is too large", ErrNotReality, d)
+		}
+	}
+	var shortId [8]byte
+	copy(shortId[:], plain[8:16])
+	if _, ok := c.shortIds[shortId]; !ok {
+		return nil, fmt.Errorf("%w: unknown short-id %v", ErrNotReality, hex.EncodeToString(shortId[:]))
+	}
+	return authKey, nil
+}
+
+var aesgcmCiphers = map[uint16]bool{
+	tls.TLS_AES_128_GCM_SHA256:                  true,
+	tls.TLS_AES_256_GCM_SHA384:                  true,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   true,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: true,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:   true,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: true,
+}
+
+// aesgcmPreferred reports whether the first known cipher suite of the client
+// is AES-GCM, which is how REALITY clients choose the session id cipher.
+func aesgcmPreferred(ciphers []uint16) bool {
+	for _, id := range ciphers {
+		if knownCipherSuite(id) {
+			return aesgcmCiphers[id]
+		}
+	}
+	return false
+}
+
+func knownCipherSuite(id uint16) bool {
+	for _, suite := range tls.CipherSuites() {
+		if suite.ID == id {
+			return true
+		}
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// cryptoString is a minimal reader of TLS vectors.
+type cryptoString []byte
+
+func (s *cryptoString) skip(n int) bool {
+	if len(*s) < n {
+		return false
+	}
+	*s = (*s)[n:]
+	return true
+}
+
+func (s *cryptoString) read(n int, out *[]byte) bool {
+	if len(*s) < n {
+		return false
+	}
+	*out = (*s)[:n]
+	*s = (*s)[n:]
+	return true
+}
+
+func (s *cryptoString) readU8(out *uint8) bool {
+	if len(*s) < 1 {
+		return false
+	}
+	*out = (*s)[0]
+	*s = (*s)[1:]
+	return true
+}
+
+func (s *cryptoString) readU16(out *uint16) bool {
+	if len(*s) < 2 {
+		return false
+	}
+	*out = binary.BigEndian.Uint16(*s)
+	*s = (*s)[2:]
+	return true
+}
+
+func (s *cryptoString) readU8LengthPrefixed(out *cryptoString) bool {
+	var n uint8
+	var b []byte
+	if !s.readU8(&n) || !s.read(int(n), &b) {
+		return false
+	}
+	*out = b
+	return true
+}
+
+func (s *cryptoString) readU16LengthPrefixed(out *cryptoString) bool {
+	var n uint16
+	var b []byte
+	if !s.readU16(&n) || !s.read(int(n), &b) {
+		return false
+	}
+	*out = b
+	return true
+}
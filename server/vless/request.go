@@ -0,0 +1,235 @@
+package vless
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/outbound/pool"
+	"github.com/daeuniverse/outbound/protocol"
+	"github.com/daeuniverse/outbound/protocol/vless"
+	"github.com/daeuniverse/outbound/protocol/vmess"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
+	jsoniter "github.com/json-iterator/go"
+	"google.golang.org/protobuf/proto"
+)
+
+const maxPacketSize = 65535
+
+// responseHeader is the VLESS response header: version 0 without addons.
+var responseHeader = []byte{0, 0}
+
+// readRequest reads the VLESS request header:
+// Version | UUID | Addons Length | Addons | Cmd | Port | ATYP | Address
+func (s *Server) readRequest(r io.Reader) (*Passage, *vmess.Metadata, error) {
+	var buf [18]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return nil, nil, err
+	}
+	if buf[0] != 0 {
+		return nil, nil, fmt.Errorf("%w: unexpected vless version: %v", protocol.ErrFailAuth, buf[0])
+	}
+	s.mutex.Lock()
+	passage, ok := s.users[[16]byte(buf[1:17])]
+	s.mutex.Unlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: unknown vless uuid", protocol.ErrFailAuth)
+	}
+	if buf[17] > 0 {
+		addonsBytes := make([]byte, buf[17])
+		if _, err := io.ReadFull(r, addonsBytes); err != nil {
+			return nil, nil, err
+		}
+		var addons vless.Addons
+		if err := proto.Unmarshal(addonsBytes, &addons); err != nil {
+			return nil, nil, fmt.Errorf("invalid vless addons: %w", err)
+		}
+		if addons.Flow != "" {
+			return nil, nil, fmt.Errorf("unsupported vless flow: %v. Only the empty flow is supported", addons.Flow)
+		}
+	}
+
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, nil, err
+	}
+	mdata := &vmess.Metadata{Network: vmess.ParseNetwork(head[0])}
+	if mdata.Network == "invalid" {
+		return nil, nil, fmt.Errorf("unsupported vless command: %v", head[0])
+	}
+	mdata.Port = binary.BigEndian.Uint16(head[1:3])
+	mdata.Type = vmess.ParseMetadataType(head[3])
+	switch mdata.Type {
+	case protocol.MetadataTypeIPv4, protocol.MetadataTypeIPv6:
+		ip := make([]byte, 4)
+		if mdata.Type == protocol.MetadataTypeIPv6 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return nil, nil, err
+		}
+		mdata.Hostname = net.IP(ip).String()
+	case protocol.MetadataTypeDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return nil, nil, err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return nil, nil, err
+		}
+		mdata.Hostname = string(domain)
+	case protocol.MetadataTypeMsg:
+		var cmd [1]byte
+		if _, err := io.ReadFull(r, cmd[:]); err != nil {
+			return nil, nil, err
+		}
+		mdata.Cmd = protocol.MetadataCmd(cmd[0])
+	default:
+		return nil, nil, fmt.Errorf("%w: invalid type: %v", vmess.ErrInvalidMetadata, head[3])
+	}
+	return &passage, mdata, nil
+}
+
+func (s *Server) handleMsg(conn *realityConn, reqMetadata *vmess.Metadata, passage *Passage) error {
+	if !passage.Manager {
+		return fmt.Errorf("handleMsg: illegal message received from a non-manager passage")
+	}
+	log.Trace("handleMsg(vless): cmd: %v", reqMetadata.Cmd)
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+		return err
+	}
+	reqBody := make([]byte, int(binary.BigEndian.Uint32(lenBuf[:])))
+	if _, err := io.ReadFull(conn, reqBody); err != nil {
+		return err
+	}
+
+	var resp []byte
+	switch reqMetadata.Cmd {
+	case protocol.MetadataCmdPing:
+		if !bytes.Equal(reqBody, []byte("ping")) {
+			log.Warn("the body of received ping message is %v instead of %v", strconv.Quote(string(reqBody)), strconv.Quote("ping"))
+		}
+		s.setLastAlive(time.Now())
+		pingResp, err := server.GeneratePingResp()
+		if err != nil {
+			return err
+		}
+		resp, err = jsoniter.Marshal(pingResp)
+		if err != nil {
+			return err
+		}
+	case protocol.MetadataCmdSyncPassages:
+		var passages []model.Passage
+		if err := jsoniter.Unmarshal(reqBody, &passages); err != nil {
+			return err
+		}
+		serverPassages := make([]server.Passage, 0, len(passages))
+		for _, passage := range passages {
+			serverPassages = append(serverPassages, server.Passage{Passage: passage})
+		}
+		log.Info("Server asked to SyncPassages")
+		if err := s.SyncPassages(serverPassages); err != nil {
+			return err
+		}
+		resp = []byte("OK")
+	default:
+		return fmt.Errorf("%w: unexpected metadata cmd type: %v", protocol.ErrFailAuth, reqMetadata.Cmd)
+	}
+	buf := make([]byte, len(responseHeader)+4+len(resp))
+	copy(buf, responseHeader)
+	binary.BigEndian.PutUint32(buf[len(responseHeader):], uint32(len(resp)))
+	copy(buf[len(responseHeader)+4:], resp)
+	_, err := conn.Write(buf)
+	return err
+}
+
+// handleUDP relays the packets of a VLESS UDP request, each of which is
+// prefixed by its 2-byte length.
+func (s *Server) handleUDP(lConn *realityConn, dialer netproxy.Dialer, target string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), server.DialTimeout)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, "udp", target)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil // ignore i/o timeout
+		}
+		return err
+	}
+	rConn, ok := conn.(netproxy.PacketConn)
+	if !ok {
+		_ = conn.Close()
+		return fmt.Errorf("dialer returned %T for udp", conn)
+	}
+	defer rConn.Close()
+	if _, err = lConn.Write(responseHeader); err != nil {
+		return err
+	}
+
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- relayPacketsToPacketConn(rConn, lConn, target)
+	}()
+	go func() {
+		errCh <- relayPacketConnToPackets(lConn, rConn)
+	}()
+	if err = <-errCh; isIgnorableUDPError(err) {
+		return nil
+	}
+	return fmt.Errorf("relay udp error: %w", err)
+}
+
+func relayPacketsToPacketConn(dst netproxy.PacketConn, src *realityConn, target string) error {
+	buf := pool.Get(maxPacketSize)
+	defer pool.Put(buf)
+	for {
+		_ = src.SetReadDeadline(time.Now().Add(server.DefaultNatTimeout))
+		if _, err := io.ReadFull(src, buf[:2]); err != nil {
+			return err
+		}
+		n := int(binary.BigEndian.Uint16(buf))
+		if _, err := io.ReadFull(src, buf[:n]); err != nil {
+			return err
+		}
+		_ = dst.SetWriteDeadline(time.Now().Add(server.DefaultNatTimeout)) // should keep consistent
+		if _, err := dst.WriteTo(buf[:n], target); err != nil {
+			return err
+		}
+	}
+}
+
+func relayPacketConnToPackets(dst *realityConn, src netproxy.PacketConn) error {
+	buf := pool.Get(2 + maxPacketSize)
+	defer pool.Put(buf)
+	for {
+		_ = src.SetReadDeadline(time.Now().Add(server.DefaultNatTimeout))
+		n, _, err := src.ReadFrom(buf[2:])
+		if err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint16(buf, uint16(n))
+		_ = dst.SetWriteDeadline(time.Now().Add(server.DefaultNatTimeout))
+		if _, err = dst.Write(buf[:2+n]); err != nil {
+			return err
+		}
+	}
+}
+
+func isIgnorableUDPError(err error) bool {
+	if err == nil || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
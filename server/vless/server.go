@@ -0,0 +1,484 @@
+package vless
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/outbound/protocol"
+	"github.com/daeuniverse/outbound/protocol/vless"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/api"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/common"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
+	gonanoid "github.com/matoous/go-nanoid"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+func init() {
+	server.Register(string(server.ProtocolVlessReality), NewJohn)
+}
+
+type Server struct {
+	dialer  netproxy.Dialer
+	reality *realityConfig
+
+	sweetLisa config.Lisa
+	arg       server.Argument
+
+	mutex    sync.Mutex
+	passages []Passage
+	users    map[[16]byte]Passage
+
+	passageContentionCache *server.ContentionCache
+	lastAliveMu            sync.RWMutex
+	lastAlive              time.Time
+
+	lifecycleMu sync.Mutex
+	closeOnce   sync.Once
+	closed      bool
+	ctx         context.Context
+	cancel      context.CancelFunc
+	listener    net.Listener
+	activeConns map[net.Conn]struct{}
+}
+
+type Passage struct {
+	server.Passage
+	key [16]byte
+}
+
+func New(valueCtx context.Context, dialer netproxy.Dialer) (server.Server, error) {
+	reality, err := realityConfigFromContext(valueCtx)
+	if err != nil {
+		return nil, err
+	}
+	return newServer(dialer, reality), nil
+}
+
+func newServer(dialer netproxy.Dialer, reality *realityConfig) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		dialer:      dialer,
+		reality:     reality,
+		users:       make(map[[16]byte]Passage),
+		ctx:         ctx,
+		cancel:      cancel,
+		activeConns: make(map[net.Conn]struct{}),
+	}
+}
+
+func NewJohn(valueCtx context.Context, dialer netproxy.Dialer, sweetLisa config.Lisa, arg server.Argument) (server.Server, error) {
+	reality, err := newRealityConfig(config.ParamsObj.John.Reality)
+	if err != nil {
+		return nil, err
+	}
+	john := newServer(dialer, reality)
+	john.sweetLisa = sweetLisa
+	john.arg = arg
+	john.passageContentionCache = server.NewContentionCache()
+	if err := john.AddPassages([]server.Passage{{Manager: true}}); err != nil {
+		return nil, err
+	}
+	if err := john.register(); err != nil {
+		return nil, err
+	}
+	go john.registerBackground()
+	go server.RotateManager(john, john.register, john.ctx.Done())
+	return john, nil
+}
+
+func (s *Server) Listen(addr string) error {
+	lt, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.serveListener(lt)
+}
+
+func (s *Server) serveListener(lt net.Listener) error {
+	if !s.setListener(lt) {
+		_ = lt.Close()
+		return nil
+	}
+	defer s.clearListener(lt)
+	for {
+		conn, err := lt.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if !s.trackConn(conn) {
+			_ = conn.Close()
+			continue
+		}
+		go func(conn net.Conn) {
+			defer s.untrackConn(conn)
+			if err := s.handleConn(conn); err != nil {
+				if errors.Is(err, server.ErrPassageAbuse) ||
+					errors.Is(err, protocol.ErrFailAuth) {
+					log.Warn("vless handleConn: %v", err)
+				} else {
+					log.Info("vless handleConn: %v", err)
+				}
+			}
+		}(conn)
+	}
+}
+
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		s.lifecycleMu.Lock()
+		s.closed = true
+		if s.cancel != nil {
+			s.cancel()
+		}
+		listener := s.listener
+		s.listener = nil
+		activeConns := make([]net.Conn, 0, len(s.activeConns))
+		for conn := range s.activeConns {
+			activeConns = append(activeConns, conn)
+		}
+		s.activeConns = make(map[net.Conn]struct{})
+		s.lifecycleMu.Unlock()
+		if listener != nil {
+			err = listener.Close()
+		}
+		for _, conn := range activeConns {
+			_ = conn.Close()
+		}
+	})
+	return err
+}
+
+func (s *Server) AddPassages(passages []server.Passage) error {
+	local, _ := LocalizePassages(passages)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if server.ReplacesManagers(passages) {
+		s.removePassagesFuncLocked(func(p *Passage) bool { return p.Manager })
+	}
+	for _, passage := range local {
+		s.passages = append(s.passages, passage)
+	}
+	s.rebuildUsersLocked()
+	return nil
+}
+
+func (s *Server) RemovePassages(passages []server.Passage, alsoManager bool) error {
+	local, _ := LocalizePassages(passages)
+	keySet := make(map[string]struct{}, len(local))
+	for _, passage := range local {
+		if passage.Manager && !alsoManager {
+			continue
+		}
+		keySet[passage.In.Argument.Hash()] = struct{}{}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.removePassagesFuncLocked(func(p *Passage) bool {
+		_, ok := keySet[p.In.Argument.Hash()]
+		return ok
+	})
+	s.rebuildUsersLocked()
+	return nil
+}
+
+func (s *Server) SyncPassages(passages []server.Passage) error {
+	return server.SyncPassages(s, passages)
+}
+
+func (s *Server) Passages() (passages []server.Passage) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, passage := range s.passages {
+		passages = append(passages, passage.Passage)
+	}
+	return passages
+}
+
+func LocalizePassages(passages []server.Passage) ([]Passage, *Passage) {
+	passages = server.LocalizeManagers(passages, func(passage *server.Passage) {
+		passage.In.Password, _ = gonanoid.Generate(common.Alphabet, 23)
+	})
+	local := make([]Passage, 0, len(passages))
+	var manager *Passage
+	for _, passage := range passages {
+		key, err := vless.Password2Key(passage.In.Password)
+		if err != nil {
+			log.Warn("vless: skip the passage: %v", err)
+			continue
+		}
+		local = append(local, Passage{Passage: passage, key: [16]byte(key)})
+		if passage.Manager {
+			manager = &local[len(local)-1]
+		}
+	}
+	return local, manager
+}
+
+func (s *Server) removePassagesFuncLocked(f func(*Passage) bool) {
+	for i := len(s.passages) - 1; i >= 0; i-- {
+		if f(&s.passages[i]) {
+			s.passages = append(s.passages[:i], s.passages[i+1:]...)
+		}
+	}
+}
+
+func (s *Server) rebuildUsersLocked() {
+	s.users = make(map[[16]byte]Passage, len(s.passages))
+	for i := range s.passages {
+		s.users[s.passages[i].key] = s.passages[i]
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) error {
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	consumed, hello, err := readClientHello(conn)
+	var authKey []byte
+	if err == nil {
+		authKey, err = s.reality.authenticate(hello)
+	}
+	if err != nil {
+		if errors.Is(err, ErrNotReality) {
+			return s.handleFallback(conn, consumed, err)
+		}
+		return err
+	}
+	flight, alpn := s.reality.mirror(hello, consumed)
+	lConn, err := realityHandshake(conn, hello, authKey, s.reality.cert, flight, alpn)
+	_ = alpn
+	if err != nil {
+		return fmt.Errorf("reality handshake: %w", err)
+	}
+	defer lConn.Close()
+
+	passage, req, err := s.readRequest(lConn)
+	if err != nil {
+		return err
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		if err := s.ContentionCheck(tcpAddr.IP, passage); err != nil {
+			return err
+		}
+	}
+	if req.Type == protocol.MetadataTypeMsg {
+		return s.handleMsg(lConn, req, passage)
+	}
+	if passage.Manager {
+		return fmt.Errorf("%w: manager key is abused for a non-cmd connection", server.ErrPassageAbuse)
+	}
+
+	dialer := s.dialer
+	if passage.Out != nil {
+		header, err := server.GetHeader(*passage.Out, &s.sweetLisa)
+		if err != nil {
+			return err
+		}
+		dialer, err = server.NewDialer(string(passage.Out.Protocol), dialer, header)
+		if err != nil {
+			return err
+		}
+	}
+	target := net.JoinHostPort(req.Hostname, strconv.Itoa(int(req.Port)))
+	switch req.Network {
+	case "tcp":
+		return s.handleTCP(lConn, dialer, target)
+	case "udp":
+		return s.handleUDP(lConn, dialer, target)
+	default:
+		return fmt.Errorf("unexpected network: %v", req.Network)
+	}
+}
+
+// handleFallback relays a connection that is not from a REALITY client to the
+// dest, so that active probes see the real site.
+func (s *Server) handleFallback(conn net.Conn, consumed []byte, authErr error) error {
+	_ = conn.SetReadDeadline(time.Time{})
+	log.Debug("vless: relay the conn from %v to dest %v: %v", conn.RemoteAddr().String(), s.reality.dest, authErr)
+	rConn, err := net.DialTimeout("tcp", s.reality.dest, server.DialTimeout)
+	if err != nil {
+		return fmt.Errorf("%w. Failed to dial dest: %v", authErr, err)
+	}
+	defer rConn.Close()
+	if _, err = rConn.Write(consumed); err != nil {
+		return err
+	}
+	if err = server.RelayTCP(conn, rConn); err != nil {
+		var netErr net.Error
+		if errors.Is(err, io.EOF) || (errors.As(err, &netErr) && netErr.Timeout()) {
+			return nil
+		}
+		return fmt.Errorf("relay dest error: %w", err)
+	}
+	return nil
+}
+
+func (s *Server) handleTCP(lConn *realityConn, dialer netproxy.Dialer, target string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), server.DialTimeout)
+	defer cancel()
+	rConn, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			log.Debug("%v", err)
+			return nil
+		}
+		return err
+	}
+	defer rConn.Close()
+	if _, err = lConn.Write(responseHeader); err != nil {
+		return err
+	}
+	if err = server.RelayTCP(lConn, rConn); err != nil {
+		var netErr net.Error
+		if errors.Is(err, io.EOF) || (errors.As(err, &netErr) && netErr.Timeout()) {
+			return nil
+		}
+		return fmt.Errorf("relay tcp error: %w", err)
+	}
+	return nil
+}
+
+func (s *Server) reRegister() {
+	s.setLastAlive(time.Time{})
+}
+
+func (s *Server) ContentionCheck(thisIP net.IP, passage *Passage) error {
+	if s.passageContentionCache == nil {
+		return nil
+	}
+	contentionDuration := server.ProtectTime[passage.Use()]
+	if contentionDuration > 0 {
+		passageKey := passage.In.Argument.Hash()
+		accept, conflictIP := s.passageContentionCache.Check(passageKey, contentionDuration, thisIP)
+		if !accept {
+			return fmt.Errorf("%w: from %v and %v: contention detected", server.ErrPassageAbuse, thisIP.String(), conflictIP.String())
+		}
+	}
+	return nil
+}
+
+func (s *Server) registerBackground() {
+	interval := 2 * time.Second
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-s.ctx.Done():
+			ticker.Stop()
+			return
+		case <-ticker.C:
+			if time.Since(s.getLastAlive()) < server.LostThreshold {
+				continue
+			}
+			if err := s.register(); err != nil {
+				interval *= 2
+				if interval > 600*time.Second {
+					interval = 600 * time.Second
+				}
+				log.Warn("vless registerBackground: %v. retry in %v", err, interval.String())
+			} else {
+				interval = 2 * time.Second
+			}
+			ticker.Reset(interval)
+		}
+	}
+}
+
+func (s *Server) register() error {
+	manager := server.CurrentManager(s.Passages())
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	t, _ := net.LookupTXT("cdn-validate." + s.sweetLisa.Host)
+	var validateToken string
+	if len(t) > 0 {
+		validateToken = t[0]
+	}
+	bandwidthLimit, err := server.GenerateBandwidthLimit()
+	if err != nil {
+		return err
+	}
+	cdnNames, users, err := api.Register(ctx, s.sweetLisa.Host, validateToken, model.Server{
+		Ticket: s.arg.Ticket,
+		Name:   s.arg.ServerName,
+		Hosts:  s.arg.Hostnames,
+		Port:   s.arg.Port,
+		Argument: model.Argument{
+			Protocol: "vless+reality",
+			Password: manager.In.Password,
+			Method:   s.reality.method(),
+		},
+		BandwidthLimit: bandwidthLimit,
+		NoRelay:        s.arg.NoRelay,
+	})
+	if err != nil {
+		return err
+	}
+	log.Alert("Succeed to register at %v (%v)", strconv.Quote(s.sweetLisa.Host), cdnNames)
+	s.setLastAlive(time.Now())
+	return s.SyncPassages(users)
+}
+
+func (s *Server) setListener(lt net.Listener) bool {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.listener = lt
+	return true
+}
+
+func (s *Server) clearListener(lt net.Listener) {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+	if s.listener == lt {
+		s.listener = nil
+	}
+}
+
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.activeConns == nil {
+		s.activeConns = make(map[net.Conn]struct{})
+	}
+	s.activeConns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+	delete(s.activeConns, conn)
+}
+
+func (s *Server) setLastAlive(t time.Time) {
+	s.lastAliveMu.Lock()
+	defer s.lastAliveMu.Unlock()
+	s.lastAlive = t
+}
+
+func (s *Server) getLastAlive() time.Time {
+	s.lastAliveMu.RLock()
+	defer s.lastAliveMu.RUnlock()
+	return s.lastAlive
+}
@@ -0,0 +1,471 @@
+package vless
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/outbound/protocol"
+	"github.com/daeuniverse/outbound/protocol/direct"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/internal/testutil"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
+)
+
+const testUUID = "b831381d-6324-4d53-ad4f-8cda48b30811"
+
+func TestDialerRelaysTCPThroughServer(t *testing.T) {
+	echoAddr, closeEcho := testutil.StartEchoServer(t)
+	defer closeEcho()
+
+	srv, addr := startVlessServer(t, vlessPassage(testUUID))
+	dialer := newTestDialer(t, srv, addr, testUUID)
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", echoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf), "pong"; got != want {
+		t.Fatalf("echo response = %q, want %q", got, want)
+	}
+}
+
+func TestDialerRelaysUDPThroughServer(t *testing.T) {
+	udpAddr, closeUDP := testutil.StartUDPEchoServer(t)
+	defer closeUDP()
+
+	srv, addr := startVlessServer(t, vlessPassage(testUUID))
+	dialer := newTestDialer(t, srv, addr, testUUID)
+
+	conn, err := dialer.DialContext(context.Background(), "udp", udpAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	packetConn := conn.(netproxy.PacketConn)
+	if _, err := packetConn.WriteTo([]byte("ping"), udpAddr.String()); err != nil {
+		t.Fatal(err)
+	}
+	_ = packetConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	n, _, err := packetConn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "pong" {
+		t.Fatalf("udp response = %q, want %q", string(buf[:n]), "pong")
+	}
+}
+
+func TestDialCmdMsgPing(t *testing.T) {
+	srv, addr := startVlessServer(t, server.Passage{Manager: true})
+	dialer := newTestDialer(t, srv, addr, srv.Passages()[0].In.Password)
+
+	conn, err := dialer.DialCmdMsg(protocol.MetadataCmdPing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := make([]byte, 8)
+	binary.BigEndian.PutUint32(req[:4], 4)
+	copy(req[4:], "ping")
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, req[:4]); err != nil {
+		t.Fatal(err)
+	}
+	if n := binary.BigEndian.Uint32(req[:4]); n == 0 {
+		t.Fatal("empty ping response")
+	} else if n > 4096 {
+		t.Fatalf("ping response too large: %d", n)
+	}
+	if srv.getLastAlive().IsZero() {
+		t.Fatal("lastAlive is not updated by ping")
+	}
+}
+
+func TestUserCannotSendManagerMessage(t *testing.T) {
+	srv, addr := startVlessServer(t, vlessPassage(testUUID))
+	dialer := newTestDialer(t, srv, addr, testUUID)
+
+	conn, err := dialer.DialCmdMsg(protocol.MetadataCmdPing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := make([]byte, 8)
+	binary.BigEndian.PutUint32(req[:4], 4)
+	copy(req[4:], "ping")
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, req[:4]); err == nil {
+		t.Fatal("non-manager passage received a ping response")
+	}
+}
+
+func TestUnauthenticatedHandshakeIsForwardedToDest(t *testing.T) {
+	srv, addr := startVlessServer(t, vlessPassage(testUUID))
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		ServerName:         "localhost",
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.ConnectionState().PeerCertificates[0].Raw; string(got) != string(srv.testDestCert) {
+		t.Fatal("the certificate is not from the dest")
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf), "pong"; got != want {
+		t.Fatalf("dest response = %q, want %q", got, want)
+	}
+}
+
+func TestNonTLSConnectionIsForwardedToDest(t *testing.T) {
+	received := make(chan string, 1)
+	lt, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lt.Close()
+	go func() {
+		conn, err := lt.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 5)
+		n, _ := io.ReadFull(conn, buf)
+		received <- string(buf[:n])
+	}()
+
+	srv, addr := startVlessServer(t, vlessPassage(testUUID))
+	srv.reality.dest = lt.Addr().String()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("GET /")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-received:
+		if got != "GET /" {
+			t.Fatalf("dest received %q, want %q", got, "GET /")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dest received nothing")
+	}
+}
+
+func TestHandshakeMirrorsDest(t *testing.T) {
+	echoAddr, closeEcho := testutil.StartEchoServer(t)
+	defer closeEcho()
+
+	srv, addr := startVlessServer(t, vlessPassage(testUUID))
+	rec := &recordingDialer{Dialer: direct.SymmetricDirect}
+	dialer, err := NewDialer(rec, protocol.Header{
+		ProxyAddress: addr,
+		Cipher:       srv.reality.method(),
+		Password:     testUUID,
+		IsClient:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.DialContext(context.Background(), "tcp", echoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	// what dest answers the same ClientHello with
+	rec.mu.Lock()
+	written, read := bytes.Clone(rec.written.Bytes()), bytes.Clone(rec.read.Bytes())
+	rec.mu.Unlock()
+	consumed, hello, err := readClientHello(bytes.NewReader(written))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flight, err := fetchDestFlight(srv.reality.dest, consumed, hello.sessionId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flight.serverHello == nil {
+		t.Fatal("the flight of dest cannot be mirrored")
+	}
+
+	r := bytes.NewReader(read)
+	header, body, err := readRecord(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != recordTypeHandshake || len(body) != len(flight.serverHello) {
+		t.Fatalf("got a ServerHello of %v bytes, want %v", len(body), len(flight.serverHello))
+	}
+	var records []int
+	for len(records) < len(flight.records) {
+		if header, body, err = readRecord(r); err != nil {
+			t.Fatal(err)
+		}
+		if header[0] == recordTypeApplicationData {
+			records = append(records, len(body))
+		}
+	}
+	if !slices.Equal(records, flight.records) {
+		t.Fatalf("got records of %v bytes, want %v like dest", records, flight.records)
+	}
+
+	alpn, err := srv.reality.alpn.negotiate(srv.reality.dest, "localhost", []string{"h2", "http/1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alpn != "h2" {
+		t.Fatalf("got ALPN %q, want h2 like dest", alpn)
+	}
+}
+
+// recordingDialer records the bytes of the conns it dials.
+type recordingDialer struct {
+	netproxy.Dialer
+	mu      sync.Mutex
+	written bytes.Buffer
+	read    bytes.Buffer
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, addr string) (netproxy.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingConn{Conn: conn, d: d}, nil
+}
+
+type recordingConn struct {
+	netproxy.Conn
+	d *recordingDialer
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.d.mu.Lock()
+	c.d.read.Write(b[:n])
+	c.d.mu.Unlock()
+	return n, err
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.d.mu.Lock()
+	c.d.written.Write(b)
+	c.d.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func TestParseShortId(t *testing.T) {
+	tests := []struct {
+		sid     string
+		want    [8]byte
+		wantErr bool
+	}{
+		{sid: "", want: [8]byte{}},
+		{sid: "0123456789abcdef", want: [8]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}},
+		{sid: "ab", want: [8]byte{0xab}},
+		{sid: "abc", wantErr: true},
+		{sid: "0123456789abcdef01", wantErr: true},
+		{sid: "zz", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseShortId(tt.sid)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("ParseShortId(%q) error = %v, wantErr %v", tt.sid, err, tt.wantErr)
+		}
+		if err == nil && got != tt.want {
+			t.Fatalf("ParseShortId(%q) = %x, want %x", tt.sid, got, tt.want)
+		}
+	}
+}
+
+func TestGenerateKeyPair(t *testing.T) {
+	privateKey, publicKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParsePrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &realityConfig{
+		conf:       config.Reality{Dest: "www.example.com:443", ShortIds: "ab"},
+		privateKey: key,
+	}
+	if got, want := c.method(), "pbk="+publicKey+";sid=ab;sni=www.example.com;flow="; got != want {
+		t.Fatalf("method = %q, want %q", got, want)
+	}
+}
+
+func vlessPassage(uuid string) server.Passage {
+	return server.Passage{
+		Passage: model.Passage{
+			In: model.In{Argument: model.Argument{
+				Protocol: "vless+reality",
+				Password: uuid,
+			}},
+		},
+	}
+}
+
+type testServer struct {
+	*Server
+	testDestCert []byte
+}
+
+func startVlessServer(t *testing.T, passages ...server.Passage) (*testServer, string) {
+	t.Helper()
+
+	destAddr, destCert := startDest(t)
+	privateKey, _, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shortId, err := GenerateShortId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := WithRealityConfig(context.Background(), config.Reality{
+		Dest:        destAddr,
+		ServerNames: "localhost",
+		PrivateKey:  privateKey,
+		ShortIds:    shortId,
+	})
+	srvIface, err := New(ctx, direct.SymmetricDirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := srvIface.(*Server)
+	t.Cleanup(func() { _ = srv.Close() })
+	if err := srv.AddPassages(passages); err != nil {
+		t.Fatal(err)
+	}
+	lt, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = srv.serveListener(lt)
+	}()
+	return &testServer{Server: srv, testDestCert: destCert}, lt.Addr().String()
+}
+
+func newTestDialer(t *testing.T, srv *testServer, addr string, password string) *Dialer {
+	t.Helper()
+
+	dialer, err := NewDialer(direct.SymmetricDirect, protocol.Header{
+		ProxyAddress: addr,
+		Cipher:       srv.reality.method(),
+		Password:     password,
+		IsClient:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialer.(*Dialer)
+}
+
+// startDest starts a TLS 1.3 echo server as the site REALITY borrows.
+func startDest(t *testing.T) (addr string, cert []byte) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lt.Close() })
+	go func() {
+		for {
+			conn, err := lt.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+				buf := make([]byte, 4)
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					return
+				}
+				if string(buf) == "ping" {
+					_, _ = conn.Write([]byte("pong"))
+				}
+			}(conn)
+		}
+	}()
+	return lt.Addr().String(), der
+}
@@ -0,0 +1,513 @@
+package vless
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// REALITY clients accept the server only if the leaf certificate is an ed25519
+// certificate whose signature is HMAC-SHA512(authKey, publicKey), and they
+// usually do not advertise ed25519 in signature_algorithms. crypto/tls refuses
+// to sign with a scheme the peer did not advertise, so the handshake of
+// authenticated clients is done by the minimal TLS 1.3 server below, which
+// mirrors the handshake of dest.
+
+const (
+	handshakeTypeEncryptedExtensions = 8
+	handshakeTypeCertificate         = 11
+	handshakeTypeCertificateVerify   = 15
+	handshakeTypeFinished            = 20
+	handshakeTypeKeyUpdate           = 24
+
+	maxPlaintext  = 16384
+	maxCiphertext = maxPlaintext + 256
+)
+
+type realityCertificate struct {
+	der        []byte
+	publicKey  ed25519.PublicKey
+	privateKey ed25519.PrivateKey
+}
+
+func newRealityCertificate() (*realityCertificate, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	template := x509.Certificate{SerialNumber: serial}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, publicKey, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &realityCertificate{
+		der:        der,
+		publicKey:  publicKey,
+		privateKey: privateKey,
+	}, nil
+}
+
+// signedFor replaces the signature, which is the tail of the DER, by the HMAC
+// of the public key.
+func (c *realityCertificate) signedFor(authKey []byte) []byte {
+	der := bytes.Clone(c.der)
+	h := hmac.New(sha512.New, authKey)
+	h.Write(c.publicKey)
+	copy(der[len(der)-ed25519.SignatureSize:], h.Sum(nil))
+	return der
+}
+
+type tls13Suite struct {
+	id     uint16
+	hash   func() hash.Hash
+	keyLen int
+	aead   func(key []byte) (cipher.AEAD, error)
+}
+
+var tls13Suites = []*tls13Suite{
+	{id: tls.TLS_AES_128_GCM_SHA256, hash: sha256.New, keyLen: 16, aead: newAESGCM},
+	{id: tls.TLS_AES_256_GCM_SHA384, hash: sha512.New384, keyLen: 32, aead: newAESGCM},
+	{id: tls.TLS_CHACHA20_POLY1305_SHA256, hash: sha256.New, keyLen: 32, aead: chacha20poly1305.New},
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// selectTLS13Suite follows the preference of the client, like browsers expect.
+func selectTLS13Suite(ids []uint16) *tls13Suite {
+	for _, id := range ids {
+		for _, suite := range tls13Suites {
+			if suite.id == id {
+				return suite
+			}
+		}
+	}
+	return nil
+}
+
+func (s *tls13Suite) expandLabel(secret []byte, label string, context []byte, length int) []byte {
+	info := binary.BigEndian.AppendUint16(nil, uint16(length))
+	info = append(info, byte(len("tls13 ")+len(label)))
+	info = append(info, "tls13 "...)
+	info = append(info, label...)
+	info = append(info, byte(len(context)))
+	info = append(info, context...)
+	out := make([]byte, length)
+	_, _ = io.ReadFull(hkdf.Expand(s.hash, secret, info), out)
+	return out
+}
+
+func (s *tls13Suite) deriveSecret(secret []byte, label string, transcript hash.Hash) []byte {
+	if transcript == nil {
+		transcript = s.hash()
+	}
+	return s.expandLabel(secret, label, transcript.Sum(nil), transcript.Size())
+}
+
+func (s *tls13Suite) extract(newSecret, currentSecret []byte) []byte {
+	if newSecret == nil {
+		newSecret = make([]byte, s.hash().Size())
+	}
+	return hkdf.Extract(s.hash, newSecret, currentSecret)
+}
+
+func (s *tls13Suite) finishedHash(baseKey []byte, transcript hash.Hash) []byte {
+	finishedKey := s.expandLabel(baseKey, "finished", nil, transcript.Size())
+	h := hmac.New(s.hash, finishedKey)
+	h.Write(transcript.Sum(nil))
+	return h.Sum(nil)
+}
+
+type halfConn struct {
+	suite  *tls13Suite
+	secret []byte
+	aead   cipher.AEAD
+	iv     []byte
+	seq    uint64
+}
+
+func (h *halfConn) setTrafficSecret(suite *tls13Suite, secret []byte) {
+	h.suite = suite
+	h.secret = secret
+	h.aead, _ = suite.aead(suite.expandLabel(secret, "key", nil, suite.keyLen))
+	h.iv = suite.expandLabel(secret, "iv", nil, 12)
+	h.seq = 0
+}
+
+func (h *halfConn) updateTrafficSecret() {
+	h.setTrafficSecret(h.suite, h.suite.expandLabel(h.secret, "traffic upd", nil, len(h.secret)))
+}
+
+func (h *halfConn) nonce() []byte {
+	nonce := bytes.Clone(h.iv)
+	for i := 0; i < 8; i++ {
+		nonce[4+i] ^= byte(h.seq >> (56 - 8*i))
+	}
+	return nonce
+}
+
+// seal encrypts the payload into a TLS 1.3 record.
+func (h *halfConn) seal(typ byte, payload []byte) []byte {
+	return h.sealPadded(typ, payload, 0)
+}
+
+// sealPadded is like seal, but pads the record with zeros.
+func (h *halfConn) sealPadded(typ byte, payload []byte, padding int) []byte {
+	header := []byte{recordTypeApplicationData, 3, 3, 0, 0}
+	innerLen := len(payload) + 1 + padding
+	binary.BigEndian.PutUint16(header[3:], uint16(innerLen+h.aead.Overhead()))
+	inner := make([]byte, innerLen, innerLen+h.aead.Overhead())
+	copy(inner, payload)
+	inner[len(payload)] = typ
+	record := append(bytes.Clone(header), h.aead.Seal(inner[:0], h.nonce(), inner, header)...)
+	h.seq++
+	return record
+}
+
+func (h *halfConn) open(header []byte, ciphertext []byte) (typ byte, plain []byte, err error) {
+	plain, err = h.aead.Open(ciphertext[:0], h.nonce(), ciphertext, header)
+	if err != nil {
+		return 0, nil, fmt.Errorf("tls: bad record MAC")
+	}
+	h.seq++
+	i := len(plain) - 1
+	for i >= 0 && plain[i] == 0 {
+		i--
+	}
+	if i < 0 {
+		return 0, nil, fmt.Errorf("tls: record without content type")
+	}
+	return plain[i], plain[:i], nil
+}
+
+func readRecord(r io.Reader) (header []byte, body []byte, err error) {
+	header = make([]byte, 5)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	length := int(binary.BigEndian.Uint16(header[3:]))
+	if length > maxCiphertext {
+		return nil, nil, fmt.Errorf("tls: record overflow")
+	}
+	body = make([]byte, length)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	return header, body, nil
+}
+
+func plaintextRecord(typ byte, payload []byte) []byte {
+	record := []byte{typ, 3, 3, 0, 0}
+	binary.BigEndian.PutUint16(record[3:], uint16(len(payload)))
+	return append(record, payload...)
+}
+
+func handshakeMessage(typ byte, body []byte) []byte {
+	msg := []byte{typ, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	return append(msg, body...)
+}
+
+func appendUint24(b []byte, n int) []byte {
+	return append(b, byte(n>>16), byte(n>>8), byte(n))
+}
+
+// realityConn is a TLS 1.3 server connection established with a REALITY client.
+type realityConn struct {
+	conn net.Conn
+
+	readMu sync.Mutex
+	in     halfConn
+	input  []byte
+
+	writeMu         sync.Mutex
+	out             halfConn
+	closeNotifySent bool
+}
+
+// realityHandshake mirrors the flight of dest and the ALPN if they are given.
+func realityHandshake(conn net.Conn, hello *clientHello, authKey []byte, cert *realityCertificate, flight *destFlight, alpn string) (*realityConn, error) {
+	suite := selectTLS13Suite(hello.cipherSuites)
+	if flight != nil {
+		suite = selectTLS13Suite([]uint16{flight.suite})
+	}
+	if suite == nil {
+		return nil, fmt.Errorf("tls: no TLS 1.3 cipher suite in common")
+	}
+	clientKey, err := ecdh.X25519().NewPublicKey(hello.x25519Share)
+	if err != nil {
+		return nil, err
+	}
+	serverKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sharedKey, err := serverKey.ECDH(clientKey)
+	if err != nil {
+		return nil, err
+	}
+
+	transcript := suite.hash()
+	transcript.Write(hello.raw)
+	var serverHello []byte
+	if flight != nil {
+		random := make([]byte, 32)
+		if _, err = rand.Read(random); err != nil {
+			return nil, err
+		}
+		serverHello = flight.marshalServerHello(random, serverKey.PublicKey().Bytes())
+	} else if serverHello, err = marshalServerHello(hello.sessionId, suite.id, serverKey.PublicKey().Bytes()); err != nil {
+		return nil, err
+	}
+	transcript.Write(serverHello)
+
+	earlySecret := suite.extract(nil, nil)
+	handshakeSecret := suite.extract(sharedKey, suite.deriveSecret(earlySecret, "derived", nil))
+	clientSecret := suite.deriveSecret(handshakeSecret, "c hs traffic", transcript)
+	serverSecret := suite.deriveSecret(handshakeSecret, "s hs traffic", transcript)
+	c := &realityConn{conn: conn}
+	c.in.setTrafficSecret(suite, clientSecret)
+	c.out.setTrafficSecret(suite, serverSecret)
+
+	var extensions []byte
+	if alpn != "" {
+		extensions = binary.BigEndian.AppendUint16(extensions, extensionALPN)
+		extensions = binary.BigEndian.AppendUint16(extensions, uint16(3+len(alpn)))
+		extensions = binary.BigEndian.AppendUint16(extensions, uint16(1+len(alpn)))
+		extensions = append(extensions, byte(len(alpn)))
+		extensions = append(extensions, alpn...)
+	}
+	encryptedExtensions := handshakeMessage(handshakeTypeEncryptedExtensions, append(binary.BigEndian.AppendUint16(nil, uint16(len(extensions))), extensions...))
+	transcript.Write(encryptedExtensions)
+
+	der := cert.signedFor(authKey)
+	entry := appendUint24(nil, len(der))
+	entry = append(entry, der...)
+	entry = append(entry, 0, 0) // no extensions
+	certificate := handshakeMessage(handshakeTypeCertificate, append(appendUint24([]byte{0}, len(entry)), entry...))
+	transcript.Write(certificate)
+
+	signed := append(bytes.Repeat([]byte{0x20}, 64), "TLS 1.3, server CertificateVerify\x00"...)
+	signed = append(signed, transcript.Sum(nil)...)
+	signature := ed25519.Sign(cert.privateKey, signed)
+	certificateVerify := binary.BigEndian.AppendUint16(nil, uint16(tls.Ed25519))
+	certificateVerify = binary.BigEndian.AppendUint16(certificateVerify, uint16(len(signature)))
+	certificateVerify = handshakeMessage(handshakeTypeCertificateVerify, append(certificateVerify, signature...))
+	transcript.Write(certificateVerify)
+
+	finished := handshakeMessage(handshakeTypeFinished, suite.finishedHash(serverSecret, transcript))
+	transcript.Write(finished)
+
+	msgs := bytes.Join([][]byte{encryptedExtensions, certificate, certificateVerify, finished}, nil)
+	out := plaintextRecord(recordTypeHandshake, serverHello)
+	if flight == nil || flight.ccs {
+		out = append(out, plaintextRecord(recordTypeChangeCipherSpec, []byte{1})...)
+	}
+	if flight != nil {
+		out = append(out, c.out.sealFlight(msgs, flight.records)...)
+	} else {
+		out = append(out, c.out.seal(recordTypeHandshake, msgs)...)
+	}
+	if _, err = conn.Write(out); err != nil {
+		return nil, err
+	}
+
+	masterSecret := suite.extract(nil, suite.deriveSecret(handshakeSecret, "derived", nil))
+	clientAppSecret := suite.deriveSecret(masterSecret, "c ap traffic", transcript)
+	serverAppSecret := suite.deriveSecret(masterSecret, "s ap traffic", transcript)
+	expectedFinished := suite.finishedHash(clientSecret, transcript)
+
+	var msg []byte
+	for len(msg) < 4 || len(msg) < 4+(int(msg[1])<<16|int(msg[2])<<8|int(msg[3])) {
+		header, body, err := readRecord(conn)
+		if err != nil {
+			return nil, err
+		}
+		switch header[0] {
+		case recordTypeChangeCipherSpec:
+			if len(msg) > 0 || !bytes.Equal(body, []byte{1}) {
+				return nil, fmt.Errorf("tls: unexpected ChangeCipherSpec")
+			}
+			continue
+		case recordTypeApplicationData:
+		default:
+			return nil, fmt.Errorf("tls: unexpected record type %v", header[0])
+		}
+		typ, plain, err := c.in.open(header, body)
+		if err != nil {
+			return nil, err
+		}
+		if typ != recordTypeHandshake {
+			return nil, fmt.Errorf("tls: unexpected record type %v in handshake", typ)
+		}
+		msg = append(msg, plain...)
+	}
+	if msg[0] != handshakeTypeFinished || !hmac.Equal(msg[4:], expectedFinished) {
+		return nil, fmt.Errorf("tls: invalid client finished")
+	}
+
+	c.in.setTrafficSecret(suite, clientAppSecret)
+	c.out.setTrafficSecret(suite, serverAppSecret)
+	return c, nil
+}
+
+func marshalServerHello(sessionId []byte, suite uint16, publicKey []byte) ([]byte, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	var extensions []byte
+	extensions = binary.BigEndian.AppendUint16(extensions, extensionSupportedVersions)
+	extensions = binary.BigEndian.AppendUint16(extensions, 2)
+	extensions = binary.BigEndian.AppendUint16(extensions, tls.VersionTLS13)
+	extensions = binary.BigEndian.AppendUint16(extensions, extensionKeyShare)
+	extensions = binary.BigEndian.AppendUint16(extensions, uint16(4+len(publicKey)))
+	extensions = binary.BigEndian.AppendUint16(extensions, groupX25519)
+	extensions = binary.BigEndian.AppendUint16(extensions, uint16(len(publicKey)))
+	extensions = append(extensions, publicKey...)
+
+	body := []byte{3, 3}
+	body = append(body, random...)
+	body = append(body, byte(len(sessionId)))
+	body = append(body, sessionId...)
+	body = binary.BigEndian.AppendUint16(body, suite)
+	body = append(body, 0) // compression method
+	body = binary.BigEndian.AppendUint16(body, uint16(len(extensions)))
+	body = append(body, extensions...)
+	return handshakeMessage(2, body), nil
+}
+
+func (c *realityConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for len(c.input) == 0 {
+		header, body, err := readRecord(c.conn)
+		if err != nil {
+			return 0, err
+		}
+		if header[0] != recordTypeApplicationData {
+			return 0, fmt.Errorf("tls: unexpected record type %v", header[0])
+		}
+		typ, plain, err := c.in.open(header, body)
+		if err != nil {
+			return 0, err
+		}
+		switch typ {
+		case recordTypeApplicationData:
+			c.input = plain
+		case recordTypeAlert:
+			if len(plain) == 2 && plain[1] == 0 {
+				return 0, io.EOF
+			}
+			return 0, fmt.Errorf("tls: received alert %v", plain)
+		case recordTypeHandshake:
+			if err := c.handlePostHandshake(plain); err != nil {
+				return 0, err
+			}
+		default:
+			return 0, fmt.Errorf("tls: unexpected record type %v", typ)
+		}
+	}
+	n := copy(b, c.input)
+	c.input = c.input[n:]
+	return n, nil
+}
+
+func (c *realityConn) handlePostHandshake(msg []byte) error {
+	if len(msg) != 5 || msg[0] != handshakeTypeKeyUpdate {
+		return fmt.Errorf("tls: unexpected post-handshake message")
+	}
+	c.in.updateTrafficSecret()
+	if msg[4] == 1 {
+		c.writeMu.Lock()
+		defer c.writeMu.Unlock()
+		if _, err := c.conn.Write(c.out.seal(recordTypeHandshake, handshakeMessage(handshakeTypeKeyUpdate, []byte{0}))); err != nil {
+			return err
+		}
+		c.out.updateTrafficSecret()
+	}
+	return nil
+}
+
+func (c *realityConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeNotifySent {
+		return 0, net.ErrClosed
+	}
+	var n int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxPlaintext {
+			chunk = chunk[:maxPlaintext]
+		}
+		if _, err := c.conn.Write(c.out.seal(recordTypeApplicationData, chunk)); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+func (c *realityConn) closeNotify() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeNotifySent {
+		return nil
+	}
+	c.closeNotifySent = true
+	_, err := c.conn.Write(c.out.seal(recordTypeAlert, []byte{1, 0}))
+	return err
+}
+
+func (c *realityConn) CloseWrite() error {
+	return c.closeNotify()
+}
+
+func (c *realityConn) Close() error {
+	// Do not be blocked by a pending Write forever.
+	_ = c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	err := c.closeNotify()
+	if closeErr := c.conn.Close(); closeErr != nil {
+		return closeErr
+	}
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (c *realityConn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *realityConn) RemoteAddr() net.Addr               { return c.conn.RemoteAddr() }
+func (c *realityConn) SetDeadline(t time.Time) error      { return c.conn.SetDeadline(t) }
+func (c *realityConn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *realityConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
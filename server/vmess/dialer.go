@@ -0,0 +1,77 @@
+package vmess
+
+import (
+	"net"
+	"net/url"
+
+	"github.com/daeuniverse/outbound/dialer"
+	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/outbound/protocol"
+	"github.com/daeuniverse/outbound/protocol/vmess"
+	"github.com/daeuniverse/outbound/transport/ws"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+)
+
+func init() {
+	protocol.Register(string(ProtocolVMessWs), newWsDialerFactory(false))
+	protocol.Register(string(ProtocolVMessTlsWs), newWsDialerFactory(true))
+	// replaces the one of outbound, which always sends the ClientHello of
+	// crypto/tls
+	protocol.Register(string(protocol.ProtocolVMessTlsGrpc), newTlsGrpcDialer)
+}
+
+// newWsDialerFactory creates dialers to relay passages to vmess servers over
+// WebSocket, whose path is the feature1 of the header.
+func newWsDialerFactory(tls bool) func(nextDialer netproxy.Dialer, header protocol.Header) (netproxy.Dialer, error) {
+	return func(nextDialer netproxy.Dialer, header protocol.Header) (netproxy.Dialer, error) {
+		path, _ := header.Feature1.(string)
+		u := url.URL{
+			Scheme: "ws",
+			Host:   header.ProxyAddress,
+			Path:   path,
+		}
+		q := url.Values{}
+		if header.SNI != "" {
+			q.Set("host", header.SNI)
+		} else if host, _, err := net.SplitHostPort(header.ProxyAddress); err == nil {
+			q.Set("host", host)
+		}
+		if tls {
+			u.Scheme = "wss"
+			q.Set("sni", q.Get("host"))
+			if header.TlsConfig != nil && header.TlsConfig.InsecureSkipVerify {
+				q.Set("allowInsecure", "1")
+			}
+		}
+		u.RawQuery = q.Encode()
+		wsDialer, _, err := ws.NewWs(&dialer.ExtraOption{}, nextDialer, u.String())
+		if err != nil {
+			return nil, err
+		}
+		// the vmess dialer takes feature1 as the service name of gRPC
+		header.Feature1 = ""
+		return vmess.NewDialerFactory(protocol.ProtocolVMessTCP)(wsDialer, header)
+	}
+}
+
+// newTlsGrpcDialer creates dialers to relay passages to vmess servers over
+// gRPC, whose ClientHello mimics the fingerprint in the method if any.
+func newTlsGrpcDialer(nextDialer netproxy.Dialer, header protocol.Header) (netproxy.Dialer, error) {
+	fingerprint, err := server.Fingerprint(header.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	if fingerprint == "" {
+		return vmess.NewDialerFactory(protocol.ProtocolVMessTlsGrpc)(nextDialer, header)
+	}
+	serviceName, _ := header.Feature1.(string)
+	grpcDialer := &uTLSGrpcDialer{
+		nextDialer:  nextDialer,
+		serviceName: serviceName,
+		serverName:  header.SNI,
+		fingerprint: fingerprint,
+	}
+	// the vmess dialer takes feature1 as the service name of gRPC
+	header.Feature1 = ""
+	return vmess.NewDialerFactory(protocol.ProtocolVMessTCP)(grpcDialer, header)
+}
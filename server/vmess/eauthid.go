@@ -0,0 +1,40 @@
+package vmess
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	"github.com/daeuniverse/outbound/pool"
+	"github.com/daeuniverse/outbound/protocol"
+)
+
+// authEAuthID is like vmess.AuthEAuthID, but accepts the EAuthID within the
+// interval of the replay filter. Right after the start, the window grows from
+// zero like v2ray unless the filter has restored all the records of the last
+// run, lest the lost records reopen replays.
+func (s *Server) authEAuthID(blk cipher.Block, eAuthID []byte) error {
+	buf := pool.Get(16)
+	defer pool.Put(buf)
+	blk.Decrypt(buf, eAuthID)
+	if crc32.ChecksumIEEE(buf[:12]) != binary.BigEndian.Uint32(buf[12:16]) {
+		return fmt.Errorf("incorrect checksum")
+	}
+
+	t := int64(binary.BigEndian.Uint64(buf[:8]))
+	now := time.Now().Unix()
+	window := s.doubleCuckoo.Interval()
+	if !s.doubleCuckoo.Restored() {
+		window = min(window, 3*(now-s.startTimestamp))
+	}
+	if max(now-t, t-now) > window {
+		return fmt.Errorf("%w: time exceed", protocol.ErrFailAuth)
+	}
+
+	if !s.doubleCuckoo.Check(eAuthID) {
+		return fmt.Errorf("%w: repeated EAuthID", protocol.ErrReplayAttack)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package vmess
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	proto "github.com/daeuniverse/outbound/pkg/gun_proto"
+	grpc2 "github.com/daeuniverse/outbound/transport/grpc"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+)
+
+var (
+	uTLSGrpcConns   = make(map[string]*grpc.ClientConn)
+	uTLSGrpcConnsMu sync.Mutex
+)
+
+// uTLSGrpcDialer dials gRPC tunnels whose ClientHello mimics a fingerprint.
+// Like outbound, the gRPC connections to the same server are shared.
+type uTLSGrpcDialer struct {
+	nextDialer  netproxy.Dialer
+	serviceName string
+	serverName  string
+	fingerprint string
+	// rootCAs is nil for the system ones
+	rootCAs *x509.CertPool
+}
+
+func (d *uTLSGrpcDialer) Dial(network string, addr string) (netproxy.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *uTLSGrpcDialer) DialContext(ctx context.Context, network string, addr string) (netproxy.Conn, error) {
+	magicNetwork, err := netproxy.ParseMagicNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	if magicNetwork.Network != "tcp" {
+		return nil, fmt.Errorf("%w: %v", netproxy.UnsupportedTunnelTypeError, magicNetwork.Network)
+	}
+	cc, err := d.clientConn(ctx, addr, magicNetwork)
+	if err != nil {
+		return nil, err
+	}
+	serviceName := d.serviceName
+	if serviceName == "" {
+		serviceName = "GunService"
+	}
+	// the tun lives until the conn is closed instead of ctx
+	ctxStream, cancel := context.WithCancel(context.Background())
+	tun, err := proto.NewGunServiceClient(cc).(proto.GunServiceClientX).TunCustomName(ctxStream, serviceName)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return grpc2.NewClientConn(tun, cancel), nil
+}
+
+func (d *uTLSGrpcDialer) key(addr string) string {
+	return addr + "|" + d.serverName + "|" + d.fingerprint
+}
+
+func (d *uTLSGrpcDialer) clientConn(ctx context.Context, addr string, magicNetwork *netproxy.MagicNetwork) (*grpc.ClientConn, error) {
+	uTLSGrpcConnsMu.Lock()
+	defer uTLSGrpcConnsMu.Unlock()
+	if cc, ok := uTLSGrpcConns[d.key(addr)]; ok && cc.GetState() != connectivity.Shutdown {
+		return cc, nil
+	}
+	tcpNetwork := netproxy.MagicNetwork{
+		Network: "tcp",
+		Mark:    magicNetwork.Mark,
+		Mptcp:   magicNetwork.Mptcp,
+	}.Encode()
+	cc, err := grpc.DialContext(ctx, addr,
+		grpc.WithTransportCredentials(&uTLSCreds{
+			config: &tls.Config{
+				ServerName: d.serverName,
+				RootCAs:    d.rootCAs,
+				NextProtos: []string{"h2"},
+			},
+			fingerprint: d.fingerprint,
+		}),
+		grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+			c, err := d.nextDialer.DialContext(ctx, tcpNetwork, s)
+			if err != nil {
+				return nil, err
+			}
+			return &netproxy.FakeNetConn{Conn: c}, nil
+		}),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: backoff.Config{
+				BaseDelay:  500 * time.Millisecond,
+				Multiplier: 1.5,
+				Jitter:     0.2,
+				MaxDelay:   19 * time.Second,
+			},
+			MinConnectTimeout: 5 * time.Second,
+		}),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                30 * time.Second,
+			Timeout:             10 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	uTLSGrpcConns[d.key(addr)] = cc
+	return cc, nil
+}
+
+// uTLSCreds are the gRPC client credentials of uTLS.
+type uTLSCreds struct {
+	config      *tls.Config
+	fingerprint string
+}
+
+type uTLSAuthInfo struct {
+	credentials.CommonAuthInfo
+}
+
+func (uTLSAuthInfo) AuthType() string {
+	return "utls"
+}
+
+func (c *uTLSCreds) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	config := c.config.Clone()
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(authority); err == nil {
+			config.ServerName = host
+		} else {
+			config.ServerName = authority
+		}
+	}
+	conn, err := server.TLSClient(rawConn, config, c.fingerprint)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = conn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	return conn, uTLSAuthInfo{credentials.CommonAuthInfo{SecurityLevel: credentials.PrivacyAndIntegrity}}, nil
+}
+
+func (c *uTLSCreds) ServerHandshake(net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, fmt.Errorf("uTLS credentials are only for clients")
+}
+
+func (c *uTLSCreds) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "tls", SecurityVersion: "1.2", ServerName: c.config.ServerName}
+}
+
+func (c *uTLSCreds) Clone() credentials.TransportCredentials {
+	return &uTLSCreds{config: c.config.Clone(), fingerprint: c.fingerprint}
+}
+
+func (c *uTLSCreds) OverrideServerName(serverName string) error {
+	c.config.ServerName = serverName
+	return nil
+}
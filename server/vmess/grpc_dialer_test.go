@@ -0,0 +1,161 @@
+package vmess
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	proto "github.com/daeuniverse/outbound/pkg/gun_proto"
+	"github.com/daeuniverse/outbound/protocol"
+	"github.com/daeuniverse/outbound/protocol/direct"
+	"github.com/daeuniverse/outbound/protocol/vmess"
+	grpc2 "github.com/daeuniverse/outbound/transport/grpc"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/replay_filter"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+func TestUTLSGrpcDialerRelay(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+
+	svr, err := New(context.WithValue(context.Background(), "doubleCuckoo", replay_filter.New(120)), direct.SymmetricDirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = svr.AddPassages([]server.Passage{vmessTestPassage("", "28446de9-2a7e-4fab-827b-6df93e46f945")}); err != nil {
+		t.Fatal(err)
+	}
+	s := svr.(*Server)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"grpc.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	hellos := make(chan *tls.ClientHelloInfo, 1)
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{"h2"},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			select {
+			case hellos <- hello:
+			default:
+			}
+			return nil, nil
+		},
+	}
+
+	lt, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.grpc = grpc2.Server{
+		Server:     grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig))),
+		LocalAddr:  lt.Addr(),
+		HandleConn: s.handleConn,
+	}
+	proto.RegisterGunServiceServerX(s.grpc.Server, s.grpc, "relay")
+	go func() {
+		_ = s.grpc.Serve(lt)
+	}()
+	defer s.grpc.Stop()
+
+	header := protocol.Header{
+		ProxyAddress: lt.Addr().String(),
+		SNI:          "grpc.example.com",
+		Feature1:     "",
+		Password:     "28446de9-2a7e-4fab-827b-6df93e46f945",
+		IsClient:     true,
+		Flags:        protocol.Flags_VMess_UsePacketAddr,
+	}
+	d, err := vmess.NewDialerFactory(protocol.ProtocolVMessTCP)(&uTLSGrpcDialer{
+		nextDialer:  direct.SymmetricDirect,
+		serviceName: "relay",
+		serverName:  header.SNI,
+		fingerprint: "chrome",
+		rootCAs:     roots,
+	}, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := d.DialContext(ctx, "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("got %q, want %q", buf, "ping")
+	}
+
+	// crypto/tls never sends GREASE values, which Chrome does
+	hello := <-hellos
+	var grease bool
+	for _, suite := range hello.CipherSuites {
+		grease = grease || suite&0x0f0f == 0x0a0a
+	}
+	if !grease {
+		t.Fatalf("the ClientHello does not look like Chrome: %v", hello.CipherSuites)
+	}
+}
+
+func TestTlsGrpcDialerRejectsUnknownFingerprint(t *testing.T) {
+	_, err := protocol.NewDialer(string(protocol.ProtocolVMessTlsGrpc), direct.SymmetricDirect, protocol.Header{
+		ProxyAddress: "127.0.0.1:443",
+		Feature1:     "relay",
+		Cipher:       "serviceName=relay;fp=netscape",
+		Password:     "28446de9-2a7e-4fab-827b-6df93e46f945",
+		IsClient:     true,
+	})
+	if err == nil {
+		t.Fatal("NewDialer succeeded, want an error")
+	}
+}
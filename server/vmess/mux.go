@@ -0,0 +1,639 @@
+package vmess
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/outbound/pool"
+	"github.com/daeuniverse/outbound/protocol/vmess"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+)
+
+// Mux.Cool: https://www.v2fly.org/en_US/developer/protocols/muxcool.html
+// XUDP carries the UDP packets of a session in Mux.Cool frames, each of
+// which is addressed.
+
+const (
+	// muxInstructionCmd is the instruction cmd of the vmess request for mux.
+	muxInstructionCmd = 3
+	// MuxHost is the target of mux requests seen by vmess.Conn.
+	MuxHost = "v1.mux.cool"
+
+	muxMaxMetadataLen = 512
+	muxTCPBufferSize  = 8192
+	muxUDPBufferSize  = 1<<16 - 1
+
+	// muxMaxSessions bounds the concurrent sessions of a mux connection.
+	muxMaxSessions = 128
+	// muxSessionBufferSize bounds the data from the client queued for a
+	// session, which has no flow control in Mux.Cool. The reader of the mux
+	// connection never waits for a session, thus the packets of UDP sessions
+	// beyond it are dropped and TCP sessions are ended with an error.
+	muxSessionBufferSize = 512 << 10
+)
+
+const (
+	muxStatusNew       byte = 0x01
+	muxStatusKeep      byte = 0x02
+	muxStatusEnd       byte = 0x03
+	muxStatusKeepAlive byte = 0x04
+
+	muxOptionData  byte = 0x01
+	muxOptionError byte = 0x02
+
+	muxNetworkTCP byte = 0x01
+	muxNetworkUDP byte = 0x02
+
+	muxAddrIPv4   byte = 0x01
+	muxAddrDomain byte = 0x02
+	muxAddrIPv6   byte = 0x03
+)
+
+// headerConn replays the request header before reading from Conn.
+type headerConn struct {
+	net.Conn
+	header *bytes.Reader
+}
+
+func (c *headerConn) Read(b []byte) (int, error) {
+	if c.header.Len() > 0 {
+		return c.header.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *headerConn) CloseWrite() error {
+	if conn, ok := c.Conn.(server.WriteCloser); ok {
+		return conn.CloseWrite()
+	}
+	return nil
+}
+
+// NetConn returns the connection the header was read from.
+func (c *headerConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// readRequestHeader reads the AEAD request header following the EAuthID.
+// Mux requests carry no target address, which vmess.Conn cannot parse, thus
+// their headers are rebuilt as tcp requests to MuxHost. The returned conn
+// replays the header to vmess.Conn.
+func readRequestHeader(conn net.Conn, cmdKey []byte, eAuthID []byte) (c net.Conn, isMux bool, err error) {
+	// len(2) + tag(16) + connection_nonce(8)
+	raw := make([]byte, 26)
+	if _, err = io.ReadFull(conn, raw); err != nil {
+		return nil, false, fmt.Errorf("failed to read ALength and ConnectionNonce: %w", err)
+	}
+	connectionNonce := raw[18:26]
+	lenCiph, err := vmess.NewAesGcm(vmess.KDF(cmdKey, []byte(vmess.KDFSaltConstVMessHeaderPayloadLengthAEADKey), eAuthID, connectionNonce)[:16])
+	if err != nil {
+		return nil, false, err
+	}
+	lenNonce := vmess.KDF(cmdKey, []byte(vmess.KDFSaltConstVMessHeaderPayloadLengthAEADIV), eAuthID, connectionNonce)[:12]
+	bLen, err := lenCiph.Open(nil, lenNonce, raw[:18], eAuthID)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to decrypt request header length: %w", err)
+	}
+	lenInstruction := int(binary.BigEndian.Uint16(bLen))
+	raw = append(raw, make([]byte, lenInstruction+16)...)
+	if _, err = io.ReadFull(conn, raw[26:]); err != nil {
+		return nil, false, fmt.Errorf("failed to read instruction data: %w", err)
+	}
+	ciph, err := vmess.NewAesGcm(vmess.KDF(cmdKey, []byte(vmess.KDFSaltConstVMessHeaderPayloadAEADKey), eAuthID, connectionNonce)[:16])
+	if err != nil {
+		return nil, false, err
+	}
+	nonce := vmess.KDF(cmdKey, []byte(vmess.KDFSaltConstVMessHeaderPayloadAEADIV), eAuthID, connectionNonce)[:12]
+	instruction, err := ciph.Open(nil, nonce, raw[26:], eAuthID)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to decrypt request header: %w", err)
+	}
+	if len(instruction) < 38 || instruction[37] != muxInstructionCmd {
+		return &headerConn{Conn: conn, header: bytes.NewReader(raw)}, false, nil
+	}
+
+	// Rebuild the instruction as a tcp request to MuxHost without padding.
+	rebuilt := make([]byte, 0, 38+4+len(MuxHost)+4)
+	rebuilt = append(rebuilt, instruction[:37]...)
+	rebuilt[35] &= 0xf
+	rebuilt = append(rebuilt, vmess.NetworkToByte("tcp"), 0, 0, muxAddrDomain, byte(len(MuxHost)))
+	rebuilt = append(rebuilt, MuxHost...)
+	h := fnv.New32a()
+	h.Write(rebuilt)
+	rebuilt = h.Sum(rebuilt)
+
+	header := make([]byte, 0, 26+len(rebuilt)+16)
+	header = lenCiph.Seal(header, lenNonce, binary.BigEndian.AppendUint16(nil, uint16(len(rebuilt))), eAuthID)
+	header = append(header, connectionNonce...)
+	header = ciph.Seal(header, nonce, rebuilt, eAuthID)
+	return &headerConn{Conn: conn, header: bytes.NewReader(header)}, true, nil
+}
+
+type muxPacket struct {
+	b []byte
+	// addr is the target of the packet of UDP sessions
+	addr string
+}
+
+// muxSession is a sub-stream of a mux connection.
+type muxSession struct {
+	id      uint16
+	network byte
+	target  string
+
+	// queue is the data from the client to write, and notify is signaled
+	// once a packet is queued.
+	queueMu sync.Mutex
+	queue   []muxPacket
+	queued  int
+	// released is set once the session is closed, after which no packet is
+	// queued.
+	released bool
+	notify   chan struct{}
+
+	end       chan struct{}
+	endOnce   sync.Once
+	endSent   sync.Once
+	rConn     netproxy.Conn
+	rConnMu   sync.Mutex
+	closed    bool
+	closeOnce sync.Once
+}
+
+func newMuxSession(id uint16, network byte, target string) *muxSession {
+	return &muxSession{
+		id:      id,
+		network: network,
+		target:  target,
+		notify:  make(chan struct{}, 1),
+		end:     make(chan struct{}),
+	}
+}
+
+// push queues the packet without waiting. It returns false and keeps p if the
+// buffer is full. The packet is dropped if the session has been closed.
+func (s *muxSession) push(p muxPacket) bool {
+	s.queueMu.Lock()
+	if s.released {
+		s.queueMu.Unlock()
+		pool.Put(p.b)
+		return true
+	}
+	if s.queued+len(p.b) > muxSessionBufferSize {
+		s.queueMu.Unlock()
+		return false
+	}
+	s.queue = append(s.queue, p)
+	s.queued += len(p.b)
+	s.queueMu.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (s *muxSession) pop() (p muxPacket, ok bool) {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	if len(s.queue) == 0 {
+		return muxPacket{}, false
+	}
+	p = s.queue[0]
+	s.queue[0] = muxPacket{}
+	s.queue = s.queue[1:]
+	s.queued -= len(p.b)
+	return p, true
+}
+
+// release drops the queued packets.
+func (s *muxSession) release() {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	s.released = true
+	for _, p := range s.queue {
+		pool.Put(p.b)
+	}
+	s.queue = nil
+	s.queued = 0
+}
+
+func (s *muxSession) closeEnd() {
+	s.endOnce.Do(func() {
+		close(s.end)
+	})
+}
+
+// setRConn returns false if the session has been closed before dialed.
+func (s *muxSession) setRConn(rConn netproxy.Conn) bool {
+	s.rConnMu.Lock()
+	defer s.rConnMu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.rConn = rConn
+	return true
+}
+
+func (s *muxSession) close() {
+	s.closeOnce.Do(func() {
+		s.closeEnd()
+		s.rConnMu.Lock()
+		s.closed = true
+		if s.rConn != nil {
+			s.rConn.Close()
+		}
+		s.rConnMu.Unlock()
+		s.release()
+	})
+}
+
+// muxServer demultiplexes the sub-streams of a mux connection into
+// independent dials through the dialer of the passage.
+type muxServer struct {
+	conn   io.ReadWriter
+	dialer netproxy.Dialer
+
+	writeMu  sync.Mutex
+	mu       sync.Mutex
+	sessions map[uint16]*muxSession
+	wg       sync.WaitGroup
+}
+
+func newMuxServer(conn io.ReadWriter, dialer netproxy.Dialer) *muxServer {
+	return &muxServer{
+		conn:     conn,
+		dialer:   dialer,
+		sessions: make(map[uint16]*muxSession),
+	}
+}
+
+// Serve reads frames until the mux connection is closed.
+func (m *muxServer) Serve() error {
+	defer func() {
+		m.mu.Lock()
+		for _, sess := range m.sessions {
+			sess.close()
+		}
+		m.mu.Unlock()
+		m.wg.Wait()
+	}()
+	bLen := make([]byte, 2)
+	meta := make([]byte, muxMaxMetadataLen)
+	for {
+		if _, err := io.ReadFull(m.conn, bLen); err != nil {
+			return err
+		}
+		metaLen := int(binary.BigEndian.Uint16(bLen))
+		if metaLen < 4 || metaLen > muxMaxMetadataLen {
+			return fmt.Errorf("invalid length of mux frame metadata: %v", metaLen)
+		}
+		if _, err := io.ReadFull(m.conn, meta[:metaLen]); err != nil {
+			return err
+		}
+		id := binary.BigEndian.Uint16(meta)
+		status, option := meta[2], meta[3]
+		var data []byte
+		if option&muxOptionData != 0 {
+			if _, err := io.ReadFull(m.conn, bLen); err != nil {
+				return err
+			}
+			if dataLen := int(binary.BigEndian.Uint16(bLen)); dataLen > 0 {
+				data = pool.Get(dataLen)
+				if _, err := io.ReadFull(m.conn, data); err != nil {
+					pool.Put(data)
+					return err
+				}
+			}
+		}
+		if err := m.handleFrame(id, status, meta[4:metaLen], data); err != nil {
+			return err
+		}
+	}
+}
+
+// handleFrame takes over data.
+func (m *muxServer) handleFrame(id uint16, status byte, meta []byte, data []byte) error {
+	switch status {
+	case muxStatusNew:
+		network, target, err := parseMuxTarget(meta)
+		if err != nil {
+			if data != nil {
+				pool.Put(data)
+			}
+			return err
+		}
+		sess := newMuxSession(id, network, target)
+		m.mu.Lock()
+		old, ok := m.sessions[id]
+		if !ok && len(m.sessions) >= muxMaxSessions {
+			m.mu.Unlock()
+			if data != nil {
+				pool.Put(data)
+			}
+			log.Debug("mux: too many sessions, refuse %v", target)
+			return m.writeFrame(id, muxStatusEnd, muxOptionError, nil, nil)
+		}
+		if ok {
+			old.close()
+		}
+		m.sessions[id] = sess
+		m.mu.Unlock()
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			m.serveSession(sess)
+		}()
+		m.deliver(sess, data, target)
+	case muxStatusKeep:
+		m.mu.Lock()
+		sess, ok := m.sessions[id]
+		m.mu.Unlock()
+		if !ok {
+			if data != nil {
+				pool.Put(data)
+			}
+			// tell the client the session is gone
+			return m.writeFrame(id, muxStatusEnd, 0, nil, nil)
+		}
+		addr := sess.target
+		if sess.network == muxNetworkUDP && len(meta) > 0 {
+			// XUDP addresses every packet
+			_, target, err := parseMuxTarget(meta)
+			if err != nil {
+				if data != nil {
+					pool.Put(data)
+				}
+				return err
+			}
+			addr = target
+		}
+		m.deliver(sess, data, addr)
+	case muxStatusEnd:
+		if data != nil {
+			pool.Put(data)
+		}
+		m.mu.Lock()
+		sess, ok := m.sessions[id]
+		m.mu.Unlock()
+		if ok {
+			sess.closeEnd()
+		}
+	case muxStatusKeepAlive:
+		if data != nil {
+			pool.Put(data)
+		}
+	default:
+		if data != nil {
+			pool.Put(data)
+		}
+		return fmt.Errorf("unexpected status of mux frame: %v", status)
+	}
+	return nil
+}
+
+// deliver queues data for the session without waiting.
+func (m *muxServer) deliver(sess *muxSession, data []byte, addr string) {
+	if data == nil {
+		return
+	}
+	if sess.push(muxPacket{b: data, addr: addr}) {
+		return
+	}
+	pool.Put(data)
+	if sess.network == muxNetworkTCP {
+		// the stream cannot go on with a hole
+		log.Debug("mux: the buffer of %v overflows", sess.target)
+		sess.close()
+		_ = m.endSession(sess, muxOptionError)
+	}
+}
+
+// endSession tells the client the session is ended once.
+func (m *muxServer) endSession(sess *muxSession, option byte) (err error) {
+	sess.endSent.Do(func() {
+		err = m.writeFrame(sess.id, muxStatusEnd, option, nil, nil)
+	})
+	return err
+}
+
+func (m *muxServer) removeSession(sess *muxSession) {
+	sess.close()
+	m.mu.Lock()
+	if m.sessions[sess.id] == sess {
+		delete(m.sessions, sess.id)
+	}
+	m.mu.Unlock()
+}
+
+func (m *muxServer) serveSession(sess *muxSession) {
+	defer m.removeSession(sess)
+	network := "tcp"
+	if sess.network == muxNetworkUDP {
+		network = "udp"
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), server.DialTimeout)
+	rConn, err := m.dialer.DialContext(ctx, network, sess.target)
+	cancel()
+	if err != nil {
+		log.Debug("mux: dial %v %v: %v", network, sess.target, err)
+		_ = m.endSession(sess, muxOptionError)
+		return
+	}
+	if !sess.setRConn(rConn) {
+		rConn.Close()
+		return
+	}
+	var e error
+	if sess.network == muxNetworkUDP {
+		e = m.relayUDP(sess, rConn.(netproxy.PacketConn))
+	} else {
+		e = m.relayTCP(sess, rConn)
+	}
+	var option byte
+	if e != nil && !isIgnorableMuxError(e) {
+		log.Debug("mux: relay %v %v: %v", network, sess.target, e)
+		option = muxOptionError
+	}
+	_ = m.endSession(sess, option)
+}
+
+func (m *muxServer) relayTCP(sess *muxSession, rConn netproxy.Conn) error {
+	eCh := make(chan error, 1)
+	go func() {
+		e := m.copyToRConn(sess, func(p muxPacket) error {
+			_, err := rConn.Write(p.b)
+			return err
+		})
+		if e != nil {
+			sess.close()
+		} else {
+			// the client ended the session
+			if rConn, ok := rConn.(server.WriteCloser); ok {
+				rConn.CloseWrite()
+			}
+			rConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		}
+		eCh <- e
+	}()
+	buf := pool.Get(muxTCPBufferSize)
+	defer pool.Put(buf)
+	for {
+		n, err := rConn.Read(buf)
+		if n > 0 {
+			if e := m.writeFrame(sess.id, muxStatusKeep, muxOptionData, nil, buf[:n]); e != nil {
+				sess.close()
+				<-eCh
+				return e
+			}
+		}
+		if err != nil {
+			sess.close()
+			<-eCh
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (m *muxServer) relayUDP(sess *muxSession, rConn netproxy.PacketConn) error {
+	go func() {
+		_ = m.copyToRConn(sess, func(p muxPacket) error {
+			_ = rConn.SetWriteDeadline(time.Now().Add(server.DefaultNatTimeout)) // should keep consistent
+			_, err := rConn.WriteTo(p.b, p.addr)
+			if errors.Is(err, net.ErrWriteToConnected) {
+				log.Error("mux: relayUDP: %v", err)
+			}
+			return err
+		})
+		// UDP sessions end once the client ends
+		sess.close()
+	}()
+	buf := pool.Get(muxUDPBufferSize)
+	defer pool.Put(buf)
+	for {
+		_ = rConn.SetReadDeadline(time.Now().Add(server.DefaultNatTimeout))
+		n, addr, err := rConn.ReadFrom(buf)
+		if err != nil {
+			sess.close()
+			return err
+		}
+		if err = m.writeFrame(sess.id, muxStatusKeep, muxOptionData, &addr, buf[:n]); err != nil {
+			sess.close()
+			return err
+		}
+	}
+}
+
+// copyToRConn writes the data from the client until the session ends, and the
+// data queued before the end.
+func (m *muxServer) copyToRConn(sess *muxSession, write func(p muxPacket) error) error {
+	var ended bool
+	for {
+		if p, ok := sess.pop(); ok {
+			err := write(p)
+			pool.Put(p.b)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if ended {
+			return nil
+		}
+		select {
+		case <-sess.notify:
+		case <-sess.end:
+			ended = true
+		}
+	}
+}
+
+// writeFrame writes a frame in one write. The source address is given for
+// the frames of UDP sessions.
+func (m *muxServer) writeFrame(id uint16, status byte, option byte, addr *netip.AddrPort, data []byte) error {
+	metaLen := 4
+	if addr != nil {
+		metaLen += 1 + 2 + 1 + 16
+	}
+	buf := pool.Get(2 + metaLen + 2 + len(data))
+	defer pool.Put(buf)
+	b := buf[:2]
+	b = binary.BigEndian.AppendUint16(b, id)
+	b = append(b, status, option)
+	if addr != nil {
+		b = append(b, muxNetworkUDP)
+		b = binary.BigEndian.AppendUint16(b, addr.Port())
+		if ip := addr.Addr().Unmap(); ip.Is4() {
+			b = append(b, muxAddrIPv4)
+			b = append(b, ip.AsSlice()...)
+		} else {
+			b = append(b, muxAddrIPv6)
+			b = append(b, ip.AsSlice()...)
+		}
+	}
+	binary.BigEndian.PutUint16(b, uint16(len(b)-2))
+	if option&muxOptionData != 0 {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+		b = append(b, data...)
+	}
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	_, err := m.conn.Write(b)
+	return err
+}
+
+// parseMuxTarget parses the network and the target following the option of
+// the frame metadata.
+func parseMuxTarget(meta []byte) (network byte, target string, err error) {
+	if len(meta) < 4 {
+		return 0, "", fmt.Errorf("insufficient mux frame metadata: %v", len(meta))
+	}
+	network = meta[0]
+	if network != muxNetworkTCP && network != muxNetworkUDP {
+		return 0, "", fmt.Errorf("unexpected network of mux frame: %v", network)
+	}
+	port := binary.BigEndian.Uint16(meta[1:])
+	var host string
+	switch meta[3] {
+	case muxAddrIPv4:
+		if len(meta) < 8 {
+			return 0, "", fmt.Errorf("bad mux ipv4 target: insufficient data")
+		}
+		host = netip.AddrFrom4([4]byte(meta[4:8])).String()
+	case muxAddrIPv6:
+		if len(meta) < 20 {
+			return 0, "", fmt.Errorf("bad mux ipv6 target: insufficient data")
+		}
+		host = netip.AddrFrom16([16]byte(meta[4:20])).String()
+	case muxAddrDomain:
+		if len(meta) < 5 || len(meta) < 5+int(meta[4]) {
+			return 0, "", fmt.Errorf("bad mux domain target: insufficient data")
+		}
+		host = string(meta[5 : 5+int(meta[4])])
+	default:
+		return 0, "", fmt.Errorf("unexpected address type of mux frame: %v", meta[3])
+	}
+	// the GlobalID of XUDP may follow, which is only useful to share the
+	// UDP mapping across connections.
+	return network, net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+func isIgnorableMuxError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || (errors.As(err, &netErr) && netErr.Timeout())
+}
@@ -0,0 +1,292 @@
+package vmess
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/outbound/protocol"
+	"github.com/daeuniverse/outbound/protocol/direct"
+	"github.com/daeuniverse/outbound/protocol/vmess"
+	"github.com/google/uuid"
+)
+
+func testRequestHeader(t *testing.T, network string, hostname string, port uint16) (cmdKey []byte, header []byte) {
+	t.Helper()
+	cmdKey = vmess.NewID(uuid.MustParse("28446de9-2a7e-4fab-827b-6df93e46f945")).CmdKey()
+	metadata := vmess.Metadata{
+		Metadata: protocol.Metadata{
+			Type:     protocol.MetadataTypeDomain,
+			Hostname: hostname,
+			Port:     port,
+			Cipher:   string(vmess.CipherAES128GCM),
+			IsClient: true,
+		},
+		Network: network,
+	}
+	instruction := vmess.ReqInstructionDataFromPool(metadata)
+	if network == "mux" {
+		// v2ray writes no target for mux requests
+		instruction = instruction[:38]
+		instruction[35] &= 0xf
+		h := fnv.New32a()
+		h.Write(instruction)
+		instruction = h.Sum(instruction)
+	}
+	header, err := vmess.EncryptReqHeaderFromPool(instruction, cmdKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cmdKey, header
+}
+
+func TestReadRequestHeader(t *testing.T) {
+	for _, tc := range []struct {
+		network  string
+		hostname string
+		port     uint16
+		isMux    bool
+	}{
+		{network: "tcp", hostname: "example.com", port: 443},
+		{network: "mux", hostname: "example.com", port: 443, isMux: true},
+	} {
+		cmdKey, header := testRequestHeader(t, tc.network, tc.hostname, tc.port)
+		client, conn := net.Pipe()
+		go func() {
+			_, _ = client.Write(header[16:])
+		}()
+		hConn, isMux, err := readRequestHeader(conn, cmdKey, header[:16])
+		if err != nil {
+			t.Fatalf("%v: %v", tc.network, err)
+		}
+		if isMux != tc.isMux {
+			t.Fatalf("%v: isMux = %v, want %v", tc.network, isMux, tc.isMux)
+		}
+		lConn, err := vmess.NewConn(hConn, *vmess.NewServerMetadata(cmdKey, header[:16]), "", cmdKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = lConn.Read(nil); err != nil {
+			t.Fatalf("%v: %v", tc.network, err)
+		}
+		m := lConn.Metadata()
+		wantHost, wantPort := tc.hostname, tc.port
+		if tc.isMux {
+			wantHost, wantPort = MuxHost, 0
+		}
+		if m.Network != "tcp" || m.Hostname != wantHost || m.Port != wantPort {
+			t.Fatalf("%v: got %v %v:%v, want tcp %v:%v", tc.network, m.Network, m.Hostname, m.Port, wantHost, wantPort)
+		}
+		client.Close()
+		conn.Close()
+	}
+}
+
+func writeTestMuxFrame(t *testing.T, w io.Writer, id uint16, status byte, target []byte, data []byte) {
+	t.Helper()
+	meta := binary.BigEndian.AppendUint16(nil, id)
+	meta = append(meta, status, 0)
+	meta = append(meta, target...)
+	if data != nil {
+		meta[3] = muxOptionData
+	}
+	b := binary.BigEndian.AppendUint16(nil, uint16(len(meta)))
+	b = append(b, meta...)
+	if data != nil {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+		b = append(b, data...)
+	}
+	if _, err := w.Write(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestMuxFrame(t *testing.T, r io.Reader) (id uint16, status byte, meta []byte, data []byte) {
+	t.Helper()
+	bLen := make([]byte, 2)
+	if _, err := io.ReadFull(r, bLen); err != nil {
+		t.Fatal(err)
+	}
+	meta = make([]byte, binary.BigEndian.Uint16(bLen))
+	if _, err := io.ReadFull(r, meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta[3]&muxOptionData != 0 {
+		if _, err := io.ReadFull(r, bLen); err != nil {
+			t.Fatal(err)
+		}
+		data = make([]byte, binary.BigEndian.Uint16(bLen))
+		if _, err := io.ReadFull(r, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return binary.BigEndian.Uint16(meta), meta[2], meta[4:], data
+}
+
+func testMuxTarget(network byte, addr netip.AddrPort) []byte {
+	b := []byte{network}
+	b = binary.BigEndian.AppendUint16(b, addr.Port())
+	b = append(b, muxAddrIPv4)
+	return append(b, addr.Addr().AsSlice()...)
+}
+
+func TestMuxServer(t *testing.T) {
+	tcpEcho, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpEcho.Close()
+	go func() {
+		for {
+			c, err := tcpEcho.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	udpEcho, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpEcho.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := udpEcho.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = udpEcho.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- newMuxServer(conn, direct.SymmetricDirect).Serve()
+		conn.Close()
+	}()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	tcpAddr := tcpEcho.Addr().(*net.TCPAddr).AddrPort()
+	writeTestMuxFrame(t, client, 1, muxStatusNew, testMuxTarget(muxNetworkTCP, tcpAddr), []byte("hello tcp"))
+	id, status, _, data := readTestMuxFrame(t, client)
+	if id != 1 || status != muxStatusKeep || string(data) != "hello tcp" {
+		t.Fatalf("tcp: got session %v status %v data %q", id, status, data)
+	}
+
+	// XUDP addresses the packets in the Keep frames
+	udpAddr := udpEcho.LocalAddr().(*net.UDPAddr).AddrPort()
+	writeTestMuxFrame(t, client, 2, muxStatusNew, testMuxTarget(muxNetworkUDP, udpAddr), nil)
+	writeTestMuxFrame(t, client, 2, muxStatusKeep, testMuxTarget(muxNetworkUDP, udpAddr), []byte("hello udp"))
+	id, status, meta, data := readTestMuxFrame(t, client)
+	if id != 2 || status != muxStatusKeep || string(data) != "hello udp" {
+		t.Fatalf("udp: got session %v status %v data %q", id, status, data)
+	}
+	if _, target, err := parseMuxTarget(meta); err != nil || target != udpAddr.String() {
+		t.Fatalf("udp: got source %v (%v), want %v", target, err, udpAddr)
+	}
+
+	writeTestMuxFrame(t, client, 1, muxStatusEnd, nil, nil)
+	id, status, _, _ = readTestMuxFrame(t, client)
+	if id != 1 || status != muxStatusEnd {
+		t.Fatalf("tcp end: got session %v status %v", id, status)
+	}
+
+	client.Close()
+	select {
+	case <-errCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after the conn was closed")
+	}
+}
+
+// stallingDialer stalls the dials to the target until the context is done.
+type stallingDialer struct {
+	target string
+}
+
+func (d stallingDialer) DialContext(ctx context.Context, network, addr string) (netproxy.Conn, error) {
+	if addr == d.target {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return direct.SymmetricDirect.DialContext(ctx, network, addr)
+}
+
+func TestMuxServerStalledSession(t *testing.T) {
+	tcpEcho, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpEcho.Close()
+	go func() {
+		for {
+			c, err := tcpEcho.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	stalled := netip.MustParseAddrPort("192.0.2.1:80")
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go func() {
+		_ = newMuxServer(conn, stallingDialer{target: stalled.String()}).Serve()
+		conn.Close()
+	}()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// the data queued for a dialing session does not stall the reader, and
+	// the session ends once its buffer overflows
+	writeTestMuxFrame(t, client, 1, muxStatusNew, testMuxTarget(muxNetworkTCP, stalled), nil)
+	chunk := bytes.Repeat([]byte{1}, 60000)
+	for i := 0; i <= muxSessionBufferSize/len(chunk); i++ {
+		writeTestMuxFrame(t, client, 1, muxStatusKeep, nil, chunk)
+	}
+	if id, status, _, _ := readTestMuxFrame(t, client); id != 1 || status != muxStatusEnd {
+		t.Fatalf("overflow: got session %v status %v", id, status)
+	}
+
+	tcpAddr := tcpEcho.Addr().(*net.TCPAddr).AddrPort()
+	writeTestMuxFrame(t, client, 2, muxStatusNew, testMuxTarget(muxNetworkTCP, tcpAddr), []byte("hello tcp"))
+	if id, status, _, data := readTestMuxFrame(t, client); id != 2 || status != muxStatusKeep || string(data) != "hello tcp" {
+		t.Fatalf("tcp: got session %v status %v data %q", id, status, data)
+	}
+
+}
+
+func TestMuxServerMaxSessions(t *testing.T) {
+	stalled := netip.MustParseAddrPort("192.0.2.1:80")
+	client, conn := net.Pipe()
+	defer client.Close()
+	go func() {
+		_ = newMuxServer(conn, stallingDialer{target: stalled.String()}).Serve()
+		conn.Close()
+	}()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	for id := uint16(1); id <= muxMaxSessions+1; id++ {
+		writeTestMuxFrame(t, client, id, muxStatusNew, testMuxTarget(muxNetworkTCP, stalled), nil)
+	}
+	if id, status, _, _ := readTestMuxFrame(t, client); id != muxMaxSessions+1 || status != muxStatusEnd {
+		t.Fatalf("got session %v status %v, want the end of %v", id, status, muxMaxSessions+1)
+	}
+}
@@ -16,10 +16,10 @@ import (
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/infra/lru"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/replay_filter"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
 	"github.com/google/uuid"
-	"golang.org/x/crypto/acme/autocert"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
@@ -33,8 +33,15 @@ import (
 func init() {
 	server.Register("vmess", NewJohnTCP)
 	server.Register("vmess+tls+grpc", NewJohnTlsGrpc)
+	server.Register(string(ProtocolVMessWs), NewJohnWs)
+	server.Register(string(ProtocolVMessTlsWs), NewJohnTlsWs)
 }
 
+const (
+	ProtocolVMessWs    = server.ProtocolVMessWs
+	ProtocolVMessTlsWs = server.ProtocolVMessTlsWs
+)
+
 type Server struct {
 	closed    chan struct{}
 	sweetLisa config.Lisa
@@ -51,21 +58,45 @@ type Server struct {
 	// passageContentionCache log the last client IP of passages
 	passageContentionCache *server.ContentionCache
 
+	// startTimestamp is when the replay filter is taken, from which the
+	// window of EAuthID grows if the filter was not restored
 	startTimestamp int64
 
-	doubleCuckoo *vmess.ReplayFilter
-	dialer       netproxy.Dialer
+	doubleCuckoo *replay_filter.Filter
+	// auths tracks the authentications in flight, which insert into
+	// doubleCuckoo. No more are started once authClosed is set.
+	authMu     sync.Mutex
+	authClosed bool
+	auths      sync.WaitGroup
+	dialer     netproxy.Dialer
 
 	// grpc
 	grpc grpc2.Server
 
+	// websocket
+	ws *http.Server
+
 	autocertServer *http.Server
+	tlsResources   *server.TLSResources
+	// echKeys is nil if ECH is disabled
+	echKeys *server.ECHKeys
+
+	// failure treats the connections failing the authentication
+	failure *server.FailureHandler
 }
 
 func New(valueCtx context.Context, dialer netproxy.Dialer) (server.Server, error) {
-	doubleCuckoo := valueCtx.Value("doubleCuckoo").(*vmess.ReplayFilter)
+	doubleCuckoo := valueCtx.Value("doubleCuckoo").(*replay_filter.Filter)
+	failure, err := server.NewFailureHandler(config.ParamsObj.John.VMess.FailurePolicy, config.ParamsObj.John.VMess.Decoy, dialer)
+	if err != nil {
+		return nil, err
+	}
+	echKeys, _ := valueCtx.Value("echKeys").(*server.ECHKeys)
 	s := &Server{
+		failure:         failure,
 		doubleCuckoo:    doubleCuckoo,
+		startTimestamp:  time.Now().Unix(),
+		echKeys:         echKeys,
 		dialer:          dialer,
 		closed:          make(chan struct{}),
 		userContextPool: (*UserContextPool)(lru.New(lru.FixedTimeout, int64(1*time.Hour))),
@@ -74,6 +105,12 @@ func New(valueCtx context.Context, dialer netproxy.Dialer) (server.Server, error
 }
 
 func NewJohn(valueCtx context.Context, dialer netproxy.Dialer, sweetLisaHost config.Lisa, arg server.Argument, protocol protocol.Protocol) (server.Server, error) {
+	return newJohn(valueCtx, dialer, sweetLisaHost, arg, protocol, false)
+}
+
+// newJohn bans the sources failing repeatedly if ban is set and the ban is
+// enabled.
+func newJohn(valueCtx context.Context, dialer netproxy.Dialer, sweetLisaHost config.Lisa, arg server.Argument, protocol protocol.Protocol, ban bool) (server.Server, error) {
 	s, err := New(valueCtx, dialer)
 	if err != nil {
 		return nil, err
@@ -83,6 +120,15 @@ func NewJohn(valueCtx context.Context, dialer netproxy.Dialer, sweetLisaHost con
 	john.arg = arg
 	john.passageContentionCache = server.NewContentionCache()
 	john.protocol = protocol
+	if ban && config.ParamsObj.John.Ban.Enable {
+		if john.failure.Banner, err = server.NewBanner(config.ParamsObj.John.Ban, sweetLisaHost.Host, john.closed); err != nil {
+			return nil, err
+		}
+	}
+	if john.echKeys != nil {
+		// publish the new configs
+		john.echKeys.OnRotate(john.reRegister)
+	}
 	if err := s.AddPassages([]server.Passage{{Manager: true}}); err != nil {
 		return nil, err
 	}
@@ -92,19 +138,34 @@ func NewJohn(valueCtx context.Context, dialer netproxy.Dialer, sweetLisaHost con
 		return nil, err
 	}
 	go john.registerBackground()
+	go server.RotateManager(john, john.register, john.closed)
 	return john, nil
 }
 
 func NewJohnTCP(valueCtx context.Context, dialer netproxy.Dialer, sweetLisaHost config.Lisa, arg server.Argument) (server.Server, error) {
-	john, err := NewJohn(valueCtx, dialer, sweetLisaHost, arg, protocol.ProtocolVMessTCP)
+	// only over TCP, lest the CDNs or reverse proxies of the other transports
+	// be banned
+	return newJohn(valueCtx, dialer, sweetLisaHost, arg, protocol.ProtocolVMessTCP, true)
+}
+
+func NewJohnTlsGrpc(valueCtx context.Context, dialer netproxy.Dialer, sweetLisaHost config.Lisa, arg server.Argument) (server.Server, error) {
+	john, err := NewJohn(valueCtx, dialer, sweetLisaHost, arg, protocol.ProtocolVMessTlsGrpc)
 	if err != nil {
 		return nil, err
 	}
 	return john, nil
 }
 
-func NewJohnTlsGrpc(valueCtx context.Context, dialer netproxy.Dialer, sweetLisaHost config.Lisa, arg server.Argument) (server.Server, error) {
-	john, err := NewJohn(valueCtx, dialer, sweetLisaHost, arg, protocol.ProtocolVMessTlsGrpc)
+func NewJohnWs(valueCtx context.Context, dialer netproxy.Dialer, sweetLisaHost config.Lisa, arg server.Argument) (server.Server, error) {
+	john, err := NewJohn(valueCtx, dialer, sweetLisaHost, arg, ProtocolVMessWs)
+	if err != nil {
+		return nil, err
+	}
+	return john, nil
+}
+
+func NewJohnTlsWs(valueCtx context.Context, dialer netproxy.Dialer, sweetLisaHost config.Lisa, arg server.Argument) (server.Server, error) {
+	john, err := NewJohn(valueCtx, dialer, sweetLisaHost, arg, ProtocolVMessTlsWs)
 	if err != nil {
 		return nil, err
 	}
@@ -120,7 +181,6 @@ func (s *Server) Listen(addr string) (err error) {
 	if err != nil {
 		return err
 	}
-	s.startTimestamp = time.Now().Unix()
 	s.mutex.Lock()
 	select {
 	case <-s.closed:
@@ -155,42 +215,17 @@ func (s *Server) Listen(addr string) (err error) {
 			}(conn)
 		}
 	case protocol.ProtocolVMessTlsGrpc:
-		sni, err := common.HostsToSNI(s.arg.Hostnames, s.sweetLisa.Host)
+		tlsConfig, err := s.autocertTLSConfig()
 		if err != nil {
 			return err
 		}
-		m := &autocert.Manager{
-			Cache:      autocert.DirCache("tls"),
-			Prompt:     autocert.AcceptTOS,
-			HostPolicy: autocert.HostWhitelist(sni),
+		tlsConfig.NextProtos = []string{"h2"}
+		if s.echKeys != nil {
+			tlsConfig.GetEncryptedClientHelloKeys = s.echKeys.GetEncryptedClientHelloKeys
 		}
-		s.autocertServer = &http.Server{Addr: ":80", Handler: m.HTTPHandler(nil)}
-		go func() {
-			log.Alert("BitterJohn is listening at 80 for ACME Challenges")
-			if err := s.autocertServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-				log.Fatal("autocertServer: %v", err)
-			}
-		}()
 		s.grpc = grpc2.Server{
 			Server: grpc.NewServer(
-				grpc.Creds(credentials.NewTLS(&tls.Config{GetCertificate: func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
-					isChallenge := false
-					defer func() {
-						if isChallenge {
-							log.Warn("The certificate for %v is renewed successfully.", sni)
-							// Actively request an attempt to re-register
-							s.reRegister()
-						}
-					}()
-					// If there is any cache, it couldn't be more than 5 seconds to retrieve a cert.
-					t := time.AfterFunc(5*time.Second, func() {
-						isChallenge = true
-						log.Warn("We are now renewing the certificate for %v.", sni)
-					})
-					defer t.Stop()
-
-					return m.GetCertificate(info)
-				}, NextProtos: []string{"h2"}})),
+				grpc.Creds(acmeTLSCreds{credentials.NewTLS(tlsConfig)}),
 				grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
 					MinTime:             30 * time.Second,
 					PermitWithoutStream: true,
@@ -209,19 +244,88 @@ func (s *Server) Listen(addr string) (err error) {
 		if err = s.grpc.Serve(lt); err != nil {
 			return err
 		}
+	case ProtocolVMessWs, ProtocolVMessTlsWs:
+		var ln net.Listener = lt
+		if s.protocol == ProtocolVMessTlsWs {
+			tlsConfig, err := s.autocertTLSConfig()
+			if err != nil {
+				return err
+			}
+			tlsConfig.NextProtos = []string{"http/1.1"}
+			ln = tls.NewListener(lt, tlsConfig)
+		}
+		if err = s.serveWs(ln); err != nil {
+			return err
+		}
 	default:
 		return fmt.Errorf("unrecognized protocol: %v", s.protocol)
 	}
 	return nil
 }
 
+// acmeTLSCreds closes the connections of tls-alpn-01 challenges after the
+// handshake instead of serving HTTP/2 on them.
+type acmeTLSCreds struct {
+	credentials.TransportCredentials
+}
+
+func (c acmeTLSCreds) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn, authInfo, err := c.TransportCredentials.ServerHandshake(rawConn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tlsInfo, ok := authInfo.(credentials.TLSInfo); ok && server.IsACMETLSALPNConn(tlsInfo.State) {
+		_ = conn.Close()
+		// tell gRPC not to log it as a failure
+		return nil, nil, credentials.ErrConnDispatched
+	}
+	return conn, authInfo, nil
+}
+
+func (c acmeTLSCreds) Clone() credentials.TransportCredentials {
+	return acmeTLSCreds{c.TransportCredentials.Clone()}
+}
+
+// autocertTLSConfig starts the ACME HTTP-01 challenge server at port 80 if
+// needed and returns the TLS config serving certificates for the hostname.
+func (s *Server) autocertTLSConfig() (*tls.Config, error) {
+	sni, err := common.HostsToSNI(s.arg.Hostnames, s.sweetLisa.Host)
+	if err != nil {
+		return nil, err
+	}
+	resources, err := server.NewTLSResources(sni, func() {
+		// Actively request an attempt to re-register
+		s.reRegister()
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	s.tlsResources = resources
+	s.mutex.Unlock()
+	if resources.HTTPServer == nil {
+		// certificate files, or other ACME challenges
+		return resources.TLSConfig, nil
+	}
+	s.mutex.Lock()
+	s.autocertServer = resources.HTTPServer
+	s.mutex.Unlock()
+	go func() {
+		log.Alert("BitterJohn is listening at 80 for ACME Challenges")
+		if err := resources.HTTPServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("autocertServer: %v", err)
+		}
+	}()
+	return resources.TLSConfig, nil
+}
+
 func (s *Server) AddPassages(passages []server.Passage) (err error) {
 	log.Trace("AddPassages: %v", len(passages))
-	us, managerKey := LocalizePassages(passages)
+	us, _ := LocalizePassages(passages)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	// update manager key
-	if managerKey != nil {
+	if server.ReplacesManagers(passages) {
 		// remove manager key in UserContext
 		s.removePassagesFunc(func(passage *Passage) (remove bool) {
 			return passage.Manager == true
@@ -232,17 +336,13 @@ func (s *Server) AddPassages(passages []server.Passage) (err error) {
 }
 
 func LocalizePassages(passages []server.Passage) (psgs []Passage, manager *Passage) {
+	passages = server.LocalizeManagers(passages, func(passage *server.Passage) {
+		passage.In.Password = uuid.New().String()
+	})
 	psgs = make([]Passage, len(passages))
 	for i, psg := range passages {
 		if psg.Manager {
-			psg.In.Password = uuid.New().String()
-			// allow only one manager
-			if manager == nil {
-				manager = &psgs[i]
-			} else {
-				psg.Manager = false
-				log.Warn("found more than one manager")
-			}
+			manager = &psgs[i]
 		}
 		psgs[i].Passage = psg
 		id, err := uuid.Parse(psgs[i].In.Password)
@@ -301,21 +401,52 @@ func (s *Server) Close() error {
 	s.closeOnce.Do(func() {
 		close(s.closed)
 		s.mutex.Lock()
-		defer s.mutex.Unlock()
 		if s.grpc.Server != nil {
 			s.grpc.Stop()
 			s.grpc.Server = nil
 		}
+		if s.ws != nil {
+			s.ws.Close()
+		}
 		if s.autocertServer != nil {
 			s.autocertServer.Close()
 		}
+		if s.tlsResources != nil {
+			_ = s.tlsResources.Close()
+		}
+		if s.echKeys != nil {
+			_ = s.echKeys.Close()
+		}
 		if s.listener != nil {
 			err = s.listener.Close()
 		}
+		s.mutex.Unlock()
+
+		// Save the replay filter for the next run only after the last EAuthID
+		// is inserted, lest the next run trust an incomplete one.
+		s.authMu.Lock()
+		s.authClosed = true
+		s.authMu.Unlock()
+		s.auths.Wait()
+		if e := s.doubleCuckoo.Close(); e != nil {
+			log.Warn("Failed to save the replay filter: %v", e)
+		}
 	})
 	return err
 }
 
+// beginAuth tells if an authentication can start, and the caller should call
+// s.auths.Done after it.
+func (s *Server) beginAuth() bool {
+	s.authMu.Lock()
+	defer s.authMu.Unlock()
+	if s.authClosed {
+		return false
+	}
+	s.auths.Add(1)
+	return true
+}
+
 func (s *Server) addPassages(passages []Passage) {
 	s.passages = append(s.passages, passages...)
 
@@ -382,14 +513,7 @@ func (s *Server) registerBackground() {
 }
 
 func (s *Server) register() error {
-	var manager server.Passage
-	users := s.Passages()
-	for _, u := range users {
-		if u.Manager {
-			manager = u
-			break
-		}
-	}
+	manager := server.CurrentManager(s.Passages())
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 	t, _ := net.LookupTXT("cdn-validate." + s.sweetLisa.Host)
@@ -410,6 +534,15 @@ func (s *Server) register() error {
 		argument.Protocol = "vmess"
 	case protocol.ProtocolVMessTlsGrpc:
 		argument.Protocol = "vmess+tls+grpc"
+		if s.echKeys != nil {
+			argument.Method += ";" + s.echKeys.MethodParam()
+		}
+	case ProtocolVMessWs:
+		argument.Protocol = "vmess+ws"
+		argument.Method = "path=" + wsPath()
+	case ProtocolVMessTlsWs:
+		argument.Protocol = "vmess+tls+ws"
+		argument.Method = "path=" + wsPath()
 	}
 	cdnNames, users, err := api.Register(ctx, s.sweetLisa.Host, validateToken, model.Server{
 		Ticket:         s.arg.Ticket,
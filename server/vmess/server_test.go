@@ -10,16 +10,16 @@ import (
 	proto "github.com/daeuniverse/outbound/pkg/gun_proto"
 	"github.com/daeuniverse/outbound/protocol"
 	"github.com/daeuniverse/outbound/protocol/direct"
-	"github.com/daeuniverse/outbound/protocol/vmess"
 	grpc2 "github.com/daeuniverse/outbound/transport/grpc"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/replay_filter"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
 	"google.golang.org/grpc"
 )
 
 func TestServer(t *testing.T) {
-	doubleCuckoo := vmess.NewReplayFilter(120)
+	doubleCuckoo := replay_filter.New(120)
 	svr, err := New(context.WithValue(context.Background(), "doubleCuckoo", doubleCuckoo), direct.SymmetricDirect)
 	if err != nil {
 		t.Fatal(err)
@@ -41,11 +41,17 @@ func TestServer(t *testing.T) {
 	}
 	s := svr.(*Server)
 	s.protocol = protocol.ProtocolVMessTCP
+	// as if it listened long after the start
+	s.startTimestamp -= 3600
+	startTimestamp := s.startTimestamp
 	errCh := make(chan error, 1)
 	go func() {
 		errCh <- svr.Listen("127.0.0.1:0")
 	}()
 	waitForListener(t, s)
+	if s.startTimestamp != startTimestamp {
+		t.Fatal("Listen resets the window of EAuthID")
+	}
 	if err := svr.Close(); err != nil {
 		t.Fatal(err)
 	}
@@ -60,7 +66,7 @@ func TestServer(t *testing.T) {
 }
 
 func TestCloseClosesClosedChannel(t *testing.T) {
-	doubleCuckoo := vmess.NewReplayFilter(120)
+	doubleCuckoo := replay_filter.New(120)
 	svr, err := New(context.WithValue(context.Background(), "doubleCuckoo", doubleCuckoo), direct.SymmetricDirect)
 	if err != nil {
 		t.Fatal(err)
@@ -82,7 +88,7 @@ func TestCloseClosesClosedChannel(t *testing.T) {
 }
 
 func TestAuthenticatedPassageSurvivesHotSync(t *testing.T) {
-	doubleCuckoo := vmess.NewReplayFilter(120)
+	doubleCuckoo := replay_filter.New(120)
 	svr, err := New(context.WithValue(context.Background(), "doubleCuckoo", doubleCuckoo), direct.SymmetricDirect)
 	if err != nil {
 		t.Fatal(err)
@@ -113,7 +119,7 @@ func TestAuthenticatedPassageSurvivesHotSync(t *testing.T) {
 
 func TestGrpcServer(t *testing.T) {
 	log.SetLogLevel("trace")
-	doubleCuckoo := vmess.NewReplayFilter(120)
+	doubleCuckoo := replay_filter.New(120)
 	svr, err := New(context.WithValue(context.Background(), "doubleCuckoo", doubleCuckoo), direct.SymmetricDirect)
 	if err != nil {
 		t.Fatal(err)
@@ -17,7 +17,6 @@ import (
 	"github.com/daeuniverse/outbound/pool"
 	"github.com/daeuniverse/outbound/protocol"
 	"github.com/daeuniverse/outbound/protocol/vmess"
-	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
@@ -26,32 +25,42 @@ import (
 
 func (s *Server) handleConn(conn net.Conn) error {
 	defer conn.Close()
+	if s.failure.Banned(conn.RemoteAddr()) {
+		if e := s.failure.Handle(conn, nil); e != nil {
+			log.Debug("handleConn: %v", e)
+		}
+		return fmt.Errorf("%v is banned. Treated the conn by the %v policy", conn.RemoteAddr().String(), s.failure.Policy)
+	}
 	passage, eAuthID, err := s.authFromPool(conn)
 	if err != nil {
 		log.Trace("handleConn: auth fail")
-		// Auth fail. Drain the conn
-		if config.ParamsObj.John.MaxDrainN == -1 {
-			io.Copy(io.Discard, conn)
-		} else {
-			io.CopyN(io.Discard, conn, config.ParamsObj.John.MaxDrainN)
+		if eAuthID != nil {
+			defer pool.Put(eAuthID)
 		}
-		return fmt.Errorf("auth fail: %w. Drained the conn from: %v", err, conn.RemoteAddr().String())
+		s.failure.Fail(conn.RemoteAddr(), err)
+		if e := s.failure.Handle(conn, eAuthID); e != nil {
+			log.Debug("handleConn: %v", e)
+		}
+		return fmt.Errorf("auth fail: %w. Treated the conn from %v by the %v policy", err, conn.RemoteAddr().String(), s.failure.Policy)
 	}
 
 	// detect passage contention
 	if err := s.ContentionCheck(conn.RemoteAddr().(*net.TCPAddr).IP, passage); err != nil {
-		if config.ParamsObj.John.MaxDrainN == -1 {
-			io.Copy(io.Discard, conn)
-		} else {
-			io.CopyN(io.Discard, conn, config.ParamsObj.John.MaxDrainN)
+		defer pool.Put(eAuthID)
+		if e := s.failure.Handle(conn, eAuthID); e != nil {
+			log.Debug("handleConn: %v", e)
 		}
 		return err
 	}
 	metadata := vmess.NewServerMetadata(passage.inCmdKey, eAuthID)
+	hConn, isMux, err := readRequestHeader(conn, passage.inCmdKey, eAuthID)
 	pool.Put(eAuthID)
+	if err != nil {
+		return err
+	}
 	// handle connection
 	var target string
-	lConn, err := vmess.NewConn(conn, *metadata, conn.RemoteAddr().String(), passage.inCmdKey)
+	lConn, err := vmess.NewConn(hConn, *metadata, conn.RemoteAddr().String(), passage.inCmdKey)
 	if err != nil {
 		return err
 	}
@@ -84,6 +93,12 @@ func (s *Server) handleConn(conn net.Conn) error {
 			return err
 		}
 	}
+	if isMux {
+		if err = newMuxServer(lConn, dialer).Serve(); err != nil && !isIgnorableMuxError(err) {
+			return fmt.Errorf("mux error: %w", err)
+		}
+		return nil
+	}
 	ctx, cancel := context.WithTimeout(context.TODO(), server.DialTimeout)
 	defer cancel()
 	switch targetMetadata.Network {
@@ -147,6 +162,9 @@ func (s *Server) handleConn(conn net.Conn) error {
 	return nil
 }
 
+// authFromPool authenticates the EAuthID read from conn. The EAuthID is also
+// returned on the authentication failure for the failure policy, and the
+// caller should put it back to the pool.
 func (s *Server) authFromPool(conn net.Conn) (passage *Passage, eAuthID []byte, err error) {
 	eAuthID = pool.Get(16)
 	_, err = io.ReadFull(conn, eAuthID)
@@ -154,20 +172,23 @@ func (s *Server) authFromPool(conn net.Conn) (passage *Passage, eAuthID []byte,
 		pool.Put(eAuthID)
 		return nil, nil, err
 	}
+	if !s.beginAuth() {
+		pool.Put(eAuthID)
+		return nil, nil, fmt.Errorf("server closed")
+	}
 	userContext := s.GetUserContextOrInsert(conn.RemoteAddr().(*net.TCPAddr).IP.String())
 	hit, _ := userContext.Auth(func(passage *Passage) ([]byte, bool) {
-		if err = vmess.AuthEAuthID(passage.inEAuthIDBlock, eAuthID, s.doubleCuckoo, s.startTimestamp); err == nil {
+		if err = s.authEAuthID(passage.inEAuthIDBlock, eAuthID); err == nil {
 			return nil, true
 		}
 		return nil, false
 	})
+	s.auths.Done()
 	if errors.Is(err, protocol.ErrReplayAttack) || errors.Is(err, protocol.ErrFailAuth) {
-		pool.Put(eAuthID)
-		return nil, nil, err
+		return nil, eAuthID, err
 	}
 	if hit == nil {
-		pool.Put(eAuthID)
-		return nil, nil, fmt.Errorf("%w: not found", protocol.ErrFailAuth)
+		return nil, eAuthID, fmt.Errorf("%w: not found", protocol.ErrFailAuth)
 	}
 	return hit, eAuthID, nil
 }
@@ -203,12 +224,12 @@ func (s *Server) handleMsg(conn *vmess.Conn, reqMetadata *vmess.Metadata, passag
 		}
 		log.Trace("Received a ping message")
 		s.setLastAlive(time.Now())
-		bandwidthLimit, err := server.GenerateBandwidthLimit()
+		pingResp, err := server.GeneratePingResp()
 		if err != nil {
 			log.Warn("generatePingResp: %v", err)
 			return err
 		}
-		bPingResp, err := jsoniter.Marshal(model.PingResp{BandwidthLimit: bandwidthLimit})
+		bPingResp, err := jsoniter.Marshal(pingResp)
 		if err != nil {
 			log.Warn("%v", err)
 			return err
@@ -0,0 +1,151 @@
+package vmess
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/daeuniverse/outbound/protocol"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/common"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+	"github.com/gorilla/websocket"
+)
+
+// wsPath is derived from the ticket like the service name of gRPC.
+func wsPath() string {
+	return "/" + common.GenServiceName([]byte(config.ParamsObj.John.Ticket))
+}
+
+func (s *Server) serveWs(ln net.Listener) error {
+	upgrader := &websocket.Upgrader{
+		HandshakeTimeout: 10 * time.Second,
+		// CDNs may rewrite the Origin header
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	path := wsPath()
+	ws := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != path || !websocket.IsWebSocketUpgrade(r) {
+				server.ServeDecoy(w, r)
+				return
+			}
+			s.handleWs(upgrader, w, r)
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	s.mutex.Lock()
+	select {
+	case <-s.closed:
+		s.mutex.Unlock()
+		return nil
+	default:
+	}
+	s.ws = ws
+	s.mutex.Unlock()
+	if err := ws.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) handleWs(upgrader *websocket.Upgrader, w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWs(upgrader, w, r)
+	if err != nil {
+		log.Info("handleWs: %v", err)
+		return
+	}
+	if err := s.handleConn(conn); err != nil {
+		if errors.Is(err, server.ErrPassageAbuse) ||
+			errors.Is(err, protocol.ErrReplayAttack) {
+			log.Warn("handleConn: %v", err)
+		} else {
+			log.Info("handleConn: %v", err)
+		}
+	}
+}
+
+// upgradeWs completes the WebSocket handshake. The early data is carried in the
+// Sec-WebSocket-Protocol header, which must be echoed back.
+func upgradeWs(upgrader *websocket.Upgrader, w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	var earlyData []byte
+	var respHeader http.Header
+	if protocols := r.Header.Get("Sec-WebSocket-Protocol"); protocols != "" {
+		if b, err := base64.RawURLEncoding.DecodeString(protocols); err == nil {
+			earlyData = b
+			respHeader = http.Header{"Sec-WebSocket-Protocol": []string{protocols}}
+		}
+	}
+	c, err := upgrader.Upgrade(w, r, respHeader)
+	if err != nil {
+		return nil, err
+	}
+	return newWsConn(c, earlyData), nil
+}
+
+// wsConn is a stream over the binary messages of a WebSocket connection, which
+// starts with the early data.
+type wsConn struct {
+	*websocket.Conn
+	earlyData []byte
+	reader    io.Reader
+	writeMu   sync.Mutex
+}
+
+func newWsConn(c *websocket.Conn, earlyData []byte) *wsConn {
+	return &wsConn{Conn: c, earlyData: earlyData}
+}
+
+func (c *wsConn) Read(b []byte) (n int, err error) {
+	if len(c.earlyData) > 0 {
+		n = copy(b, c.earlyData)
+		c.earlyData = c.earlyData[n:]
+		return n, nil
+	}
+	for {
+		if c.reader == nil {
+			_, c.reader, err = c.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+		}
+		n, err = c.reader.Read(b)
+		if errors.Is(err, io.EOF) {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(b []byte) (n int, err error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err = c.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// NetConn returns the underlying connection of the WebSocket.
+func (c *wsConn) NetConn() net.Conn {
+	return c.UnderlyingConn()
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
@@ -0,0 +1,155 @@
+package vmess
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daeuniverse/outbound/protocol"
+	"github.com/daeuniverse/outbound/protocol/direct"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/replay_filter"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+	"github.com/gorilla/websocket"
+)
+
+func startWsServer(t *testing.T) *Server {
+	t.Helper()
+	doubleCuckoo := replay_filter.New(120)
+	svr, err := New(context.WithValue(context.Background(), "doubleCuckoo", doubleCuckoo), direct.SymmetricDirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = svr.AddPassages([]server.Passage{vmessTestPassage("", "28446de9-2a7e-4fab-827b-6df93e46f945")}); err != nil {
+		t.Fatal(err)
+	}
+	s := svr.(*Server)
+	s.protocol = ProtocolVMessWs
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- svr.Listen("127.0.0.1:0")
+	}()
+	waitForListener(t, s)
+	t.Cleanup(func() {
+		_ = svr.Close()
+		select {
+		case err := <-errCh:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(time.Second):
+			t.Error("Listen did not return after Close")
+		}
+	})
+	return s
+}
+
+func TestWsServerRelay(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+
+	s := startWsServer(t)
+	d, err := protocol.NewDialer(string(ProtocolVMessWs), direct.SymmetricDirect, protocol.Header{
+		ProxyAddress: s.listener.Addr().String(),
+		Feature1:     wsPath(),
+		Password:     "28446de9-2a7e-4fab-827b-6df93e46f945",
+		IsClient:     true,
+		Flags:        protocol.Flags_VMess_UsePacketAddr,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	want := []byte("hello over websocket")
+	if _, err = c.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	if _, err = io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestWsServerDecoy(t *testing.T) {
+	s := startWsServer(t)
+	for _, path := range []string{"/", wsPath()} {
+		resp, err := http.Get("http://" + s.listener.Addr().String() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != server.DecoyPage {
+			t.Fatalf("GET %v: status %v, want the decoy page", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestUpgradeWsEarlyData(t *testing.T) {
+	upgrader := &websocket.Upgrader{}
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgradeWs(upgrader, w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 64)
+		n, err := io.ReadAtLeast(conn, buf, len("early+later"))
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write(buf[:n])
+	}))
+	defer svr.Close()
+
+	protocols := base64.RawURLEncoding.EncodeToString([]byte("early"))
+	c, resp, err := websocket.DefaultDialer.Dial(strings.Replace(svr.URL, "http", "ws", 1), http.Header{
+		"Sec-WebSocket-Protocol": []string{protocols},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != protocols {
+		t.Fatalf("Sec-WebSocket-Protocol = %q, want %q", got, protocols)
+	}
+	if err = c.WriteMessage(websocket.BinaryMessage, []byte("+later")); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, b, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "early+later" {
+		t.Fatalf("got %q, want %q", b, "early+later")
+	}
+}